@@ -0,0 +1,322 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Anti-entropy is what catches the replicas of a QuorumStore up on what read
+// repair and hinted handoff miss: keys nobody reads, and hints that were
+// lost with the node that kept them. Every node keeps a MerkleTree for each
+// other node, over the keys the two of them are replicas of. Every
+// AntiEntropyInterval it compares one of its trees with the other node's
+// for it, level by level from the root, down to the buckets that differ,
+// and then only the keys in those buckets that differ go over the wire, the
+// newer record to the side that has the older one.
+
+// AntiEntropyStatus is how anti-entropy is doing on a node.
+type AntiEntropyStatus struct {
+	Enabled bool `json:"enabled"`
+	// Rounds are the comparisons with another node so far, Failures the
+	// ones that didn't finish.
+	Rounds   uint64 `json:"rounds"`
+	Failures uint64 `json:"failures"`
+	// KeysPulled are the keys this node got a newer record of from another
+	// one, KeysPushed the keys it sent a newer record of.
+	KeysPulled uint64 `json:"keysPulled"`
+	KeysPushed uint64 `json:"keysPushed"`
+	LastPeer   string `json:"lastPeer,omitempty"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+// merkleRequest is the body of POST /quorum/merkle and
+// /quorum/merkle/buckets: the nodes at Level (or the buckets) with the
+// given indexes of the tree the node keeps for Peer.
+type merkleRequest struct {
+	Peer    string `json:"peer"`
+	Level   int    `json:"level"`
+	Indexes []int  `json:"indexes"`
+}
+
+type merkleLevelResponse struct {
+	Depth  int      `json:"depth"`
+	Hashes []uint64 `json:"hashes"`
+}
+
+type merkleBucketsResponse struct {
+	Buckets map[int]map[string]uint64 `json:"buckets"`
+}
+
+// recordsRequest is the body of POST /quorum/records, the answer maps the
+// keys the node has to their records.
+type recordsRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type recordsResponse struct {
+	Records map[string]quorumRecord `json:"records"`
+}
+
+// digest identifies the write that made r. The time and the node it was
+// taken on are enough, a node never hands out the same time twice.
+func (r *quorumRecord) digest() uint64 {
+	return ringHash(strconv.FormatUint(r.Time, 10) + "/" + r.Node + "/" + strconv.FormatBool(r.Deleted))
+}
+
+// buildTrees fills the trees from the local store, if it can list its keys.
+// Without that there is no anti-entropy.
+func (q *quorumNode) buildTrees() error {
+	lister, ok := q.local.(KeyLister)
+	if !ok {
+		return nil
+	}
+	q.trees = make(map[string]*MerkleTree)
+	keys, err := lister.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		record, err := q.localRecord(key)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			q.track(key, record)
+		}
+	}
+	return nil
+}
+
+// track puts the record of key in the trees of the other replicas of key.
+func (q *quorumNode) track(key string, record *quorumRecord) {
+	if q.trees == nil {
+		return
+	}
+	replicas := q.ring.Owners(key, q.opts.N)
+	isReplica := false
+	for _, replica := range replicas {
+		isReplica = isReplica || replica == q.opts.Self
+	}
+	if !isReplica {
+		return
+	}
+	digest := record.digest()
+	q.treeMu.Lock()
+	defer q.treeMu.Unlock()
+	for _, replica := range replicas {
+		if replica == q.opts.Self {
+			continue
+		}
+		tree := q.trees[replica]
+		if tree == nil {
+			tree = NewMerkleTree(q.opts.MerkleDepth)
+			q.trees[replica] = tree
+		}
+		tree.Set(key, digest)
+	}
+}
+
+// treeLevel returns the hashes of the nodes at indexes of level of the tree
+// for peer. A peer without a tree shares no keys, its tree is all empty.
+func (q *quorumNode) treeLevel(peer string, level int, indexes []int) []uint64 {
+	q.treeMu.Lock()
+	defer q.treeMu.Unlock()
+	hashes := make([]uint64, len(indexes))
+	tree := q.trees[peer]
+	if tree == nil {
+		return hashes
+	}
+	all := tree.Level(level)
+	for i, index := range indexes {
+		hashes[i] = all[index]
+	}
+	return hashes
+}
+
+// treeBuckets returns the entries of the buckets at indexes of the tree for
+// peer.
+func (q *quorumNode) treeBuckets(peer string, indexes []int) map[int]map[string]uint64 {
+	q.treeMu.Lock()
+	defer q.treeMu.Unlock()
+	buckets := make(map[int]map[string]uint64, len(indexes))
+	tree := q.trees[peer]
+	for _, index := range indexes {
+		if tree != nil {
+			buckets[index] = tree.Entries(index)
+		} else {
+			buckets[index] = map[string]uint64{}
+		}
+	}
+	return buckets
+}
+
+// validIndexes reports whether indexes are all nodes of level.
+func (q *quorumNode) validIndexes(level int, indexes []int) bool {
+	if level < 0 || level > q.opts.MerkleDepth {
+		return false
+	}
+	for _, index := range indexes {
+		if index < 0 || index >= 1<<level {
+			return false
+		}
+	}
+	return true
+}
+
+// antiEntropy compares the trees with the other nodes, one every
+// AntiEntropyInterval in turn, until Close.
+func (q *quorumNode) antiEntropy() {
+	defer q.wg.Done()
+	var peers []string
+	for _, node := range q.ring.Nodes() {
+		if node != q.opts.Self {
+			peers = append(peers, node)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	ticker := time.NewTicker(q.opts.AntiEntropyInterval)
+	defer ticker.Stop()
+	for next := 0; ; next = (next + 1) % len(peers) {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		q.syncWith(q.ctx, peers[next])
+	}
+}
+
+// syncWith compares the tree for peer with peer's tree for this node, and
+// swaps the records of the keys they disagree on, so both end up with the
+// newer. It returns how many keys it repaired, on either side.
+func (q *quorumNode) syncWith(ctx context.Context, peer string) (int, error) {
+	pulled, pushed, err := q.compare(ctx, peer)
+	q.aePulled.Add(uint64(pulled))
+	q.aePushed.Add(uint64(pushed))
+	q.aeRounds.Add(1)
+	if err != nil {
+		q.aeFailures.Add(1)
+	}
+	q.mu.Lock()
+	q.aeLastPeer = peer
+	q.aeLastError = ""
+	if err != nil {
+		q.aeLastError = err.Error()
+	}
+	q.mu.Unlock()
+	return pulled + pushed, err
+}
+
+func (q *quorumNode) compare(ctx context.Context, peer string) (pulled, pushed int, err error) {
+	if q.trees == nil {
+		return 0, 0, fmt.Errorf("kv: the local store can't list its keys, there are no trees to compare")
+	}
+	call := func(path string, req, resp interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, q.opts.Timeout)
+		defer cancel()
+		return q.call(ctx, http.MethodPost, peer, path, req, resp)
+	}
+
+	// Down from the root, only into the nodes that differ.
+	depth := q.opts.MerkleDepth
+	indexes := []int{0}
+	var buckets []int
+	for level := 0; level <= depth && len(indexes) > 0; level++ {
+		var theirs merkleLevelResponse
+		if err := call("/quorum/merkle", merkleRequest{q.opts.Self, level, indexes}, &theirs); err != nil {
+			return 0, 0, err
+		}
+		if theirs.Depth != depth || len(theirs.Hashes) != len(indexes) {
+			return 0, 0, fmt.Errorf("kv: %s has trees of depth %d, this node of %d", peer, theirs.Depth, depth)
+		}
+		ours := q.treeLevel(peer, level, indexes)
+		var differ []int
+		for i, index := range indexes {
+			if ours[i] != theirs.Hashes[i] {
+				if level == depth {
+					buckets = append(buckets, index)
+				} else {
+					differ = append(differ, 2*index, 2*index+1)
+				}
+			}
+		}
+		indexes = differ
+	}
+	if len(buckets) == 0 {
+		return 0, 0, nil
+	}
+
+	// The keys of those buckets that either side has a different record
+	// of, or only one side has.
+	var theirs merkleBucketsResponse
+	if err := call("/quorum/merkle/buckets", merkleRequest{Peer: q.opts.Self, Level: depth, Indexes: buckets}, &theirs); err != nil {
+		return 0, 0, err
+	}
+	ours := q.treeBuckets(peer, buckets)
+	var keys []string
+	for _, bucket := range buckets {
+		for key, digest := range ours[bucket] {
+			if other, ok := theirs.Buckets[bucket][key]; !ok || other != digest {
+				keys = append(keys, key)
+			}
+		}
+		for key := range theirs.Buckets[bucket] {
+			if _, ok := ours[bucket][key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	var records recordsResponse
+	if err := call("/quorum/records", recordsRequest{keys}, &records); err != nil {
+		return 0, 0, err
+	}
+	for _, key := range keys {
+		var remote *quorumRecord
+		if record, ok := records.Records[key]; ok {
+			remote = &record
+		}
+		local, err := q.localRecord(key)
+		if err != nil {
+			return pulled, pushed, err
+		}
+		switch {
+		case remote.newer(local):
+			if err := q.apply(key, *remote); err != nil {
+				return pulled, pushed, err
+			}
+			pulled++
+		case local.newer(remote):
+			sendCtx, cancel := context.WithTimeout(ctx, q.opts.Timeout)
+			err := q.send(sendCtx, peer, key, *local, "")
+			cancel()
+			if err != nil {
+				return pulled, pushed, err
+			}
+			pushed++
+		}
+	}
+	return pulled, pushed, nil
+}
+
+// antiEntropyStatus is the AntiEntropyStatus of q.
+func (q *quorumNode) antiEntropyStatus() AntiEntropyStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return AntiEntropyStatus{
+		Enabled:    q.trees != nil && q.opts.AntiEntropyInterval > 0,
+		Rounds:     q.aeRounds.Load(),
+		Failures:   q.aeFailures.Load(),
+		KeysPulled: q.aePulled.Load(),
+		KeysPushed: q.aePushed.Load(),
+		LastPeer:   q.aeLastPeer,
+		LastError:  q.aeLastError,
+	}
+}
@@ -0,0 +1,385 @@
+package kv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Authenticator finds out who a request comes from. ok is false when r has
+// none of the credentials it knows about, so the next Authenticator gets a
+// go. Credentials that are there but wrong are an error, and the request is
+// turned away with a 401 no matter what the ACL says.
+type Authenticator interface {
+	Authenticate(r *http.Request) (id Identity, ok bool, err error)
+}
+
+type badCredentialsError struct {
+	reason string
+}
+
+func (e *badCredentialsError) Error() string {
+	return "invalid credentials: " + e.reason
+}
+
+var (
+	ErrUnknownAPIKey = &badCredentialsError{"unknown API key"}
+	ErrBadToken      = &badCredentialsError{"malformed or wrongly signed token"}
+	ErrTokenExpired  = &badCredentialsError{"token expired"}
+)
+
+// APIKeys authenticates requests by the X-API-Key header. Only hashes of the
+// keys are kept, which also makes the lookup constant time with respect to
+// the key.
+type APIKeys struct {
+	keys map[[sha256.Size]byte]string
+}
+
+// NewAPIKeys returns an Authenticator for keys, which maps every key to the
+// name of its identity.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	a := &APIKeys{keys: make(map[[sha256.Size]byte]string, len(keys))}
+	for key, name := range keys {
+		a.keys[sha256.Sum256([]byte(key))] = name
+	}
+	return a
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (Identity, bool, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return Identity{}, false, nil
+	}
+	name, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return Identity{}, false, ErrUnknownAPIKey
+	}
+	return Identity{Name: name, Method: "apikey"}, true, nil
+}
+
+// Tokens authenticates requests by an "Authorization: Bearer" token signed
+// with HMAC-SHA256. A token is
+//
+//	base64url(claims) "." base64url(HMAC-SHA256(secret, base64url(claims)))
+//
+// where the claims are the JSON {"sub": identity, "exp": unix seconds}. It is
+// the shape of a JWT without the header, there is only the one algorithm.
+type Tokens struct {
+	secrets [][]byte
+	now     func() time.Time
+}
+
+type tokenClaims struct {
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+var errNoSecret = errors.New("kv: tokens need at least one non empty secret")
+
+// NewTokens returns an Authenticator for tokens signed with any of secrets.
+// Sign uses the first one, so a secret is rotated by putting the new one in
+// front and dropping the old one once its tokens have expired.
+func NewTokens(secrets ...[]byte) (*Tokens, error) {
+	if len(secrets) == 0 {
+		return nil, errNoSecret
+	}
+	for _, secret := range secrets {
+		if len(secret) == 0 {
+			return nil, errNoSecret
+		}
+	}
+	return &Tokens{secrets: secrets, now: time.Now}, nil
+}
+
+// Sign returns a token for the identity name that is good for ttl.
+func (t *Tokens) Sign(name string, ttl time.Duration) (string, error) {
+	claims, err := json.Marshal(tokenClaims{Subject: name, Expires: t.now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(t.secrets[0], payload)), nil
+}
+
+func sign(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (t *Tokens) Authenticate(r *http.Request) (Identity, bool, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return Identity{}, false, nil
+	}
+	name, err := t.verify(strings.TrimSpace(auth[len("Bearer "):]))
+	if err != nil {
+		return Identity{}, false, err
+	}
+	return Identity{Name: name, Method: "token"}, true, nil
+}
+
+// verify returns the subject of token if a secret signed it and it has not
+// expired yet.
+func (t *Tokens) verify(token string) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrBadToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", ErrBadToken
+	}
+	signed := false
+	for _, secret := range t.secrets {
+		if hmac.Equal(mac, sign(secret, payload)) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return "", ErrBadToken
+	}
+	// Only look inside once we know we wrote it.
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrBadToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(decoded, &claims); err != nil || claims.Subject == "" {
+		return "", ErrBadToken
+	}
+	if t.now().Unix() >= claims.Expires {
+		return "", ErrTokenExpired
+	}
+	return claims.Subject, nil
+}
+
+// Permission is what an identity may do with the keys under a prefix, a set
+// of the flags below.
+type Permission uint8
+
+const (
+	// PermRead is /get, /ttl, /getOrPut, the gets and conditions of a /txn,
+	// listing keys and taking snapshots.
+	PermRead Permission = 1 << iota
+	// PermWrite is /set, /update, /putIfAbsent, /getOrPut, /compareAndSwap,
+	// the puts of a /txn, /updateBulk and restoring snapshots.
+	PermWrite
+	// PermDelete is /delete, /compareAndDelete, the deletes of a /txn and
+	// restoring snapshots.
+	PermDelete
+	// PermBulk is needed on top of the above for every key of an
+	// /updateBulk or a /txn, and for restoring snapshots. It keeps an
+	// identity that may write a key at a time from rewriting everything at
+	// once.
+	PermBulk
+)
+
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{{PermRead, "read"}, {PermWrite, "write"}, {PermDelete, "delete"}, {PermBulk, "bulk"}}
+
+func (p Permission) String() string {
+	var names []string
+	for _, n := range permissionNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParsePermission parses a comma separated list of read, write, delete and
+// bulk, or "all" for all of them.
+func ParsePermission(s string) (Permission, error) {
+	var p Permission
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			p |= PermRead | PermWrite | PermDelete | PermBulk
+			continue
+		}
+		found := false
+		for _, n := range permissionNames {
+			if n.name == name {
+				p |= n.perm
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown permission %q, expected read, write, delete, bulk or all", name)
+		}
+	}
+	return p, nil
+}
+
+const (
+	// AnyIdentity in an ACLRule matches every request, including the ones
+	// that did not authenticate at all.
+	AnyIdentity = "*"
+	// AnyNamespace in an ACLRule matches every namespace, and the server's
+	// own store.
+	AnyNamespace = "*"
+)
+
+// ACLRule grants Identity the Permission on every key that starts with
+// Prefix in Namespace. An empty prefix is every key, an empty namespace the
+// server's own store.
+type ACLRule struct {
+	Identity   string
+	Namespace  string
+	Prefix     string
+	Permission Permission
+}
+
+// ACL is a list of rules, and what an identity may do with a key is what all
+// the rules that match both give it together. There is no deny, anything not
+// granted is denied.
+type ACL []ACLRule
+
+// permission is everything the rules grant id (nil when the request did not
+// authenticate) on key in namespace.
+func (acl ACL) permission(id *Identity, namespace, key string) Permission {
+	var p Permission
+	for _, rule := range acl {
+		if rule.matches(id, namespace) && strings.HasPrefix(key, rule.Prefix) {
+			p |= rule.Permission
+		}
+	}
+	return p
+}
+
+// prefixPermission is everything the rules grant id on all the keys that
+// start with prefix, the ones that could be there later included.
+func (acl ACL) prefixPermission(id *Identity, namespace, prefix string) Permission {
+	var p Permission
+	for _, rule := range acl {
+		if rule.matches(id, namespace) && strings.HasPrefix(prefix, rule.Prefix) {
+			p |= rule.Permission
+		}
+	}
+	return p
+}
+
+// namespacePermission is everything the rules grant id on any key in
+// namespace.
+func (acl ACL) namespacePermission(id *Identity, namespace string) Permission {
+	var p Permission
+	for _, rule := range acl {
+		if rule.matches(id, namespace) {
+			p |= rule.Permission
+		}
+	}
+	return p
+}
+
+func (rule ACLRule) matches(id *Identity, namespace string) bool {
+	return (rule.Identity == AnyIdentity || (id != nil && rule.Identity == id.Name)) &&
+		(rule.Namespace == AnyNamespace || rule.Namespace == namespace)
+}
+
+// authenticate runs the Authenticators of the server (the client certificate
+// counts as one, and comes first) and puts the identity in the context of the
+// request. It answers 401 and returns false if there are credentials that
+// don't check out.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.opts.TLS != nil {
+		if id, ok := s.opts.TLS.certIdentity(r); ok {
+			return r.WithContext(withIdentity(r.Context(), id)), true
+		}
+	}
+	for _, auth := range s.opts.Auth {
+		id, ok, err := auth.Authenticate(r)
+		if err != nil {
+			authError(w, http.StatusUnauthorized, err.Error())
+			return r, false
+		}
+		if ok {
+			return r.WithContext(withIdentity(r.Context(), id)), true
+		}
+	}
+	return r, true
+}
+
+// allowed checks that the identity of r has perm on every one of keys, and
+// answers 401 (no identity) or 403 and returns false if it doesn't. Without
+// an ACL everything is allowed.
+func (s *Server) allowed(w http.ResponseWriter, r *http.Request, perm Permission, keys ...string) bool {
+	if s.opts.ACL == nil {
+		return true
+	}
+	id, namespace := requestIdentity(r), requestNamespace(r)
+	for _, key := range keys {
+		if missing := perm &^ s.opts.ACL.permission(id, namespace, key); missing != 0 {
+			denied(w, id, fmt.Sprintf("%s not allowed on key %q", missing, key))
+			return false
+		}
+	}
+	return true
+}
+
+// allowedPrefix is allowed for all the keys under prefix.
+func (s *Server) allowedPrefix(w http.ResponseWriter, r *http.Request, perm Permission, prefix string) bool {
+	if s.opts.ACL == nil {
+		return true
+	}
+	id := requestIdentity(r)
+	if missing := perm &^ s.opts.ACL.prefixPermission(id, requestNamespace(r), prefix); missing != 0 {
+		denied(w, id, fmt.Sprintf("%s not allowed on prefix %q", missing, prefix))
+		return false
+	}
+	return true
+}
+
+// allowedNamespace is allowed for all of namespace, for creating and deleting
+// it.
+func (s *Server) allowedNamespace(w http.ResponseWriter, r *http.Request, namespace string, perm Permission) bool {
+	if s.opts.ACL == nil {
+		return true
+	}
+	id := requestIdentity(r)
+	if missing := perm &^ s.opts.ACL.prefixPermission(id, namespace, ""); missing != 0 {
+		denied(w, id, fmt.Sprintf("%s not allowed on namespace %q", missing, namespace))
+		return false
+	}
+	return true
+}
+
+func requestIdentity(r *http.Request) *Identity {
+	if id, ok := IdentityFromContext(r.Context()); ok {
+		return &id
+	}
+	return nil
+}
+
+func denied(w http.ResponseWriter, id *Identity, msg string) {
+	if id == nil {
+		authError(w, http.StatusUnauthorized, "authentication required: "+msg)
+		return
+	}
+	authError(w, http.StatusForbidden, id.Name+": "+msg)
+}
+
+// authError is the one place the API answers with a JSON error rather than
+// plain text, so clients can tell an auth failure from the rest.
+func authError(w http.ResponseWriter, code int, msg string) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kv"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
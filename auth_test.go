@@ -0,0 +1,165 @@
+package kv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	tokens, err := NewTokens([]byte("new"), []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTokens, _ := NewTokens([]byte("old"))
+	otherTokens, _ := NewTokens([]byte("other"))
+	now := time.Now()
+	tokens.now = func() time.Time { return now }
+
+	verify := func(token string) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		id, ok, err := tokens.Authenticate(r)
+		if err == nil && !ok {
+			t.Fatalf("Expected a bearer token to be looked at")
+		}
+		return id.Name, err
+	}
+
+	token, _ := tokens.Sign("alice", time.Minute)
+	if name, err := verify(token); err != nil || name != "alice" {
+		t.Errorf("Expected alice, got %q, %v", name, err)
+	}
+	token, _ = oldTokens.Sign("bob", time.Minute)
+	if name, err := verify(token); err != nil || name != "bob" {
+		t.Errorf("Expected a token signed with the old secret to still work, got %q, %v", name, err)
+	}
+	token, _ = otherTokens.Sign("mallory", time.Minute)
+	if _, err := verify(token); err != ErrBadToken {
+		t.Errorf("Expected ErrBadToken for another secret, got %v", err)
+	}
+	// Changing the claims breaks the signature.
+	token, _ = tokens.Sign("alice", time.Minute)
+	_, signature, _ := strings.Cut(token, ".")
+	forged, _ := otherTokens.Sign("admin", time.Minute)
+	payload, _, _ := strings.Cut(forged, ".")
+	if _, err := verify(payload + "." + signature); err != ErrBadToken {
+		t.Errorf("Expected ErrBadToken for changed claims, got %v", err)
+	}
+	if _, err := verify("garbage"); err != ErrBadToken {
+		t.Errorf("Expected ErrBadToken for garbage, got %v", err)
+	}
+
+	token, _ = tokens.Sign("alice", time.Minute)
+	now = now.Add(time.Minute)
+	if _, err := verify(token); err != ErrTokenExpired {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+
+	if _, ok, err := tokens.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil)); ok || err != nil {
+		t.Errorf("Expected a request without a token to be left to others, got %v, %v", ok, err)
+	}
+	if _, err := NewTokens(); err == nil {
+		t.Errorf("Expected NewTokens to want a secret")
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	p, err := ParsePermission("read, delete")
+	if err != nil || p != PermRead|PermDelete {
+		t.Errorf("Expected read and delete, got %v, %v", p, err)
+	}
+	if p.String() != "read,delete" {
+		t.Errorf("Expected read,delete, got %s", p)
+	}
+	if p, _ := ParsePermission("all"); p != PermRead|PermWrite|PermDelete|PermBulk {
+		t.Errorf("Expected all to be everything, got %v", p)
+	}
+	if _, err := ParsePermission("read,admin"); err == nil {
+		t.Errorf("Expected an unknown permission to be rejected")
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	tokens, _ := NewTokens([]byte("secret"))
+	server := NewHTTPServerWithOptions(NewWriteOptimizedMapStore(1, true, 100), "", HTTPOptions{
+		Auth: []Authenticator{NewAPIKeys(map[string]string{"k-alice": "alice", "k-bob": "bob"}), tokens},
+		ACL: ACL{
+			{Identity: AnyIdentity, Prefix: "public/", Permission: PermRead},
+			{Identity: "alice", Prefix: "", Permission: PermRead | PermWrite | PermDelete | PermBulk},
+			{Identity: "bob", Prefix: "users/bob/", Permission: PermRead | PermWrite},
+			{Identity: "bob", Prefix: "public/", Permission: PermWrite},
+			{Identity: "bob", Prefix: "drop/", Permission: PermWrite | PermDelete},
+		},
+	})
+	bobToken, _ := tokens.Sign("bob", time.Minute)
+
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, r)
+		return rec
+	}
+	alice := []string{"X-API-Key", "k-alice"}
+	bob := []string{"Authorization", "Bearer " + bobToken}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		header       []string
+		want         int
+	}{
+		{"alice writes anywhere", http.MethodPost, "/set", `{"key":"public/a","value":1}`, alice, http.StatusCreated},
+		{"alice writes bob's keys", http.MethodPost, "/set", `{"key":"users/bob/x","value":1}`, alice, http.StatusCreated},
+		{"anyone reads public", http.MethodGet, "/get?key=public/a", "", nil, http.StatusOK},
+		{"anonymous reads private", http.MethodGet, "/get?key=users/bob/x", "", nil, http.StatusUnauthorized},
+		{"anonymous writes public", http.MethodPost, "/set", `{"key":"public/a","value":2}`, nil, http.StatusUnauthorized},
+		{"bob reads his keys", http.MethodGet, "/get?key=users/bob/x", "", bob, http.StatusOK},
+		{"bob writes public", http.MethodPost, "/set", `{"key":"public/b","value":1}`, bob, http.StatusCreated},
+		{"bob deletes his keys", http.MethodDelete, "/delete?key=users/bob/x", "", bob, http.StatusForbidden},
+		{"bob reads others", http.MethodGet, "/get?key=users/carol/x", "", bob, http.StatusForbidden},
+		{"bob bulk updates", http.MethodPatch, "/updateBulk", `[{"key":"users/bob/x","value":2}]`, bob, http.StatusForbidden},
+		{"alice bulk updates", http.MethodPatch, "/updateBulk", `[{"key":"users/bob/x","value":2}]`, alice, http.StatusOK},
+		{"bob lists his keys", http.MethodGet, "/admin/keys?prefix=users/bob/", "", bob, http.StatusOK},
+		{"bob lists all keys", http.MethodGet, "/admin/keys", "", bob, http.StatusForbidden},
+		{"bob takes a snapshot", http.MethodGet, "/admin/snapshot", "", bob, http.StatusForbidden},
+		// A 200 or a 409 would tell bob what is in keys he can't read.
+		{"alice writes a drop", http.MethodPost, "/set", `{"key":"drop/a","value":1}`, alice, http.StatusCreated},
+		{"bob writes a drop", http.MethodPost, "/set", `{"key":"drop/b","value":1}`, bob, http.StatusCreated},
+		{"bob compares and swaps unread", http.MethodPost, "/compareAndSwap", `{"key":"drop/a","old":1,"new":2}`, bob, http.StatusForbidden},
+		{"bob compares and deletes unread", http.MethodPost, "/compareAndDelete", `{"key":"drop/a","old":1}`, bob, http.StatusForbidden},
+		{"bob compares and swaps his keys", http.MethodPost, "/compareAndSwap", `{"key":"users/bob/y","old":1,"new":2}`, bob, http.StatusNotFound},
+		{"bob in a txn", http.MethodPost, "/txn", `{"operations":[{"op":"get","key":"users/bob/x"}]}`, bob, http.StatusForbidden},
+		{"alice in a txn", http.MethodPost, "/txn", `{"operations":[{"op":"delete","key":"users/bob/x"}]}`, alice, http.StatusOK},
+		{"stats are open", http.MethodGet, "/admin/stats", "", nil, http.StatusOK},
+		{"unknown API key", http.MethodGet, "/get?key=public/a", "", []string{"X-API-Key", "nope"}, http.StatusUnauthorized},
+		{"bad token", http.MethodGet, "/get?key=public/a", "", []string{"Authorization", "Bearer nope"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(tt.method, tt.path, tt.body, tt.header...)
+			if rec.Code != tt.want {
+				t.Fatalf("Expected %d, got %d: %s", tt.want, rec.Code, rec.Body)
+			}
+			if rec.Code != http.StatusUnauthorized && rec.Code != http.StatusForbidden {
+				return
+			}
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+				t.Errorf("Expected a JSON error, got %q", rec.Body)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected a WWW-Authenticate header with the 401")
+			}
+		})
+	}
+}
@@ -0,0 +1,840 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is a log structured store in the style of Bitcask
+// (https://riak.com/assets/bitcask-intro.pdf). Every write is appended to the
+// active data file and an in-memory key directory points at the latest record
+// of every key, so a Get is one map lookup plus one disk read. The dataset can
+// be much bigger than memory, only the keys have to fit.
+//
+// Old records are never rewritten in place. A merge copies the records that are
+// still live out of the immutable files into new ones (with a hint file next to
+// each so startup does not have to read the values) and deletes the old files.
+//
+// Every record carries a sequence number and on startup the highest sequence
+// number wins. Merged files get fresh file ids but keep the old sequence
+// numbers, so the order in which files get loaded does not matter.
+//
+// That is only true as long as a merge removes all of the files it merged.
+// Merged files get ids after the active file, so a put a merge copied can
+// sit in a later file than the tombstone that deleted it meanwhile, and if
+// the next merge removed the tombstone and then crashed before removing the
+// put, the key would come back. So a merge first writes down which files it
+// is about to remove, and opening the store finishes the job.
+
+const (
+	bitcaskDataExt = ".data"
+	bitcaskHintExt = ".hint"
+	// bitcaskObsoleteName lists the files a merge is removing.
+	bitcaskObsoleteName = "obsolete.json"
+
+	defaultBitcaskMaxFileSize = 64 << 20
+)
+
+// BitcaskOptions configures a Bitcask store.
+type BitcaskOptions struct {
+	// MaxFileSize is the size at which the active data file gets rotated.
+	// Defaults to 64MB.
+	MaxFileSize int64
+	// Fsync and FsyncInterval work the same way as for the write-ahead log.
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+	// MergeInterval controls how often the background merge runs. Zero
+	// disables it, Merge can still be called by hand.
+	MergeInterval time.Duration
+	// BatchedWritesCheckInterval controls how often BatchUpdate checks whether
+	// its context has been cancelled. Defaults to 1 (every pair).
+	BatchedWritesCheckInterval int
+}
+
+type keydirEntry struct {
+	fileID uint32
+	offset int64
+	size   uint32
+	seq    uint64
+}
+
+// Bitcask is a Store that keeps its data in append-only files on disk.
+type Bitcask struct {
+	mu     sync.RWMutex
+	dir    string
+	opts   BitcaskOptions
+	keydir map[string]keydirEntry
+	files  map[uint32]*os.File
+
+	active     *os.File
+	activeID   uint32
+	activeSize int64
+	nextID     uint32
+	seq        uint64
+	dirty      bool
+	closed     bool
+
+	// Only one merge runs at a time.
+	mergeMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	storeMetrics
+}
+
+var errBitcaskClosed = errors.New("kv: bitcask store is closed")
+
+// OpenBitcaskStore opens (or creates) a Bitcask store in dir.
+func OpenBitcaskStore(dir string, opts BitcaskOptions) (*Bitcask, error) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = defaultBitcaskMaxFileSize
+	}
+	if opts.Fsync == FsyncInterval && opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = defaultFsyncInterval
+	}
+	if opts.BatchedWritesCheckInterval <= 0 {
+		opts.BatchedWritesCheckInterval = 1
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	b := &Bitcask{
+		dir:    dir,
+		opts:   opts,
+		keydir: make(map[string]keydirEntry),
+		files:  make(map[uint32]*os.File),
+		done:   make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		b.closeFiles()
+		return nil, err
+	}
+	if err := b.rotate(); err != nil {
+		b.closeFiles()
+		return nil, err
+	}
+
+	if opts.Fsync == FsyncInterval {
+		b.wg.Add(1)
+		go b.every(opts.FsyncInterval, func() {
+			if err := b.Sync(); err != nil {
+				log.Printf("bitcask: background fsync failed: %v", err)
+			}
+		})
+	}
+	if opts.MergeInterval > 0 {
+		b.wg.Add(1)
+		go b.every(opts.MergeInterval, func() {
+			if err := b.Merge(); err != nil {
+				log.Printf("bitcask: background merge failed: %v", err)
+			}
+		})
+	}
+	return b, nil
+}
+
+func (b *Bitcask) dataPath(id uint32) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%09d%s", id, bitcaskDataExt))
+}
+
+func (b *Bitcask) hintPath(id uint32) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%09d%s", id, bitcaskHintExt))
+}
+
+func (b *Bitcask) load() error {
+	if err := b.removeObsolete(); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(b.dir, "*"+bitcaskDataExt))
+	if err != nil {
+		return err
+	}
+	ids := make([]uint32, 0, len(names))
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), bitcaskDataExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Tombstones have to be remembered while loading: a merged file can hold
+	// an older put of a key that a tombstone in another file deleted.
+	deleted := make(map[string]uint64)
+	apply := func(key string, e keydirEntry, tombstone bool) {
+		if e.seq > b.seq {
+			b.seq = e.seq
+		}
+		if tombstone {
+			if e.seq > deleted[key] {
+				deleted[key] = e.seq
+			}
+			if cur, ok := b.keydir[key]; ok && cur.seq < e.seq {
+				delete(b.keydir, key)
+			}
+			return
+		}
+		if deleted[key] > e.seq {
+			return
+		}
+		if cur, ok := b.keydir[key]; !ok || cur.seq < e.seq {
+			b.keydir[key] = e
+		}
+	}
+
+	for _, id := range ids {
+		f, err := os.Open(b.dataPath(id))
+		if err != nil {
+			return err
+		}
+		b.files[id] = f
+		if id >= b.nextID {
+			b.nextID = id + 1
+		}
+
+		if err := b.loadHints(id, apply); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			log.Printf("bitcask: ignoring unreadable hint file for %d: %v", id, err)
+		}
+		if err := b.scan(id, f, apply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bitcask) loadHints(id uint32, apply func(string, keydirEntry, bool)) error {
+	data, err := os.ReadFile(b.hintPath(id))
+	if err != nil {
+		return err
+	}
+	// Validate the whole file before touching the keydir, so a bad hint file
+	// can still fall back to scanning the data file.
+	type hint struct {
+		key   string
+		entry keydirEntry
+	}
+	hints := make([]hint, 0)
+	r := bytes.NewReader(data)
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(payload) < 20 {
+			return errCorruptRecord
+		}
+		hints = append(hints, hint{
+			key: string(payload[20:]),
+			entry: keydirEntry{
+				fileID: id,
+				seq:    binary.LittleEndian.Uint64(payload[0:8]),
+				offset: int64(binary.LittleEndian.Uint64(payload[8:16])),
+				size:   binary.LittleEndian.Uint32(payload[16:20]),
+			},
+		})
+	}
+	for _, h := range hints {
+		apply(h.key, h.entry, false)
+	}
+	return nil
+}
+
+// scan reads every record of a data file. A torn record at the end (or a
+// batch that never got its last record) is ignored, nothing after it can
+// have been acknowledged.
+func (b *Bitcask) scan(id uint32, f *os.File, apply func(string, keydirEntry, bool)) error {
+	type pending struct {
+		key       string
+		entry     keydirEntry
+		tombstone bool
+	}
+	batch := make([]pending, 0)
+
+	r := &countingReader{r: io.NewSectionReader(f, 0, 1<<62)}
+	for {
+		offset := r.n
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			log.Printf("bitcask: ignoring torn record in %s at offset %d: %v", b.dataPath(id), offset, err)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		seq, flag, key, _, err := decodeEntryRecord(payload)
+		if err != nil {
+			return err
+		}
+		p := pending{
+			key:       key,
+			entry:     keydirEntry{fileID: id, offset: offset, size: uint32(r.n - offset), seq: seq},
+			tombstone: flag == entryTombstone,
+		}
+		if flag == entryBatch {
+			batch = append(batch, p)
+			continue
+		}
+		for _, bp := range batch {
+			apply(bp.key, bp.entry, bp.tombstone)
+		}
+		batch = batch[:0]
+		apply(p.key, p.entry, p.tombstone)
+	}
+	return nil
+}
+
+// rotate starts a new active data file. Must be called with the lock held.
+func (b *Bitcask) rotate() error {
+	if b.active != nil {
+		if err := b.active.Sync(); err != nil {
+			return err
+		}
+		if err := b.active.Close(); err != nil {
+			return err
+		}
+		// Reopen read-only, the file is immutable from now on.
+		f, err := os.Open(b.dataPath(b.activeID))
+		if err != nil {
+			return err
+		}
+		b.files[b.activeID] = f
+	}
+
+	id := b.nextID
+	b.nextID++
+	f, err := os.OpenFile(b.dataPath(id), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	b.active = f
+	b.activeID = id
+	b.activeSize = 0
+	b.files[id] = f
+	return nil
+}
+
+// write appends already framed records to the active file and returns the
+// offset they start at. Must be called with the lock held.
+func (b *Bitcask) write(buf []byte) (int64, error) {
+	if b.closed {
+		return 0, errBitcaskClosed
+	}
+	if b.activeSize > 0 && b.activeSize+int64(len(buf)) > b.opts.MaxFileSize {
+		if err := b.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	offset := b.activeSize
+	n, err := b.active.Write(buf)
+	b.activeSize += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	if b.opts.Fsync == FsyncAlways {
+		return offset, b.active.Sync()
+	}
+	b.dirty = true
+	return offset, nil
+}
+
+// writeOne writes a single record and points the keydir at it. Must be called
+// with the lock held.
+func (b *Bitcask) writeOne(flag byte, key string, value interface{}) error {
+	payload, err := encodeEntryRecord(b.seq+1, flag, key, value)
+	if err != nil {
+		return err
+	}
+	buf := appendRecord(nil, payload)
+	offset, err := b.write(buf)
+	if err != nil {
+		return err
+	}
+	b.seq++
+	if flag == entryTombstone {
+		delete(b.keydir, key)
+		return nil
+	}
+	b.keydir[key] = keydirEntry{fileID: b.activeID, offset: offset, size: uint32(len(buf)), seq: b.seq}
+	return nil
+}
+
+func (b *Bitcask) Get(key string) (_ interface{}, err error) {
+	defer func() { b.observe(opGet, err) }()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.keydir[key]
+	if !ok {
+		return nil, newNotFoundError(key)
+	}
+	return b.read(e)
+}
+
+// Keys only needs the keydir, which is all in memory.
+func (b *Bitcask) Keys() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]string, 0, len(b.keydir))
+	for key := range b.keydir {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Len is the size of the keydir.
+func (b *Bitcask) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.keydir)
+}
+
+// read loads the value a keydir entry points at. Must be called with at least
+// the read lock held.
+func (b *Bitcask) read(e keydirEntry) (interface{}, error) {
+	f, ok := b.files[e.fileID]
+	if !ok {
+		return nil, fmt.Errorf("kv: bitcask data file %d is missing", e.fileID)
+	}
+	buf := make([]byte, e.size)
+	if _, err := f.ReadAt(buf, e.offset); err != nil {
+		return nil, err
+	}
+	payload, err := readRecord(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, encoded, err := decodeEntryRecord(payload)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(encoded, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (b *Bitcask) Put(key string, value interface{}) (err error) {
+	defer func() { b.observe(opPut, err) }()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writeOne(entryPut, key, value)
+}
+
+func (b *Bitcask) Update(key string, value interface{}) (err error) {
+	defer func() { b.observe(opUpdate, err) }()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.keydir[key]; !exists {
+		return newNotFoundError(key)
+	}
+	return b.writeOne(entryPut, key, value)
+}
+
+func (b *Bitcask) Delete(key string) (err error) {
+	defer func() { b.observe(opDelete, err) }()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.keydir[key]; !exists {
+		return nil
+	}
+	return b.writeOne(entryTombstone, key, nil)
+}
+
+// BatchUpdate writes all the records of a batch with a single write call and
+// only then touches the keydir. A cancelled batch never reaches the disk, so
+// there is nothing to roll back.
+func (b *Bitcask) BatchUpdate(ctx context.Context, pairs []Pair) (_ []Pair, err error) {
+	defer func() { b.observeBatch(len(pairs), err) }()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	updatedPairs := make([]Pair, 0)
+	for i, pair := range pairs {
+		if i%b.opts.BatchedWritesCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if _, exists := b.keydir[pair.Key]; exists {
+			updatedPairs = append(updatedPairs, pair)
+		}
+	}
+	if len(updatedPairs) == 0 {
+		return updatedPairs, nil
+	}
+
+	buf := make([]byte, 0)
+	sizes := make([]int, len(updatedPairs))
+	for i, pair := range updatedPairs {
+		flag := entryBatch
+		if i == len(updatedPairs)-1 {
+			flag = entryPut
+		}
+		payload, err := encodeEntryRecord(b.seq+uint64(i)+1, flag, pair.Key, pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		before := len(buf)
+		buf = appendRecord(buf, payload)
+		sizes[i] = len(buf) - before
+	}
+
+	// A batch is never split across files. It might make the active file go
+	// over MaxFileSize, which is fine.
+	offset, err := b.write(buf)
+	if err != nil {
+		return nil, err
+	}
+	for i, pair := range updatedPairs {
+		b.seq++
+		b.keydir[pair.Key] = keydirEntry{fileID: b.activeID, offset: offset, size: uint32(sizes[i]), seq: b.seq}
+		offset += int64(sizes[i])
+	}
+	return updatedPairs, nil
+}
+
+// Sync forces everything written so far to disk.
+func (b *Bitcask) Sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || !b.dirty {
+		return nil
+	}
+	b.dirty = false
+	return b.active.Sync()
+}
+
+type bitcaskRemap struct {
+	key      string
+	from, to keydirEntry
+}
+
+// Merge rewrites the live records of every immutable data file into new files
+// (with hint files) and removes the old ones. Writes carry on while it runs,
+// they only wait for the rotation at the start and the swap at the end.
+func (b *Bitcask) Merge() error {
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errBitcaskClosed
+	}
+	if b.activeSize > 0 {
+		if err := b.rotate(); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	old := make([]uint32, 0, len(b.files))
+	for id := range b.files {
+		if id != b.activeID {
+			old = append(old, id)
+		}
+	}
+	b.mu.Unlock()
+	if len(old) == 0 {
+		return nil
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i] < old[j] })
+
+	m := &bitcaskMerger{b: b}
+	for _, id := range old {
+		b.mu.RLock()
+		f := b.files[id]
+		b.mu.RUnlock()
+		if err := m.copyLive(id, f); err != nil {
+			m.abort()
+			return err
+		}
+	}
+	if err := m.finish(); err != nil {
+		m.abort()
+		return err
+	}
+
+	b.mu.Lock()
+	for _, r := range m.remaps {
+		if cur, ok := b.keydir[r.key]; ok && cur == r.from {
+			b.keydir[r.key] = r.to
+		}
+	}
+	for _, id := range m.ids {
+		f, err := os.Open(b.dataPath(id))
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		b.files[id] = f
+	}
+	for _, id := range old {
+		b.files[id].Close()
+		delete(b.files, id)
+	}
+	b.mu.Unlock()
+
+	// If this fails the old files stay around and get loaded again on the
+	// next open, which is fine, they still have all their tombstones.
+	if err := b.markObsolete(old); err != nil {
+		return err
+	}
+	return b.removeObsolete()
+}
+
+// markObsolete durably adds ids to the files to remove.
+func (b *Bitcask) markObsolete(ids []uint32) error {
+	pending, err := b.obsolete()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(append(pending, ids...))
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(b.dir, bitcaskObsoleteName)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// obsolete returns the ids of the files to remove.
+func (b *Bitcask) obsolete() ([]uint32, error) {
+	data, err := os.ReadFile(filepath.Join(b.dir, bitcaskObsoleteName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("kv: reading %s: %w", bitcaskObsoleteName, err)
+	}
+	return ids, nil
+}
+
+// removeObsolete removes the files markObsolete listed, and then the list.
+// The list stays if any of them can't be removed, so the next merge or open
+// tries again.
+func (b *Bitcask) removeObsolete() error {
+	ids, err := b.obsolete()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	var failed error
+	for _, id := range ids {
+		for _, path := range []string{b.dataPath(id), b.hintPath(id)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) && failed == nil {
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	return os.Remove(filepath.Join(b.dir, bitcaskObsoleteName))
+}
+
+type bitcaskMerger struct {
+	b      *Bitcask
+	ids    []uint32
+	remaps []bitcaskRemap
+
+	// The hint file of the current data file is kept in memory and only
+	// written once the data file is safely on disk, so a hint can never point
+	// at a record that is not there.
+	data  *os.File
+	hints []byte
+	id    uint32
+	size  int64
+}
+
+func (m *bitcaskMerger) copyLive(id uint32, f *os.File) error {
+	r := &countingReader{r: io.NewSectionReader(f, 0, 1<<62)}
+	for {
+		offset := r.n
+		payload, err := readRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seq, flag, key, _, err := decodeEntryRecord(payload)
+		if err != nil {
+			return err
+		}
+		if flag == entryTombstone {
+			continue
+		}
+		from := keydirEntry{fileID: id, offset: offset, size: uint32(r.n - offset), seq: seq}
+		m.b.mu.RLock()
+		cur, live := m.b.keydir[key]
+		m.b.mu.RUnlock()
+		if !live || cur != from {
+			continue
+		}
+
+		if m.data == nil || m.size >= m.b.opts.MaxFileSize {
+			if err := m.next(); err != nil {
+				return err
+			}
+		}
+		// Copied records are never part of a pending batch any more.
+		copied := append(make([]byte, 0, len(payload)), payload...)
+		copied[8] = entryPut
+		buf := appendRecord(nil, copied)
+		if _, err := m.data.Write(buf); err != nil {
+			return err
+		}
+		to := keydirEntry{fileID: m.id, offset: m.size, size: uint32(len(buf)), seq: seq}
+		m.size += int64(len(buf))
+
+		hint := make([]byte, 20, 20+len(key))
+		binary.LittleEndian.PutUint64(hint[0:8], seq)
+		binary.LittleEndian.PutUint64(hint[8:16], uint64(to.offset))
+		binary.LittleEndian.PutUint32(hint[16:20], to.size)
+		m.hints = appendRecord(m.hints, append(hint, key...))
+		m.remaps = append(m.remaps, bitcaskRemap{key: key, from: from, to: to})
+	}
+}
+
+func (m *bitcaskMerger) next() error {
+	if err := m.closeCurrent(); err != nil {
+		return err
+	}
+	m.b.mu.Lock()
+	m.id = m.b.nextID
+	m.b.nextID++
+	m.b.mu.Unlock()
+
+	data, err := os.OpenFile(m.b.dataPath(m.id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	m.data, m.hints, m.size = data, nil, 0
+	m.ids = append(m.ids, m.id)
+	return nil
+}
+
+func (m *bitcaskMerger) closeCurrent() error {
+	if m.data == nil {
+		return nil
+	}
+	if err := m.data.Sync(); err != nil {
+		return err
+	}
+	if err := m.data.Close(); err != nil {
+		return err
+	}
+	m.data = nil
+
+	tmp := m.b.hintPath(m.id) + ".tmp"
+	if err := os.WriteFile(tmp, m.hints, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.b.hintPath(m.id))
+}
+
+func (m *bitcaskMerger) finish() error {
+	return m.closeCurrent()
+}
+
+func (m *bitcaskMerger) abort() {
+	if m.data != nil {
+		m.data.Close()
+	}
+	for _, id := range m.ids {
+		os.Remove(m.b.dataPath(id))
+		os.Remove(m.b.hintPath(id))
+	}
+}
+
+func (b *Bitcask) every(interval time.Duration, fn func()) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// Close stops the background work, syncs the active file and closes everything.
+func (b *Bitcask) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	b.mu.Unlock()
+
+	// Wait for a running merge before closing the files under it.
+	b.wg.Wait()
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.active.Sync()
+	b.closeFiles()
+	return err
+}
+
+func (b *Bitcask) closeFiles() {
+	for id, f := range b.files {
+		f.Close()
+		delete(b.files, id)
+	}
+}
@@ -0,0 +1,210 @@
+package kv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func openTestBitcask(t *testing.T, dir string, opts BitcaskOptions) *Bitcask {
+	t.Helper()
+	b, err := OpenBitcaskStore(dir, opts)
+	if err != nil {
+		t.Fatalf("OpenBitcaskStore returned an error: %v", err)
+	}
+	return b
+}
+
+func TestBitcask_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever})
+	b.Put("a", "1")
+	b.Put("b", "2")
+	b.Put("c", "3")
+	b.Update("a", "10")
+	b.Delete("b")
+	if err := b.Update("missing", "x"); err == nil {
+		t.Errorf("Expected Update of a missing key to fail")
+	}
+	updated, err := b.BatchUpdate(context.Background(), []Pair{{"c", "30"}, {"missing", "x"}})
+	if err != nil || len(updated) != 1 {
+		t.Fatalf("BatchUpdate = %v, %v", updated, err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+
+	b = openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever})
+	defer b.Close()
+	want := map[string]interface{}{"a": "10", "c": "30"}
+	for k, v := range want {
+		if value, err := b.Get(k); err != nil || value != v {
+			t.Errorf("Get(%s) = %v, %v, want %v", k, value, err, v)
+		}
+	}
+	if _, err := b.Get("b"); err == nil {
+		t.Errorf("Expected b to stay deleted after a reopen")
+	}
+}
+
+func TestBitcask_MergeDropsStaleRecords(t *testing.T) {
+	dir := t.TempDir()
+	// A tiny max file size so we end up with plenty of immutable files.
+	b := openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever, MaxFileSize: 256})
+	for i := 0; i < 50; i++ {
+		b.Put("key"+strconv.Itoa(i%5), i)
+	}
+	b.Put("deleted", "x")
+	b.Delete("deleted")
+
+	before := dataFiles(t, dir)
+	if err := b.Merge(); err != nil {
+		t.Fatalf("Merge returned an error: %v", err)
+	}
+	after := dataFiles(t, dir)
+	if after >= before {
+		t.Errorf("Expected merge to reduce the number of data files, %d before, %d after", before, after)
+	}
+	for i := 0; i < 5; i++ {
+		key := "key" + strconv.Itoa(i)
+		// Values always come back from disk as JSON, so numbers are float64.
+		if value, err := b.Get(key); err != nil || value != float64(45+i) {
+			t.Errorf("Get(%s) = %v, %v after merge", key, value, err)
+		}
+	}
+
+	// Reopen from the hint files.
+	b.Close()
+	hints, _ := filepath.Glob(filepath.Join(dir, "*"+bitcaskHintExt))
+	if len(hints) == 0 {
+		t.Fatalf("Expected merge to write hint files")
+	}
+	b = openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever})
+	defer b.Close()
+	for i := 0; i < 5; i++ {
+		key := "key" + strconv.Itoa(i)
+		if value, err := b.Get(key); err != nil || value != float64(45+i) {
+			t.Errorf("Get(%s) = %v, %v after reopen", key, value, err)
+		}
+	}
+	if _, err := b.Get("deleted"); err == nil {
+		t.Errorf("Expected deleted to stay deleted after merge and reopen")
+	}
+}
+
+func TestBitcask_MergeCrashDoesNotBringBackDeletedKeys(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever})
+	rotate := func() uint32 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		id := b.activeID
+		if err := b.rotate(); err != nil {
+			t.Fatalf("rotate returned an error: %v", err)
+		}
+		return id
+	}
+	b.Put("k", "1")
+	put := rotate()
+	b.Delete("k")
+	tombstone := rotate()
+	b.Close()
+
+	// A merge of both files crashed after removing the one with the
+	// tombstone but before removing the one with the put.
+	if err := b.markObsolete([]uint32{put, tombstone}); err != nil {
+		t.Fatalf("markObsolete returned an error: %v", err)
+	}
+	os.Remove(b.dataPath(tombstone))
+
+	b = openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever})
+	defer b.Close()
+	if value, err := b.Get("k"); err == nil {
+		t.Errorf("Expected k to stay deleted, got %v", value)
+	}
+	if _, err := os.Stat(filepath.Join(dir, bitcaskObsoleteName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the list of obsolete files to be gone after the open, got %v", err)
+	}
+}
+
+func TestBitcask_TornBatchIsIgnored(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever})
+	b.Put("a", "1")
+	b.Put("b", "2")
+	b.BatchUpdate(context.Background(), []Pair{{"a", "10"}, {"b", "20"}})
+	active := b.dataPath(b.activeID)
+	b.Close()
+
+	// Chop the last record of the batch off, as if we crashed halfway through
+	// writing it. Neither pair of the batch should survive.
+	data, err := os.ReadFile(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(active, data[:len(data)-3], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	b = openTestBitcask(t, dir, BitcaskOptions{Fsync: FsyncNever})
+	defer b.Close()
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if value, err := b.Get(k); err != nil || value != v {
+			t.Errorf("Get(%s) = %v, %v, want %v", k, value, err, v)
+		}
+	}
+}
+
+func TestBitcask_CancelledBatchUpdate(t *testing.T) {
+	b := openTestBitcask(t, t.TempDir(), BitcaskOptions{Fsync: FsyncNever})
+	defer b.Close()
+	b.Put("a", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.BatchUpdate(ctx, []Pair{{"a", "2"}}); err == nil {
+		t.Fatal("Expected BatchUpdate to fail on a cancelled context")
+	}
+	if value, _ := b.Get("a"); value != "1" {
+		t.Errorf("Expected a=1, got %v", value)
+	}
+}
+
+func dataFiles(t *testing.T, dir string) int {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+bitcaskDataExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func BenchmarkBitcaskPut(b *testing.B) {
+	store, err := OpenBitcaskStore(b.TempDir(), BitcaskOptions{Fsync: FsyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 0; i < b.N; i++ {
+		store.Put("key"+strconv.Itoa(i%1000), i)
+	}
+}
+
+func BenchmarkBitcaskGet(b *testing.B) {
+	store, err := OpenBitcaskStore(b.TempDir(), BitcaskOptions{Fsync: FsyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+	for i := 0; i < 1000; i++ {
+		store.Put("key"+strconv.Itoa(i), i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Get("key" + strconv.Itoa(i%1000))
+	}
+}
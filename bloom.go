@@ -0,0 +1,77 @@
+package kv
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter answers "is this key maybe in the set" without false negatives.
+// Every sstable has one so that a Get for a key that is not there usually
+// does not have to touch the disk at all.
+type bloomFilter struct {
+	bits []uint64
+	k    uint32
+}
+
+// newBloomFilter sizes a filter for n keys at the given false positive rate.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := uint32(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (uint64(m)+63)/64), k: k}
+}
+
+// bloomHash is computed once per key and reused for all k probes (double
+// hashing, see Kirsch and Mitzenmacher).
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (b *bloomFilter) add(hash uint64) {
+	h1, h2 := uint32(hash), uint32(hash>>32)
+	m := uint32(len(b.bits) * 64)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(hash uint64) bool {
+	h1, h2 := uint32(hash), uint32(hash>>32)
+	m := uint32(len(b.bits) * 64)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) marshal() []byte {
+	buf := make([]byte, 4+8*len(b.bits))
+	binary.LittleEndian.PutUint32(buf[0:4], b.k)
+	for i, word := range b.bits {
+		binary.LittleEndian.PutUint64(buf[4+8*i:], word)
+	}
+	return buf
+}
+
+func unmarshalBloomFilter(buf []byte) (*bloomFilter, error) {
+	if len(buf) < 12 || (len(buf)-4)%8 != 0 {
+		return nil, errCorruptRecord
+	}
+	b := &bloomFilter{k: binary.LittleEndian.Uint32(buf[0:4]), bits: make([]uint64, (len(buf)-4)/8)}
+	for i := range b.bits {
+		b.bits[i] = binary.LittleEndian.Uint64(buf[4+8*i:])
+	}
+	return b, nil
+}
@@ -0,0 +1,324 @@
+// Package client talks to the kv HTTP API, so nobody has to hand roll
+// another net/http wrapper around /set, /get, /update, /updateBulk and
+// /delete.
+//
+// It deliberately does not import kv, so pulling it in does not drag every
+// storage engine along with it. The errors mirror the ones the in-process
+// stores return: a *NotFoundError for a missing key and ErrKVFull when the
+// store is full.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pair is the same as kv.Pair.
+type Pair struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// Options configures a Client. The zero value is fine.
+type Options struct {
+	// Timeout bounds every attempt of a request, on top of whatever deadline
+	// the caller's context has. Defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is how many times a request is retried after a network
+	// error or a 502, 503 or 504. Defaults to 3, set it to -1 to disable
+	// retries.
+	MaxRetries int
+	// Backoff is the wait before the first retry. Every retry after that
+	// waits twice as long, up to MaxBackoff, with some jitter so a fleet of
+	// clients does not retry in lockstep. Default to 50ms and 2s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Connection pool settings, see http.Transport. MaxIdleConnsPerHost
+	// defaults to 16 instead of Go's 2, since a client only ever talks to
+	// the one server and would otherwise keep opening new connections under
+	// load.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// HTTPClient replaces the client built from the settings above, for
+	// when you need full control (TLS, proxies and so on).
+	HTTPClient *http.Client
+
+	// APIKey or Token, if set, are sent with every request for servers
+	// that want to know who is asking. Token is a bearer token.
+	APIKey string
+	Token  string
+
+	// Namespace, if set, sends every request to that namespace of the
+	// server instead of its own store. See also WithNamespace.
+	Namespace string
+
+	// VirtualNodes is only for NewCluster, it has to be the same as the
+	// proxies' of the cluster. Defaults to 128, like theirs.
+	VirtualNodes int
+}
+
+// Client is safe for concurrent use. Make one per server and keep it around,
+// that is what makes the connection pool useful.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	opts    Options
+}
+
+// New returns a client for the server at baseURL, e.g. http://localhost:11200.
+func New(baseURL string, opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = 50 * time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 2 * time.Second
+	}
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.MaxIdleConns != 0 {
+			transport.MaxIdleConns = opts.MaxIdleConns
+		}
+		transport.MaxIdleConnsPerHost = 16
+		if opts.MaxIdleConnsPerHost != 0 {
+			transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		}
+		if opts.IdleConnTimeout != 0 {
+			transport.IdleConnTimeout = opts.IdleConnTimeout
+		}
+		httpClient = &http.Client{Transport: transport}
+	}
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), http: httpClient, opts: opts}
+}
+
+// Get returns the value of key. Numbers come back as float64, like anything
+// else that went through JSON.
+func (c *Client) Get(ctx context.Context, key string) (interface{}, error) {
+	var resp struct {
+		Value interface{} `json:"value"`
+	}
+	err := c.do(ctx, http.MethodGet, "/get?key="+url.QueryEscape(key), key, nil, func(status int, body []byte) error {
+		return json.Unmarshal(body, &resp)
+	})
+	return resp.Value, err
+}
+
+// Put sets key to value, creating it if needed.
+func (c *Client) Put(ctx context.Context, key string, value interface{}) error {
+	return c.do(ctx, http.MethodPost, "/set", key, Pair{key, value}, nil)
+}
+
+// PutWithTTL is Put, except that the key expires after ttl.
+func (c *Client) PutWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	body := struct {
+		Pair
+		TTL float64 `json:"ttl"`
+	}{Pair{key, value}, ttl.Seconds()}
+	return c.do(ctx, http.MethodPost, "/set", key, body, nil)
+}
+
+// Update sets key to value only if key exists, and returns a *NotFoundError
+// otherwise.
+func (c *Client) Update(ctx context.Context, key string, value interface{}) error {
+	return c.do(ctx, http.MethodPatch, "/update", key, Pair{key, value}, nil)
+}
+
+// Delete deletes key. Deleting a key that does not exist is not an error,
+// whatever store the server runs on.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, "/delete?key="+url.QueryEscape(key), key, nil, nil)
+}
+
+// BatchUpdate updates the keys that exist and ignores the others, like
+// Store.BatchUpdate. It returns the pairs that were applied, which is all of
+// them unless the server answered 206 Partial Content.
+//
+// Retrying a batch is safe: updating a key to the value it already has
+// changes nothing, and keys that did not exist still don't.
+func (c *Client) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+	var resp struct {
+		Value []Pair `json:"value"`
+	}
+	err := c.do(ctx, http.MethodPatch, "/updateBulk", "", pairs, func(status int, body []byte) error {
+		return json.Unmarshal(body, &resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Value, nil
+}
+
+// Keys lists the keys that start with prefix, in order. limit 0 means all of
+// them.
+func (c *Client) Keys(ctx context.Context, prefix string, limit int) ([]string, error) {
+	var resp struct {
+		Value []string `json:"value"`
+	}
+	query := url.Values{"prefix": {prefix}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	err := c.do(ctx, http.MethodGet, "/admin/keys?"+query.Encode(), "", nil, func(status int, body []byte) error {
+		return json.Unmarshal(body, &resp)
+	})
+	return resp.Value, err
+}
+
+// Stats returns what /admin/stats knows about the store, which depends on
+// the store.
+func (c *Client) Stats(ctx context.Context) (map[string]interface{}, error) {
+	var stats map[string]interface{}
+	err := c.do(ctx, http.MethodGet, "/admin/stats", "", nil, func(status int, body []byte) error {
+		return json.Unmarshal(body, &stats)
+	})
+	return stats, err
+}
+
+// Snapshot streams a snapshot of the store into w. It is never retried, w
+// may already have part of it by the time something goes wrong.
+func (c *Client) Snapshot(ctx context.Context, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/admin/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	c.setHeaders(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return statusError(resp.StatusCode, body, "")
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// do sends a request with body (JSON encoded, if not nil), retrying it if it
+// failed in a way worth retrying. That is only safe because every call the
+// API has is idempotent, anything that isn't (a compare-and-swap, say) must
+// not go through here as is. handle, if not nil, gets the status and body of
+// a 2xx response. Every other status is turned into an error, key is for the
+// *NotFoundError.
+func (c *Client) do(ctx context.Context, method, path, key string, body interface{}, handle func(status int, body []byte) error) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	retries := max(c.opts.MaxRetries, 0)
+	for attempt := 0; ; attempt++ {
+		status, respBody, err := c.attempt(ctx, method, path, encoded)
+		if err == nil {
+			err = statusError(status, respBody, key)
+		}
+		if err == nil {
+			if handle == nil {
+				return nil
+			}
+			return handle(status, respBody)
+		}
+		// No point retrying once the caller has given up.
+		if attempt >= retries || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		if err := c.sleep(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.setHeaders(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// setHeaders adds the credentials and the namespace to req.
+func (c *Client) setHeaders(req *http.Request) {
+	if c.opts.Namespace != "" {
+		req.Header.Set("X-KV-Namespace", c.opts.Namespace)
+	}
+	if c.opts.APIKey != "" {
+		req.Header.Set("X-API-Key", c.opts.APIKey)
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+}
+
+// sleep waits out the backoff before retry number attempt+1, or until ctx is
+// done.
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	backoff := c.opts.Backoff << attempt
+	if backoff > c.opts.MaxBackoff || backoff <= 0 {
+		backoff = c.opts.MaxBackoff
+	}
+	// Somewhere between half and all of it.
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryable reports whether err is worth another go: the request never got
+// an answer (connection refused or reset, or the attempt timed out) or the
+// server said it is temporarily unavailable.
+func retryable(err error) bool {
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.StatusCode == http.StatusBadGateway ||
+			serverErr.StatusCode == http.StatusServiceUnavailable ||
+			serverErr.StatusCode == http.StatusGatewayTimeout
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
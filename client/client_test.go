@@ -0,0 +1,249 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kv"
+	"kv/client"
+)
+
+func newTestClient(t *testing.T, handler http.Handler) *client.Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return client.New(server.URL, client.Options{Backoff: time.Millisecond})
+}
+
+func TestClient_Operations(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, kv.NewHTTPServer(kv.NewWriteOptimizedMapStore(1, true, 3), ""))
+
+	if err := c.Put(ctx, "a", "1"); err != nil {
+		t.Fatalf("Put returned an error: %v", err)
+	}
+	if value, err := c.Get(ctx, "a"); err != nil || value != "1" {
+		t.Errorf("Get = %v, %v, want 1", value, err)
+	}
+	if _, err := c.Get(ctx, "missing"); !client.IsNotFound(err) {
+		t.Errorf("Expected a *NotFoundError, got %v", err)
+	} else if err.(*client.NotFoundError).Key != "missing" {
+		t.Errorf("Expected the error to name the key, got %v", err)
+	}
+
+	if err := c.Update(ctx, "a", float64(2)); err != nil {
+		t.Errorf("Update returned an error: %v", err)
+	}
+	if err := c.Update(ctx, "missing", 2); !client.IsNotFound(err) {
+		t.Errorf("Expected a *NotFoundError from Update, got %v", err)
+	}
+
+	c.Put(ctx, "b", "1")
+	updated, err := c.BatchUpdate(ctx, []client.Pair{{"a", "x"}, {"missing", "x"}, {"b", "y"}})
+	if err != nil {
+		t.Fatalf("BatchUpdate returned an error: %v", err)
+	}
+	if len(updated) != 2 || updated[0].Key != "a" || updated[1].Key != "b" || updated[1].Value != "y" {
+		t.Errorf("Expected a and b to be updated, got %v", updated)
+	}
+
+	c.Put(ctx, "c", "1")
+	if err := c.Put(ctx, "d", "1"); err != client.ErrKVFull {
+		t.Errorf("Expected ErrKVFull, got %v", err)
+	}
+
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Errorf("Delete returned an error: %v", err)
+	}
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Errorf("Expected deleting a missing key to be fine, got %v", err)
+	}
+	if _, err := c.Get(ctx, "a"); !client.IsNotFound(err) {
+		t.Errorf("Expected a to be deleted, got %v", err)
+	}
+}
+
+func TestClient_DeleteMissingKeyFromTheCache(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, kv.NewHTTPServer(kv.NewLRUCacheStore(3), ""))
+
+	c.Put(ctx, "a", "1")
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Errorf("Delete returned an error: %v", err)
+	}
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Errorf("Expected deleting a missing key from the cache to be fine, got %v", err)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	ctx := context.Background()
+	store := kv.NewHTTPServer(kv.NewWriteOptimizedMapStore(1, true, 10), "")
+	var calls atomic.Int32
+	flaky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1)%3 != 0 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		store.ServeHTTP(w, r)
+	})
+	c := newTestClient(t, flaky)
+
+	if err := c.Put(ctx, "a", "1"); err != nil {
+		t.Fatalf("Expected Put to succeed after retries, got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls.Load())
+	}
+
+	// 500s are the store failing, retrying won't help.
+	calls.Store(0)
+	broken := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}))
+	err := broken.Put(ctx, "a", "1")
+	if serverErr, ok := err.(*client.ServerError); !ok || serverErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected a 500 ServerError, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected a 500 not to be retried, got %d attempts", calls.Load())
+	}
+
+	// Neither is a request the caller gave up on.
+	calls.Store(0)
+	down := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := down.Get(cancelled, "a"); err == nil {
+		t.Errorf("Expected an error with a cancelled context")
+	}
+	if calls.Load() != 0 {
+		t.Errorf("Expected no attempts with a cancelled context, got %d", calls.Load())
+	}
+	if _, err := down.Get(ctx, "a"); err == nil {
+		t.Errorf("Expected an error once the retries run out")
+	}
+	if calls.Load() != 4 {
+		t.Errorf("Expected 1 attempt and 3 retries, got %d", calls.Load())
+	}
+}
+
+func TestClient_Auth(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(kv.NewHTTPServerWithOptions(kv.NewWriteOptimizedMapStore(1, true, 3), "", kv.HTTPOptions{
+		Auth: []kv.Authenticator{kv.NewAPIKeys(map[string]string{"secret": "alice"})},
+		ACL:  kv.ACL{{Identity: "alice", Prefix: "alice/", Permission: kv.PermRead | kv.PermWrite}},
+	}))
+	t.Cleanup(server.Close)
+
+	c := client.New(server.URL, client.Options{APIKey: "secret"})
+	if err := c.Put(ctx, "alice/a", "1"); err != nil {
+		t.Errorf("Put returned an error: %v", err)
+	}
+	err := c.Put(ctx, "bob/a", "1")
+	if serverErr, ok := err.(*client.ServerError); !ok || serverErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a 403 ServerError, got %v", err)
+	} else if serverErr.Message != `alice: write not allowed on key "bob/a"` {
+		t.Errorf("Expected the message from the JSON body, got %q", serverErr.Message)
+	}
+
+	anonymous := client.New(server.URL, client.Options{})
+	if _, err := anonymous.Get(ctx, "alice/a"); err == nil || err.(*client.ServerError).StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 without the key, got %v", err)
+	}
+}
+
+func TestClient_Namespaces(t *testing.T) {
+	ctx := context.Background()
+	namespaces, _ := kv.NewNamespaces(kv.NamespacesOptions{})
+	server := httptest.NewServer(kv.NewHTTPServerWithOptions(kv.NewWriteOptimizedMapStore(1, true, 3), "", kv.HTTPOptions{Namespaces: namespaces}))
+	t.Cleanup(server.Close)
+	c := client.New(server.URL, client.Options{})
+
+	if err := c.CreateNamespace(ctx, client.NamespaceSpec{Name: "t1", Capacity: 1}); err != nil {
+		t.Fatalf("CreateNamespace returned an error: %v", err)
+	}
+	t1 := c.WithNamespace("t1")
+	if err := t1.Put(ctx, "a", "1"); err != nil {
+		t.Errorf("Put returned an error: %v", err)
+	}
+	if err := t1.Put(ctx, "b", "1"); err != client.ErrKVFull {
+		t.Errorf("Expected t1 to be full, got %v", err)
+	}
+	if _, err := c.Get(ctx, "a"); !client.IsNotFound(err) {
+		t.Errorf("Expected the server's own store not to have a, got %v", err)
+	}
+	// The namespaced client can still manage the namespaces.
+	if specs, err := t1.Namespaces(ctx); err != nil || len(specs) != 1 || specs[0].Name != "t1" {
+		t.Errorf("Namespaces = %+v, %v", specs, err)
+	}
+	if err := c.DeleteNamespace(ctx, "t1"); err != nil {
+		t.Errorf("DeleteNamespace returned an error: %v", err)
+	}
+	if err := c.DeleteNamespace(ctx, "t1"); !client.IsNotFound(err) {
+		t.Errorf("Expected deleting t1 again to be a *NotFoundError, got %v", err)
+	}
+}
+
+func TestClient_Cluster(t *testing.T) {
+	ctx := context.Background()
+	var nodes []string
+	for i := 0; i < 3; i++ {
+		server := httptest.NewServer(kv.NewHTTPServer(kv.NewWriteOptimizedMapStore(1, true, 100), ""))
+		t.Cleanup(server.Close)
+		nodes = append(nodes, server.URL)
+	}
+	c := client.NewCluster(nodes, client.Options{})
+	// The proxy gets the nodes in another order, it has to agree all the
+	// same, or the client's copy of the ring has drifted from kv.Ring.
+	proxy, err := kv.NewClusterStore([]string{nodes[2], nodes[0], nodes[1]}, kv.ClusterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if c.Owner(key) != proxy.Ring().Owner(key) {
+			t.Fatalf("Expected the client and the proxy to agree on the owner of %s", key)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := c.Put(ctx, fmt.Sprintf("k%02d", i), float64(i)); err != nil {
+			t.Fatalf("Put returned an error: %v", err)
+		}
+	}
+	if value, err := proxy.Get("k07"); err != nil || value != float64(7) {
+		t.Errorf("Expected the proxy to find what the client wrote, got %v, %v", value, err)
+	}
+	if _, err := c.Node("k07").Get(ctx, "k07"); err != nil {
+		t.Errorf("Expected k07 on its node, got %v", err)
+	}
+	if err := c.Update(ctx, "missing", 1); !client.IsNotFound(err) {
+		t.Errorf("Expected a *NotFoundError from Update, got %v", err)
+	}
+
+	batch := []client.Pair{{"k19", "x"}, {"missing", "x"}, {"k00", "x"}, {"k10", "x"}, {"k05", "x"}}
+	updated, err := c.BatchUpdate(ctx, batch)
+	if err != nil {
+		t.Fatalf("BatchUpdate returned an error: %v", err)
+	}
+	if len(updated) != 4 || updated[0].Key != "k19" || updated[1].Key != "k00" || updated[3].Key != "k05" {
+		t.Errorf("Expected the updated pairs in the order of the batch, got %v", updated)
+	}
+
+	if err := c.Delete(ctx, "k00"); err != nil {
+		t.Errorf("Delete returned an error: %v", err)
+	}
+	keys, err := c.Keys(ctx, "k1", 3)
+	if err != nil || len(keys) != 3 || keys[0] != "k10" || keys[2] != "k12" {
+		t.Errorf("Expected the first three k1 keys of the cluster, got %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster talks to a cluster of servers that share the keys out by
+// consistent hashing, the way a kv.ClusterStore (the -cluster-nodes proxy)
+// does. It sends every key straight to the server that owns it, which saves
+// the hop through a proxy. The nodes have to be the URLs the proxies were
+// given, in any order, for the two to agree on who owns what.
+type Cluster struct {
+	ring    *ring
+	clients map[string]*Client
+}
+
+// NewCluster returns a client for the servers at nodes. Their clients share
+// one connection pool.
+func NewCluster(nodes []string, opts Options) *Cluster {
+	c := &Cluster{clients: make(map[string]*Client)}
+	trimmed := make([]string, len(nodes))
+	for i, node := range nodes {
+		trimmed[i] = strings.TrimRight(node, "/")
+		if _, ok := c.clients[trimmed[i]]; ok {
+			continue
+		}
+		client := New(trimmed[i], opts)
+		opts.HTTPClient = client.http
+		c.clients[trimmed[i]] = client
+	}
+	c.ring = newRing(trimmed, opts.VirtualNodes)
+	return c
+}
+
+// Owner returns the URL of the node key belongs to.
+func (c *Cluster) Owner(key string) string {
+	return c.ring.owner(key)
+}
+
+// Node returns the client of the node key belongs to, for everything
+// Cluster doesn't route by itself, like a conditional write.
+func (c *Cluster) Node(key string) *Client {
+	return c.clients[c.ring.owner(key)]
+}
+
+// Get is Client.Get on the node that owns key.
+func (c *Cluster) Get(ctx context.Context, key string) (interface{}, error) {
+	return c.Node(key).Get(ctx, key)
+}
+
+// Put is Client.Put on the node that owns key.
+func (c *Cluster) Put(ctx context.Context, key string, value interface{}) error {
+	return c.Node(key).Put(ctx, key, value)
+}
+
+// PutWithTTL is Client.PutWithTTL on the node that owns key.
+func (c *Cluster) PutWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.Node(key).PutWithTTL(ctx, key, value, ttl)
+}
+
+// Update is Client.Update on the node that owns key.
+func (c *Cluster) Update(ctx context.Context, key string, value interface{}) error {
+	return c.Node(key).Update(ctx, key, value)
+}
+
+// Delete is Client.Delete on the node that owns key.
+func (c *Cluster) Delete(ctx context.Context, key string) error {
+	return c.Node(key).Delete(ctx, key)
+}
+
+// BatchUpdate splits pairs by node and sends every node its share at once.
+// It returns the pairs that were applied, in the order they were given.
+//
+// If a node fails, the others may have applied their share already.
+// Retrying the whole batch is safe, see Client.BatchUpdate.
+func (c *Cluster) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+	split := make(map[string][]Pair)
+	for _, pair := range pairs {
+		owner := c.ring.owner(pair.Key)
+		split[owner] = append(split[owner], pair)
+	}
+	updated := make(map[string][]Pair, len(split))
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for node, share := range split {
+		wg.Add(1)
+		go func(node string, share []Pair) {
+			defer wg.Done()
+			applied, err := c.clients[node].BatchUpdate(ctx, share)
+			mu.Lock()
+			defer mu.Unlock()
+			updated[node], errs[node] = applied, err
+		}(node, share)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return nil, err
+	}
+
+	// A node returns its share minus the keys it doesn't have, in order.
+	result := make([]Pair, 0, len(pairs))
+	next := make(map[string]int, len(updated))
+	for _, pair := range pairs {
+		node := c.ring.owner(pair.Key)
+		if i := next[node]; i < len(updated[node]) && updated[node][i].Key == pair.Key {
+			result = append(result, updated[node][i])
+			next[node] = i + 1
+		}
+	}
+	return result, nil
+}
+
+// Keys is Client.Keys over every node.
+func (c *Cluster) Keys(ctx context.Context, prefix string, limit int) ([]string, error) {
+	lists := make(map[string][]string, len(c.clients))
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for node, client := range c.clients {
+		wg.Add(1)
+		go func(node string, client *Client) {
+			defer wg.Done()
+			// Every node's first limit keys are enough to find the first
+			// limit of them all.
+			keys, err := client.Keys(ctx, prefix, limit)
+			mu.Lock()
+			defer mu.Unlock()
+			lists[node], errs[node] = keys, err
+		}(node, client)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, list := range lists {
+		keys = append(keys, list...)
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+// firstError returns the error of the first node by URL, so it doesn't
+// depend on which one was slowest.
+func firstError(errs map[string]error) error {
+	nodes := make([]string, 0, len(errs))
+	for node, err := range errs {
+		if err != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	sort.Strings(nodes)
+	return errs[nodes[0]]
+}
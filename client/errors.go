@@ -0,0 +1,65 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// NotFoundError is returned when the key does not exist, like the stores'
+// notFoundError.
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return "key not found: " + e.Key
+}
+
+type kvFullError struct{}
+
+func (e *kvFullError) Error() string {
+	return "kv store is full"
+}
+
+// ErrKVFull is returned when the server answers 507 Insufficient Storage
+// because the store is at its size limit.
+var ErrKVFull = &kvFullError{}
+
+// ServerError is any other status the server answered with, Message is the
+// body it sent along.
+type ServerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ServerError) Error() string {
+	return "kv: " + http.StatusText(e.StatusCode) + ": " + e.Message
+}
+
+// IsNotFound reports whether err is a *NotFoundError.
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// statusError turns a response status into an error, nil for a 2xx (which
+// includes 206 Partial Content from /updateBulk, that is a success too).
+func statusError(status int, body []byte, key string) error {
+	switch {
+	case status >= 200 && status < 300:
+		return nil
+	case status == http.StatusNotFound:
+		return &NotFoundError{Key: key}
+	case status == http.StatusInsufficientStorage:
+		return ErrKVFull
+	}
+	// Authentication and authorization failures come as JSON.
+	var authErr struct {
+		Error string `json:"error"`
+	}
+	if (status == http.StatusUnauthorized || status == http.StatusForbidden) && json.Unmarshal(body, &authErr) == nil && authErr.Error != "" {
+		return &ServerError{StatusCode: status, Message: authErr.Error}
+	}
+	return &ServerError{StatusCode: status, Message: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// NamespaceSpec is the same as kv.NamespaceSpec.
+type NamespaceSpec struct {
+	Name     string `json:"name"`
+	Engine   string `json:"engine,omitempty"`
+	Capacity int    `json:"capacity,omitempty"`
+	MaxBytes int64  `json:"maxBytes,omitempty"`
+	Eviction string `json:"eviction,omitempty"`
+}
+
+// WithNamespace returns a client for the namespace name of the same server.
+// It shares the connection pool of c.
+func (c *Client) WithNamespace(name string) *Client {
+	scoped := *c
+	scoped.opts.Namespace = name
+	return &scoped
+}
+
+// server is c without its namespace, the namespaces are managed from the
+// server's side.
+func (c *Client) server() *Client {
+	return c.WithNamespace("")
+}
+
+// Namespaces lists the namespaces of the server, sorted by name.
+func (c *Client) Namespaces(ctx context.Context) ([]NamespaceSpec, error) {
+	var resp struct {
+		Value []NamespaceSpec `json:"value"`
+	}
+	err := c.server().do(ctx, http.MethodGet, "/admin/namespaces", "", nil, func(status int, body []byte) error {
+		return json.Unmarshal(body, &resp)
+	})
+	return resp.Value, err
+}
+
+// CreateNamespace creates a namespace. It is not retried, a retry of one that
+// did get through would fail with a 409.
+func (c *Client) CreateNamespace(ctx context.Context, spec NamespaceSpec) error {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	status, respBody, err := c.server().attempt(ctx, http.MethodPost, "/admin/namespaces", body)
+	if err != nil {
+		return err
+	}
+	return statusError(status, respBody, "")
+}
+
+// DeleteNamespace deletes a namespace and everything in it. It is not
+// retried either, for the same reason as CreateNamespace. A namespace that
+// does not exist is a *NotFoundError.
+func (c *Client) DeleteNamespace(ctx context.Context, name string) error {
+	status, respBody, err := c.server().attempt(ctx, http.MethodDelete, "/admin/namespaces?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	return statusError(status, respBody, name)
+}
@@ -0,0 +1,256 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterStore spreads the keys over the HTTP servers of other nodes with a
+// consistent hash Ring, and forwards every operation to the node that owns
+// the key. Serving it makes a routing proxy: clients talk to it like to any
+// other server and don't need to know where the keys live.
+//
+// Every key lives on exactly one node, there are no copies. A node that is
+// down takes its share of the keys with it until it is back, and changing
+// the nodes moves keys to new owners without moving their values, so that
+// is for an empty cluster or one whose data can be thrown away.
+type ClusterStore struct {
+	ring   *Ring
+	opts   ClusterOptions
+	client *http.Client
+}
+
+// ClusterOptions configure a ClusterStore.
+type ClusterOptions struct {
+	// VirtualNodes is how many points every node gets on the ring,
+	// DefaultVirtualNodes if it is 0. Every proxy and client of the cluster
+	// has to use the same.
+	VirtualNodes int
+	// Timeout bounds every request to a node, except those of a
+	// BatchUpdate, which have its context. Defaults to 10s.
+	Timeout time.Duration
+	// HTTPClient is for talking to the nodes, for TLS say. APIKey is sent
+	// along if the nodes want one.
+	HTTPClient *http.Client
+	APIKey     string
+}
+
+// nodeError is a node that couldn't be reached or answered with something
+// unexpected. The proxy answers 502 for it.
+type nodeError struct {
+	node string
+	err  error
+}
+
+func (e *nodeError) Error() string {
+	return fmt.Sprintf("node %s: %v", e.node, e.err)
+}
+
+func (e *nodeError) Unwrap() error {
+	return e.err
+}
+
+// ErrNoNodes is returned for a cluster without any nodes.
+var ErrNoNodes = errors.New("kv: a cluster needs at least one node")
+
+// NewClusterStore returns a store that routes every key to one of nodes,
+// the URLs of their HTTP servers, like http://10.0.0.1:11200.
+func NewClusterStore(nodes []string, opts ClusterOptions) (*ClusterStore, error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	trimmed := make([]string, len(nodes))
+	for i, node := range nodes {
+		u, err := url.Parse(node)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("kv: expected an http:// or https:// URL for a node, got %q", node)
+		}
+		// http://a:1/ and http://a:1 are the same node, and have to be the
+		// same point on the ring.
+		trimmed[i] = strings.TrimRight(node, "/")
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &ClusterStore{ring: NewRing(trimmed, opts.VirtualNodes), opts: opts, client: client}, nil
+}
+
+// Ring returns the ring the keys are routed with.
+func (c *ClusterStore) Ring() *Ring {
+	return c.ring
+}
+
+func (c *ClusterStore) Get(key string) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	var resp Response
+	err := c.do(ctx, c.ring.Owner(key), http.MethodGet, "/get?key="+url.QueryEscape(key), key, nil, &resp)
+	return resp.Value, err
+}
+
+func (c *ClusterStore) Put(key string, value interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	return c.do(ctx, c.ring.Owner(key), http.MethodPost, "/set", key, Pair{key, value}, nil)
+}
+
+func (c *ClusterStore) Update(key string, value interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	return c.do(ctx, c.ring.Owner(key), http.MethodPatch, "/update", key, Pair{key, value}, nil)
+}
+
+func (c *ClusterStore) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	return c.do(ctx, c.ring.Owner(key), http.MethodDelete, "/delete?key="+url.QueryEscape(key), key, nil, nil)
+}
+
+// BatchUpdate splits pairs by node and sends every node its share at once.
+// It returns the pairs the nodes updated, in the order they were given.
+//
+// Every node applies its share on its own, so if one of them fails the
+// others may have applied theirs already, and the error doesn't say which.
+// Retrying the whole batch is the way out, updating a key to the value it
+// already has changes nothing.
+func (c *ClusterStore) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+	split := c.ring.Split(pairs)
+	updated := make(map[string][]Pair, len(split))
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for node, share := range split {
+		wg.Add(1)
+		go func(node string, share []Pair) {
+			defer wg.Done()
+			var resp struct{ Value []Pair }
+			err := c.do(ctx, node, http.MethodPatch, "/updateBulk", "", share, &resp)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[node] = err
+				return
+			}
+			updated[node] = resp.Value
+		}(node, share)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// The first node by name, so the error doesn't depend on which one
+		// was slowest.
+		nodes := make([]string, 0, len(errs))
+		for node := range errs {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		return nil, errs[nodes[0]]
+	}
+
+	// What a node updated is its share minus the keys it doesn't have, in
+	// the same order, so walking the pairs once puts them back in order.
+	result := make([]Pair, 0, len(pairs))
+	next := make(map[string]int, len(updated))
+	for _, pair := range pairs {
+		node := c.ring.Owner(pair.Key)
+		if i := next[node]; i < len(updated[node]) && updated[node][i].Key == pair.Key {
+			result = append(result, updated[node][i])
+			next[node] = i + 1
+		}
+	}
+	return result, nil
+}
+
+// Keys lists the keys of every node. It fails if any of them can't, a list
+// with a node missing would look complete when it isn't.
+func (c *ClusterStore) Keys() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	nodes := c.ring.Nodes()
+	lists := make([][]string, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			var resp struct{ Value []string }
+			errs[i] = c.do(ctx, node, http.MethodGet, "/admin/keys", "", nil, &resp)
+			lists[i] = resp.Value
+		}(i, node)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	var keys []string
+	for _, list := range lists {
+		keys = append(keys, list...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// do sends body (JSON encoded, if not nil) to node and decodes the answer
+// into resp, if not nil. A 404 is a *notFoundError for key, if there is one,
+// and a 507 is ErrKVFull, like they would be from a store of our own. Any
+// other status that isn't a 2xx is a *nodeError.
+func (c *ClusterStore) do(ctx context.Context, node, method, path, key string, body, resp interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, node+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.APIKey != "" {
+		req.Header.Set("X-API-Key", c.opts.APIKey)
+	}
+	httpResp, err := c.client.Do(req)
+	if err != nil {
+		return &nodeError{node, err}
+	}
+	defer httpResp.Body.Close()
+	switch code := httpResp.StatusCode; {
+	case code == http.StatusNotFound && key != "":
+		return newNotFoundError(key)
+	case code == http.StatusInsufficientStorage:
+		return ErrKVFull
+	case code < 200 || code > 299:
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return &nodeError{node, fmt.Errorf("%d %s", code, strings.TrimSpace(string(msg)))}
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return &nodeError{node, err}
+	}
+	return nil
+}
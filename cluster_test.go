@@ -0,0 +1,154 @@
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startClusterNodes starts n servers with a map store each, and returns
+// their stores by URL.
+func startClusterNodes(t *testing.T, n int) (map[string]*WriteOptimizedMap, []*httptest.Server) {
+	stores := make(map[string]*WriteOptimizedMap)
+	var servers []*httptest.Server
+	for i := 0; i < n; i++ {
+		store := NewWriteOptimizedMapStore(1, true, 1000)
+		server := httptest.NewServer(NewHTTPServer(store, ""))
+		t.Cleanup(server.Close)
+		stores[server.URL] = store
+		servers = append(servers, server)
+	}
+	return stores, servers
+}
+
+func TestClusterStore_Proxy(t *testing.T) {
+	stores, servers := startClusterNodes(t, 3)
+	var nodes []string
+	for _, server := range servers {
+		nodes = append(nodes, server.URL+"/")
+	}
+	cluster, err := NewClusterStore(nodes, ClusterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(NewHTTPServer(cluster, ""))
+	defer proxy.Close()
+
+	do := func(method, path, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i := 0; i < 30; i++ {
+		if code := do(http.MethodPost, "/set", fmt.Sprintf(`{"key":"k%d","value":%d}`, i, i)); code != http.StatusCreated {
+			t.Fatalf("Expected /set through the proxy to work, got %d", code)
+		}
+	}
+	// Every key is on its owner and nowhere else, and every node got some.
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%d", i)
+		owner := cluster.Ring().Owner(key)
+		for node, store := range stores {
+			if _, err := store.Get(key); (err == nil) != (node == owner) {
+				t.Fatalf("Expected %s only on %s, %s says %v", key, owner, node, err)
+			}
+		}
+	}
+	for node, store := range stores {
+		if store.Len() == 0 {
+			t.Errorf("Expected %s to get some of the keys", node)
+		}
+	}
+
+	if value, err := cluster.Get("k7"); err != nil || value != float64(7) {
+		t.Errorf("Expected k7 back from its node, got %v, %v", value, err)
+	}
+	if code := do(http.MethodGet, "/get?key=missing", ""); code != http.StatusNotFound {
+		t.Errorf("Expected a missing key to be a 404, got %d", code)
+	}
+	if err := cluster.Update("missing", 1); !isNotFound(err) {
+		t.Errorf("Expected the node's not found to make it back, got %v", err)
+	}
+	if code := do(http.MethodDelete, "/delete?key=k0", ""); code != http.StatusOK {
+		t.Errorf("Expected /delete through the proxy to work, got %d", code)
+	}
+	if _, err := cluster.Get("k0"); !isNotFound(err) {
+		t.Errorf("Expected k0 to be deleted, got %v", err)
+	}
+
+	// The batch is split over the nodes and comes back in order, without the
+	// key that doesn't exist.
+	var batch []Pair
+	for i := 1; i < 30; i += 3 {
+		batch = append(batch, Pair{fmt.Sprintf("k%d", i), "bulk"})
+	}
+	batch = append(batch[:3], append([]Pair{{"missing", "bulk"}}, batch[3:]...)...)
+	body, _ := json.Marshal(batch)
+	req, _ := http.NewRequest(http.MethodPatch, proxy.URL+"/updateBulk", strings.NewReader(string(body)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updated struct{ Value []Pair }
+	json.NewDecoder(resp.Body).Decode(&updated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || len(updated.Value) != len(batch)-1 {
+		t.Fatalf("Expected a 206 with every pair but the missing one, got %d %v", resp.StatusCode, updated.Value)
+	}
+	for i, j := 0, 0; i < len(batch); i++ {
+		if batch[i].Key == "missing" {
+			continue
+		}
+		if updated.Value[j].Key != batch[i].Key || updated.Value[j].Value != "bulk" {
+			t.Fatalf("Expected the updated pairs in the order of the batch, got %v", updated.Value)
+		}
+		j++
+	}
+	if value, _ := cluster.Get("k28"); value != "bulk" {
+		t.Errorf("Expected k28 to be updated, got %v", value)
+	}
+
+	keys, err := cluster.Keys()
+	if err != nil || len(keys) != 29 || keys[0] != "k1" {
+		t.Errorf("Expected the keys of every node but k0, got %v, %v", keys, err)
+	}
+
+	// A node that is gone is a 502, for its keys only.
+	down := servers[0]
+	down.Close()
+	var lost, kept string
+	for i := 1; i < 30 && (lost == "" || kept == ""); i++ {
+		key := fmt.Sprintf("k%d", i)
+		if cluster.Ring().Owner(key) == down.URL {
+			lost = key
+		} else {
+			kept = key
+		}
+	}
+	if code := do(http.MethodGet, "/get?key="+lost, ""); code != http.StatusBadGateway {
+		t.Errorf("Expected a key on the node that is down to be a 502, got %d", code)
+	}
+	if code := do(http.MethodGet, "/get?key="+kept, ""); code != http.StatusOK {
+		t.Errorf("Expected the other nodes to carry on, got %d", code)
+	}
+	body, _ = json.Marshal([]Pair{{lost, 1}, {kept, 1}})
+	if code := do(http.MethodPatch, "/updateBulk", string(body)); code != http.StatusBadGateway {
+		t.Errorf("Expected a batch with a node down to be a 502, got %d", code)
+	}
+
+	if _, err := NewClusterStore(nil, ClusterOptions{}); err != ErrNoNodes {
+		t.Errorf("Expected ErrNoNodes, got %v", err)
+	}
+	if _, err := NewClusterStore([]string{"10.0.0.1:11200"}, ClusterOptions{}); err == nil {
+		t.Errorf("Expected a node without a scheme to be refused")
+	}
+}
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"kv"
+)
+
+// Config is everything the server can be told. It comes from, in order of
+// precedence: flags, KV_* environment variables (-max-bytes is KV_MAX_BYTES),
+// the JSON file given by -config, and the defaults below.
+type Config struct {
+	Store StoreConfig `json:"store"`
+	Cache CacheConfig `json:"cache"`
+	HTTP  HTTPConfig  `json:"http"`
+	// Namespaces are hosted by the HTTP server of the store.
+	Namespaces NamespacesConfig `json:"namespaces"`
+	// ShutdownTimeout is how long requests in flight get to finish on
+	// SIGTERM before they are cancelled.
+	ShutdownTimeout duration `json:"shutdownTimeout"`
+}
+
+// StoreConfig is the store that is supposed to keep its data. It runs if
+// any of its addresses is set.
+type StoreConfig struct {
+	Addr          string `json:"addr"`
+	RESPAddr      string `json:"respAddr"`
+	MemcachedAddr string `json:"memcachedAddr"`
+	// Engine is map, syncmap, bitcask or lsm.
+	Engine string `json:"engine"`
+	// Capacity is the number of keys the map engine takes, MaxBytes replaces
+	// it with a limit in bytes when it is set.
+	Capacity                   int   `json:"capacity"`
+	MaxBytes                   int64 `json:"maxBytes"`
+	Rollback                   bool  `json:"rollback"`
+	BatchedWritesCheckInterval int   `json:"batchedWritesCheckInterval"`
+	// WAL is the write-ahead log of the map engine, empty for none.
+	WAL           string   `json:"wal"`
+	DataDir       string   `json:"dataDir"`
+	MergeInterval duration `json:"mergeInterval"`
+	Fsync         string   `json:"fsync"`
+	FsyncInterval duration `json:"fsyncInterval"`
+	// Raft replicates the map engine over a cluster.
+	Raft RaftConfig `json:"raft"`
+	// Replication makes the store a primary with read-only replicas, or
+	// one of the replicas.
+	Replication ReplicationConfig `json:"replication"`
+	// Cluster makes the store a proxy for other servers instead.
+	Cluster ClusterConfig `json:"cluster"`
+	// Quorum replicates the store over a set of nodes, Dynamo style.
+	Quorum QuorumConfig `json:"quorum"`
+}
+
+// QuorumConfig makes the store one of Nodes when there are any, see
+// kv.QuorumStore. The nodes talk to each other over the HTTP server of the
+// store.
+type QuorumConfig struct {
+	// Self is the URL of this node, as it is in Nodes.
+	Self  string `json:"self"`
+	Nodes urls   `json:"nodes,omitempty"`
+	// N is how many nodes have a copy of every key, R and W how many of them
+	// a read and a write wait for unless the request says otherwise. 0 for
+	// the defaults: 3, and a majority of N.
+	N int `json:"n"`
+	R int `json:"r"`
+	W int `json:"w"`
+	// AntiEntropyInterval is how often the node compares its replicas with
+	// another node's to repair the keys they disagree on, 0 for 30s and
+	// never if negative.
+	AntiEntropyInterval duration `json:"antiEntropyInterval"`
+	// APIKey is sent to the other nodes when they check credentials. Only
+	// the config file can set it.
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+// ClusterConfig routes the store to Nodes by consistent hashing when there
+// are any, see kv.ClusterStore. The store keeps nothing itself then, and the
+// engine settings don't matter.
+type ClusterConfig struct {
+	// Nodes are the URLs of the HTTP servers of the nodes.
+	Nodes urls `json:"nodes,omitempty"`
+	// VirtualNodes is how many points every node gets on the ring, 0 for
+	// the default. Every proxy and client has to use the same.
+	VirtualNodes int `json:"virtualNodes"`
+	// APIKey is sent to the nodes when they check credentials. Only the
+	// config file can set it.
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+// urls is a list of URLs that is a flag like
+// "http://10.0.0.1:11200,http://10.0.0.2:11200".
+type urls []string
+
+func (u urls) String() string {
+	return strings.Join(u, ",")
+}
+
+func (u *urls) Set(s string) error {
+	var parsed urls
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			parsed = append(parsed, addr)
+		}
+	}
+	*u = parsed
+	return nil
+}
+
+// ReplicationConfig is asynchronous replication, see kv.ReplicatedStore.
+// Replicas follow the primary over its HTTP server.
+type ReplicationConfig struct {
+	Primary bool `json:"primary"`
+	// ReplicaOf is the URL of the HTTP server of the primary.
+	ReplicaOf string `json:"replicaOf"`
+	// FeedSize is how many writes the primary keeps for replicas that fall
+	// behind, 0 for the default.
+	FeedSize int `json:"feedSize"`
+	// Name is what a replica reports to the primary as, the host name by
+	// default.
+	Name string `json:"name"`
+	// APIKey is sent to the primary when it checks credentials. Only the
+	// config file can set it.
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+// RaftConfig makes the store a member of a Raft cluster when ID is set, see
+// kv.RaftStore. The members talk to each other over the HTTP server of the
+// store, and write their log with the fsync settings of the store.
+type RaftConfig struct {
+	ID string `json:"id"`
+	// Peers maps every member of the initial cluster to the URL of its HTTP
+	// server, this one included.
+	Peers peers `json:"peers,omitempty"`
+	// Join starts the member outside of any cluster, for one to add it.
+	Join bool   `json:"join"`
+	Dir  string `json:"dir"`
+	// SnapshotThreshold is how many entries the log keeps before they are
+	// compacted into a snapshot, 0 for the default.
+	SnapshotThreshold int `json:"snapshotThreshold"`
+	// APIKey is sent to the other members when they check credentials. Only
+	// the config file can set it.
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+// peers is a map of Raft member IDs to URLs that is a flag like
+// "a=http://10.0.0.1:11200,b=http://10.0.0.2:11200".
+type peers map[string]string
+
+func (p peers) String() string {
+	pairs := make([]string, 0, len(p))
+	for id, addr := range p {
+		pairs = append(pairs, id+"="+addr)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p *peers) Set(s string) error {
+	parsed := peers{}
+	for _, pair := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || addr == "" {
+			return fmt.Errorf("expected id=url, got %q", pair)
+		}
+		parsed[id] = addr
+	}
+	*p = parsed
+	return nil
+}
+
+// CacheConfig is the cache that evicts instead of refusing writes. It runs
+// if any of its addresses is set.
+type CacheConfig struct {
+	Addr          string `json:"addr"`
+	RESPAddr      string `json:"respAddr"`
+	MemcachedAddr string `json:"memcachedAddr"`
+	Capacity      int    `json:"capacity"`
+	MaxBytes      int64  `json:"maxBytes"`
+	Eviction      string `json:"eviction"`
+}
+
+type HTTPConfig struct {
+	ReadHeaderTimeout duration   `json:"readHeaderTimeout"`
+	ReadTimeout       duration   `json:"readTimeout"`
+	WriteTimeout      duration   `json:"writeTimeout"`
+	IdleTimeout       duration   `json:"idleTimeout"`
+	BatchTimeout      duration   `json:"batchTimeout"`
+	TLS               TLSConfig  `json:"tls"`
+	Auth              AuthConfig `json:"auth"`
+}
+
+// TLSConfig turns on HTTPS for every HTTP server when CertFile is set.
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile turns on mutual TLS, ClientAuth says whether a client
+	// certificate is required or optional then.
+	ClientCAFile string `json:"clientCAFile"`
+	ClientAuth   string `json:"clientAuth"`
+	// Identities maps client certificate subjects (or common names) to
+	// identities. Only the config file can set it.
+	Identities     map[string]string `json:"identities,omitempty"`
+	ReloadInterval duration          `json:"reloadInterval"`
+}
+
+// NamespacesConfig lets the HTTP server of the store host namespaces, see
+// kv.Namespaces. They share the fsync settings of the store.
+type NamespacesConfig struct {
+	Enabled bool `json:"enabled"`
+	// Dir keeps the namespaces across restarts, they only live in memory
+	// without it.
+	Dir string `json:"dir"`
+	// Create are created on startup, unless they exist already. Only the
+	// config file can set it.
+	Create []kv.NamespaceSpec `json:"create,omitempty"`
+}
+
+// AuthConfig turns on authentication and authorization for every HTTP
+// server. Client certificates are identities too, see TLSConfig.
+type AuthConfig struct {
+	// APIKeys maps API keys to identities. Only the config file can set it,
+	// keys don't belong on a command line.
+	APIKeys map[string]string `json:"apiKeys,omitempty"`
+	// TokenSecretFile holds the secret bearer tokens are signed with, see
+	// kvctl token.
+	TokenSecretFile string `json:"tokenSecretFile"`
+	// ACL is also only set by the config file.
+	ACL []ACLRuleConfig `json:"acl,omitempty"`
+}
+
+// ACLRuleConfig is a kv.ACLRule, Permissions is a list like "read,write".
+type ACLRuleConfig struct {
+	Identity    string `json:"identity"`
+	Namespace   string `json:"namespace,omitempty"`
+	Prefix      string `json:"prefix"`
+	Permissions string `json:"permissions"`
+}
+
+func (a *AuthConfig) enabled() bool {
+	return len(a.APIKeys) > 0 || a.TokenSecretFile != "" || len(a.ACL) > 0
+}
+
+// duration is a time.Duration that reads and writes "1m30s" in JSON rather
+// than nanoseconds.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"1m30s\", got %s", b)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// defaultConfig is what the binary always did: a map store of 100 keys on
+// :11200 and an LRU cache of 100 keys on :11201.
+func defaultConfig() Config {
+	return Config{
+		Store: StoreConfig{
+			Addr:                       "0.0.0.0:11200",
+			Engine:                     "map",
+			Capacity:                   100,
+			Rollback:                   true,
+			BatchedWritesCheckInterval: 1,
+			DataDir:                    "data",
+			MergeInterval:              duration(10 * time.Minute),
+			Fsync:                      "always",
+			FsyncInterval:              duration(100 * time.Millisecond),
+		},
+		Cache: CacheConfig{
+			Addr:     "0.0.0.0:11201",
+			Capacity: 100,
+			Eviction: "lru",
+		},
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: duration(10 * time.Second),
+			IdleTimeout:       duration(2 * time.Minute),
+			BatchTimeout:      duration(30 * time.Second),
+			TLS: TLSConfig{
+				ClientAuth:     "require",
+				ReloadInterval: duration(10 * time.Second),
+			},
+		},
+		ShutdownTimeout: duration(30 * time.Second),
+	}
+}
+
+// flagSet binds the flags to cfg. The defaults it shows are whatever cfg
+// already holds, so -help shows the config file and environment applied.
+func flagSet(cfg *Config, configPath *string, printConfig *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet("kv", flag.ContinueOnError)
+	fs.StringVar(configPath, "config", *configPath, "JSON config file, see -print-config for its shape")
+	fs.BoolVar(printConfig, "print-config", false, "print the config that would be used as JSON and exit")
+
+	s := &cfg.Store
+	fs.StringVar(&s.Addr, "addr", s.Addr, "HTTP address of the store (empty to not serve it over HTTP)")
+	fs.StringVar(&s.RESPAddr, "resp-addr", s.RESPAddr, "also serve the store over the Redis protocol on this address (e.g. :6379)")
+	fs.StringVar(&s.MemcachedAddr, "memcached-addr", s.MemcachedAddr, "also serve the store over the memcached text protocol on this address (e.g. :11211)")
+	fs.StringVar(&s.Engine, "engine", s.Engine, "engine of the store: map, syncmap, bitcask or lsm")
+	fs.IntVar(&s.Capacity, "capacity", s.Capacity, "number of keys the map engine holds")
+	fs.Int64Var(&s.MaxBytes, "max-bytes", s.MaxBytes, "limit the map engine to this many bytes of keys and values instead of -capacity keys")
+	fs.BoolVar(&s.Rollback, "rollback", s.Rollback, "undo a bulk update of the map engine that fails halfway")
+	fs.IntVar(&s.BatchedWritesCheckInterval, "batched-writes-check-interval", s.BatchedWritesCheckInterval, "check whether a bulk update was cancelled every this many pairs")
+	fs.StringVar(&s.WAL, "wal", s.WAL, "path to a write-ahead log for the map engine (empty disables persistence)")
+	fs.StringVar(&s.DataDir, "data-dir", s.DataDir, "directory for the bitcask or lsm data files")
+	fs.DurationVar((*time.Duration)(&s.MergeInterval), "merge-interval", time.Duration(s.MergeInterval), "how often bitcask merges stale records away (0 disables it)")
+	fs.StringVar(&s.Fsync, "fsync", s.Fsync, "when to fsync the write-ahead log or bitcask files: always, interval or never")
+	fs.DurationVar((*time.Duration)(&s.FsyncInterval), "fsync-interval", time.Duration(s.FsyncInterval), "how often to fsync when -fsync=interval")
+	fs.StringVar(&s.Raft.ID, "raft-id", s.Raft.ID, "replicate the map engine with Raft, as the member with this ID (empty for no replication)")
+	fs.Var(&s.Raft.Peers, "raft-peers", "members of the initial Raft cluster, as id=url,... with this one included")
+	fs.BoolVar(&s.Raft.Join, "raft-join", s.Raft.Join, "start outside of any Raft cluster, to be added to one through /raft/members")
+	fs.StringVar(&s.Raft.Dir, "raft-dir", s.Raft.Dir, "directory that keeps the Raft log and snapshots (empty to keep them in memory)")
+	fs.IntVar(&s.Raft.SnapshotThreshold, "raft-snapshot-threshold", s.Raft.SnapshotThreshold, "compact the Raft log every this many entries (0 for the default)")
+	fs.BoolVar(&s.Replication.Primary, "replication-primary", s.Replication.Primary, "stream the writes of the store to read-only replicas")
+	fs.StringVar(&s.Replication.ReplicaOf, "replica-of", s.Replication.ReplicaOf, "make the store a read-only replica of the primary at this URL")
+	fs.IntVar(&s.Replication.FeedSize, "replication-feed-size", s.Replication.FeedSize, "writes the primary keeps for replicas that fall behind (0 for the default)")
+	fs.StringVar(&s.Replication.Name, "replica-name", s.Replication.Name, "name the replica reports to the primary as (empty for the host name)")
+	fs.Var(&s.Cluster.Nodes, "cluster-nodes", "make the store a proxy that routes every key to one of these servers by consistent hashing, as url,...")
+	fs.StringVar(&s.Quorum.Self, "quorum-self", s.Quorum.Self, "URL of this node in -quorum-nodes")
+	fs.Var(&s.Quorum.Nodes, "quorum-nodes", "replicate the store over these nodes with quorum reads and writes, as url,... with this one included")
+	fs.IntVar(&s.Quorum.N, "quorum-n", s.Quorum.N, "nodes that have a copy of every key (0 for 3)")
+	fs.IntVar(&s.Quorum.R, "quorum-r", s.Quorum.R, "replicas a read waits for unless it asks for another ?r= (0 for a majority of -quorum-n)")
+	fs.IntVar(&s.Quorum.W, "quorum-w", s.Quorum.W, "replicas a write waits for unless it asks for another ?w= (0 for a majority of -quorum-n)")
+	fs.DurationVar((*time.Duration)(&s.Quorum.AntiEntropyInterval), "quorum-anti-entropy-interval", time.Duration(s.Quorum.AntiEntropyInterval), "how often to compare replicas with another node and repair what differs (0 for 30s, negative disables it)")
+	fs.IntVar(&s.Cluster.VirtualNodes, "cluster-virtual-nodes", s.Cluster.VirtualNodes, "points every node gets on the hash ring (0 for the default, has to match the other proxies and clients)")
+
+	c := &cfg.Cache
+	fs.StringVar(&c.Addr, "cache-addr", c.Addr, "HTTP address of the cache (empty to not serve it over HTTP)")
+	fs.StringVar(&c.RESPAddr, "cache-resp-addr", c.RESPAddr, "also serve the cache over the Redis protocol on this address")
+	fs.StringVar(&c.MemcachedAddr, "cache-memcached-addr", c.MemcachedAddr, "also serve the cache over the memcached text protocol on this address")
+	fs.IntVar(&c.Capacity, "cache-capacity", c.Capacity, "number of keys the cache holds")
+	fs.Int64Var(&c.MaxBytes, "cache-max-bytes", c.MaxBytes, "limit the cache to this many bytes of keys and values instead of -cache-capacity keys")
+	fs.StringVar(&c.Eviction, "eviction", c.Eviction, "eviction policy of the cache: lru, lfu, arc or tinylfu")
+
+	h := &cfg.HTTP
+	fs.DurationVar((*time.Duration)(&h.ReadHeaderTimeout), "read-header-timeout", time.Duration(h.ReadHeaderTimeout), "how long clients get to send the request headers (0 for no limit)")
+	fs.DurationVar((*time.Duration)(&h.ReadTimeout), "read-timeout", time.Duration(h.ReadTimeout), "how long clients get to send the whole request (0 for no limit)")
+	fs.DurationVar((*time.Duration)(&h.WriteTimeout), "write-timeout", time.Duration(h.WriteTimeout), "how long a response can take to write, snapshots included (0 for no limit)")
+	fs.DurationVar((*time.Duration)(&h.IdleTimeout), "idle-timeout", time.Duration(h.IdleTimeout), "how long an idle keep-alive connection stays open (0 for no limit)")
+	fs.DurationVar((*time.Duration)(&h.BatchTimeout), "batch-timeout", time.Duration(h.BatchTimeout), "how long a bulk update can take before it is cancelled")
+	fs.StringVar(&h.TLS.CertFile, "tls-cert", h.TLS.CertFile, "PEM certificate to serve HTTPS with (empty for plain HTTP)")
+	fs.StringVar(&h.TLS.KeyFile, "tls-key", h.TLS.KeyFile, "PEM key of -tls-cert")
+	fs.StringVar(&h.TLS.ClientCAFile, "tls-client-ca", h.TLS.ClientCAFile, "PEM bundle of CAs to verify client certificates against (turns on mutual TLS)")
+	fs.StringVar(&h.TLS.ClientAuth, "tls-client-auth", h.TLS.ClientAuth, "with -tls-client-ca, whether a client certificate is required or optional")
+	fs.DurationVar((*time.Duration)(&h.TLS.ReloadInterval), "tls-reload-interval", time.Duration(h.TLS.ReloadInterval), "how often to check the TLS files for changes")
+	fs.StringVar(&h.Auth.TokenSecretFile, "auth-token-secret-file", h.Auth.TokenSecretFile, "file with the secret bearer tokens are signed with (the ACL comes from -config)")
+
+	fs.BoolVar(&cfg.Namespaces.Enabled, "namespaces", cfg.Namespaces.Enabled, "let the store's HTTP server host namespaces, under /ns/<name>/")
+	fs.StringVar(&cfg.Namespaces.Dir, "namespaces-dir", cfg.Namespaces.Dir, "directory that keeps the namespaces across restarts (empty to keep them in memory)")
+
+	fs.DurationVar((*time.Duration)(&cfg.ShutdownTimeout), "shutdown-timeout", time.Duration(cfg.ShutdownTimeout), "how long requests in flight get to finish on SIGTERM before they are cancelled")
+	return fs
+}
+
+// envName is the environment variable of a flag: -max-bytes is KV_MAX_BYTES.
+func envName(flagName string) string {
+	return "KV_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig works out the config from the command line and the environment.
+func loadConfig(args []string, getenv func(string) string, stderr io.Writer) (cfg Config, printConfig bool, err error) {
+	// The config file has to be read before the flags are applied on top of
+	// it, so the flags are parsed twice, the first time only for -config.
+	cfg = defaultConfig()
+	configPath := getenv(envName("config"))
+	scratch := cfg
+	fs := flagSet(&scratch, &configPath, &printConfig)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil && err != flag.ErrHelp {
+		// Let the second parse report it with the usage.
+		configPath = ""
+	}
+	if configPath != "" {
+		if err := readConfigFile(configPath, &cfg); err != nil {
+			return cfg, false, err
+		}
+	}
+
+	fs = flagSet(&cfg, &configPath, &printConfig)
+	fs.SetOutput(stderr)
+	var envErrs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if value := getenv(envName(f.Name)); value != "" {
+			if err := f.Value.Set(value); err != nil {
+				envErrs = append(envErrs, fmt.Errorf("%s: %v", envName(f.Name), err))
+			}
+		}
+	})
+	if err := errors.Join(envErrs...); err != nil {
+		return cfg, false, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	return cfg, printConfig, cfg.validate()
+}
+
+// readConfigFile applies the file on top of cfg, so it only has to mention
+// what it changes. Unknown fields are an error, a typo should not be
+// silently ignored.
+func readConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("reading config %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *StoreConfig) enabled() bool {
+	return s.Addr != "" || s.RESPAddr != "" || s.MemcachedAddr != ""
+}
+
+// validate reports the problems with the Raft settings of s.
+func (r *RaftConfig) validate(s *StoreConfig, problem func(field, format string, args ...interface{})) {
+	if r.ID == "" {
+		if len(r.Peers) > 0 || r.Join || r.Dir != "" {
+			problem("store.raft", "peers, join and dir need an id")
+		}
+		return
+	}
+	if s.Engine != "map" {
+		problem("store.raft", "only the map engine can be replicated, not %s", s.Engine)
+	}
+	if s.WAL != "" {
+		problem("store.wal", "the Raft log replaces the write-ahead log, leave it empty")
+	}
+	if s.Addr == "" {
+		problem("store.raft", "the members talk over the HTTP server of the store, store.addr can't be empty")
+	}
+	if _, ok := r.Peers[r.ID]; !ok && !r.Join {
+		problem("store.raft.peers", "must include %s itself, or set join", r.ID)
+	}
+	for id, addr := range r.Peers {
+		if u, err := url.Parse(addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("store.raft.peers", "%s: expected an http:// or https:// URL, got %q", id, addr)
+		}
+	}
+	if r.SnapshotThreshold < 0 {
+		problem("store.raft.snapshotThreshold", "must not be negative, got %d", r.SnapshotThreshold)
+	}
+}
+
+// validate reports the problems with the replication settings of s.
+func (r *ReplicationConfig) validate(s *StoreConfig, problem func(field, format string, args ...interface{})) {
+	if !r.Primary && r.ReplicaOf == "" {
+		return
+	}
+	if r.Primary && r.ReplicaOf != "" {
+		problem("store.replication", "a store can't be a primary and a replica at once")
+	}
+	if s.Raft.ID != "" {
+		problem("store.replication", "can't be combined with raft")
+	}
+	if s.Engine != "map" && s.Engine != "syncmap" {
+		problem("store.replication", "only the map and syncmap engines can be replicated, not %s", s.Engine)
+	}
+	if r.Primary && s.Addr == "" {
+		problem("store.replication", "replicas follow the HTTP server of the primary, store.addr can't be empty")
+	}
+	if r.ReplicaOf != "" {
+		if u, err := url.Parse(r.ReplicaOf); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("store.replication.replicaOf", "expected an http:// or https:// URL, got %q", r.ReplicaOf)
+		}
+	}
+	if r.FeedSize < 0 {
+		problem("store.replication.feedSize", "must not be negative, got %d", r.FeedSize)
+	}
+}
+
+// validate reports the problems with the cluster settings of s.
+func (c *ClusterConfig) validate(s *StoreConfig, problem func(field, format string, args ...interface{})) {
+	if len(c.Nodes) == 0 {
+		return
+	}
+	if s.Raft.ID != "" || s.Replication.Primary || s.Replication.ReplicaOf != "" {
+		problem("store.cluster", "a proxy keeps nothing to replicate, it can't be combined with raft or replication")
+	}
+	if s.WAL != "" {
+		problem("store.wal", "a proxy keeps nothing to log, leave it empty")
+	}
+	for _, addr := range c.Nodes {
+		if u, err := url.Parse(addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("store.cluster.nodes", "expected an http:// or https:// URL, got %q", addr)
+		}
+	}
+	if c.VirtualNodes < 0 {
+		problem("store.cluster.virtualNodes", "must not be negative, got %d", c.VirtualNodes)
+	}
+}
+
+// validate reports the problems with the quorum settings of s.
+func (q *QuorumConfig) validate(s *StoreConfig, problem func(field, format string, args ...interface{})) {
+	if len(q.Nodes) == 0 {
+		if q.Self != "" {
+			problem("store.quorum", "self needs nodes")
+		}
+		return
+	}
+	if s.Raft.ID != "" || s.Replication.Primary || s.Replication.ReplicaOf != "" || len(s.Cluster.Nodes) > 0 {
+		problem("store.quorum", "can't be combined with raft, replication or cluster")
+	}
+	if s.Addr == "" {
+		problem("store.quorum", "the nodes talk over the HTTP server of the store, store.addr can't be empty")
+	}
+	self := false
+	for _, addr := range q.Nodes {
+		if u, err := url.Parse(addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("store.quorum.nodes", "expected an http:// or https:// URL, got %q", addr)
+		}
+		self = self || strings.TrimRight(addr, "/") == strings.TrimRight(q.Self, "/")
+	}
+	if !self {
+		problem("store.quorum.self", "must be one of the nodes, got %q", q.Self)
+	}
+	n := q.N
+	if n == 0 {
+		n = min(3, len(q.Nodes))
+	}
+	if n < 0 || n > len(q.Nodes) {
+		problem("store.quorum.n", "must be between 1 and the %d nodes, got %d", len(q.Nodes), q.N)
+	}
+	for _, f := range []struct {
+		field string
+		value int
+	}{{"store.quorum.r", q.R}, {"store.quorum.w", q.W}} {
+		if f.value < 0 || f.value > n {
+			problem(f.field, "must be between 1 and n, got %d", f.value)
+		}
+	}
+}
+
+func (c *CacheConfig) enabled() bool {
+	return c.Addr != "" || c.RESPAddr != "" || c.MemcachedAddr != ""
+}
+
+// validate returns every problem with the config at once rather than making
+// you fix them one restart at a time.
+func (cfg *Config) validate() error {
+	var errs []error
+	problem := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if !cfg.Store.enabled() && !cfg.Cache.enabled() {
+		problem("addr", "nothing to serve, every address is empty")
+	}
+	seen := map[string]string{}
+	addrs := []struct{ field, addr string }{
+		{"store.addr", cfg.Store.Addr},
+		{"store.respAddr", cfg.Store.RESPAddr},
+		{"store.memcachedAddr", cfg.Store.MemcachedAddr},
+		{"cache.addr", cfg.Cache.Addr},
+		{"cache.respAddr", cfg.Cache.RESPAddr},
+		{"cache.memcachedAddr", cfg.Cache.MemcachedAddr},
+	}
+	for _, a := range addrs {
+		if a.addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			problem(a.field, "%v", err)
+		} else if other, ok := seen[a.addr]; ok {
+			problem(a.field, "%s is already used by %s", a.addr, other)
+		}
+		seen[a.addr] = a.field
+	}
+
+	if s := &cfg.Store; s.enabled() {
+		switch s.Engine {
+		case "map", "syncmap", "bitcask", "lsm":
+		default:
+			problem("store.engine", "unknown engine %q, expected map, syncmap, bitcask or lsm", s.Engine)
+		}
+		if s.Engine == "map" && s.MaxBytes == 0 && s.Capacity <= 0 {
+			problem("store.capacity", "must be positive, got %d", s.Capacity)
+		}
+		if s.MaxBytes < 0 {
+			problem("store.maxBytes", "must not be negative, got %d", s.MaxBytes)
+		}
+		if s.BatchedWritesCheckInterval <= 0 {
+			problem("store.batchedWritesCheckInterval", "must be positive, got %d", s.BatchedWritesCheckInterval)
+		}
+		if s.WAL != "" && s.Engine != "map" {
+			problem("store.wal", "only the map engine has a write-ahead log, not %s", s.Engine)
+		}
+		if (s.Engine == "bitcask" || s.Engine == "lsm") && s.DataDir == "" {
+			problem("store.dataDir", "the %s engine needs a data directory", s.Engine)
+		}
+		if s.MergeInterval < 0 {
+			problem("store.mergeInterval", "must not be negative, got %v", time.Duration(s.MergeInterval))
+		}
+		if _, err := fsyncPolicy(s.Fsync); err != nil {
+			problem("store.fsync", "%v", err)
+		}
+		if s.Fsync == "interval" && s.FsyncInterval <= 0 {
+			problem("store.fsyncInterval", "must be positive with fsync interval, got %v", time.Duration(s.FsyncInterval))
+		}
+		s.Raft.validate(s, problem)
+		s.Replication.validate(s, problem)
+		s.Cluster.validate(s, problem)
+		s.Quorum.validate(s, problem)
+	}
+
+	if c := &cfg.Cache; c.enabled() {
+		if c.MaxBytes == 0 && c.Capacity <= 0 {
+			problem("cache.capacity", "must be positive, got %d", c.Capacity)
+		}
+		if c.MaxBytes < 0 {
+			problem("cache.maxBytes", "must not be negative, got %d", c.MaxBytes)
+		}
+		if _, err := kv.NewEvictionPolicy(c.Eviction, max(c.Capacity, 1)); err != nil {
+			problem("cache.eviction", "%v", err)
+		}
+	}
+
+	timeouts := []struct {
+		field string
+		d     duration
+	}{
+		{"http.readHeaderTimeout", cfg.HTTP.ReadHeaderTimeout},
+		{"http.readTimeout", cfg.HTTP.ReadTimeout},
+		{"http.writeTimeout", cfg.HTTP.WriteTimeout},
+		{"http.idleTimeout", cfg.HTTP.IdleTimeout},
+	}
+	for _, t := range timeouts {
+		if t.d < 0 {
+			problem(t.field, "must not be negative, got %v", time.Duration(t.d))
+		}
+	}
+	if cfg.HTTP.BatchTimeout <= 0 {
+		problem("http.batchTimeout", "must be positive, got %v", time.Duration(cfg.HTTP.BatchTimeout))
+	}
+	if t := &cfg.HTTP.TLS; t.CertFile != "" || t.KeyFile != "" || t.ClientCAFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			problem("http.tls", "needs both certFile and keyFile")
+		}
+		for _, f := range []struct{ field, path string }{
+			{"http.tls.certFile", t.CertFile},
+			{"http.tls.keyFile", t.KeyFile},
+			{"http.tls.clientCAFile", t.ClientCAFile},
+		} {
+			if f.path == "" {
+				continue
+			}
+			if _, err := os.Stat(f.path); err != nil {
+				problem(f.field, "%v", err)
+			}
+		}
+		if _, err := t.clientAuth(); err != nil {
+			problem("http.tls.clientAuth", "%v", err)
+		}
+		if t.ReloadInterval <= 0 {
+			problem("http.tls.reloadInterval", "must be positive, got %v", time.Duration(t.ReloadInterval))
+		}
+	}
+	if a := &cfg.HTTP.Auth; a.enabled() {
+		if len(a.ACL) == 0 {
+			problem("http.auth.acl", "credentials are checked but no ACL says what they allow, so everything would stay open")
+		}
+		for i, rule := range a.ACL {
+			if rule.Identity == "" {
+				problem(fmt.Sprintf("http.auth.acl[%d].identity", i), "is empty, use %q for everyone", kv.AnyIdentity)
+			}
+			if _, err := kv.ParsePermission(rule.Permissions); err != nil {
+				problem(fmt.Sprintf("http.auth.acl[%d].permissions", i), "%v", err)
+			}
+		}
+		if a.TokenSecretFile != "" {
+			if _, err := readSecret(a.TokenSecretFile); err != nil {
+				problem("http.auth.tokenSecretFile", "%v", err)
+			}
+		}
+		// The other protocols have no idea who is asking, they would be a
+		// way around the ACL.
+		for _, f := range []struct{ field, addr string }{
+			{"store.respAddr", cfg.Store.RESPAddr},
+			{"store.memcachedAddr", cfg.Store.MemcachedAddr},
+			{"cache.respAddr", cfg.Cache.RESPAddr},
+			{"cache.memcachedAddr", cfg.Cache.MemcachedAddr},
+		} {
+			if f.addr != "" {
+				problem(f.field, "has no authentication, it can't be served along with http.auth")
+			}
+		}
+	}
+	if n := &cfg.Namespaces; !n.Enabled && (n.Dir != "" || len(n.Create) > 0) {
+		problem("namespaces", "dir and create need enabled")
+	} else if n.Enabled && cfg.Store.Addr == "" {
+		problem("namespaces", "the store has no HTTP address to host them on")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		problem("shutdownTimeout", "must be positive, got %v", time.Duration(cfg.ShutdownTimeout))
+	}
+	return errors.Join(errs...)
+}
+
+func fsyncPolicy(name string) (kv.FsyncPolicy, error) {
+	switch name {
+	case "always":
+		return kv.FsyncAlways, nil
+	case "interval":
+		return kv.FsyncInterval, nil
+	case "never":
+		return kv.FsyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q, expected always, interval or never", name)
+}
+
+func (t *TLSConfig) clientAuth() (tls.ClientAuthType, error) {
+	switch t.ClientAuth {
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	}
+	return 0, fmt.Errorf("unknown client auth %q, expected require or optional", t.ClientAuth)
+}
+
+// readSecret reads a token secret, trailing newlines and all aren't part of it.
+func readSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
+// options are the kv.HTTPOptions of h. It only fails if the token secret
+// went away since the config was validated.
+func (h *HTTPConfig) options() (kv.HTTPOptions, error) {
+	opts := kv.HTTPOptions{
+		ReadHeaderTimeout: time.Duration(h.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(h.ReadTimeout),
+		WriteTimeout:      time.Duration(h.WriteTimeout),
+		IdleTimeout:       time.Duration(h.IdleTimeout),
+		BatchTimeout:      time.Duration(h.BatchTimeout),
+	}
+	if h.TLS.CertFile != "" {
+		// Validated already.
+		clientAuth, _ := h.TLS.clientAuth()
+		opts.TLS = &kv.TLSOptions{
+			CertFile:       h.TLS.CertFile,
+			KeyFile:        h.TLS.KeyFile,
+			ClientCAFile:   h.TLS.ClientCAFile,
+			ClientAuth:     clientAuth,
+			Identities:     h.TLS.Identities,
+			ReloadInterval: time.Duration(h.TLS.ReloadInterval),
+		}
+	}
+	if len(h.Auth.APIKeys) > 0 {
+		opts.Auth = append(opts.Auth, kv.NewAPIKeys(h.Auth.APIKeys))
+	}
+	if h.Auth.TokenSecretFile != "" {
+		secret, err := readSecret(h.Auth.TokenSecretFile)
+		if err != nil {
+			return opts, err
+		}
+		tokens, err := kv.NewTokens(secret)
+		if err != nil {
+			return opts, err
+		}
+		opts.Auth = append(opts.Auth, tokens)
+	}
+	for _, rule := range h.Auth.ACL {
+		perm, _ := kv.ParsePermission(rule.Permissions)
+		opts.ACL = append(opts.ACL, kv.ACLRule{Identity: rule.Identity, Namespace: rule.Namespace, Prefix: rule.Prefix, Permission: perm})
+	}
+	return opts, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kv"
+)
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.json")
+	file := `{"store": {"engine": "lsm", "capacity": 5, "fsyncInterval": "1s"}, "cache": {"eviction": "arc", "capacity": 5}}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"KV_CONFIG":         path,
+		"KV_CAPACITY":       "7",
+		"KV_CACHE_CAPACITY": "7",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	cfg, _, err := loadConfig([]string{"-capacity", "9", "-cache-addr", ""}, getenv, io.Discard)
+	if err != nil {
+		t.Fatalf("loadConfig returned an error: %v", err)
+	}
+	// Defaults, then the file, then the environment, then flags.
+	if cfg.Store.Addr != "0.0.0.0:11200" || cfg.Store.Engine != "lsm" || time.Duration(cfg.Store.FsyncInterval) != time.Second {
+		t.Errorf("Expected the file to apply over the defaults, got %+v", cfg.Store)
+	}
+	if cfg.Cache.Eviction != "arc" || cfg.Cache.Capacity != 7 {
+		t.Errorf("Expected the environment to apply over the file, got %+v", cfg.Cache)
+	}
+	if cfg.Store.Capacity != 9 || cfg.Cache.Addr != "" {
+		t.Errorf("Expected flags to apply over everything, got %+v and %+v", cfg.Store, cfg.Cache)
+	}
+}
+
+func TestLoadConfig_Validation(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	if _, _, err := loadConfig(nil, noEnv, io.Discard); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+
+	_, _, err := loadConfig([]string{
+		"-engine", "btree",
+		"-batched-writes-check-interval", "0",
+		"-cache-addr", "0.0.0.0:11200",
+		"-eviction", "random",
+		"-read-timeout", "-1s",
+	}, noEnv, io.Discard)
+	if err == nil {
+		t.Fatal("Expected an invalid config to be rejected")
+	}
+	for _, field := range []string{"store.engine", "store.batchedWritesCheckInterval", "cache.addr", "cache.eviction", "http.readTimeout"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected a problem with %s, got:\n%v", field, err)
+		}
+	}
+
+	if _, _, err := loadConfig([]string{"-addr", "", "-cache-addr", ""}, noEnv, io.Discard); err == nil {
+		t.Error("Expected a config that serves nothing to be rejected")
+	}
+	if _, _, err := loadConfig(nil, func(name string) string {
+		if name == "KV_ROLLBACK" {
+			return "maybe"
+		}
+		return ""
+	}, io.Discard); err == nil || !strings.Contains(err.Error(), "KV_ROLLBACK") {
+		t.Errorf("Expected a bad environment variable to be rejected, got %v", err)
+	}
+	_, _, err = loadConfig([]string{"-tls-cert", "/does/not/exist.pem", "-tls-client-auth", "sometimes"}, noEnv, io.Discard)
+	for _, field := range []string{"http.tls", "http.tls.certFile", "http.tls.clientAuth"} {
+		if err == nil || !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected a problem with %s, got:\n%v", field, err)
+		}
+	}
+
+	cfg, _, err := loadConfig([]string{"-raft-id", "a", "-raft-peers", "a=http://10.0.0.1:11200, b=http://10.0.0.2:11200"}, noEnv, io.Discard)
+	if err != nil || cfg.Store.Raft.Peers["b"] != "http://10.0.0.2:11200" {
+		t.Errorf("Expected a valid raft config, got %v, %v", cfg.Store.Raft.Peers, err)
+	}
+	_, _, err = loadConfig([]string{"-raft-id", "c", "-raft-peers", "a=10.0.0.1:11200", "-wal", "kv.wal"}, noEnv, io.Discard)
+	for _, field := range []string{"store.wal", "store.raft.peers"} {
+		if err == nil || !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected a problem with %s, got:\n%v", field, err)
+		}
+	}
+	_, _, err = loadConfig([]string{"-replication-primary", "-replica-of", "localhost:11200", "-engine", "lsm"}, noEnv, io.Discard)
+	for _, field := range []string{"store.replication", "store.replication.replicaOf"} {
+		if err == nil || !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected a problem with %s, got:\n%v", field, err)
+		}
+	}
+	cfg, _, err = loadConfig([]string{"-cluster-nodes", "http://10.0.0.1:11200, http://10.0.0.2:11200"}, noEnv, io.Discard)
+	if err != nil || len(cfg.Store.Cluster.Nodes) != 2 || cfg.Store.Cluster.Nodes[1] != "http://10.0.0.2:11200" {
+		t.Errorf("Expected a valid cluster config, got %v, %v", cfg.Store.Cluster.Nodes, err)
+	}
+	cfg, _, err = loadConfig([]string{"-quorum-self", "http://10.0.0.1:11200", "-quorum-nodes", "http://10.0.0.1:11200,http://10.0.0.2:11200,http://10.0.0.3:11200", "-quorum-w", "3", "-quorum-anti-entropy-interval", "-1s"}, noEnv, io.Discard)
+	if err != nil || len(cfg.Store.Quorum.Nodes) != 3 || cfg.Store.Quorum.W != 3 || cfg.Store.Quorum.AntiEntropyInterval != duration(-time.Second) {
+		t.Errorf("Expected a valid quorum config, got %+v, %v", cfg.Store.Quorum, err)
+	}
+	_, _, err = loadConfig([]string{"-quorum-self", "http://10.0.0.4:11200", "-quorum-nodes", "http://10.0.0.1:11200,http://10.0.0.2:11200", "-quorum-r", "3"}, noEnv, io.Discard)
+	for _, field := range []string{"store.quorum.self", "store.quorum.r"} {
+		if err == nil || !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected a problem with %s, got:\n%v", field, err)
+		}
+	}
+	_, _, err = loadConfig([]string{"-cluster-nodes", "10.0.0.1:11200", "-replication-primary", "-cluster-virtual-nodes", "-1"}, noEnv, io.Discard)
+	for _, field := range []string{"store.cluster", "store.cluster.nodes", "store.cluster.virtualNodes"} {
+		if err == nil || !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected a problem with %s, got:\n%v", field, err)
+		}
+	}
+}
+
+func TestLoadConfig_Auth(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "kv.json")
+	file := `{"http": {"auth": {"apiKeys": {"k": "alice"}, "acl": [{"identity": "alice", "prefix": "a/", "permissions": "read,write"}]}}}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	noEnv := func(string) string { return "" }
+
+	cfg, _, err := loadConfig([]string{"-config", path, "-auth-token-secret-file", secret}, noEnv, io.Discard)
+	if err != nil {
+		t.Fatalf("loadConfig returned an error: %v", err)
+	}
+	opts, err := cfg.HTTP.options()
+	if err != nil {
+		t.Fatalf("options returned an error: %v", err)
+	}
+	if len(opts.Auth) != 2 || len(opts.ACL) != 1 || opts.ACL[0].Permission != kv.PermRead|kv.PermWrite {
+		t.Errorf("Expected API keys, tokens and the rule, got %+v", opts)
+	}
+
+	_, _, err = loadConfig([]string{"-config", path, "-resp-addr", ":6379", "-auth-token-secret-file", filepath.Join(dir, "nope")}, noEnv, io.Discard)
+	for _, field := range []string{"store.respAddr", "http.auth.tokenSecretFile"} {
+		if err == nil || !strings.Contains(err.Error(), field+":") {
+			t.Errorf("Expected a problem with %s, got:\n%v", field, err)
+		}
+	}
+	if _, _, err := loadConfig([]string{"-auth-token-secret-file", secret}, noEnv, io.Discard); err == nil || !strings.Contains(err.Error(), "http.auth.acl:") {
+		t.Errorf("Expected tokens without an ACL to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,567 @@
+// kvctl operates a running kv server over its HTTP API.
+//
+//	kvctl [-addr url] [-o table|json] [-timeout d] [-cacert f] [-cert f -key f]
+//	      [-api-key k | -token t] [-n namespace] <command> [args]
+//
+// It is meant to be scripted, so it prints nothing on success unless there is
+// something to show, and the exit code says what went wrong:
+//
+//	0  success
+//	1  any other error (network, server, bad input)
+//	2  bad usage
+//	3  key not found
+//	4  store full
+//	5  bulk update only updated some of the keys
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"kv"
+	"kv/client"
+)
+
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitFull
+	exitPartial
+)
+
+const usage = `usage: kvctl [-addr url] [-o table|json] [-timeout d] [-cacert f] [-cert f -key f]
+             [-api-key k | -token t] [-n namespace] <command> [args]
+
+commands:
+  get <key>                          print the value of key
+  set [-ttl d] [-json] <key> <value> set key, creating it if needed
+  update [-json] <key> <value>       set key only if it exists
+  delete <key>...                    delete keys
+  bulk-update [-format f] [file]     update the pairs in file (or stdin) that exist
+  keys [-prefix p] [-limit n]        list keys, in order
+  stats                              print what the server knows about the store
+  snapshot [-out file]               save a snapshot of the store (stdout by default)
+  token -secret-file f [-ttl d] <id> sign a bearer token for identity id, offline
+  namespaces [list]                  list the namespaces of the server
+  namespaces create [flags] <name>   create a namespace (-engine, -capacity, -max-bytes, -eviction)
+  namespaces delete <name>           delete a namespace and everything in it
+
+Values are strings unless -json is given, then they are parsed as JSON.
+Bulk input is a JSON array of {"key": ..., "value": ...} or one of those per
+line (NDJSON). -format auto (the default) tells them apart by the first
+character.
+
+For an https server, -cacert is the CA to trust if it is not one of the
+system's, and -cert and -key are the client certificate for mutual TLS.
+-api-key and -token are the credentials for servers that require them.
+-n runs the command in a namespace of the server.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// cli is what every command gets to work with.
+type cli struct {
+	client *client.Client
+	ctx    context.Context
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	defaultAddr := os.Getenv("KV_ADDR")
+	if defaultAddr == "" {
+		defaultAddr = "http://localhost:11200"
+	}
+	addr := flags.String("addr", defaultAddr, "server to talk to (defaults to $KV_ADDR)")
+	output := flags.String("o", "table", "output format: table or json")
+	timeout := flags.Duration("timeout", 30*time.Second, "give up after this long")
+	caCert := flags.String("cacert", "", "PEM bundle of CAs to verify an https server against")
+	cert := flags.String("cert", "", "PEM client certificate, for servers that want mutual TLS")
+	key := flags.String("key", "", "PEM key of -cert")
+	apiKey := flags.String("api-key", os.Getenv("KV_API_KEY"), "API key to send (defaults to $KV_API_KEY)")
+	token := flags.String("token", os.Getenv("KV_TOKEN"), "bearer token to send (defaults to $KV_TOKEN)")
+	namespace := flags.String("n", os.Getenv("KV_NAMESPACE"), "namespace to work in (defaults to $KV_NAMESPACE, empty for the server's own store)")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 || (*output != "table" && *output != "json") {
+		flags.Usage()
+		return exitUsage
+	}
+	opts, err := tlsOptions(*caCert, *cert, *key)
+	if err != nil {
+		fmt.Fprintf(stderr, "kvctl: %v\n", err)
+		return exitUsage
+	}
+	opts.APIKey, opts.Token, opts.Namespace = *apiKey, *token, *namespace
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	c := &cli{
+		client: client.New(*addr, opts),
+		ctx:    ctx,
+		json:   *output == "json",
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	commands := map[string]func([]string) error{
+		"get":         c.get,
+		"set":         c.set,
+		"update":      c.update,
+		"delete":      c.delete,
+		"bulk-update": c.bulkUpdate,
+		"keys":        c.keys,
+		"stats":       c.stats,
+		"snapshot":    c.snapshot,
+		"token":       c.token,
+		"namespaces":  c.namespaces,
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "kvctl: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return exitUsage
+	}
+	err = cmd(flags.Args()[1:])
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "kvctl: %v\n", err)
+	var partial *partialError
+	switch {
+	case errors.As(err, new(*usageError)):
+		return exitUsage
+	case client.IsNotFound(err):
+		return exitNotFound
+	case err == client.ErrKVFull:
+		return exitFull
+	case errors.As(err, &partial):
+		return exitPartial
+	}
+	return exitError
+}
+
+// tlsOptions are the client options for -cacert, -cert and -key. Without
+// any of them the defaults do, which trust the system roots.
+func tlsOptions(caCert, cert, key string) (client.Options, error) {
+	if caCert == "" && cert == "" && key == "" {
+		return client.Options{}, nil
+	}
+	config := &tls.Config{}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return client.Options{}, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return client.Options{}, fmt.Errorf("no certificates in %s", caCert)
+		}
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return client.Options{}, errors.New("-cert and -key go together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return client.Options{}, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return client.Options{HTTPClient: &http.Client{Transport: transport}}, nil
+}
+
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+type partialError struct {
+	updated, total int
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("only %d of %d keys were updated, the others do not exist", e.updated, e.total)
+}
+
+// parse parses the flags of a subcommand and checks it got n arguments, or
+// at least -n if n is negative.
+func (c *cli) parse(flags *flag.FlagSet, args []string, n int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, &usageError{flags.Name() + ": " + err.Error()}
+	}
+	if (n >= 0 && flags.NArg() != n) || flags.NArg() < -n {
+		return nil, &usageError{flags.Name() + ": wrong number of arguments"}
+	}
+	return flags.Args(), nil
+}
+
+// parseValue turns a value from the command line into what gets stored.
+func parseValue(arg string, isJSON bool) (interface{}, error) {
+	if !isJSON {
+		return arg, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(arg), &value); err != nil {
+		return nil, fmt.Errorf("value is not valid JSON: %v", err)
+	}
+	return value, nil
+}
+
+// formatValue prints strings as they are and everything else as JSON, so
+// `kvctl get` is easy to use in $(...).
+func formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) get(args []string) error {
+	args, err := c.parse(flag.NewFlagSet("get", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	value, err := c.client.Get(c.ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(client.Pair{Key: args[0], Value: value})
+	}
+	_, err = fmt.Fprintln(c.stdout, formatValue(value))
+	return err
+}
+
+func (c *cli) set(args []string) error {
+	flags := flag.NewFlagSet("set", flag.ContinueOnError)
+	ttl := flags.Duration("ttl", 0, "expire the key after this long")
+	isJSON := flags.Bool("json", false, "parse the value as JSON")
+	args, err := c.parse(flags, args, 2)
+	if err != nil {
+		return err
+	}
+	value, err := parseValue(args[1], *isJSON)
+	if err != nil {
+		return err
+	}
+	if *ttl > 0 {
+		return c.client.PutWithTTL(c.ctx, args[0], value, *ttl)
+	}
+	return c.client.Put(c.ctx, args[0], value)
+}
+
+func (c *cli) update(args []string) error {
+	flags := flag.NewFlagSet("update", flag.ContinueOnError)
+	isJSON := flags.Bool("json", false, "parse the value as JSON")
+	args, err := c.parse(flags, args, 2)
+	if err != nil {
+		return err
+	}
+	value, err := parseValue(args[1], *isJSON)
+	if err != nil {
+		return err
+	}
+	return c.client.Update(c.ctx, args[0], value)
+}
+
+func (c *cli) delete(args []string) error {
+	args, err := c.parse(flag.NewFlagSet("delete", flag.ContinueOnError), args, -1)
+	if err != nil {
+		return err
+	}
+	for _, key := range args {
+		if err := c.client.Delete(c.ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) bulkUpdate(args []string) error {
+	flags := flag.NewFlagSet("bulk-update", flag.ContinueOnError)
+	format := flags.String("format", "auto", "input format: auto, json or ndjson")
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return &usageError{"bulk-update: " + err.Error()}
+	}
+	args = flags.Args()
+	if len(args) > 1 {
+		return &usageError{"bulk-update: wrong number of arguments"}
+	}
+	in := c.stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	pairs, err := readPairs(in, *format)
+	if err != nil {
+		return err
+	}
+
+	updated, err := c.client.BatchUpdate(c.ctx, pairs)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		err = c.printJSON(updated)
+	} else {
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE")
+		for _, pair := range updated {
+			fmt.Fprintf(w, "%s\t%s\n", pair.Key, formatValue(pair.Value))
+		}
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	if len(updated) != len(pairs) {
+		return &partialError{len(updated), len(pairs)}
+	}
+	return nil
+}
+
+// readPairs reads a JSON array of pairs or NDJSON, one pair per line.
+func readPairs(r io.Reader, format string) ([]client.Pair, error) {
+	br := bufio.NewReader(r)
+	if format == "auto" {
+		format = "ndjson"
+		for {
+			b, err := br.ReadByte()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.ContainsRune([]byte(" \t\r\n"), rune(b)) {
+				if b == '[' {
+					format = "json"
+				}
+				br.UnreadByte()
+				break
+			}
+		}
+	}
+
+	var pairs []client.Pair
+	switch format {
+	case "json":
+		if err := json.NewDecoder(br).Decode(&pairs); err != nil {
+			return nil, fmt.Errorf("reading JSON input: %v", err)
+		}
+	case "ndjson":
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var pair client.Pair
+			if err := json.Unmarshal([]byte(text), &pair); err != nil {
+				return nil, fmt.Errorf("reading NDJSON input, line %d: %v", line, err)
+			}
+			pairs = append(pairs, pair)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &usageError{fmt.Sprintf("bulk-update: unknown format %q", format)}
+	}
+	return pairs, nil
+}
+
+func (c *cli) keys(args []string) error {
+	flags := flag.NewFlagSet("keys", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "only list keys starting with this")
+	limit := flags.Int("limit", 0, "list at most this many keys (0 for all)")
+	if _, err := c.parse(flags, args, 0); err != nil {
+		return err
+	}
+	keys, err := c.client.Keys(c.ctx, *prefix, *limit)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(keys)
+	}
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(c.stdout, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) stats(args []string) error {
+	if _, err := c.parse(flag.NewFlagSet("stats", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	stats, err := c.client.Stats(c.ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(stats)
+	}
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, formatValue(stats[name]))
+	}
+	return w.Flush()
+}
+
+func (c *cli) snapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	out := flags.String("out", "", "write the snapshot to this file instead of stdout")
+	if _, err := c.parse(flags, args, 0); err != nil {
+		return err
+	}
+	if *out == "" {
+		return c.client.Snapshot(c.ctx, c.stdout)
+	}
+	// Written next to the target and renamed, so a failed snapshot never
+	// leaves a truncated file behind with the right name.
+	tmp, err := os.CreateTemp(filepath.Dir(*out), ".kvctl-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := c.client.Snapshot(c.ctx, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), *out)
+}
+
+// token signs a token with the server's secret, so it never talks to the
+// server and whoever runs it needs the secret file.
+func (c *cli) token(args []string) error {
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	secretFile := flags.String("secret-file", "", "file with the secret the server verifies tokens with")
+	ttl := flags.Duration("ttl", time.Hour, "how long the token is good for")
+	args, err := c.parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	if *secretFile == "" {
+		return &usageError{"token needs -secret-file"}
+	}
+	secret, err := os.ReadFile(*secretFile)
+	if err != nil {
+		return err
+	}
+	tokens, err := kv.NewTokens(bytes.TrimSpace(secret))
+	if err != nil {
+		return err
+	}
+	token, err := tokens.Sign(args[0], *ttl)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]string{"token": token})
+	}
+	_, err = fmt.Fprintln(c.stdout, token)
+	return err
+}
+
+func (c *cli) namespaces(args []string) error {
+	sub := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = args[0], args[1:]
+	}
+	switch sub {
+	case "list":
+		if _, err := c.parse(flag.NewFlagSet("namespaces list", flag.ContinueOnError), args, 0); err != nil {
+			return err
+		}
+		specs, err := c.client.Namespaces(c.ctx)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(specs)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tENGINE\tCAPACITY\tMAX BYTES\tEVICTION")
+		for _, spec := range specs {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", spec.Name, spec.Engine, spec.Capacity, spec.MaxBytes, spec.Eviction)
+		}
+		return w.Flush()
+	case "create":
+		flags := flag.NewFlagSet("namespaces create", flag.ContinueOnError)
+		var spec client.NamespaceSpec
+		flags.StringVar(&spec.Engine, "engine", "", "map (the default), syncmap, cache, bitcask or lsm")
+		flags.IntVar(&spec.Capacity, "capacity", 0, "number of keys, for map and cache")
+		flags.Int64Var(&spec.MaxBytes, "max-bytes", 0, "bytes of keys and values, for map and cache instead of -capacity")
+		flags.StringVar(&spec.Eviction, "eviction", "", "eviction policy of a cache")
+		args, err := c.parse(flags, args, 1)
+		if err != nil {
+			return err
+		}
+		spec.Name = args[0]
+		return c.client.CreateNamespace(c.ctx, spec)
+	case "delete":
+		args, err := c.parse(flag.NewFlagSet("namespaces delete", flag.ContinueOnError), args, 1)
+		if err != nil {
+			return err
+		}
+		return c.client.DeleteNamespace(c.ctx, args[0])
+	}
+	return &usageError{fmt.Sprintf("unknown namespaces command %q, expected list, create or delete", sub)}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kv"
+)
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(kv.NewHTTPServer(kv.NewWriteOptimizedMapStore(1, true, 4), ""))
+	defer server.Close()
+	kvctl := func(stdin string, args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-addr", server.URL}, args...)
+		code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+		return code, strings.TrimSpace(stdout.String())
+	}
+
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string
+		code  int
+		out   string
+	}{
+		{"set", "", []string{"set", "a", "hello"}, exitOK, ""},
+		{"set json", "", []string{"set", "-json", "b", `{"n":1}`}, exitOK, ""},
+		{"set bad json", "", []string{"set", "-json", "b", `{`}, exitError, ""},
+		{"get string", "", []string{"get", "a"}, exitOK, "hello"},
+		{"get json value", "", []string{"get", "b"}, exitOK, `{"n":1}`},
+		{"get json output", "", []string{"-o", "json", "get", "a"}, exitOK, "{\n  \"key\": \"a\",\n  \"value\": \"hello\"\n}"},
+		{"get missing", "", []string{"get", "missing"}, exitNotFound, ""},
+		{"update missing", "", []string{"update", "missing", "x"}, exitNotFound, ""},
+		{"bulk array", `[{"key":"a","value":"x"}]`, []string{"-o", "json", "bulk-update"}, exitOK, "[\n  {\n    \"key\": \"a\",\n    \"value\": \"x\"\n  }\n]"},
+		{"bulk ndjson partial", "{\"key\":\"a\",\"value\":\"y\"}\n\n{\"key\":\"nope\",\"value\":1}\n", []string{"bulk-update", "-"}, exitPartial, "KEY  VALUE\na    y"},
+		{"keys", "", []string{"keys"}, exitOK, "a\nb"},
+		{"keys limit", "", []string{"keys", "-limit", "1"}, exitOK, "a"},
+		{"stats", "", []string{"stats"}, exitOK, "keys  2"},
+		{"delete", "", []string{"delete", "a", "b"}, exitOK, ""},
+		{"keys after delete", "", []string{"keys"}, exitOK, ""},
+		{"set after delete", "", []string{"set", "1", "x"}, exitOK, ""},
+		{"unknown command", "", []string{"frobnicate"}, exitUsage, ""},
+		{"missing argument", "", []string{"get"}, exitUsage, ""},
+		{"bad flag", "", []string{"keys", "-nope"}, exitUsage, ""},
+	}
+	for _, tt := range tests {
+		code, out := kvctl(tt.stdin, tt.args...)
+		if code != tt.code || out != tt.out {
+			t.Errorf("%s: got exit code %d and output %q, want %d and %q", tt.name, code, out, tt.code, tt.out)
+		}
+	}
+
+	for _, key := range []string{"2", "3", "4"} {
+		kvctl("", "set", key, "x")
+	}
+	if code, _ := kvctl("", "set", "5", "x"); code != exitFull {
+		t.Errorf("Expected exit code %d for a full store, got %d", exitFull, code)
+	}
+}
+
+func TestRun_Token(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, _ := kv.NewTokens([]byte("s3cret"))
+	server := httptest.NewServer(kv.NewHTTPServerWithOptions(kv.NewWriteOptimizedMapStore(1, true, 4), "", kv.HTTPOptions{
+		Auth: []kv.Authenticator{tokens},
+		ACL:  kv.ACL{{Identity: "ops", Permission: kv.PermRead | kv.PermWrite}},
+	}))
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"token", "-secret-file", secretFile, "ops"}, nil, &stdout, &stderr); code != exitOK {
+		t.Fatalf("token exited with %d: %s", code, stderr.String())
+	}
+	token := strings.TrimSpace(stdout.String())
+	if code := run([]string{"-addr", server.URL, "-token", token, "set", "a", "x"}, nil, &stdout, &stderr); code != exitOK {
+		t.Errorf("set with the token exited with %d: %s", code, stderr.String())
+	}
+	if code := run([]string{"-addr", server.URL, "set", "a", "x"}, nil, &stdout, &stderr); code != exitError {
+		t.Errorf("Expected set without a token to fail, got %d", code)
+	}
+	if code := run([]string{"token", "ops"}, nil, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected token without -secret-file to be a usage error, got %d", code)
+	}
+}
+
+func TestRun_Namespaces(t *testing.T) {
+	namespaces, _ := kv.NewNamespaces(kv.NamespacesOptions{})
+	server := httptest.NewServer(kv.NewHTTPServerWithOptions(kv.NewWriteOptimizedMapStore(1, true, 4), "", kv.HTTPOptions{Namespaces: namespaces}))
+	defer server.Close()
+	kvctl := func(args ...string) (int, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(append([]string{"-addr", server.URL}, args...), nil, &stdout, &stderr)
+		return code, strings.TrimSpace(stdout.String())
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		out  string
+	}{
+		{"create", []string{"namespaces", "create", "-engine", "cache", "-capacity", "1", "t1"}, exitOK, ""},
+		{"create bad", []string{"namespaces", "create", "t2"}, exitError, ""},
+		{"list", []string{"namespaces"}, exitOK, "NAME  ENGINE  CAPACITY  MAX BYTES  EVICTION\nt1    cache   1         0          lru"},
+		{"set in t1", []string{"-n", "t1", "set", "a", "x"}, exitOK, ""},
+		{"get in t1", []string{"-n", "t1", "get", "a"}, exitOK, "x"},
+		{"get outside", []string{"get", "a"}, exitNotFound, ""},
+		{"delete", []string{"namespaces", "delete", "t1"}, exitOK, ""},
+		{"delete again", []string{"namespaces", "delete", "t1"}, exitNotFound, ""},
+		{"unknown", []string{"namespaces", "rename"}, exitUsage, ""},
+	}
+	for _, tt := range tests {
+		code, out := kvctl(tt.args...)
+		if code != tt.code || out != tt.out {
+			t.Errorf("%s: got exit code %d and output %q, want %d and %q", tt.name, code, out, tt.code, tt.out)
+		}
+	}
+}
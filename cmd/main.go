@@ -1,15 +1,282 @@
 package main
 
-import "kv"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"kv"
+)
 
 func main() {
-	// Could have two different in memory stores.
-	// ReadOptimized Store: Use an internal sync.Map implementation
-	// WriteOptimized Store: Use an internal map implementation
-	mapstore := kv.NewWriteOptimizedMapStore(1, true, 100)
-	frontend := kv.NewHTTPServer(mapstore, "0.0.0.0:11200")
-	go frontend.Start()
-	lrustore := kv.NewLRUCacheStore(100)
-	lruFrontend := kv.NewHTTPServer(lrustore, "0.0.0.0:11201")
-	lruFrontend.Start()
+	cfg, printConfig, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(cfg)
+		return
+	}
+
+	httpOpts, err := cfg.HTTP.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var servers []server
+	var closers []io.Closer
+	if cfg.Store.enabled() {
+		store, err := openStore(&cfg.Store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		closers = appendCloser(closers, store)
+		storeOpts := httpOpts
+		if cfg.Namespaces.Enabled {
+			namespaces, err := openNamespaces(&cfg.Namespaces, &cfg.Store)
+			if err != nil {
+				log.Fatal(err)
+			}
+			closers = append(closers, namespaces)
+			storeOpts.Namespaces = namespaces
+		}
+		servers = append(servers, newServers(store, cfg.Store.Addr, cfg.Store.RESPAddr, cfg.Store.MemcachedAddr, storeOpts)...)
+	}
+	if cfg.Cache.enabled() {
+		cache := newCache(&cfg.Cache)
+		closers = appendCloser(closers, cache)
+		servers = append(servers, newServers(cache, cfg.Cache.Addr, cfg.Cache.RESPAddr, cfg.Cache.MemcachedAddr, httpOpts)...)
+	}
+
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s server) { errc <- s.Start() }(s)
+	}
+	// SIGTERM is what docker stop and kubernetes send.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	case err := <-errc:
+		// Whichever server fails first takes the others down with it.
+		log.Printf("Shutting down, a server failed: %v", err)
+		exitCode = 1
+	case sig := <-sigc:
+		log.Printf("Received %v, shutting down (send it again to exit right away)", sig)
+	}
+	go func() {
+		<-sigc
+		log.Print("Exiting without waiting for the shutdown to finish")
+		os.Exit(1)
+	}()
+
+	if err := shutdown(servers, closers, time.Duration(cfg.ShutdownTimeout)); err != nil {
+		log.Printf("Shutdown: %v", err)
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+// server is what the HTTP, RESP and memcached servers have in common.
+type server interface {
+	Start() error
+	Shutdown(ctx context.Context) error
+}
+
+// newServers makes a server for every address that is set.
+func newServers(store kv.Store, addr, respAddr, memcachedAddr string, httpOpts kv.HTTPOptions) []server {
+	var servers []server
+	if addr != "" {
+		servers = append(servers, kv.NewHTTPServerWithOptions(store, addr, httpOpts))
+	}
+	if respAddr != "" {
+		servers = append(servers, kv.NewRESPServer(store, respAddr))
+	}
+	if memcachedAddr != "" {
+		servers = append(servers, kv.NewMemcachedServer(store, memcachedAddr))
+	}
+	return servers
+}
+
+// shutdown drains every server at once and then closes the stores, which
+// flushes whatever persistence they have. The stores get closed even if
+// draining ran out of time, the servers have stopped using them either way.
+func shutdown(servers []server, closers []io.Closer, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s server) {
+			defer wg.Done()
+			errs[i] = s.Shutdown(ctx)
+		}(i, s)
+	}
+	wg.Wait()
+	for _, closer := range closers {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// appendCloser appends store to closers if it has anything to close.
+func appendCloser(closers []io.Closer, store kv.Store) []io.Closer {
+	if closer, ok := store.(io.Closer); ok {
+		return append(closers, closer)
+	}
+	return closers
+}
+
+// openNamespaces opens the namespaces in cfg.Dir and creates the ones in
+// cfg.Create that aren't there yet.
+func openNamespaces(cfg *NamespacesConfig, store *StoreConfig) (*kv.Namespaces, error) {
+	// Validated already.
+	policy, _ := fsyncPolicy(store.Fsync)
+	namespaces, err := kv.NewNamespaces(kv.NamespacesOptions{
+		Dir:           cfg.Dir,
+		Fsync:         policy,
+		FsyncInterval: time.Duration(store.FsyncInterval),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range cfg.Create {
+		if err := namespaces.Create(spec); err != nil && err != kv.ErrNamespaceExists {
+			namespaces.Close()
+			return nil, fmt.Errorf("creating namespace %s: %w", spec.Name, err)
+		}
+	}
+	return namespaces, nil
+}
+
+// openStore builds the store cfg asks for, cfg has been validated already.
+func openStore(cfg *StoreConfig) (kv.Store, error) {
+	if c := cfg.Cluster; len(c.Nodes) > 0 {
+		cluster, err := kv.NewClusterStore(c.Nodes, kv.ClusterOptions{VirtualNodes: c.VirtualNodes, APIKey: c.APIKey})
+		if err != nil {
+			return nil, err
+		}
+		return cluster, nil
+	}
+	store, err := openEngine(cfg)
+	if q := cfg.Quorum; err == nil && len(q.Nodes) > 0 {
+		quorum, err := kv.NewQuorumStore(store, kv.QuorumOptions{Self: q.Self, Nodes: q.Nodes, N: q.N, R: q.R, W: q.W,
+			AntiEntropyInterval: time.Duration(q.AntiEntropyInterval), APIKey: q.APIKey})
+		if err != nil {
+			if closer, ok := store.(io.Closer); ok {
+				closer.Close()
+			}
+			return nil, err
+		}
+		return quorum, nil
+	}
+	r := cfg.Replication
+	if err != nil || (!r.Primary && r.ReplicaOf == "") {
+		return store, err
+	}
+	opts := kv.ReplicationOptions{FeedSize: r.FeedSize, Name: r.Name, APIKey: r.APIKey}
+	var replicated *kv.ReplicatedStore
+	if r.ReplicaOf != "" {
+		replicated, err = kv.NewReplicaStore(store, r.ReplicaOf, opts)
+	} else {
+		replicated, err = kv.NewPrimaryStore(store, opts)
+	}
+	if err != nil {
+		if closer, ok := store.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	return replicated, nil
+}
+
+// openEngine builds the engine of the store.
+// Could have two different in memory stores.
+// ReadOptimized Store: Use an internal sync.Map implementation
+// WriteOptimized Store: Use an internal map implementation
+func openEngine(cfg *StoreConfig) (kv.Store, error) {
+	policy, err := fsyncPolicy(cfg.Fsync)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Engine {
+	case "map":
+		mapstore := kv.NewWriteOptimizedMapStore(cfg.BatchedWritesCheckInterval, cfg.Rollback, cfg.Capacity)
+		if cfg.MaxBytes > 0 {
+			mapstore = kv.NewWeightedWriteOptimizedMapStore(cfg.BatchedWritesCheckInterval, cfg.Rollback, cfg.MaxBytes, nil)
+		}
+		if cfg.WAL != "" {
+			wal, err := kv.OpenWAL(cfg.WAL, kv.WALOptions{Fsync: policy, FsyncInterval: time.Duration(cfg.FsyncInterval)})
+			if err != nil {
+				return nil, fmt.Errorf("opening write-ahead log: %w", err)
+			}
+			if err := mapstore.AttachWAL(wal); err != nil {
+				return nil, fmt.Errorf("replaying write-ahead log: %w", err)
+			}
+		}
+		if r := cfg.Raft; r.ID != "" {
+			raft, err := kv.NewRaftStore(mapstore, kv.RaftOptions{
+				ID:                r.ID,
+				Peers:             r.Peers,
+				Join:              r.Join,
+				Dir:               r.Dir,
+				Fsync:             policy,
+				SnapshotThreshold: r.SnapshotThreshold,
+				APIKey:            r.APIKey,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("starting raft: %w", err)
+			}
+			return raft, nil
+		}
+		return mapstore, nil
+	case "syncmap":
+		return kv.NewShardedSyncMapStore(), nil
+	case "bitcask":
+		bitcask, err := kv.OpenBitcaskStore(cfg.DataDir, kv.BitcaskOptions{
+			Fsync:                      policy,
+			FsyncInterval:              time.Duration(cfg.FsyncInterval),
+			MergeInterval:              time.Duration(cfg.MergeInterval),
+			BatchedWritesCheckInterval: cfg.BatchedWritesCheckInterval,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("opening bitcask store: %w", err)
+		}
+		return bitcask, nil
+	case "lsm":
+		lsm, err := kv.OpenLSMStore(cfg.DataDir, kv.LSMOptions{
+			Fsync:                      policy,
+			FsyncInterval:              time.Duration(cfg.FsyncInterval),
+			BatchedWritesCheckInterval: cfg.BatchedWritesCheckInterval,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("opening lsm store: %w", err)
+		}
+		return lsm, nil
+	}
+	return nil, fmt.Errorf("unknown engine %q", cfg.Engine)
+}
+
+func newCache(cfg *CacheConfig) kv.Store {
+	// Validated already, so this can't fail.
+	policy, _ := kv.NewEvictionPolicy(cfg.Eviction, max(cfg.Capacity, 1))
+	if cfg.MaxBytes > 0 {
+		return kv.NewWeightedCacheStore(cfg.MaxBytes, nil, policy)
+	}
+	return kv.NewCacheStore(cfg.Capacity, policy)
 }
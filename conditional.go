@@ -0,0 +1,61 @@
+package kv
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// ConditionalStore is implemented by the stores that can do atomic read
+// modify writes, so clients don't have to race a /get against a /set.
+type ConditionalStore interface {
+	Store
+	// PutIfAbsent stores value only if key does not exist, and returns
+	// ErrKeyExists otherwise.
+	PutIfAbsent(key string, value interface{}) error
+	// CompareAndSwap replaces the value of key with new only if it currently
+	// is old. It returns a notFoundError if key does not exist and
+	// ErrValueMismatch if it holds something else. Like Update, it keeps the
+	// key's TTL.
+	CompareAndSwap(key string, old, new interface{}) error
+	// CompareAndDelete deletes key only if its value is old, with the same
+	// errors as CompareAndSwap.
+	CompareAndDelete(key string, old interface{}) error
+	// GetOrPut returns the value of key if it exists (loaded is true) and
+	// stores value and returns it otherwise.
+	GetOrPut(key string, value interface{}) (actual interface{}, loaded bool, err error)
+}
+
+type keyExistsError struct{}
+
+func (e *keyExistsError) Error() string {
+	return "key already exists"
+}
+
+var ErrKeyExists = &keyExistsError{}
+
+type valueMismatchError struct{}
+
+func (e *valueMismatchError) Error() string {
+	return "value does not match"
+}
+
+var ErrValueMismatch = &valueMismatchError{}
+
+// valuesEqual compares two values the way a client would expect. Values that
+// came in over HTTP are whatever encoding/json decoded them to, so 1 from a
+// Go caller has to equal float64(1) from a JSON body, hence the fallback to
+// comparing JSON encodings (which sorts map keys, so that is stable).
+func valuesEqual(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	encodedA, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	encodedB, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(encodedA) == string(encodedB)
+}
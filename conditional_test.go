@@ -0,0 +1,139 @@
+package kv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var conditionalStores = map[string]func() ConditionalStore{
+	"map":     func() ConditionalStore { return NewWriteOptimizedMapStore(1, true, 1000) },
+	"lru":     func() ConditionalStore { return NewLRUCacheStore(1000) },
+	"syncmap": func() ConditionalStore { return NewShardedSyncMapStore() },
+}
+
+func TestConditional_Operations(t *testing.T) {
+	for name, newStore := range conditionalStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore()
+
+			if err := s.PutIfAbsent("a", "1"); err != nil {
+				t.Fatalf("PutIfAbsent returned an error: %v", err)
+			}
+			if err := s.PutIfAbsent("a", "2"); err != ErrKeyExists {
+				t.Errorf("Expected ErrKeyExists, got %v", err)
+			}
+
+			if err := s.CompareAndSwap("a", "wrong", "3"); err != ErrValueMismatch {
+				t.Errorf("Expected ErrValueMismatch, got %v", err)
+			}
+			if err := s.CompareAndSwap("missing", "1", "3"); err == nil {
+				t.Errorf("Expected CompareAndSwap of a missing key to fail")
+			} else if _, ok := err.(*notFoundError); !ok {
+				t.Errorf("Expected a notFoundError, got %v", err)
+			}
+			if err := s.CompareAndSwap("a", "1", map[string]interface{}{"n": 1}); err != nil {
+				t.Fatalf("CompareAndSwap returned an error: %v", err)
+			}
+
+			// Compared the way JSON sees it, so an int matches a float64.
+			if err := s.CompareAndDelete("a", map[string]interface{}{"n": float64(2)}); err != ErrValueMismatch {
+				t.Errorf("Expected ErrValueMismatch, got %v", err)
+			}
+			if err := s.CompareAndDelete("a", map[string]interface{}{"n": float64(1)}); err != nil {
+				t.Fatalf("CompareAndDelete returned an error: %v", err)
+			}
+			if _, err := s.Get("a"); err == nil {
+				t.Errorf("Expected a to be deleted")
+			}
+
+			if actual, loaded, err := s.GetOrPut("b", "first"); err != nil || loaded || actual != "first" {
+				t.Errorf("GetOrPut = %v, %v, %v, want first, false, nil", actual, loaded, err)
+			}
+			if actual, loaded, err := s.GetOrPut("b", "second"); err != nil || !loaded || actual != "first" {
+				t.Errorf("GetOrPut = %v, %v, %v, want first, true, nil", actual, loaded, err)
+			}
+		})
+	}
+}
+
+// TestConditional_CompareAndSwapIsAtomic increments a counter from many
+// goroutines with CompareAndSwap retry loops. Any lost update shows up in the
+// final count.
+func TestConditional_CompareAndSwapIsAtomic(t *testing.T) {
+	for name, newStore := range conditionalStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore()
+			s.Put("counter", 0)
+
+			const goroutines, increments = 8, 100
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < increments; i++ {
+						for {
+							current, _ := s.Get("counter")
+							if s.CompareAndSwap("counter", current, current.(int)+1) == nil {
+								break
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if value, _ := s.Get("counter"); value != goroutines*increments {
+				t.Errorf("Expected counter to be %d, got %v", goroutines*increments, value)
+			}
+		})
+	}
+}
+
+func TestConditional_HTTP(t *testing.T) {
+	server := NewHTTPServer(NewWriteOptimizedMapStore(1, true, 100), "")
+	do := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	cases := []struct {
+		path, body string
+		want       int
+	}{
+		{"/putIfAbsent", `{"key":"a","value":1}`, http.StatusCreated},
+		{"/putIfAbsent", `{"key":"a","value":2}`, http.StatusConflict},
+		{"/compareAndSwap", `{"key":"a","old":2,"new":3}`, http.StatusPreconditionFailed},
+		{"/compareAndSwap", `{"key":"missing","old":2,"new":3}`, http.StatusNotFound},
+		{"/compareAndSwap", `{"key":"a","old":1,"new":3}`, http.StatusOK},
+		{"/compareAndDelete", `{"key":"a","old":1}`, http.StatusPreconditionFailed},
+		{"/compareAndDelete", `{"key":"a","old":3}`, http.StatusOK},
+		{"/getOrPut", `{"key":"b","value":"x"}`, http.StatusCreated},
+		{"/getOrPut", `{"key":"b","value":"y"}`, http.StatusOK},
+		{"/compareAndSwap", `not json`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rec := do(c.path, c.body)
+		if rec.Code != c.want {
+			t.Errorf("POST %s %s returned %d, want %d", c.path, c.body, rec.Code, c.want)
+		}
+	}
+
+	if rec := do("/getOrPut", `{"key":"b","value":"z"}`); !strings.Contains(rec.Body.String(), `"value":"x"`) {
+		t.Errorf("Expected /getOrPut to return the existing value, got %q", rec.Body.String())
+	}
+
+	bitcask, err := OpenBitcaskStore(t.TempDir(), BitcaskOptions{Fsync: FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitcask.Close()
+	server = NewHTTPServer(bitcask, "")
+	if rec := do("/putIfAbsent", `{"key":"a","value":1}`); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 from a store without conditional operations, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package kv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is what Start and Serve return after Shutdown, for every
+// server. It is http.ErrServerClosed so one check covers all of them.
+var ErrServerClosed = http.ErrServerClosed
+
+// connGroup is how the RESP and memcached servers shut down the way
+// http.Server does: stop accepting, close the connections that are waiting
+// for a command, let the others finish the one they are on and then close
+// them too. The zero value is ready to use.
+type connGroup struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	// conns maps every connection to whether it is in the middle of a
+	// command.
+	conns   map[net.Conn]bool
+	closing bool
+	// ctx is the parent of the connection contexts, it is cancelled if
+	// shutdown gives up waiting so a long BatchUpdate stops.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (g *connGroup) init() {
+	if g.conns == nil {
+		g.listeners = make(map[net.Listener]struct{})
+		g.conns = make(map[net.Conn]bool)
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// addListener returns false if the group is shutting down already.
+func (g *connGroup) addListener(l net.Listener) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	if g.closing {
+		return false
+	}
+	g.listeners[l] = struct{}{}
+	return true
+}
+
+func (g *connGroup) removeListener(l net.Listener) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.listeners, l)
+}
+
+func (g *connGroup) closed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closing
+}
+
+// add starts tracking a new connection, which starts out idle. ok is false
+// if the group is shutting down, then the connection should just be closed.
+func (g *connGroup) add(conn net.Conn) (ctx context.Context, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	if g.closing {
+		return nil, false
+	}
+	g.conns[conn] = false
+	return g.ctx, true
+}
+
+// remove closes conn and forgets about it.
+func (g *connGroup) remove(conn net.Conn) {
+	conn.Close()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.conns, conn)
+}
+
+// setBusy records whether conn is in the middle of a command. It returns
+// false once the group is shutting down, then the connection should flush
+// what it has and return without reading another command. A connection
+// must only say it is idle once its replies are flushed, shutdown closes
+// idle connections without warning.
+func (g *connGroup) setBusy(conn net.Conn, busy bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return false
+	}
+	g.conns[conn] = busy
+	return true
+}
+
+// shutdown closes the listeners and waits for every connection to be done.
+// If ctx runs out first, it cancels the connection contexts, closes them
+// all, waits for them to return and returns ctx.Err().
+func (g *connGroup) shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	g.init()
+	g.closing = true
+	for l := range g.listeners {
+		l.Close()
+	}
+	g.mu.Unlock()
+
+	// Polling is what http.Server does too, connections don't tell us when
+	// they go idle.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !g.closeIdle() {
+		select {
+		case <-ctx.Done():
+			g.mu.Lock()
+			g.cancel()
+			for conn := range g.conns {
+				conn.Close()
+			}
+			g.mu.Unlock()
+			// They are closed, but still wait for them to return so the
+			// caller knows the store is not used anymore.
+			for !g.closeIdle() {
+				<-ticker.C
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// closeIdle closes the idle connections and reports whether there are none
+// left at all.
+func (g *connGroup) closeIdle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for conn, busy := range g.conns {
+		if !busy {
+			conn.Close()
+		}
+	}
+	return len(g.conns) == 0
+}
@@ -0,0 +1,75 @@
+package kv
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseETags parses an If-Match or If-None-Match header into versions. any is
+// true for "*". Tags that are not one of ours can never match, so they are
+// simply skipped.
+func parseETags(header string) (versions []uint64, any bool) {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			any = true
+			continue
+		}
+		// Weak comparison: our tags are all strong anyway.
+		tag = strings.TrimPrefix(tag, "W/")
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return versions, any
+}
+
+// ifMatch and ifNoneMatch turn the headers into preconditions, nil if the
+// header is not there.
+func ifMatch(r *http.Request) Precondition {
+	header := strings.Join(r.Header.Values("If-Match"), ",")
+	if header == "" {
+		return nil
+	}
+	if versions, any := parseETags(header); !any {
+		return IfMatch(versions...)
+	}
+	return IfExists
+}
+
+func ifNoneMatch(r *http.Request) Precondition {
+	header := strings.Join(r.Header.Values("If-None-Match"), ",")
+	if header == "" {
+		return nil
+	}
+	if versions, any := parseETags(header); !any {
+		return IfNoneMatch(versions...)
+	}
+	return IfNotExists
+}
+
+// requestPrecondition combines If-Match and If-None-Match. ok is false if the
+// request has neither.
+func requestPrecondition(r *http.Request) (cond Precondition, ok bool) {
+	match, noneMatch := ifMatch(r), ifNoneMatch(r)
+	if match == nil && noneMatch == nil {
+		return nil, false
+	}
+	return func(current *Versioned) error {
+		if err := match.check(current); err != nil {
+			return err
+		}
+		return noneMatch.check(current)
+	}, true
+}
+
+func setVersionHeaders(w http.ResponseWriter, v Versioned) {
+	w.Header().Set("ETag", v.ETag())
+	if !v.Modified.IsZero() {
+		w.Header().Set("Last-Modified", v.Modified.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,485 @@
+package kv
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// EvictionPolicy decides which key the cache store throws out when it is
+// full. The store owns the values, a policy only ever sees keys.
+//
+// Policies are not safe for concurrent use, the store calls them with its own
+// lock held.
+type EvictionPolicy interface {
+	// Access records a hit on a key the policy is tracking.
+	Access(key string)
+	// Insert starts tracking a key that was just added to the cache.
+	Insert(key string)
+	// Victim picks the key to evict and stops tracking it. It can return the
+	// key that was just inserted, which is how W-TinyLFU turns new keys away.
+	// Policies with ghost entries (ARC) remember victims, so the store must
+	// not call Remove for it as well. ok is false if nothing is tracked.
+	Victim() (key string, ok bool)
+	// Remove forgets a key that was deleted or expired.
+	Remove(key string)
+}
+
+// NewEvictionPolicy returns a policy by name (lru, lfu, arc or tinylfu) for
+// a cache of size entries, mostly so it can be picked with a flag.
+func NewEvictionPolicy(name string, size int) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return NewLRUPolicy(), nil
+	case "lfu":
+		return NewLFUPolicy(), nil
+	case "arc":
+		return NewARCPolicy(size), nil
+	case "tinylfu":
+		return NewWTinyLFUPolicy(size), nil
+	}
+	return nil, fmt.Errorf("kv: unknown eviction policy %q", name)
+}
+
+// lruPolicy evicts the least recently used key. This is what the cache
+// store always did before policies were pluggable.
+type lruPolicy struct {
+	ll    *list.List
+	elems map[string]*list.Element
+}
+
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{ll: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Access(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.ll.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Insert(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.ll.MoveToFront(elem)
+		return
+	}
+	p.elems[key] = p.ll.PushFront(key)
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	elem := p.ll.Back()
+	if elem == nil {
+		return "", false
+	}
+	key := elem.Value.(string)
+	p.Remove(key)
+	return key, true
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.ll.Remove(elem)
+		delete(p.elems, key)
+	}
+}
+
+// keys returns the tracked keys most recently used first. The cache store
+// uses it to order snapshots.
+func (p *lruPolicy) keys() []string {
+	keys := make([]string, 0, p.ll.Len())
+	for elem := p.ll.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(string))
+	}
+	return keys
+}
+
+// lfuPolicy evicts the least frequently used key, and the least recently
+// used one among those. Everything is O(1): keys sit in buckets by access
+// count and the buckets are kept in a list ordered by count.
+//
+// Plain LFU never forgets, so a key that was hot yesterday can stick around
+// forever. W-TinyLFU is the fix for that, this one is mostly here to compare.
+type lfuPolicy struct {
+	buckets *list.List // of *lfuBucket, lowest count first
+	items   map[string]*lfuItem
+	// newest is the last key inserted. The store evicts after inserting, and
+	// a new key always has the lowest count, so without special casing it
+	// nothing new would ever get in.
+	newest string
+}
+
+type lfuBucket struct {
+	count int
+	keys  *list.List // most recently used first
+}
+
+type lfuItem struct {
+	bucket *list.Element
+	elem   *list.Element
+}
+
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{buckets: list.New(), items: make(map[string]*lfuItem)}
+}
+
+func (p *lfuPolicy) Access(key string) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+	cur := item.bucket
+	count := cur.Value.(*lfuBucket).count + 1
+	next := cur.Next()
+	if next == nil || next.Value.(*lfuBucket).count != count {
+		next = p.buckets.InsertAfter(&lfuBucket{count: count, keys: list.New()}, cur)
+	}
+	p.unlink(item)
+	item.bucket = next
+	item.elem = next.Value.(*lfuBucket).keys.PushFront(key)
+}
+
+func (p *lfuPolicy) Insert(key string) {
+	if _, ok := p.items[key]; ok {
+		p.Access(key)
+		return
+	}
+	first := p.buckets.Front()
+	if first == nil || first.Value.(*lfuBucket).count != 1 {
+		first = p.buckets.PushFront(&lfuBucket{count: 1, keys: list.New()})
+	}
+	p.items[key] = &lfuItem{bucket: first, elem: first.Value.(*lfuBucket).keys.PushFront(key)}
+	p.newest = key
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	first := p.buckets.Front()
+	if first == nil {
+		return "", false
+	}
+	victim := first.Value.(*lfuBucket).keys.Back()
+	if victim.Value.(string) == p.newest {
+		// The newest key is at the front of its bucket, so it is only at the
+		// back when it is alone in there.
+		if next := first.Next(); next != nil {
+			victim = next.Value.(*lfuBucket).keys.Back()
+		}
+	}
+	key := victim.Value.(string)
+	p.Remove(key)
+	return key, true
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if item, ok := p.items[key]; ok {
+		p.unlink(item)
+		delete(p.items, key)
+	}
+}
+
+// unlink takes an item out of its bucket, dropping the bucket if it is empty.
+func (p *lfuPolicy) unlink(item *lfuItem) {
+	bucket := item.bucket.Value.(*lfuBucket)
+	bucket.keys.Remove(item.elem)
+	if bucket.keys.Len() == 0 {
+		p.buckets.Remove(item.bucket)
+	}
+}
+
+// arcPolicy is the Adaptive Replacement Cache from Megiddo and Modha. t1
+// holds keys seen once recently, t2 keys seen at least twice. b1 and b2 are
+// ghosts of what was evicted from each, and a hit on a ghost moves the target
+// size of t1 (p) towards whichever side would have kept it.
+type arcPolicy struct {
+	c              int
+	p              int
+	t1, t2, b1, b2 *list.List
+	items          map[string]*arcItem
+}
+
+type arcItem struct {
+	list *list.List
+	elem *list.Element
+}
+
+func NewARCPolicy(size int) EvictionPolicy {
+	if size < 1 {
+		size = 1
+	}
+	return &arcPolicy{
+		c:     size,
+		t1:    list.New(),
+		t2:    list.New(),
+		b1:    list.New(),
+		b2:    list.New(),
+		items: make(map[string]*arcItem),
+	}
+}
+
+func (p *arcPolicy) move(key string, to *list.List) {
+	if item, ok := p.items[key]; ok {
+		item.list.Remove(item.elem)
+		item.list = to
+		item.elem = to.PushFront(key)
+		return
+	}
+	p.items[key] = &arcItem{list: to, elem: to.PushFront(key)}
+}
+
+func (p *arcPolicy) Access(key string) {
+	if item, ok := p.items[key]; ok && (item.list == p.t1 || item.list == p.t2) {
+		p.move(key, p.t2)
+	}
+}
+
+func (p *arcPolicy) Insert(key string) {
+	item, ok := p.items[key]
+	switch {
+	case !ok:
+		p.move(key, p.t1)
+	case item.list == p.b1:
+		p.p = min(p.c, p.p+max(p.b2.Len()/p.b1.Len(), 1))
+		p.move(key, p.t2)
+	case item.list == p.b2:
+		p.p = max(0, p.p-max(p.b1.Len()/p.b2.Len(), 1))
+		p.move(key, p.t2)
+	default:
+		p.Access(key)
+	}
+
+	// Keep the ghosts bounded: t1+b1 and everything together to c and 2c.
+	for p.t1.Len()+p.b1.Len() > p.c && p.b1.Len() > 0 {
+		p.drop(p.b1)
+	}
+	for p.t1.Len()+p.t2.Len()+p.b1.Len()+p.b2.Len() > 2*p.c && p.b2.Len() > 0 {
+		p.drop(p.b2)
+	}
+}
+
+// drop forgets the least recent key of l.
+func (p *arcPolicy) drop(l *list.List) {
+	key := l.Back().Value.(string)
+	l.Remove(l.Back())
+	delete(p.items, key)
+}
+
+func (p *arcPolicy) Victim() (string, bool) {
+	from, ghost := p.t2, p.b2
+	if p.t1.Len() > 0 && (p.t1.Len() > p.p || p.t2.Len() == 0) {
+		from, ghost = p.t1, p.b1
+	}
+	if from.Len() == 0 {
+		return "", false
+	}
+	key := from.Back().Value.(string)
+	p.move(key, ghost)
+	return key, true
+}
+
+func (p *arcPolicy) Remove(key string) {
+	if item, ok := p.items[key]; ok {
+		item.list.Remove(item.elem)
+		delete(p.items, key)
+	}
+}
+
+// wTinyLFUPolicy is W-TinyLFU as described by Einziger, Friedman and Manes
+// (and used by Caffeine). New keys go into a small LRU window. Whatever falls
+// out of the window has to beat the main cache's own victim on estimated
+// frequency to get in, so a scan of one-off keys can't flush out the keys that
+// actually get used. The main cache is a segmented LRU, keys are promoted from
+// probation to protected on their second hit.
+type wTinyLFUPolicy struct {
+	windowCap, protectedCap, mainCap int
+
+	window, probation, protected *list.List
+	items                        map[string]*list.Element // value is *tinyLFUItem
+	sketch                       *countMinSketch
+}
+
+type tinyLFUItem struct {
+	key  string
+	list *list.List
+}
+
+func NewWTinyLFUPolicy(size int) EvictionPolicy {
+	if size < 1 {
+		size = 1
+	}
+	// 1% window and 80% of the main cache protected, Caffeine's defaults.
+	windowCap := max(1, size/100)
+	mainCap := size - windowCap
+	return &wTinyLFUPolicy{
+		windowCap:    windowCap,
+		mainCap:      mainCap,
+		protectedCap: mainCap * 8 / 10,
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		items:        make(map[string]*list.Element),
+		sketch:       newCountMinSketch(size),
+	}
+}
+
+func (p *wTinyLFUPolicy) push(key string, to *list.List) {
+	p.items[key] = to.PushFront(&tinyLFUItem{key: key, list: to})
+}
+
+func (p *wTinyLFUPolicy) Access(key string) {
+	p.sketch.increment(key)
+	elem, ok := p.items[key]
+	if !ok {
+		return
+	}
+	item := elem.Value.(*tinyLFUItem)
+	switch item.list {
+	case p.window, p.protected:
+		item.list.MoveToFront(elem)
+	case p.probation:
+		p.probation.Remove(elem)
+		p.push(key, p.protected)
+		if p.protected.Len() > p.protectedCap {
+			demoted := p.protected.Back().Value.(*tinyLFUItem).key
+			p.protected.Remove(p.protected.Back())
+			p.push(demoted, p.probation)
+		}
+	}
+}
+
+func (p *wTinyLFUPolicy) Insert(key string) {
+	if _, ok := p.items[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.sketch.increment(key)
+	p.push(key, p.window)
+	// While the main cache has room there is nothing to compete against.
+	for p.window.Len() > p.windowCap && p.probation.Len()+p.protected.Len() < p.mainCap {
+		moved := p.window.Back().Value.(*tinyLFUItem).key
+		p.window.Remove(p.window.Back())
+		p.push(moved, p.probation)
+	}
+}
+
+func (p *wTinyLFUPolicy) Victim() (string, bool) {
+	for {
+		if p.window.Len() <= p.windowCap {
+			// Only the main cache can be over.
+			return p.evictMain()
+		}
+
+		candidate := p.window.Back().Value.(*tinyLFUItem).key
+		p.window.Remove(p.window.Back())
+		delete(p.items, candidate)
+		if p.probation.Len()+p.protected.Len() < p.mainCap {
+			p.push(candidate, p.probation)
+			continue
+		}
+
+		victim, ok := p.mainVictim()
+		if !ok || p.sketch.estimate(candidate) <= p.sketch.estimate(victim.Value.(*tinyLFUItem).key) {
+			// Ties go to the key already in the cache.
+			return candidate, true
+		}
+		key := victim.Value.(*tinyLFUItem).key
+		p.Remove(key)
+		p.push(candidate, p.probation)
+		return key, true
+	}
+}
+
+// mainVictim is the least recent key on probation, or in protected if
+// probation is empty.
+func (p *wTinyLFUPolicy) mainVictim() (*list.Element, bool) {
+	if elem := p.probation.Back(); elem != nil {
+		return elem, true
+	}
+	if elem := p.protected.Back(); elem != nil {
+		return elem, true
+	}
+	return nil, false
+}
+
+func (p *wTinyLFUPolicy) evictMain() (string, bool) {
+	elem, ok := p.mainVictim()
+	if !ok {
+		elem = p.window.Back()
+		if elem == nil {
+			return "", false
+		}
+	}
+	key := elem.Value.(*tinyLFUItem).key
+	p.Remove(key)
+	return key, true
+}
+
+func (p *wTinyLFUPolicy) Remove(key string) {
+	if elem, ok := p.items[key]; ok {
+		elem.Value.(*tinyLFUItem).list.Remove(elem)
+		delete(p.items, key)
+	}
+}
+
+// countMinSketch estimates how often keys were seen using 4 rows of small
+// saturating counters. Every counter is halved once sampleSize increments
+// have happened, so the estimates follow what is popular now rather than ever.
+type countMinSketch struct {
+	rows       [4][]uint8
+	shift      uint
+	additions  int
+	sampleSize int
+}
+
+const countMinMax = 15
+
+func newCountMinSketch(size int) *countMinSketch {
+	// Four counters per cached key in every row keeps keys that were only
+	// seen once from sharing all their counters with a hot key.
+	width, shift := 16, uint(60)
+	for width < 4*size {
+		width <<= 1
+		shift--
+	}
+	s := &countMinSketch{shift: shift, sampleSize: 10 * size}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// countMinSeeds remix the key's hash for every row. Double hashing like the
+// bloom filter does is not good enough here: with a table this small two keys
+// that collide in one row tend to collide in all of them, and then a key seen
+// once looks as popular as a hot one.
+var countMinSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+// index takes the top bits of the product, the low ones only depend on the
+// low bits of the hash.
+func (s *countMinSketch) index(hash uint64, row int) uint64 {
+	return ((hash ^ countMinSeeds[row]) * countMinSeeds[row]) >> s.shift
+}
+
+func (s *countMinSketch) increment(key string) {
+	hash := bloomHash(key)
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(hash, i)]; *c < countMinMax {
+			*c++
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	hash := bloomHash(key)
+	est := uint8(countMinMax)
+	for i := range s.rows {
+		est = min(est, s.rows[i][s.index(hash, i)])
+	}
+	return est
+}
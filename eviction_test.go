@@ -0,0 +1,164 @@
+package kv
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+var policyNames = []string{"lru", "lfu", "arc", "tinylfu"}
+
+func TestEvictionPolicy_NeverExceedsSize(t *testing.T) {
+	for _, name := range policyNames {
+		t.Run(name, func(t *testing.T) {
+			policy, err := NewEvictionPolicy(name, 50)
+			if err != nil {
+				t.Fatalf("NewEvictionPolicy returned an error: %v", err)
+			}
+			cache := NewCacheStore(50, policy)
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 10000; i++ {
+				key := strconv.Itoa(r.Intn(200))
+				switch r.Intn(10) {
+				case 0:
+					cache.Delete(key)
+				case 1, 2, 3:
+					cache.Put(key, i)
+				default:
+					cache.Get(key)
+				}
+				if len(cache.items) > 50 {
+					t.Fatalf("Cache holds %d entries, more than its size of 50", len(cache.items))
+				}
+			}
+
+			// Whatever the policy tracks has to match what is in the cache,
+			// otherwise it will sooner or later pick victims that are not there.
+			for len(cache.items) > 0 {
+				key, ok := cache.policy.Victim()
+				if !ok {
+					t.Fatalf("Policy ran out of victims with %d entries left", len(cache.items))
+				}
+				if _, ok := cache.items[key]; !ok {
+					t.Fatalf("Policy picked %q, which is not in the cache", key)
+				}
+				delete(cache.items, key)
+			}
+			if key, ok := cache.policy.Victim(); ok {
+				t.Errorf("Policy picked %q from an empty cache", key)
+			}
+		})
+	}
+}
+
+func TestLFUPolicy_EvictsLeastFrequent(t *testing.T) {
+	cache := NewCacheStore(2, NewLFUPolicy())
+	cache.Put("a", 1)
+	cache.Put("b", 2)
+	cache.Get("a")
+	cache.Get("a")
+	cache.Get("b")
+	cache.Put("c", 3)
+
+	if _, err := cache.Get("b"); err == nil {
+		t.Errorf("Expected b, the least frequently used key, to be evicted")
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Errorf("Expected a to still be cached")
+	}
+}
+
+func TestARCPolicy_GhostHitAdapts(t *testing.T) {
+	p := NewARCPolicy(2).(*arcPolicy)
+	p.Insert("a")
+	p.Insert("b")
+	if key, _ := p.Victim(); key != "a" {
+		t.Fatalf("Expected a to be evicted first, got %s", key)
+	}
+	// a comes back while it is still a ghost, so recency should get more room
+	// and a goes straight to the frequent list.
+	p.Insert("a")
+	if p.p == 0 {
+		t.Errorf("Expected a hit on a ghost to grow the recency target")
+	}
+	if p.items["a"].list != p.t2 {
+		t.Errorf("Expected a key seen twice to be in t2")
+	}
+}
+
+func TestWTinyLFUPolicy_ScanResistant(t *testing.T) {
+	cache := NewCacheStore(100, NewWTinyLFUPolicy(100))
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 50; i++ {
+			key := "hot" + strconv.Itoa(i)
+			if _, err := cache.Get(key); err != nil {
+				cache.Put(key, i)
+			}
+		}
+	}
+	// A scan of ten times the cache size worth of keys that are never seen
+	// again. Much longer and the sketch ages the hot keys out, which is fine.
+	for i := 0; i < 1000; i++ {
+		cache.Put("scan"+strconv.Itoa(i), i)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := cache.Get("hot" + strconv.Itoa(i)); err != nil {
+			t.Errorf("Expected hot%d to survive the scan", i)
+		}
+	}
+}
+
+// TestEvictionPolicy_HitRatio runs every policy over the same skewed traffic
+// with scans mixed in. It's mostly there to print the numbers (go test -v),
+// but LRU is easy to beat on this so the others are expected to.
+func TestEvictionPolicy_HitRatio(t *testing.T) {
+	const size = 500
+	r := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(r, 1.1, 1, 100000)
+	trace := make([]string, 0, 200000)
+	for i := 0; len(trace) < cap(trace); i++ {
+		if i%10000 == 0 {
+			for j := 0; j < 2000; j++ {
+				trace = append(trace, "scan"+strconv.Itoa(i+j))
+			}
+		}
+		trace = append(trace, strconv.FormatUint(zipf.Uint64(), 10))
+	}
+
+	ratios := make(map[string]float64)
+	for _, name := range policyNames {
+		policy, _ := NewEvictionPolicy(name, size)
+		cache := NewCacheStore(size, policy)
+		for _, key := range trace {
+			if _, err := cache.Get(key); err != nil {
+				cache.Put(key, key)
+			}
+		}
+		stats := cache.Stats()
+		ratios[name] = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+		t.Logf("%-8s hit ratio %.3f, %d evictions", name, ratios[name], stats.Evictions)
+	}
+	for _, name := range []string{"arc", "tinylfu"} {
+		if ratios[name] < ratios["lru"] {
+			t.Errorf("Expected %s to beat lru, got %.3f vs %.3f", name, ratios[name], ratios["lru"])
+		}
+	}
+}
+
+func BenchmarkCachePolicies(b *testing.B) {
+	for _, name := range policyNames {
+		b.Run(name, func(b *testing.B) {
+			policy, _ := NewEvictionPolicy(name, 1000)
+			cache := NewCacheStore(1000, policy)
+			r := rand.New(rand.NewSource(1))
+			zipf := rand.NewZipf(r, 1.1, 1, 100000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := strconv.FormatUint(zipf.Uint64(), 10)
+				if _, err := cache.Get(key); err != nil {
+					cache.Put(key, i)
+				}
+			}
+		})
+	}
+}
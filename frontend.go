@@ -3,8 +3,14 @@ package kv
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,56 +18,285 @@ type Server struct {
 	mux  *http.ServeMux
 	db   Store
 	addr string
+	opts HTTPOptions
+
+	http *http.Server
+	// ctx is the parent of every request context. Shutdown cancels it when
+	// it gives up on draining, so a long /updateBulk rolls back instead of
+	// being cut off halfway. inflight is the requests being handled.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+	// draining is closed when Shutdown starts, to end the responses that
+	// never would on their own, like a replication stream.
+	draining  chan struct{}
+	drainOnce sync.Once
+
+	metrics httpMetrics
+}
+
+// HTTPOptions are the timeouts, TLS and access control settings of the HTTP
+// server. Zero means no timeout, like for http.Server, except for BatchTimeout.
+type HTTPOptions struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// BatchTimeout is how long an /updateBulk gets before its context is
+	// cancelled. Defaults to 30s.
+	BatchTimeout time.Duration
+	// TLS turns on HTTPS when it is set.
+	TLS *TLSOptions
+	// Auth are tried in order to find the identity of a request, after the
+	// client certificate if there is one.
+	Auth []Authenticator
+	// Namespaces, if set, are the other stores the server hosts next to its
+	// own, see Namespaces.
+	Namespaces *Namespaces
+	// ACL says what every identity may do with which keys. Leaving it nil
+	// lets anyone do anything, authenticated or not. /admin/stats,
+	// /admin/cache-stats and /metrics don't show any keys and stay open.
+	ACL ACL
 }
 
 func NewHTTPServer(store Store, addr string) *Server {
+	return NewHTTPServerWithOptions(store, addr, HTTPOptions{})
+}
+
+// NewHTTPServerWithOptions is NewHTTPServer with timeouts, TLS and access
+// control.
+func NewHTTPServerWithOptions(store Store, addr string, opts HTTPOptions) *Server {
+	if opts.BatchTimeout == 0 {
+		opts.BatchTimeout = 30 * time.Second
+	}
 	mux := http.NewServeMux()
-	server := &Server{db: store, addr: addr, mux: mux}
+	server := &Server{db: store, addr: addr, mux: mux, opts: opts}
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+	server.draining = make(chan struct{})
+	server.http = &http.Server{
+		Addr:              addr,
+		Handler:           server,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		BaseContext:       func(net.Listener) context.Context { return server.ctx },
+	}
 	mux.HandleFunc("/set", server.setHandler)
 	mux.HandleFunc("/get", server.getHandler)
+	mux.HandleFunc("/update", server.updateHandler)
 	mux.HandleFunc("/updateBulk", server.updateBulkHandler)
 	mux.HandleFunc("/delete", server.deleteHandler)
+	mux.HandleFunc("/ttl", server.ttlHandler)
+	mux.HandleFunc("/putIfAbsent", server.putIfAbsentHandler)
+	mux.HandleFunc("/getOrPut", server.getOrPutHandler)
+	mux.HandleFunc("/compareAndSwap", server.compareAndSwapHandler)
+	mux.HandleFunc("/compareAndDelete", server.compareAndDeleteHandler)
+	mux.HandleFunc("/txn", server.txnHandler)
+	mux.HandleFunc("/admin/snapshot", server.snapshotHandler)
+	mux.HandleFunc("/admin/restore", server.restoreHandler)
+	mux.HandleFunc("/admin/cache-stats", server.cacheStatsHandler)
+	mux.HandleFunc("/admin/stats", server.statsHandler)
+	mux.HandleFunc("/admin/keys", server.keysHandler)
+	mux.HandleFunc("/admin/namespaces", server.namespacesHandler)
+	mux.HandleFunc("/metrics", server.metricsHandler)
+	mux.HandleFunc("/raft/", server.raftHandler)
+	mux.HandleFunc("/replication/", server.replicationHandler)
+	mux.HandleFunc("/quorum/", server.quorumHandler)
 	return server
 }
 
+// ServeHTTP makes the server usable as a plain http.Handler, for tests or to
+// mount it in a bigger mux.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	name, r, err := splitNamespace(r)
+	if err == nil {
+		r, err = s.withConsistency(r)
+	}
+
+	// Requests are counted by route rather than by path, anything that
+	// doesn't match a route is "other" so scanners can't blow up /metrics.
+	// The namespace is not part of it.
+	endpoint := "other"
+	if _, pattern := s.mux.Handler(r); pattern != "" {
+		endpoint = pattern
+	}
+	if err != nil {
+		http.Error(rec, err.Error(), http.StatusBadRequest)
+	} else if r, ok := s.authenticate(rec, r); ok {
+		s.serveNamespace(rec, r, name)
+	}
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	s.metrics.observe(endpoint, rec.code, time.Since(start))
+}
+
+// Start serves on the address the server was made with, until Shutdown.
+// It returns ErrServerClosed after a Shutdown.
 func (s *Server) Start() error {
-	log.Printf("Server running at: %s\n", s.addr)
-	// TODO: Consider implementing TLS support with http.ListenAndServeTLS
-	return http.ListenAndServe(s.addr, s.mux)
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if s.opts.TLS != nil {
+		log.Printf("Server running at: %s (TLS)\n", s.addr)
+	} else {
+		log.Printf("Server running at: %s\n", s.addr)
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Shutdown. With TLS it fails right
+// away if the certificate or the CAs don't load.
+func (s *Server) Serve(l net.Listener) error {
+	if s.opts.TLS == nil {
+		return s.http.Serve(l)
+	}
+	reloader, err := newTLSReloader(*s.opts.TLS)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	s.http.TLSConfig = reloader.tlsConfig()
+	return s.http.ServeTLS(l, "", "")
+}
+
+// Shutdown stops accepting connections and waits for the requests in flight
+// to finish, like http.Server.Shutdown. If ctx runs out first, the requests
+// still running have their contexts cancelled (the stores roll back a
+// cancelled BatchUpdate) and their connections closed, and Shutdown waits
+// for their handlers to return before it returns ctx.Err(). Either way, the
+// store is left alone, closing it is up to the caller.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainOnce.Do(func() { close(s.draining) })
+	err := s.http.Shutdown(ctx)
+	s.cancel()
+	if err != nil {
+		s.http.Close()
+		s.inflight.Wait()
+	}
+	return err
 }
 
 type Response struct {
 	Value interface{} `json:"value"`
 }
 
+// getHandler sends the version of the value as its ETag when the store keeps
+// versions, and answers If-None-Match with a 304 so clients can cache.
 func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
-	value, err := s.db.Get(key)
+	if !s.allowed(w, r, PermRead, key) {
+		return
+	}
+	db := s.store(r)
+	versioned, ok := db.(VersionedStore)
+	if !ok {
+		value, err := db.Get(key)
+		if err != nil {
+			if unavailable(w, err) {
+				return
+			}
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Response{Value: value})
+		return
+	}
+
+	v, err := versioned.GetVersioned(key)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if ifMatch(r).check(&v) != nil {
+		http.Error(w, ErrPreconditionFailed.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	setVersionHeaders(w, v)
+	if ifNoneMatch(r).check(&v) != nil {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-	resp := Response{Value: value}
+	resp := Response{Value: v.Value}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// setRequest is the body of /set. TTL is in seconds, leaving it out (or 0)
+// stores the key without an expiry.
+type setRequest struct {
+	Pair
+	TTL float64 `json:"ttl,omitempty"`
+}
+
 func (s *Server) setHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var kv Pair
+	var kv setRequest
 	err := json.NewDecoder(r.Body).Decode(&kv)
 	r.Body.Close()
-	if err != nil {
+	if err != nil || kv.TTL < 0 {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	if !s.allowed(w, r, PermWrite, kv.Key) {
+		return
+	}
+
+	cond, conditional := requestPrecondition(r)
+	db := s.store(r)
+	versioned, isVersioned := db.(VersionedStore)
+	if conditional && !isVersioned {
+		http.Error(w, "If-Match and If-None-Match not supported by this store", http.StatusNotImplemented)
+		return
+	}
+
+	if isVersioned {
+		var v Versioned
+		if kv.TTL > 0 {
+			v, err = versioned.PutIfWithTTL(kv.Key, kv.Value, time.Duration(kv.TTL*float64(time.Second)), cond)
+		} else {
+			v, err = versioned.PutIf(kv.Key, kv.Value, cond)
+		}
+		if err != nil {
+			conditionalError(w, err)
+			return
+		}
+		setVersionHeaders(w, v)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
 
-	if err := s.db.Put(kv.Key, kv.Value); err != nil {
+	if kv.TTL > 0 {
+		ttlStore, ok := db.(TTLStore)
+		if !ok {
+			http.Error(w, "TTLs not supported by this store", http.StatusBadRequest)
+			return
+		}
+		err = ttlStore.PutWithTTL(kv.Key, kv.Value, time.Duration(kv.TTL*float64(time.Second)))
+	} else {
+		err = db.Put(kv.Key, kv.Value)
+	}
+	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		if err == ErrKVFull {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -83,12 +318,39 @@ func (s *Server) updateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	if !s.allowed(w, r, PermWrite, kv.Key) {
+		return
+	}
 
-	if err := s.db.Update(kv.Key, kv.Value); err != nil {
+	cond, conditional := requestPrecondition(r)
+	db := s.store(r)
+	if versioned, ok := db.(VersionedStore); ok {
+		v, err := versioned.UpdateIf(kv.Key, kv.Value, cond)
+		if err != nil {
+			conditionalError(w, err)
+			return
+		}
+		setVersionHeaders(w, v)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if conditional {
+		http.Error(w, "If-Match and If-None-Match not supported by this store", http.StatusNotImplemented)
+		return
+	}
+
+	if err := db.Update(kv.Key, kv.Value); err != nil {
+		if unavailable(w, err) {
+			return
+		}
 		if err, ok := err.(*notFoundError); ok && err != nil {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
 		}
+		if err == ErrKVFull {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -114,21 +376,36 @@ func (s *Server) updateBulkHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	keys := make([]string, len(kvs))
+	for i, kv := range kvs {
+		keys[i] = kv.Key
+	}
+	if !s.allowed(w, r, PermWrite|PermBulk, keys...) {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), s.opts.BatchTimeout)
 	defer cancel()
 
-	updatedKeys, err := s.db.BatchUpdate(ctx, kvs)
+	updatedKeys, err := s.store(r).BatchUpdate(ctx, kvs)
 	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		if err == ErrKVFull {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
+	// A partial update still says which pairs made it, otherwise the client
+	// has no idea what to retry.
 	if len(updatedKeys) != len(kvs) {
-		http.Error(w, "Partial update", http.StatusPartialContent)
-		return
+		w.WriteHeader(http.StatusPartialContent)
 	} else {
 		w.WriteHeader(http.StatusOK)
 	}
@@ -144,10 +421,516 @@ func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	key := r.URL.Query().Get("key")
-	if err := s.db.Delete(key); err != nil {
+	if !s.allowed(w, r, PermDelete, key) {
+		return
+	}
+	db := s.store(r)
+	cond, conditional := requestPrecondition(r)
+	if conditional {
+		versioned, ok := db.(VersionedStore)
+		if !ok {
+			http.Error(w, "If-Match and If-None-Match not supported by this store", http.StatusNotImplemented)
+			return
+		}
+		// If the precondition passed for a key that does not exist, it is
+		// already as deleted as it gets.
+		if err := versioned.DeleteIf(key, cond); err != nil && !isNotFound(err) {
+			conditionalError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// Some stores (the cache) say when the key wasn't there. Over HTTP a
+	// missing key is already deleted, whatever the store.
+	if err := db.Delete(key); err != nil && !isNotFound(err) {
+		if unavailable(w, err) {
+			return
+		}
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// conditionalStore returns the store as a ConditionalStore, or answers with a
+// 501 and returns false if it isn't one.
+func (s *Server) conditionalStore(w http.ResponseWriter, r *http.Request) (ConditionalStore, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	store, ok := s.store(r).(ConditionalStore)
+	if !ok {
+		http.Error(w, "Conditional operations not supported by this store", http.StatusNotImplemented)
+		return nil, false
+	}
+	return store, true
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// conditionalError maps the errors of the conditional operations to status
+// codes: 409 if the key exists when it should not, 412 if it holds something
+// other than expected.
+func conditionalError(w http.ResponseWriter, err error) {
+	switch err := err.(type) {
+	case *keyExistsError, *txnConflictError:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case *valueMismatchError, *preconditionFailedError:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case *notFoundError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case *kvFullError:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) putIfAbsentHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.conditionalStore(w, r)
+	if !ok {
+		return
+	}
+
+	var kv Pair
+	err := json.NewDecoder(r.Body).Decode(&kv)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(w, r, PermWrite, kv.Key) {
+		return
+	}
+
+	if err := store.PutIfAbsent(kv.Key, kv.Value); err != nil {
+		conditionalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getOrPutHandler answers 200 with the existing value, or 201 with the value
+// from the body if it was stored.
+func (s *Server) getOrPutHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.conditionalStore(w, r)
+	if !ok {
+		return
+	}
+
+	var kv Pair
+	err := json.NewDecoder(r.Body).Decode(&kv)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(w, r, PermRead|PermWrite, kv.Key) {
+		return
+	}
+
+	actual, loaded, err := store.GetOrPut(kv.Key, kv.Value)
+	if err != nil {
+		conditionalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !loaded {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(Response{Value: actual})
+}
+
+// compareRequest is the body of /compareAndSwap and /compareAndDelete, the
+// latter ignores New.
+type compareRequest struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+func (s *Server) compareAndSwapHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.conditionalStore(w, r)
+	if !ok {
+		return
+	}
+
+	var req compareRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(w, r, PermRead|PermWrite, req.Key) {
+		return
+	}
+
+	if err := store.CompareAndSwap(req.Key, req.Old, req.New); err != nil {
+		conditionalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) compareAndDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.conditionalStore(w, r)
+	if !ok {
+		return
+	}
+
+	var req compareRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !s.allowed(w, r, PermRead|PermDelete, req.Key) {
+		return
+	}
+
+	if err := store.CompareAndDelete(req.Key, req.Old); err != nil {
+		conditionalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// txnRequest is the body of /txn. All the conditions are checked and all the
+// operations run in one transaction, against the same snapshot.
+type txnRequest struct {
+	Conditions []txnCondition `json:"conditions"`
+	Operations []txnOperation `json:"operations"`
+}
+
+// txnCondition is a check on one key. Every field that is set has to hold:
+// the key has the given version, it does (or does not) exist, and it holds
+// the given value (compared like /compareAndSwap does).
+type txnCondition struct {
+	Key     string          `json:"key"`
+	Version *uint64         `json:"version,omitempty"`
+	Exists  *bool           `json:"exists,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+}
+
+func (c txnCondition) precondition() (Precondition, error) {
+	var value interface{}
+	if c.Value != nil {
+		if err := json.Unmarshal(c.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+	return func(current *Versioned) error {
+		if c.Exists != nil && *c.Exists != (current != nil) {
+			return ErrPreconditionFailed
+		}
+		if c.Version != nil && (current == nil || current.Version != *c.Version) {
+			return ErrPreconditionFailed
+		}
+		if c.Value != nil && (current == nil || !valuesEqual(current.Value, value)) {
+			return ErrPreconditionFailed
+		}
+		return nil
+	}, nil
+}
+
+// txnOperation is one of get, put or delete.
+type txnOperation struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+var txnPermissions = map[string]Permission{"get": PermRead, "put": PermWrite, "delete": PermDelete}
+
+// txnResult is what a get in a transaction returned.
+type txnResult struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Found bool        `json:"found"`
+}
+
+// txnHandler answers 412 if a condition fails and 409 if another write got in
+// first, in which case the whole request can be retried. Otherwise it returns
+// the results of the gets, in order.
+func (s *Server) txnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	store, ok := s.store(r).(TxnStore)
+	if !ok {
+		http.Error(w, "Transactions not supported by this store", http.StatusNotImplemented)
+		return
+	}
+
+	var req txnRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	conds := make([]Precondition, len(req.Conditions))
+	for i, c := range req.Conditions {
+		if conds[i], err = c.precondition(); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, c := range req.Conditions {
+		if !s.allowed(w, r, PermRead|PermBulk, c.Key) {
+			return
+		}
+	}
+	for _, op := range req.Operations {
+		perm, ok := txnPermissions[op.Op]
+		if !ok {
+			http.Error(w, "Unknown operation "+op.Op, http.StatusBadRequest)
+			return
+		}
+		if !s.allowed(w, r, perm|PermBulk, op.Key) {
+			return
+		}
+	}
+
+	txn := store.Begin()
+	defer txn.Rollback()
+	for i, c := range req.Conditions {
+		if err := txn.Check(c.Key, conds[i]); err != nil {
+			conditionalError(w, err)
+			return
+		}
+	}
+	results := make([]txnResult, 0)
+	for _, op := range req.Operations {
+		var err error
+		switch op.Op {
+		case "get":
+			var value interface{}
+			value, err = txn.Get(op.Key)
+			found := err == nil
+			if isNotFound(err) {
+				err = nil
+			}
+			results = append(results, txnResult{Key: op.Key, Value: value, Found: found})
+		case "put":
+			err = txn.Put(op.Key, op.Value)
+		case "delete":
+			err = txn.Delete(op.Key)
+		}
+		if err != nil {
+			conditionalError(w, err)
+			return
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		conditionalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// ttlHandler returns the remaining TTL of a key in seconds, -1 if it has none.
+func (s *Server) ttlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ttlStore, ok := s.store(r).(TTLStore)
+	if !ok {
+		http.Error(w, "TTLs not supported by this store", http.StatusNotImplemented)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if !s.allowed(w, r, PermRead, key) {
+		return
+	}
+	ttl, err := ttlStore.TTL(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	seconds := float64(-1)
+	if ttl != NoExpiry {
+		seconds = ttl.Seconds()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Value: seconds})
+}
+
+// snapshotHandler streams a snapshot of the store. If the store fails halfway
+// through we have already sent a 200, but the snapshot trailer will be missing
+// so the result can never be restored by accident.
+func (s *Server) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshotter, ok := s.store(r).(Snapshotter)
+	if !ok {
+		http.Error(w, "Snapshots not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	if !s.allowedPrefix(w, r, PermRead, "") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="kv.snapshot"`)
+	if err := snapshotter.Snapshot(w); err != nil {
+		log.Printf("snapshot failed: %v", err)
+	}
+}
+
+func (s *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshotter, ok := s.store(r).(Snapshotter)
+	if !ok {
+		http.Error(w, "Snapshots not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	// A restore replaces everything, whatever is in the snapshot.
+	if !s.allowedPrefix(w, r, PermWrite|PermDelete|PermBulk, "") {
+		return
+	}
+
+	err := snapshotter.Restore(r.Body)
+	r.Body.Close()
+	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		if err == ErrKVFull {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if errors.Is(err, errBadSnapshot) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// cacheStatsHandler reports hits, misses and evictions of the cache store so
+// eviction policies can be compared on real traffic.
+func (s *Server) cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cache, ok := s.store(r).(interface{ Stats() CacheStats })
+	if !ok {
+		http.Error(w, "Not a cache", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cache.Stats())
+}
+
+// statsHandler returns whatever the store can tell about itself: the number
+// of keys if it can list them, and the cache stats if it is a cache.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	db := s.store(r)
+	stats := make(map[string]interface{})
+	if lister, ok := db.(KeyLister); ok {
+		keys, err := lister.Keys()
+		if err != nil {
+			if unavailable(w, err) {
+				return
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		stats["keys"] = len(keys)
+	}
+	if cache, ok := db.(interface{ Stats() CacheStats }); ok {
+		cs := cache.Stats()
+		stats["hits"] = cs.Hits
+		stats["misses"] = cs.Misses
+		stats["evictions"] = cs.Evictions
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// keysHandler lists the keys starting with ?prefix= in order, at most ?limit=
+// of them if it is set.
+func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lister, ok := s.store(r).(KeyLister)
+	if !ok {
+		http.Error(w, "Listing keys not supported by this store", http.StatusNotImplemented)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if !s.allowedPrefix(w, r, PermRead, prefix) {
+		return
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	all, err := lister.Keys()
+	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	keys := make([]string, 0)
+	for _, key := range all {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Value: keys})
+}
@@ -0,0 +1,24 @@
+package kv
+
+import "context"
+
+// Identity is who a request comes from, for authorization decisions.
+type Identity struct {
+	Name string
+	// Method is how the identity was established: "tls" for a client
+	// certificate, "apikey" or "token".
+	Method string
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity of the request ctx belongs to,
+// if it has one.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+func withIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
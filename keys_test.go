@@ -0,0 +1,84 @@
+package kv
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"map":     func(t *testing.T) Store { return NewWriteOptimizedMapStore(1, true, 1000) },
+		"lru":     func(t *testing.T) Store { return NewLRUCacheStore(1000) },
+		"syncmap": func(t *testing.T) Store { return NewShardedSyncMapStore() },
+		"bitcask": func(t *testing.T) Store {
+			b, err := OpenBitcaskStore(t.TempDir(), BitcaskOptions{Fsync: FsyncNever})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { b.Close() })
+			return b
+		},
+		"lsm": func(t *testing.T) Store {
+			// Small memtables, so some keys end up in tables.
+			l, err := OpenLSMStore(t.TempDir(), testLSMOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			return l
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			var want []string
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%03d", i)
+				s.Put(key, strings.Repeat("x", 20))
+				if i%10 == 0 {
+					s.Delete(key)
+				} else {
+					want = append(want, key)
+				}
+			}
+
+			keys, err := s.(KeyLister).Keys()
+			if err != nil {
+				t.Fatalf("Keys returned an error: %v", err)
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(want, ",") {
+				t.Errorf("Expected %d keys, got %d: %v", len(want), len(keys), keys)
+			}
+		})
+	}
+}
+
+func TestKeys_HTTP(t *testing.T) {
+	store := NewLRUCacheStore(100)
+	for _, k := range []string{"b", "a2", "a1", "c"} {
+		store.Put(k, 1)
+	}
+	store.Get("a1")
+	store.Get("missing")
+	server := NewHTTPServer(store, "")
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return strings.TrimSpace(rec.Body.String())
+	}
+
+	if got := get("/admin/keys"); got != `{"value":["a1","a2","b","c"]}` {
+		t.Errorf("Unexpected /admin/keys: %s", got)
+	}
+	if got := get("/admin/keys?prefix=a&limit=1"); got != `{"value":["a1"]}` {
+		t.Errorf("Unexpected /admin/keys with a prefix and limit: %s", got)
+	}
+	if got := get("/admin/stats"); got != `{"evictions":0,"hits":1,"keys":4,"misses":1}` {
+		t.Errorf("Unexpected /admin/stats: %s", got)
+	}
+}
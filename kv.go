@@ -1,6 +1,9 @@
 package kv
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // Pair is just a quick representation of KV for batch puts
 type Pair struct {
@@ -25,3 +28,26 @@ type Store interface {
 	// thought process.
 	// BatchUpdateAsync(pairs []Pair) error
 }
+
+// NoExpiry is what TTL returns for keys that never expire.
+const NoExpiry time.Duration = -1
+
+// TTLStore is implemented by stores whose keys can expire.
+type TTLStore interface {
+	Store
+	// PutWithTTL is Put, except that the key expires after ttl. A plain Put of
+	// the same key clears the TTL again, an Update keeps it.
+	PutWithTTL(key string, value interface{}, ttl time.Duration) error
+	// TTL returns how long key has left, or NoExpiry if it does not expire.
+	TTL(key string) (time.Duration, error)
+	// Expire gives key a new TTL, or takes it away if ttl is 0, without
+	// touching the value. It is a write all the same, the key gets a new
+	// version. It returns a notFoundError if key does not exist.
+	Expire(key string, ttl time.Duration) error
+}
+
+// KeyLister is implemented by the stores that can list their keys, for
+// /admin/keys. Keys come back in no particular order.
+type KeyLister interface {
+	Keys() ([]string, error)
+}
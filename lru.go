@@ -1,21 +1,62 @@
 package kv
 
 import (
-	"container/list"
 	"context"
+	"io"
 	"sync"
+	"time"
 )
 
 type entry struct {
 	key   string
 	value interface{}
+	// expireAt is the zero time for entries without a TTL.
+	expireAt time.Time
+	// cost is only set in a weighted cache.
+	cost int64
+	// version and modified change on every write.
+	version  uint64
+	modified time.Time
+}
+
+func (e *entry) versioned() *Versioned {
+	return &Versioned{Value: e.value, Version: e.version, Modified: e.modified}
 }
 
 type lru struct {
-	mu         sync.RWMutex
-	ll         *list.List
-	elementMap map[string]*list.Element
-	size       int
+	mu     sync.RWMutex
+	items  map[string]*entry
+	policy EvictionPolicy
+	size   int
+	exp    expirer
+	stats  CacheStats
+
+	// maxBytes replaces size as the limit when it is set, see
+	// NewWeightedCacheStore. used is the sum of the cost of every entry.
+	maxBytes int64
+	used     int64
+	sizer    Sizer
+
+	// version is the last version handed out.
+	version uint64
+
+	// storeMetrics counts operations for /metrics, stats is what the
+	// eviction policies are judged by.
+	storeMetrics
+}
+
+// touch gives e the next version. Must be called with the lock held.
+func (l *lru) touch(e *entry) {
+	l.version++
+	e.version = l.version
+	e.modified = time.Now()
+}
+
+// CacheStats is there to compare eviction policies on real traffic.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
 }
 
 // This is an LRU cache implementation of the KVStore interface.
@@ -23,70 +64,355 @@ type lru struct {
 // A good time to use this implementation is as a cache where it is okay
 // to lose data.
 func NewLRUCacheStore(size int) *lru {
-	return &lru{
-		ll:         list.New(),
-		size:       size,
-		elementMap: make(map[string]*list.Element),
+	return NewCacheStore(size, NewLRUPolicy())
+}
+
+// NewCacheStore is the same cache with a different eviction policy, see
+// NewEvictionPolicy.
+func NewCacheStore(size int, policy EvictionPolicy) *lru {
+	l := &lru{
+		size:   size,
+		items:  make(map[string]*entry),
+		policy: policy,
+	}
+	l.exp = newExpirer(l.removeExpired)
+	return l
+}
+
+// NewWeightedCacheStore limits the cache to maxBytes worth of keys and
+// values, as measured by sizer (DefaultSizer if nil), instead of to a number
+// of keys. It evicts until it is back under budget, however many keys that
+// takes. A single value bigger than the whole cache is refused with
+// ErrKVFull rather than flushing everything else out for nothing.
+func NewWeightedCacheStore(maxBytes int64, sizer Sizer, policy EvictionPolicy) *lru {
+	if sizer == nil {
+		sizer = DefaultSizer
+	}
+	l := NewCacheStore(0, policy)
+	l.maxBytes = maxBytes
+	l.sizer = sizer
+	return l
+}
+
+func (l *lru) weighted() bool {
+	return l.sizer != nil
+}
+
+func (l *lru) cost(key string, value interface{}) int64 {
+	if !l.weighted() {
+		return 0
+	}
+	return l.sizer(key, value)
+}
+
+func (l *lru) full() bool {
+	if l.weighted() {
+		return l.used > l.maxBytes
+	}
+	return len(l.items) > l.size
+}
+
+// lookup returns the entry of key, removing it first if it has expired.
+// Must be called with the lock held.
+func (l *lru) lookup(key string) (*entry, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	if l.exp.expired(e.expireAt) {
+		l.remove(key)
+		return nil, false
+	}
+	return e, true
+}
+
+// remove drops key from the cache and the policy. Must be called with the
+// lock held.
+func (l *lru) remove(key string) {
+	l.used -= l.items[key].cost
+	delete(l.items, key)
+	l.policy.Remove(key)
+}
+
+func (l *lru) removeExpired(keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		l.lookup(key)
 	}
 }
 
+// Close stops the expiry of keys with a TTL.
+func (l *lru) Close() error {
+	l.exp.stop()
+	return nil
+}
+
+// Stats returns the hits, misses and evictions since the cache was created.
+func (l *lru) Stats() CacheStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.stats
+}
+
 func (l *lru) Get(key string) (interface{}, error) {
+	v, err := l.GetVersioned(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.Value, nil
+}
+
+func (l *lru) GetVersioned(key string) (_ Versioned, err error) {
+	defer func() { l.observe(opGet, err) }()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	elem, ok := l.elementMap[key]
+	e, ok := l.lookup(key)
+	if !ok {
+		l.stats.Misses++
+		return Versioned{}, newNotFoundError(key)
+	}
+	l.stats.Hits++
+	l.policy.Access(key)
+	return *e.versioned(), nil
+}
+
+// current returns the versioned value of key, nil if it does not exist. Must
+// be called with the lock held.
+func (l *lru) current(key string) *Versioned {
+	e, ok := l.lookup(key)
 	if !ok {
-		return nil, newNotFoundError(key)
+		return nil
+	}
+	return e.versioned()
+}
+
+func (l *lru) PutIf(key string, value interface{}, cond Precondition) (Versioned, error) {
+	return l.putIf(key, value, time.Time{}, cond)
+}
+
+func (l *lru) PutIfWithTTL(key string, value interface{}, ttl time.Duration, cond Precondition) (Versioned, error) {
+	return l.putIf(key, value, l.exp.expireAt(ttl), cond)
+}
+
+func (l *lru) putIf(key string, value interface{}, expireAt time.Time, cond Precondition) (_ Versioned, err error) {
+	defer func() { l.observe(opPut, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := cond.check(l.current(key)); err != nil {
+		return Versioned{}, err
+	}
+	if err := l.putLocked(key, value, expireAt); err != nil {
+		return Versioned{}, err
+	}
+	// A W-TinyLFU cache can turn the new key away right away, in which case
+	// there is nothing to return a version of. That still counts as success,
+	// same as a Put that gets evicted.
+	if current := l.current(key); current != nil {
+		return *current, nil
 	}
-	l.ll.MoveToFront(elem)
-	return elem.Value.(*entry).value, nil
+	return Versioned{Value: value}, nil
+}
+
+func (l *lru) UpdateIf(key string, value interface{}, cond Precondition) (_ Versioned, err error) {
+	defer func() { l.observe(opUpdate, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.lookup(key)
+	if !ok {
+		return Versioned{}, newNotFoundError(key)
+	}
+	if err := cond.check(e.versioned()); err != nil {
+		return Versioned{}, err
+	}
+	if err := l.updateLocked(e, value); err != nil {
+		return Versioned{}, err
+	}
+	return *e.versioned(), nil
+}
+
+func (l *lru) DeleteIf(key string, cond Precondition) (err error) {
+	defer func() { l.observe(opDelete, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.current(key)
+	if err := cond.check(current); err != nil {
+		return err
+	}
+	if current == nil {
+		return newNotFoundError(key)
+	}
+	l.remove(key)
+	return nil
 }
 
 func (l *lru) Put(key string, value interface{}) error {
+	return l.put(key, value, time.Time{})
+}
+
+func (l *lru) PutWithTTL(key string, value interface{}, ttl time.Duration) error {
+	return l.put(key, value, l.exp.now().Add(ttl))
+}
+
+func (l *lru) put(key string, value interface{}, expireAt time.Time) (err error) {
+	defer func() { l.observe(opPut, err) }()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.putLocked(key, value, expireAt)
+}
 
-	if elem, ok := l.elementMap[key]; ok {
-		l.ll.MoveToFront(elem)
-		elem.Value.(*entry).value = value
+func (l *lru) putLocked(key string, value interface{}, expireAt time.Time) error {
+	cost := l.cost(key, value)
+	if l.weighted() && cost > l.maxBytes {
+		return ErrKVFull
+	}
+
+	if !expireAt.IsZero() {
+		l.exp.schedule(key, expireAt)
+	}
+
+	if e, ok := l.items[key]; ok {
+		l.policy.Access(key)
+		e.value = value
+		e.expireAt = expireAt
+		l.used += cost - e.cost
+		e.cost = cost
+		l.touch(e)
+		l.evict()
 		return nil
 	}
 
-	if len(l.elementMap) >= l.size {
-		l.evictLRU()
+	e := &entry{key: key, value: value, expireAt: expireAt, cost: cost}
+	l.touch(e)
+	l.items[key] = e
+	l.used += cost
+	l.policy.Insert(key)
+	l.evict()
+	return nil
+}
+
+func (l *lru) TTL(key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.lookup(key)
+	if !ok {
+		return 0, newNotFoundError(key)
+	}
+	return l.exp.remaining(e.expireAt), nil
+}
+
+func (l *lru) Expire(key string, ttl time.Duration) (err error) {
+	defer func() { l.observe(opUpdate, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.lookup(key)
+	if !ok {
+		return newNotFoundError(key)
 	}
+	return l.putLocked(key, e.value, l.exp.expireAt(ttl))
+}
 
-	elem := l.ll.PushFront(&entry{key: key, value: value})
-	l.elementMap[key] = elem
+func (l *lru) Delete(key string) (err error) {
+	defer func() { l.observe(opDelete, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.lookup(key); !ok {
+		return newNotFoundError(key)
+	}
+	l.remove(key)
 	return nil
 }
 
-func (l *lru) Delete(key string) error {
+func (l *lru) Update(key string, value interface{}) (err error) {
+	defer func() { l.observe(opUpdate, err) }()
+	return l.update(key, value)
+}
+
+// update is Update without counting it, for BatchUpdate.
+func (l *lru) update(key string, value interface{}) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	elem, ok := l.elementMap[key]
+	e, ok := l.lookup(key)
 	if !ok {
 		return newNotFoundError(key)
 	}
-	l.ll.Remove(elem)
-	delete(l.elementMap, key)
+	return l.updateLocked(e, value)
+}
+
+func (l *lru) updateLocked(e *entry, value interface{}) error {
+	cost := l.cost(e.key, value)
+	if l.weighted() && cost > l.maxBytes {
+		return ErrKVFull
+	}
+	e.value = value
+	l.used += cost - e.cost
+	e.cost = cost
+	l.touch(e)
+	l.policy.Access(e.key)
+	l.evict()
 	return nil
 }
 
-func (l *lru) Update(key string, value interface{}) error {
+func (l *lru) PutIfAbsent(key string, value interface{}) (err error) {
+	defer func() { l.observe(opPut, err) }()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if _, ok := l.lookup(key); ok {
+		return ErrKeyExists
+	}
+	return l.putLocked(key, value, time.Time{})
+}
 
-	elem, ok := l.elementMap[key]
+func (l *lru) CompareAndSwap(key string, old, new interface{}) (err error) {
+	defer func() { l.observe(opUpdate, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.lookup(key)
+	if !ok {
+		return newNotFoundError(key)
+	}
+	if !valuesEqual(e.value, old) {
+		return ErrValueMismatch
+	}
+	return l.updateLocked(e, new)
+}
+
+func (l *lru) CompareAndDelete(key string, old interface{}) (err error) {
+	defer func() { l.observe(opDelete, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.lookup(key)
 	if !ok {
 		return newNotFoundError(key)
 	}
-	elem.Value.(*entry).value = value
-	l.ll.MoveToFront(elem)
+	if !valuesEqual(e.value, old) {
+		return ErrValueMismatch
+	}
+	l.remove(key)
 	return nil
 }
 
-func (l *lru) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+// GetOrPut counts as a hit when the key exists and a miss when it doesn't.
+func (l *lru) GetOrPut(key string, value interface{}) (_ interface{}, _ bool, err error) {
+	defer func() { l.observe(opPut, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.lookup(key); ok {
+		l.stats.Hits++
+		l.policy.Access(key)
+		return e.value, true, nil
+	}
+	l.stats.Misses++
+	if err := l.putLocked(key, value, time.Time{}); err != nil {
+		return nil, false, err
+	}
+	return value, false, nil
+}
+
+func (l *lru) BatchUpdate(ctx context.Context, pairs []Pair) (_ []Pair, err error) {
+	defer func() { l.observeBatch(len(pairs), err) }()
 	updatedPairs := make([]Pair, 0)
 
 	for _, pair := range pairs {
@@ -94,7 +420,7 @@ func (l *lru) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
 		case <-ctx.Done():
 			return nil, ctx.Err()
 		default:
-			if err := l.Update(pair.Key, pair.Value); err != nil {
+			if err := l.update(pair.Key, pair.Value); err != nil {
 				if err, ok := err.(*notFoundError); ok && err != nil {
 					continue
 				}
@@ -107,11 +433,111 @@ func (l *lru) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
 	return updatedPairs, nil
 }
 
-func (l *lru) evictLRU() {
-	elem := l.ll.Back()
-	if elem == nil {
-		return
+// evict asks the policy for victims until the cache fits again. Must be
+// called with the lock held.
+func (l *lru) evict() {
+	for l.full() {
+		key, ok := l.policy.Victim()
+		if !ok {
+			return
+		}
+		l.used -= l.items[key].cost
+		delete(l.items, key)
+		l.stats.Evictions++
+	}
+}
+
+// Len is the number of keys, counting the expired ones that have not been
+// collected yet.
+func (l *lru) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.items)
+}
+
+func (l *lru) Keys() ([]string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	keys := make([]string, 0, len(l.items))
+	for key, e := range l.items {
+		if !l.exp.expired(e.expireAt) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Snapshot writes the entries most recently used first when the policy can
+// tell (only LRU can), so that a Restore into a smaller cache keeps the ones
+// that matter.
+func (l *lru) Snapshot(w io.Writer) error {
+	l.mu.RLock()
+	var keys []string
+	if p, ok := l.policy.(*lruPolicy); ok {
+		keys = p.keys()
+	} else {
+		keys = make([]string, 0, len(l.items))
+		for key := range l.items {
+			keys = append(keys, key)
+		}
 	}
-	l.ll.Remove(elem)
-	delete(l.elementMap, elem.Value.(*entry).key)
+	entries := make([]entry, 0, len(keys))
+	for _, key := range keys {
+		if e := l.items[key]; !l.exp.expired(e.expireAt) {
+			entries = append(entries, *e)
+		}
+	}
+	l.mu.RUnlock()
+
+	sw, err := newSnapshotWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := sw.add(e.key, e.value, e.expireAt); err != nil {
+			return err
+		}
+	}
+	return sw.close()
+}
+
+func (l *lru) Restore(r io.Reader) error {
+	var entries []*entry
+	var used int64
+	items := make(map[string]*entry)
+	err := readSnapshot(r, func(key string, value interface{}, expireAt time.Time) error {
+		if _, ok := items[key]; ok {
+			return nil
+		}
+		cost := l.cost(key, value)
+		if l.weighted() && used+cost > l.maxBytes || !l.weighted() && len(items) >= l.size {
+			return nil
+		}
+		used += cost
+		items[key] = &entry{key: key, value: value, expireAt: expireAt, cost: cost}
+		entries = append(entries, items[key])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key := range l.items {
+		l.policy.Remove(key)
+	}
+	l.items = items
+	l.used = used
+	for _, e := range entries {
+		l.touch(e)
+	}
+	// Backwards, so the first entry in the snapshot ends up the most recent.
+	for i := len(entries) - 1; i >= 0; i-- {
+		l.policy.Insert(entries[i].key)
+		if !entries[i].expireAt.IsZero() {
+			l.exp.schedule(entries[i].key, entries[i].expireAt)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,896 @@
+package kv
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is a log structured merge tree. Writes go to the write-ahead log and a
+// sorted in-memory memtable. Once the memtable is big enough it becomes
+// immutable and a background goroutine flushes it to an sstable in level 0.
+// Tables in level 0 can overlap each other, every level below that is made of
+// non-overlapping tables and is 10 times bigger than the one above. Leveled
+// compaction merges tables down a level once a level gets too big.
+//
+// A Get checks the memtable, the immutable memtable, level 0 from newest to
+// oldest and then one table per level. The first hit wins, because compaction
+// only ever moves data down, anything higher up is newer. The bloom filter of
+// every table means a miss usually never touches the disk.
+//
+// Deletes write tombstones, which only get dropped once they are compacted
+// into the lowest level that has data for their key range.
+
+const (
+	lsmMaxLevels    = 7
+	lsmManifestName = "MANIFEST"
+	lsmLogExt       = ".log"
+
+	defaultMemtableSize        = 4 << 20
+	defaultL0CompactionTrigger = 4
+	defaultLevelBaseSize       = 10 << 20
+	defaultTableSize           = 2 << 20
+	defaultBloomFPRate         = 0.01
+)
+
+// LSMOptions configures an LSM store. Zero values get sensible defaults.
+type LSMOptions struct {
+	// MemtableSize is roughly how many bytes of writes are buffered in memory
+	// before they get flushed to an sstable. Defaults to 4MB.
+	MemtableSize int64
+	// Fsync and FsyncInterval configure the write-ahead log of the memtable.
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+	// BatchedWritesCheckInterval controls how often BatchUpdate checks whether
+	// its context has been cancelled. Defaults to 1 (every pair).
+	BatchedWritesCheckInterval int
+	// L0CompactionTrigger is the number of level 0 tables that triggers a
+	// compaction into level 1. Defaults to 4.
+	L0CompactionTrigger int
+	// LevelBaseSize is the size of level 1. Every level below is 10 times
+	// bigger. Defaults to 10MB.
+	LevelBaseSize int64
+	// TableSize is the size of the tables compaction writes. Defaults to 2MB.
+	TableSize int64
+	// BloomFalsePositiveRate defaults to 1%.
+	BloomFalsePositiveRate float64
+}
+
+type lsmManifest struct {
+	NextID uint64     `json:"nextId"`
+	Levels [][]uint64 `json:"levels"`
+}
+
+var errLSMClosed = errors.New("kv: lsm store is closed")
+
+// LSM is a Store backed by a log structured merge tree on disk.
+type LSM struct {
+	mu   sync.RWMutex
+	cond *sync.Cond
+	dir  string
+	opts LSMOptions
+
+	mem      *memtable
+	wal      *WAL
+	walID    uint64
+	imm      *memtable
+	immWALID uint64
+
+	levels [lsmMaxLevels][]*sstable
+	// compactPointer remembers which table of each level got compacted last,
+	// so compactions take turns over the key space.
+	compactPointer [lsmMaxLevels]string
+	nextID         uint64
+	seq            uint64
+	closed         bool
+	// bgErr is set when a flush fails. Writes are refused from then on,
+	// because the memtable can no longer make room.
+	bgErr error
+
+	flushCh chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	storeMetrics
+}
+
+// OpenLSMStore opens (or creates) an LSM store in dir.
+func OpenLSMStore(dir string, opts LSMOptions) (*LSM, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = defaultMemtableSize
+	}
+	if opts.BatchedWritesCheckInterval <= 0 {
+		opts.BatchedWritesCheckInterval = 1
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = defaultL0CompactionTrigger
+	}
+	if opts.LevelBaseSize <= 0 {
+		opts.LevelBaseSize = defaultLevelBaseSize
+	}
+	if opts.TableSize <= 0 {
+		opts.TableSize = defaultTableSize
+	}
+	if opts.BloomFalsePositiveRate <= 0 || opts.BloomFalsePositiveRate >= 1 {
+		opts.BloomFalsePositiveRate = defaultBloomFPRate
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	l := &LSM{
+		dir:     dir,
+		opts:    opts,
+		flushCh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	if err := l.load(); err != nil {
+		l.closeTables()
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.run()
+	return l, nil
+}
+
+func (l *LSM) tablePath(id uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d%s", id, sstableExt))
+}
+
+func (l *LSM) logPath(id uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d%s", id, lsmLogExt))
+}
+
+// filesWithExt returns the ids of the files in dir with the given extension.
+func (l *LSM) filesWithExt(ext string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(l.dir, "*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(names))
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (l *LSM) load() error {
+	var manifest lsmManifest
+	data, err := os.ReadFile(filepath.Join(l.dir, lsmManifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("kv: reading lsm manifest: %w", err)
+		}
+	}
+	l.nextID = manifest.NextID
+
+	live := make(map[uint64]bool)
+	for level, ids := range manifest.Levels {
+		if level >= lsmMaxLevels {
+			return fmt.Errorf("kv: lsm manifest has %d levels, at most %d are supported", len(manifest.Levels), lsmMaxLevels)
+		}
+		for _, id := range ids {
+			t, err := openSSTable(l.tablePath(id), id)
+			if err != nil {
+				return err
+			}
+			l.levels[level] = append(l.levels[level], t)
+			live[id] = true
+			if t.meta.MaxSeq > l.seq {
+				l.seq = t.meta.MaxSeq
+			}
+		}
+	}
+
+	// Tables that are not in the manifest are leftovers from a flush or a
+	// compaction that did not finish.
+	tables, err := l.filesWithExt(sstableExt)
+	if err != nil {
+		return err
+	}
+	for _, id := range tables {
+		if !live[id] {
+			os.Remove(l.tablePath(id))
+		}
+	}
+
+	// Every write-ahead log that is still around belongs to a memtable that
+	// never made it into a table. They get replayed into one memtable, which
+	// is flushed right away so we can start over with a single fresh log.
+	logs, err := l.filesWithExt(lsmLogExt)
+	if err != nil {
+		return err
+	}
+	for _, id := range append(tables, logs...) {
+		if id >= l.nextID {
+			l.nextID = id + 1
+		}
+	}
+	l.mem = newMemtable()
+	for _, id := range logs {
+		wal, err := OpenWAL(l.logPath(id), WALOptions{Fsync: FsyncNever})
+		if err != nil {
+			return err
+		}
+		err = wal.Replay(func(rec walRecord) error {
+			return l.applyToMemtable(rec)
+		})
+		wal.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if l.mem.len > 0 {
+		t, err := l.writeTables(l.mem.each, false, 0)
+		if err != nil {
+			return err
+		}
+		l.levels[0] = append(l.levels[0], t...)
+		if err := l.saveManifest(); err != nil {
+			return err
+		}
+		l.mem = newMemtable()
+	}
+	for _, id := range logs {
+		os.Remove(l.logPath(id))
+	}
+
+	return l.newLog()
+}
+
+// newLog starts a fresh write-ahead log for l.mem. Must be called with the
+// lock held.
+func (l *LSM) newLog() error {
+	id := l.nextID
+	l.nextID++
+	wal, err := OpenWAL(l.logPath(id), WALOptions{Fsync: l.opts.Fsync, FsyncInterval: l.opts.FsyncInterval})
+	if err != nil {
+		return err
+	}
+	l.wal, l.walID = wal, id
+	return nil
+}
+
+// saveManifest atomically replaces the manifest. Must be called with the
+// lock held.
+func (l *LSM) saveManifest() error {
+	manifest := lsmManifest{NextID: l.nextID, Levels: make([][]uint64, lsmMaxLevels)}
+	for level, tables := range l.levels {
+		manifest.Levels[level] = make([]uint64, 0, len(tables))
+		for _, t := range tables {
+			manifest.Levels[level] = append(manifest.Levels[level], t.id)
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.dir, lsmManifestName)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// applyToMemtable applies a logged mutation. Must be called with the lock
+// held (or before the store is shared).
+func (l *LSM) applyToMemtable(rec walRecord) error {
+	for _, pair := range rec.Pairs {
+		l.seq++
+		if rec.Op == walOpDelete {
+			l.mem.put(pair.Key, memEntry{seq: l.seq, tombstone: true})
+			continue
+		}
+		value, err := json.Marshal(pair.Value)
+		if err != nil {
+			return err
+		}
+		l.mem.put(pair.Key, memEntry{seq: l.seq, value: value})
+	}
+	return nil
+}
+
+// makeRoom makes sure the memtable can take a write, waiting for the
+// previous memtable to be flushed if this one is full. The wait releases the
+// lock, so every mutation calls it before it looks at anything, and then
+// keeps the lock until it has written. Must be called with the lock held.
+func (l *LSM) makeRoom() error {
+	for l.mem.size >= l.opts.MemtableSize {
+		if l.closed {
+			return errLSMClosed
+		}
+		if l.bgErr != nil {
+			return l.bgErr
+		}
+		if l.imm != nil {
+			// We are writing faster than we can flush. Stall until the
+			// flush is done.
+			l.cond.Wait()
+			continue
+		}
+		old, oldID := l.wal, l.walID
+		if err := l.newLog(); err != nil {
+			return err
+		}
+		if err := old.Close(); err != nil {
+			log.Printf("lsm: closing write-ahead log %d: %v", oldID, err)
+		}
+		l.imm, l.immWALID = l.mem, oldID
+		l.mem = newMemtable()
+		select {
+		case l.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	if l.closed {
+		return errLSMClosed
+	}
+	return nil
+}
+
+// write logs a mutation and applies it to the memtable. Must be called with
+// the lock held, after makeRoom.
+func (l *LSM) write(op walOp, pairs ...Pair) error {
+	rec := walRecord{Op: op, Pairs: pairs}
+	if err := l.wal.Append(rec); err != nil {
+		return err
+	}
+	return l.applyToMemtable(rec)
+}
+
+// lookup finds the newest entry for key. Must be called with at least the
+// read lock held.
+func (l *LSM) lookup(key string) (memEntry, bool, error) {
+	if e, ok := l.mem.get(key); ok {
+		return e, true, nil
+	}
+	if l.imm != nil {
+		if e, ok := l.imm.get(key); ok {
+			return e, true, nil
+		}
+	}
+
+	hash := bloomHash(key)
+	for i := len(l.levels[0]) - 1; i >= 0; i-- {
+		if e, ok, err := l.levels[0][i].get(key, hash); err != nil || ok {
+			return e, ok, err
+		}
+	}
+	for level := 1; level < lsmMaxLevels; level++ {
+		tables := l.levels[level]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].meta.MaxKey >= key })
+		if i == len(tables) {
+			continue
+		}
+		if e, ok, err := tables[i].get(key, hash); err != nil || ok {
+			return e, ok, err
+		}
+	}
+	return memEntry{}, false, nil
+}
+
+// exists must be called with at least the read lock held.
+func (l *LSM) exists(key string) (bool, error) {
+	e, ok, err := l.lookup(key)
+	return ok && !e.tombstone, err
+}
+
+func (l *LSM) Get(key string) (_ interface{}, err error) {
+	defer func() { l.observe(opGet, err) }()
+	l.mu.RLock()
+	e, ok, err := l.lookup(key)
+	l.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok || e.tombstone {
+		return nil, newNotFoundError(key)
+	}
+	var value interface{}
+	if err := json.Unmarshal(e.value, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Keys walks the memtables and every table, newest first, so the first entry
+// seen for a key says whether it is alive. It holds the read lock the whole
+// time, so writers wait for it. Fine for an admin endpoint, not for a hot path.
+func (l *LSM) Keys() ([]string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	alive := make(map[string]bool)
+	see := func(key string, e memEntry) error {
+		if _, seen := alive[key]; !seen {
+			alive[key] = !e.tombstone
+		}
+		return nil
+	}
+	l.mem.each(see)
+	if l.imm != nil {
+		l.imm.each(see)
+	}
+	for i := len(l.levels[0]) - 1; i >= 0; i-- {
+		if err := mergeTables(l.levels[0][i:i+1], see); err != nil {
+			return nil, err
+		}
+	}
+	for level := 1; level < lsmMaxLevels; level++ {
+		if err := mergeTables(l.levels[level], see); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]string, 0, len(alive))
+	for key, ok := range alive {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (l *LSM) Put(key string, value interface{}) (err error) {
+	defer func() { l.observe(opPut, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.makeRoom(); err != nil {
+		return err
+	}
+	return l.write(walOpPut, Pair{key, value})
+}
+
+func (l *LSM) Update(key string, value interface{}) (err error) {
+	defer func() { l.observe(opUpdate, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.makeRoom(); err != nil {
+		return err
+	}
+	exists, err := l.exists(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return newNotFoundError(key)
+	}
+	return l.write(walOpUpdate, Pair{key, value})
+}
+
+func (l *LSM) Delete(key string) (err error) {
+	defer func() { l.observe(opDelete, err) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.makeRoom(); err != nil {
+		return err
+	}
+	exists, err := l.exists(key)
+	if err != nil || !exists {
+		return err
+	}
+	return l.write(walOpDelete, Pair{Key: key})
+}
+
+// BatchUpdate figures out which keys exist first and then logs and applies
+// the whole batch as one write-ahead log record. A cancelled batch never
+// reaches the log, so there is nothing to roll back.
+func (l *LSM) BatchUpdate(ctx context.Context, pairs []Pair) (_ []Pair, err error) {
+	defer func() { l.observeBatch(len(pairs), err) }()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.makeRoom(); err != nil {
+		return nil, err
+	}
+
+	updatedPairs := make([]Pair, 0)
+	for i, pair := range pairs {
+		if i%l.opts.BatchedWritesCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		exists, err := l.exists(pair.Key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			updatedPairs = append(updatedPairs, pair)
+		}
+	}
+	if len(updatedPairs) == 0 {
+		return updatedPairs, nil
+	}
+	if err := l.write(walOpBatchUpdate, updatedPairs...); err != nil {
+		return nil, err
+	}
+	return updatedPairs, nil
+}
+
+func (l *LSM) run() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-l.flushCh:
+		}
+		if err := l.flush(); err != nil {
+			log.Printf("lsm: flushing memtable: %v", err)
+			l.mu.Lock()
+			l.bgErr = err
+			l.cond.Broadcast()
+			l.mu.Unlock()
+			continue
+		}
+		if err := l.compact(); err != nil {
+			// The tables involved are left alone, the next flush will
+			// try again.
+			log.Printf("lsm: compaction failed: %v", err)
+		}
+	}
+}
+
+// flush writes the immutable memtable to a level 0 table.
+func (l *LSM) flush() error {
+	l.mu.RLock()
+	imm, walID := l.imm, l.immWALID
+	l.mu.RUnlock()
+	if imm == nil {
+		return nil
+	}
+
+	// Nobody writes to imm any more, so it is safe to read it without the lock.
+	tables, err := l.writeTables(imm.each, false, 0)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.levels[0] = append(l.levels[0], tables...)
+	if err := l.saveManifest(); err != nil {
+		l.levels[0] = l.levels[0][:len(l.levels[0])-len(tables)]
+		l.mu.Unlock()
+		for _, t := range tables {
+			t.close()
+			os.Remove(t.path)
+		}
+		return err
+	}
+	l.imm = nil
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	os.Remove(l.logPath(walID))
+	return nil
+}
+
+// writeTables writes the entries produced by each into new tables, starting
+// a new table every maxSize bytes (zero means a single table). The entries
+// have to come in key order.
+func (l *LSM) writeTables(each func(func(string, memEntry) error) error, dropTombstones bool, maxSize int64) ([]*sstable, error) {
+	tables := make([]*sstable, 0)
+	var w *sstWriter
+	var id uint64
+
+	finish := func() error {
+		if w == nil {
+			return nil
+		}
+		if err := w.finish(); err != nil {
+			return err
+		}
+		w = nil
+		t, err := openSSTable(l.tablePath(id), id)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, t)
+		return nil
+	}
+	abort := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range tables {
+			t.close()
+			os.Remove(t.path)
+		}
+	}
+
+	err := each(func(key string, e memEntry) error {
+		if dropTombstones && e.tombstone {
+			return nil
+		}
+		if w != nil && maxSize > 0 && w.size() >= maxSize {
+			if err := finish(); err != nil {
+				return err
+			}
+		}
+		if w == nil {
+			l.mu.Lock()
+			id = l.nextID
+			l.nextID++
+			l.mu.Unlock()
+			var err error
+			if w, err = createSSTable(l.tablePath(id), l.opts.BloomFalsePositiveRate); err != nil {
+				return err
+			}
+		}
+		return w.add(key, e)
+	})
+	if err == nil {
+		err = finish()
+	}
+	if err != nil {
+		abort()
+		return nil, err
+	}
+	return tables, nil
+}
+
+func (l *LSM) maxLevelSize(level int) int64 {
+	size := l.opts.LevelBaseSize
+	for i := 1; i < level; i++ {
+		size *= 10
+	}
+	return size
+}
+
+// pickCompaction decides what to compact next. It returns the level being
+// compacted and the input tables (from that level and the one below), or -1
+// when there is nothing to do. Must be called with at least the read lock held.
+func (l *LSM) pickCompaction() (int, []*sstable) {
+	if len(l.levels[0]) >= l.opts.L0CompactionTrigger {
+		inputs := append([]*sstable{}, l.levels[0]...)
+		minKey, maxKey := keyRange(inputs)
+		return 0, append(inputs, overlapping(l.levels[1], minKey, maxKey)...)
+	}
+
+	for level := 1; level < lsmMaxLevels-1; level++ {
+		var size int64
+		for _, t := range l.levels[level] {
+			size += t.size
+		}
+		if size <= l.maxLevelSize(level) {
+			continue
+		}
+		tables := l.levels[level]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].meta.MinKey > l.compactPointer[level] })
+		if i == len(tables) {
+			i = 0
+		}
+		t := tables[i]
+		return level, append([]*sstable{t}, overlapping(l.levels[level+1], t.meta.MinKey, t.meta.MaxKey)...)
+	}
+	return -1, nil
+}
+
+func keyRange(tables []*sstable) (string, string) {
+	minKey, maxKey := tables[0].meta.MinKey, tables[0].meta.MaxKey
+	for _, t := range tables[1:] {
+		if t.meta.MinKey < minKey {
+			minKey = t.meta.MinKey
+		}
+		if t.meta.MaxKey > maxKey {
+			maxKey = t.meta.MaxKey
+		}
+	}
+	return minKey, maxKey
+}
+
+func overlapping(tables []*sstable, minKey, maxKey string) []*sstable {
+	result := make([]*sstable, 0)
+	for _, t := range tables {
+		if t.overlaps(minKey, maxKey) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// compact keeps compacting until every level is within its limits.
+func (l *LSM) compact() error {
+	for {
+		select {
+		case <-l.done:
+			return nil
+		default:
+		}
+
+		l.mu.RLock()
+		level, inputs := l.pickCompaction()
+		dropTombstones := false
+		if level >= 0 {
+			// Tombstones can go once nothing below the output level could
+			// still hold an older value for their keys.
+			minKey, maxKey := keyRange(inputs)
+			dropTombstones = true
+			for below := level + 2; below < lsmMaxLevels; below++ {
+				if len(overlapping(l.levels[below], minKey, maxKey)) > 0 {
+					dropTombstones = false
+				}
+			}
+		}
+		l.mu.RUnlock()
+		if level < 0 {
+			return nil
+		}
+
+		outputs, err := l.writeTables(func(fn func(string, memEntry) error) error {
+			return mergeTables(inputs, fn)
+		}, dropTombstones, l.opts.TableSize)
+		if err != nil {
+			return err
+		}
+
+		l.mu.Lock()
+		prev := [2][]*sstable{l.levels[level], l.levels[level+1]}
+		l.levels[level] = without(l.levels[level], inputs)
+		l.levels[level+1] = append(without(l.levels[level+1], inputs), outputs...)
+		sort.Slice(l.levels[level+1], func(i, j int) bool {
+			return l.levels[level+1][i].meta.MinKey < l.levels[level+1][j].meta.MinKey
+		})
+		if err := l.saveManifest(); err != nil {
+			l.levels[level], l.levels[level+1] = prev[0], prev[1]
+			l.mu.Unlock()
+			for _, t := range outputs {
+				t.close()
+				os.Remove(t.path)
+			}
+			return err
+		}
+		if level > 0 {
+			l.compactPointer[level] = inputs[0].meta.MaxKey
+		}
+		// Reads hold the read lock for as long as they use a table, so once
+		// we have the write lock nobody is reading the inputs any more.
+		for _, t := range inputs {
+			t.close()
+			os.Remove(t.path)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func without(tables []*sstable, remove []*sstable) []*sstable {
+	result := make([]*sstable, 0, len(tables))
+	for _, t := range tables {
+		removed := false
+		for _, r := range remove {
+			if t == r {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// mergeTables calls fn with the newest entry of every key across tables, in
+// key order.
+func mergeTables(tables []*sstable, fn func(string, memEntry) error) error {
+	h := make(sstHeap, 0, len(tables))
+	iters := make([]*sstIterator, 0, len(tables))
+	for _, t := range tables {
+		it := t.iter()
+		iters = append(iters, it)
+		if it.next() {
+			h = append(h, it)
+		}
+	}
+	heap.Init(&h)
+
+	last, first := "", true
+	for h.Len() > 0 {
+		it := h[0]
+		if first || it.key != last {
+			if err := fn(it.key, it.entry); err != nil {
+				return err
+			}
+			last, first = it.key, false
+		}
+		if it.next() {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	for _, it := range iters {
+		if it.err != nil {
+			return it.err
+		}
+	}
+	return nil
+}
+
+// sstHeap orders iterators by key and, for the same key, newest first.
+type sstHeap []*sstIterator
+
+func (h sstHeap) Len() int { return len(h) }
+func (h sstHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].entry.seq > h[j].entry.seq
+}
+func (h sstHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sstHeap) Push(x interface{}) { *h = append(*h, x.(*sstIterator)) }
+func (h *sstHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Close stops the background flushes and compactions and closes every file.
+// A memtable that has not been flushed yet is still in its write-ahead log
+// and gets replayed on the next open.
+func (l *LSM) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	close(l.done)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.wal.Close()
+	l.closeTables()
+	return err
+}
+
+func (l *LSM) closeTables() {
+	for level := range l.levels {
+		for _, t := range l.levels[level] {
+			t.close()
+		}
+		l.levels[level] = nil
+	}
+}
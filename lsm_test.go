@@ -0,0 +1,265 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Tiny sizes so a handful of writes exercise flushes and every level of compaction.
+var testLSMOptions = LSMOptions{
+	Fsync:               FsyncNever,
+	MemtableSize:        512,
+	L0CompactionTrigger: 2,
+	LevelBaseSize:       2048,
+	TableSize:           1024,
+}
+
+func openTestLSM(t *testing.T, dir string) *LSM {
+	t.Helper()
+	l, err := OpenLSMStore(dir, testLSMOptions)
+	if err != nil {
+		t.Fatalf("OpenLSMStore returned an error: %v", err)
+	}
+	return l
+}
+
+// waitForFlush waits for the background goroutine to finish flushing and
+// compacting, so tests can look at the tables it produced.
+func waitForFlush(t *testing.T, l *LSM) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.RLock()
+		level, _ := l.pickCompaction()
+		idle := l.imm == nil && len(l.flushCh) == 0 && level < 0
+		l.mu.RUnlock()
+		if idle {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the memtable to be flushed")
+}
+
+func TestLSM_GetPutUpdateDelete(t *testing.T) {
+	l := openTestLSM(t, t.TempDir())
+	defer l.Close()
+
+	l.Put("a", "1")
+	if value, err := l.Get("a"); err != nil || value != "1" {
+		t.Fatalf("Get(a) = %v, %v", value, err)
+	}
+	if err := l.Update("a", "2"); err != nil {
+		t.Fatalf("Update returned an error: %v", err)
+	}
+	if err := l.Update("missing", "2"); err == nil {
+		t.Errorf("Expected Update of a missing key to fail")
+	}
+	l.Delete("a")
+	if _, err := l.Get("a"); err == nil {
+		t.Errorf("Expected a to be deleted")
+	}
+	if _, err := l.Get("never-written"); err == nil {
+		t.Errorf("Expected an error for a key that was never written")
+	} else if _, ok := err.(*notFoundError); !ok {
+		t.Errorf("Expected a notFoundError, got %v", err)
+	}
+}
+
+func TestLSM_FlushCompactAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir)
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		if err := l.Put(fmt.Sprintf("key%04d", i), i); err != nil {
+			t.Fatalf("Put returned an error: %v", err)
+		}
+	}
+	// Overwrite and delete some keys so compaction has stale entries and
+	// tombstones to deal with.
+	for i := 0; i < n; i += 3 {
+		l.Put(fmt.Sprintf("key%04d", i), "overwritten")
+	}
+	for i := 1; i < n; i += 3 {
+		l.Delete(fmt.Sprintf("key%04d", i))
+	}
+	waitForFlush(t, l)
+
+	l.mu.RLock()
+	deeper := 0
+	for level := 1; level < lsmMaxLevels; level++ {
+		deeper += len(l.levels[level])
+	}
+	l.mu.RUnlock()
+	if deeper == 0 {
+		t.Errorf("Expected compaction to move tables below level 0")
+	}
+
+	check := func(l *LSM) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			value, err := l.Get(key)
+			switch i % 3 {
+			case 0:
+				if err != nil || value != "overwritten" {
+					t.Fatalf("Get(%s) = %v, %v, want overwritten", key, value, err)
+				}
+			case 1:
+				if err == nil {
+					t.Fatalf("Expected %s to be deleted, got %v", key, value)
+				}
+			case 2:
+				if err != nil || value != float64(i) {
+					t.Fatalf("Get(%s) = %v, %v, want %d", key, value, err, i)
+				}
+			}
+		}
+	}
+	check(l)
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+	l = openTestLSM(t, dir)
+	defer l.Close()
+	check(l)
+}
+
+func TestLSM_BatchUpdate(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLSM(t, dir)
+	l.Put("a", "1")
+	l.Put("b", "2")
+
+	updated, err := l.BatchUpdate(context.Background(), []Pair{{"a", "10"}, {"missing", "x"}, {"b", "20"}})
+	if err != nil {
+		t.Fatalf("BatchUpdate returned an error: %v", err)
+	}
+	if len(updated) != 2 {
+		t.Errorf("Expected 2 updated pairs, got %v", updated)
+	}
+	if _, err := l.Get("missing"); err == nil {
+		t.Errorf("Expected BatchUpdate to ignore keys that do not exist")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.BatchUpdate(ctx, []Pair{{"a", "100"}}); err == nil {
+		t.Errorf("Expected BatchUpdate to fail on a cancelled context")
+	}
+	l.Close()
+
+	// The batch lives in the write-ahead log only, it has to survive a reopen.
+	l = openTestLSM(t, dir)
+	defer l.Close()
+	for k, v := range map[string]string{"a": "10", "b": "20"} {
+		if value, err := l.Get(k); err != nil || value != v {
+			t.Errorf("Get(%s) = %v, %v, want %v", k, value, err, v)
+		}
+	}
+}
+
+func TestLSM_StalledUpdateDoesNotBringBackADeletedKey(t *testing.T) {
+	l := openTestLSM(t, t.TempDir())
+	defer l.Close()
+	l.Put("k", "1")
+
+	// Fill the memtable and pretend the previous one is still being
+	// flushed, so the next write stalls.
+	l.mu.Lock()
+	for i := 0; l.mem.size < l.opts.MemtableSize; i++ {
+		l.mem.put("filler"+strconv.Itoa(i), memEntry{value: []byte(`"x"`)})
+	}
+	l.imm = newMemtable()
+	l.mu.Unlock()
+
+	updated := make(chan error, 1)
+	go func() { updated <- l.Update("k", "2") }()
+	// Give the Update time to get to the stall. If it hasn't yet the test
+	// passes without proving anything, it doesn't fail.
+	time.Sleep(50 * time.Millisecond)
+
+	// The flush is done, but only the Delete hears about it.
+	l.mu.Lock()
+	e, _ := l.mem.get("k")
+	l.imm = nil
+	l.mem = newMemtable()
+	l.mem.put("k", e)
+	l.mu.Unlock()
+	if err := l.Delete("k"); err != nil {
+		t.Fatalf("Delete returned an error: %v", err)
+	}
+	l.mu.Lock()
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	if err := <-updated; !isNotFound(err) {
+		t.Errorf("Expected the stalled Update of a key deleted meanwhile to be not found, got %v", err)
+	}
+	if value, err := l.Get("k"); err == nil {
+		t.Errorf("Expected k to stay deleted, got %v", value)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	b := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		b.add(bloomHash("key" + strconv.Itoa(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		if !b.mayContain(bloomHash("key" + strconv.Itoa(i))) {
+			t.Fatalf("Bloom filter has a false negative for key%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if b.mayContain(bloomHash("other" + strconv.Itoa(i))) {
+			falsePositives++
+		}
+	}
+	// 1% expected, leave plenty of room.
+	if falsePositives > 300 {
+		t.Errorf("Too many false positives: %d out of 10000", falsePositives)
+	}
+
+	decoded, err := unmarshalBloomFilter(b.marshal())
+	if err != nil {
+		t.Fatalf("unmarshalBloomFilter returned an error: %v", err)
+	}
+	if !decoded.mayContain(bloomHash("key1")) {
+		t.Errorf("Decoded bloom filter lost key1")
+	}
+}
+
+func BenchmarkLSMPut(b *testing.B) {
+	l, err := OpenLSMStore(b.TempDir(), LSMOptions{Fsync: FsyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < b.N; i++ {
+		l.Put("key"+strconv.Itoa(i), i)
+	}
+}
+
+func BenchmarkLSMGetMiss(b *testing.B) {
+	l, err := OpenLSMStore(b.TempDir(), LSMOptions{Fsync: FsyncNever, MemtableSize: 4096})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 10000; i++ {
+		l.Put("key"+strconv.Itoa(i), i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Get("missing" + strconv.Itoa(i))
+	}
+}
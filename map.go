@@ -2,7 +2,9 @@ package kv
 
 import (
 	"context"
+	"io"
 	"sync"
+	"time"
 )
 
 type notFoundError struct {
@@ -46,60 +48,517 @@ type WriteOptimizedMap struct {
 	db map[string]interface{}
 
 	size int
+	// maxBytes replaces size as the limit when it is set, see
+	// NewWeightedWriteOptimizedMapStore. costs holds the cost of every key
+	// and used their sum, both only kept up to date in that mode.
+	maxBytes int64
+	used     int64
+	costs    map[string]int64
+	sizer    Sizer
 	// batched update settings
 	// batchedWritesCheckInterval controls how often we check to see if the context is cancelled for
 	// batch writes.
 	batchedWritesCheckInterval int
 	rollback                   bool
+
+	// wal is optional. When it is set every mutation is logged to it (while
+	// still holding the lock) before it is applied to db.
+	wal *WAL
+
+	// expiry holds the expiry time of the keys that have a TTL, keys without
+	// one are not in it. Expired keys are removed lazily by Get and actively
+	// by the timing wheel of exp.
+	expiry map[string]time.Time
+	exp    expirer
+
+	// versions holds the version and modified time of every key, version is
+	// the last one handed out.
+	versions map[string]keyVersion
+	version  uint64
+
+	// txns are the open transactions and history the old versions of keys
+	// they may still read, see txn.go. written is every change in history,
+	// in the order they were made.
+	txns    map[*Txn]struct{}
+	history map[string][]keyState
+	written []historyWrite
+
+	// storeMetrics counts operations for /metrics.
+	storeMetrics
+}
+
+type keyVersion struct {
+	version  uint64
+	modified time.Time
 }
 
 // NewWriteOptimizedMapStore returns a new WriteOptimizedMapStore
 func NewWriteOptimizedMapStore(batchedWritesCheckInterval int, rollback bool, cacheSize int) *WriteOptimizedMap {
-	return &WriteOptimizedMap{
+	s := &WriteOptimizedMap{
 		db:                         make(map[string]interface{}),
+		expiry:                     make(map[string]time.Time),
+		versions:                   make(map[string]keyVersion),
+		txns:                       make(map[*Txn]struct{}),
+		history:                    make(map[string][]keyState),
 		rollback:                   rollback,
 		batchedWritesCheckInterval: batchedWritesCheckInterval,
 		size:                       cacheSize,
 	}
+	s.exp = newExpirer(s.removeExpired)
+	return s
+}
+
+// NewWeightedWriteOptimizedMapStore limits the map to maxBytes worth of keys
+// and values, as measured by sizer (DefaultSizer if nil), instead of to a
+// number of keys. Writes that would go over return ErrKVFull.
+func NewWeightedWriteOptimizedMapStore(batchedWritesCheckInterval int, rollback bool, maxBytes int64, sizer Sizer) *WriteOptimizedMap {
+	if sizer == nil {
+		sizer = DefaultSizer
+	}
+	s := NewWriteOptimizedMapStore(batchedWritesCheckInterval, rollback, 0)
+	s.maxBytes = maxBytes
+	s.sizer = sizer
+	s.costs = make(map[string]int64)
+	return s
+}
+
+func (s *WriteOptimizedMap) weighted() bool {
+	return s.costs != nil
+}
+
+// set and remove are the only places that touch db, so the byte accounting
+// stays right. Must be called with the lock held.
+func (s *WriteOptimizedMap) set(key string, value interface{}, kv keyVersion) {
+	s.track(key, keyState{version: kv.version, modified: kv.modified, value: value})
+	s.db[key] = value
+	s.versions[key] = kv
+	if s.weighted() {
+		cost := s.sizer(key, value)
+		s.used += cost - s.costs[key]
+		s.costs[key] = cost
+	}
+}
+
+func (s *WriteOptimizedMap) remove(key string) {
+	if _, exists := s.db[key]; exists && len(s.txns) > 0 {
+		// Deletes only need a version of their own when a transaction could
+		// tell the difference.
+		s.version++
+		s.track(key, keyState{version: s.version, modified: time.Now(), deleted: true})
+	}
+	delete(s.db, key)
+	delete(s.expiry, key)
+	delete(s.versions, key)
+	if s.weighted() {
+		s.used -= s.costs[key]
+		delete(s.costs, key)
+	}
+}
+
+// fits reports whether the map stays within maxBytes when the keys in
+// values are set to their new values. Must be called with the lock held.
+func (s *WriteOptimizedMap) fits(values map[string]interface{}) bool {
+	used := s.used
+	for key, value := range values {
+		used += s.sizer(key, value) - s.costs[key]
+	}
+	return used <= s.maxBytes
+}
+
+// purgeExpired removes every key whose TTL ran out but that the timing wheel
+// has not collected yet, so they don't count against the limit. Must be
+// called with the lock held.
+func (s *WriteOptimizedMap) purgeExpired() {
+	keys := make([]string, 0, len(s.expiry))
+	for k := range s.expiry {
+		keys = append(keys, k)
+	}
+	s.removeExpiredLocked(keys)
+}
+
+// AttachWAL replays the log into the map and from then on logs every mutation
+// to it. It is meant to be called once, right after construction and before
+// the map is handed to a Server.
+func (s *WriteOptimizedMap) AttachWAL(w *WAL) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err := w.Replay(func(rec walRecord) error {
+		// Replays ignore the size limit. Everything in the log was accepted
+		// at some point and refusing it now would just lose data.
+		s.apply(rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.wal = w
+	for k, expireAt := range s.expiry {
+		s.exp.schedule(k, expireAt)
+	}
+	return nil
+}
+
+// Close stops the expiry of keys with a TTL and closes the write-ahead log,
+// if there is one.
+func (s *WriteOptimizedMap) Close() error {
+	s.exp.stop()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Close()
+}
+
+// newRecord stamps a record with the next version and the current time. Must
+// be called with the lock held.
+func (s *WriteOptimizedMap) newRecord(op walOp, pairs ...Pair) walRecord {
+	return walRecord{Op: op, Pairs: pairs, Version: s.version + 1, Time: time.Now().UnixNano()}
+}
+
+func (s *WriteOptimizedMap) apply(rec walRecord) {
+	modified := time.Now()
+	if rec.Time != 0 {
+		modified = time.Unix(0, rec.Time)
+	}
+	if rec.Op == walOpRestore {
+		// Open transactions still have to see what the restore replaced.
+		if len(s.txns) > 0 {
+			for k := range s.db {
+				s.remove(k)
+			}
+		}
+		s.db = make(map[string]interface{}, len(rec.Pairs))
+		s.expiry = make(map[string]time.Time)
+		s.versions = make(map[string]keyVersion, len(rec.Pairs))
+		if s.weighted() {
+			s.costs = make(map[string]int64, len(rec.Pairs))
+			s.used = 0
+		}
+	}
+	for i, pair := range rec.Pairs {
+		switch rec.Op {
+		case walOpDelete:
+			s.remove(pair.Key)
+			continue
+		case walOpPut, walOpRestore, walOpCommit:
+			// A put without a TTL clears the one the key had, updates keep it.
+			if expireAt, ok := rec.Expires[pair.Key]; ok {
+				s.expiry[pair.Key] = time.Unix(0, expireAt)
+			} else {
+				delete(s.expiry, pair.Key)
+			}
+		}
+		version := s.version + 1
+		if rec.Version != 0 {
+			version = rec.Version + uint64(i)
+		}
+		s.version = max(s.version, version)
+		s.set(pair.Key, pair.Value, keyVersion{version: version, modified: modified})
+	}
+	for _, key := range rec.Deletes {
+		s.remove(key)
+	}
+}
+
+func (s *WriteOptimizedMap) logRecord(rec walRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Append(rec)
+}
+
+// lookup returns the value of key unless it does not exist or has expired.
+// Must be called with at least the read lock held.
+func (s *WriteOptimizedMap) lookup(key string) (interface{}, bool) {
+	value, ok := s.db[key]
+	if !ok || s.exp.expired(s.expiry[key]) {
+		return nil, false
+	}
+	return value, true
+}
+
+// removeExpired deletes the keys that have expired. It is called by the
+// timing wheel with the keys that are due, and by Put with every key that has
+// a TTL when the map is full.
+func (s *WriteOptimizedMap) removeExpired(keys []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.removeExpiredLocked(keys)
+}
+
+func (s *WriteOptimizedMap) removeExpiredLocked(keys []string) {
+	for _, key := range keys {
+		if expireAt, ok := s.expiry[key]; ok && s.exp.expired(expireAt) {
+			s.remove(key)
+		}
+	}
+}
+
+// current returns the versioned value of key, nil if it does not exist. Must
+// be called with at least the read lock held.
+func (s *WriteOptimizedMap) current(key string) *Versioned {
+	value, ok := s.lookup(key)
+	if !ok {
+		return nil
+	}
+	kv := s.versions[key]
+	return &Versioned{Value: value, Version: kv.version, Modified: kv.modified}
 }
 
 func (s *WriteOptimizedMap) Get(key string) (interface{}, error) {
+	v, err := s.GetVersioned(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.Value, nil
+}
+
+func (s *WriteOptimizedMap) GetVersioned(key string) (_ Versioned, err error) {
+	defer func() { s.observe(opGet, err) }()
 	s.m.RLock()
-	defer s.m.RUnlock()
-	if value, ok := s.db[key]; ok {
-		return value, nil
+	current := s.current(key)
+	_, hasTTL := s.expiry[key]
+	s.m.RUnlock()
+	if current != nil {
+		return *current, nil
+	}
+	if hasTTL {
+		// Lazy expiry. The timing wheel would get to it eventually, but
+		// there is no point keeping it around until then.
+		s.removeExpired([]string{key})
 	}
-	return nil, newNotFoundError(key)
+	return Versioned{}, newNotFoundError(key)
 }
 
 func (s *WriteOptimizedMap) Put(key string, value interface{}) error {
+	return s.put(key, value, time.Time{})
+}
+
+func (s *WriteOptimizedMap) PutWithTTL(key string, value interface{}, ttl time.Duration) error {
+	return s.put(key, value, s.exp.now().Add(ttl))
+}
+
+func (s *WriteOptimizedMap) put(key string, value interface{}, expireAt time.Time) (err error) {
+	defer func() { s.observe(opPut, err) }()
 	s.m.Lock()
 	defer s.m.Unlock()
-	if len(s.db) >= s.size {
-		return ErrKVFull
+	return s.putLocked(key, value, expireAt)
+}
+
+func (s *WriteOptimizedMap) putLocked(key string, value interface{}, expireAt time.Time) error {
+	if s.weighted() {
+		if !s.fits(map[string]interface{}{key: value}) {
+			s.purgeExpired()
+			if !s.fits(map[string]interface{}{key: value}) {
+				return ErrKVFull
+			}
+		}
+	} else if len(s.db) >= s.size {
+		// Expired keys that have not been collected yet should not count
+		// towards the size.
+		s.purgeExpired()
+		if len(s.db) >= s.size {
+			return ErrKVFull
+		}
+	}
+	rec := s.newRecord(walOpPut, Pair{key, value})
+	if !expireAt.IsZero() {
+		rec.Expires = map[string]int64{key: expireAt.UnixNano()}
+	}
+	if err := s.logRecord(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	if !expireAt.IsZero() {
+		s.exp.schedule(key, expireAt)
 	}
-	s.db[key] = value
 	return nil
 }
 
-func (s *WriteOptimizedMap) Update(key string, value interface{}) error {
+func (s *WriteOptimizedMap) TTL(key string) (time.Duration, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if _, ok := s.lookup(key); !ok {
+		return 0, newNotFoundError(key)
+	}
+	return s.exp.remaining(s.expiry[key]), nil
+}
+
+// Expire logs a put of the value the key already has, with the new expiry.
+// Unlike a Put it can't hit the size limit, the key is there already.
+func (s *WriteOptimizedMap) Expire(key string, ttl time.Duration) (err error) {
+	defer func() { s.observe(opUpdate, err) }()
 	s.m.Lock()
 	defer s.m.Unlock()
-	if _, exists := s.db[key]; !exists {
+	value, ok := s.lookup(key)
+	if !ok {
 		return newNotFoundError(key)
 	}
-	s.db[key] = value
+	rec := s.newRecord(walOpPut, Pair{key, value})
+	expireAt := s.exp.expireAt(ttl)
+	if !expireAt.IsZero() {
+		rec.Expires = map[string]int64{key: expireAt.UnixNano()}
+	}
+	if err := s.logRecord(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	if !expireAt.IsZero() {
+		s.exp.schedule(key, expireAt)
+	}
 	return nil
 }
 
-func (s *WriteOptimizedMap) Delete(key string) error {
+func (s *WriteOptimizedMap) Update(key string, value interface{}) (err error) {
+	defer func() { s.observe(opUpdate, err) }()
 	s.m.Lock()
 	defer s.m.Unlock()
-	delete(s.db, key)
+	if _, exists := s.lookup(key); !exists {
+		return newNotFoundError(key)
+	}
+	return s.updateLocked(key, value)
+}
+
+// updateLocked sets the value of a key that is known to exist.
+func (s *WriteOptimizedMap) updateLocked(key string, value interface{}) error {
+	if s.weighted() && !s.fits(map[string]interface{}{key: value}) {
+		s.purgeExpired()
+		if !s.fits(map[string]interface{}{key: value}) {
+			return ErrKVFull
+		}
+	}
+	rec := s.newRecord(walOpUpdate, Pair{key, value})
+	if err := s.logRecord(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
 	return nil
 }
 
-func (s *WriteOptimizedMap) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+func (s *WriteOptimizedMap) Delete(key string) (err error) {
+	defer func() { s.observe(opDelete, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, exists := s.db[key]; !exists {
+		return nil
+	}
+	return s.deleteLocked(key)
+}
+
+func (s *WriteOptimizedMap) deleteLocked(key string) error {
+	if err := s.logRecord(walRecord{Op: walOpDelete, Pairs: []Pair{{Key: key}}}); err != nil {
+		return err
+	}
+	s.remove(key)
+	return nil
+}
+
+func (s *WriteOptimizedMap) PutIf(key string, value interface{}, cond Precondition) (Versioned, error) {
+	return s.putIf(key, value, time.Time{}, cond)
+}
+
+func (s *WriteOptimizedMap) PutIfWithTTL(key string, value interface{}, ttl time.Duration, cond Precondition) (Versioned, error) {
+	return s.putIf(key, value, s.exp.expireAt(ttl), cond)
+}
+
+func (s *WriteOptimizedMap) putIf(key string, value interface{}, expireAt time.Time, cond Precondition) (_ Versioned, err error) {
+	defer func() { s.observe(opPut, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := cond.check(s.current(key)); err != nil {
+		return Versioned{}, err
+	}
+	if err := s.putLocked(key, value, expireAt); err != nil {
+		return Versioned{}, err
+	}
+	return *s.current(key), nil
+}
+
+func (s *WriteOptimizedMap) UpdateIf(key string, value interface{}, cond Precondition) (_ Versioned, err error) {
+	defer func() { s.observe(opUpdate, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	current := s.current(key)
+	if current == nil {
+		return Versioned{}, newNotFoundError(key)
+	}
+	if err := cond.check(current); err != nil {
+		return Versioned{}, err
+	}
+	if err := s.updateLocked(key, value); err != nil {
+		return Versioned{}, err
+	}
+	return *s.current(key), nil
+}
+
+func (s *WriteOptimizedMap) DeleteIf(key string, cond Precondition) (err error) {
+	defer func() { s.observe(opDelete, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	current := s.current(key)
+	if err := cond.check(current); err != nil {
+		return err
+	}
+	if current == nil {
+		return nil
+	}
+	return s.deleteLocked(key)
+}
+
+func (s *WriteOptimizedMap) PutIfAbsent(key string, value interface{}) (err error) {
+	defer func() { s.observe(opPut, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, exists := s.lookup(key); exists {
+		return ErrKeyExists
+	}
+	return s.putLocked(key, value, time.Time{})
+}
+
+func (s *WriteOptimizedMap) CompareAndSwap(key string, old, new interface{}) (err error) {
+	defer func() { s.observe(opUpdate, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	current, exists := s.lookup(key)
+	if !exists {
+		return newNotFoundError(key)
+	}
+	if !valuesEqual(current, old) {
+		return ErrValueMismatch
+	}
+	return s.updateLocked(key, new)
+}
+
+func (s *WriteOptimizedMap) CompareAndDelete(key string, old interface{}) (err error) {
+	defer func() { s.observe(opDelete, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	current, exists := s.lookup(key)
+	if !exists {
+		return newNotFoundError(key)
+	}
+	if !valuesEqual(current, old) {
+		return ErrValueMismatch
+	}
+	return s.deleteLocked(key)
+}
+
+func (s *WriteOptimizedMap) GetOrPut(key string, value interface{}) (_ interface{}, _ bool, err error) {
+	defer func() { s.observe(opPut, err) }()
+	s.m.Lock()
+	defer s.m.Unlock()
+	if current, exists := s.lookup(key); exists {
+		return current, true, nil
+	}
+	if err := s.putLocked(key, value, time.Time{}); err != nil {
+		return nil, false, err
+	}
+	return value, false, nil
+}
+
+func (s *WriteOptimizedMap) BatchUpdate(ctx context.Context, pairs []Pair) (_ []Pair, err error) {
+	defer func() { s.observeBatch(len(pairs), err) }()
 	// Check if the context is already cancelled before proceeding
 	select {
 	case <-ctx.Done():
@@ -110,12 +569,36 @@ func (s *WriteOptimizedMap) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pa
 	s.m.Lock()
 	defer s.m.Unlock()
 
+	if s.weighted() {
+		// Checked up front so a batch that does not fit is refused as a whole
+		// instead of half applied.
+		values := make(map[string]interface{}, len(pairs))
+		for _, pair := range pairs {
+			if _, exists := s.lookup(pair.Key); exists {
+				values[pair.Key] = pair.Value
+			}
+		}
+		if !s.fits(values) {
+			return nil, ErrKVFull
+		}
+	}
+
+	// Every updated key gets the next version, in order, exactly like apply
+	// would hand them out when the record is replayed.
+	rec := s.newRecord(walOpBatchUpdate)
+	modified := time.Unix(0, rec.Time)
+
 	shouldRollback := false
-	if s.rollback {
+	// With a WAL we always keep the snapshot around, regardless of the rollback
+	// setting, because if we fail to log the batch we have to undo it in memory
+	// too. Otherwise the map and the log would disagree after a restart.
+	if s.rollback || s.wal != nil {
 		snapshot := make(map[string]interface{})
+		snapshotVersions := make(map[string]keyVersion)
 		for _, pair := range pairs {
-			if originalValue, exists := s.db[pair.Key]; exists {
+			if originalValue, exists := s.lookup(pair.Key); exists {
 				snapshot[pair.Key] = originalValue
+				snapshotVersions[pair.Key] = s.versions[pair.Key]
 			}
 		}
 
@@ -124,8 +607,9 @@ func (s *WriteOptimizedMap) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pa
 		// in case something panics.
 		defer func() {
 			if shouldRollback {
+				s.rollbacks.Add(1)
 				for k, v := range snapshot {
-					s.db[k] = v
+					s.set(k, v, snapshotVersions[k])
 				}
 			}
 		}()
@@ -145,11 +629,109 @@ func (s *WriteOptimizedMap) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pa
 
 		// The exists check is because I am making an assumption. I'm assuming that
 		// an UPDATE should only happen if a key already exists (unlike a PUT/SET).
-		if _, exists := s.db[pair.Key]; exists {
-			s.db[pair.Key] = pair.Value
+		if _, exists := s.lookup(pair.Key); exists {
+			version := rec.Version + uint64(len(updatedPairs))
+			s.set(pair.Key, pair.Value, keyVersion{version: version, modified: modified})
 			updatedPairs = append(updatedPairs, pair)
 		}
 	}
 
+	// The whole batch goes into the log as one record, so a crash can never
+	// leave half of it applied.
+	if len(updatedPairs) > 0 {
+		s.version = rec.Version + uint64(len(updatedPairs)) - 1
+		rec.Pairs = updatedPairs
+		if err := s.logRecord(rec); err != nil {
+			shouldRollback = true
+			return nil, err
+		}
+	}
+
 	return updatedPairs, nil
 }
+
+// Len is the number of keys, counting the expired ones that have not been
+// collected yet. It is what the size limit counts too.
+func (s *WriteOptimizedMap) Len() int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return len(s.db)
+}
+
+func (s *WriteOptimizedMap) Keys() ([]string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	keys := make([]string, 0, len(s.db))
+	for k := range s.db {
+		if _, ok := s.lookup(k); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// Snapshot only holds the read lock long enough to copy the map, the encoding
+// and writing happens after writers have been let back in.
+func (s *WriteOptimizedMap) Snapshot(w io.Writer) error {
+	s.m.RLock()
+	db := make(map[string]interface{}, len(s.db))
+	for k := range s.db {
+		if v, ok := s.lookup(k); ok {
+			db[k] = v
+		}
+	}
+	expiry := make(map[string]time.Time, len(s.expiry))
+	for k, v := range s.expiry {
+		expiry[k] = v
+	}
+	s.m.RUnlock()
+
+	sw, err := newSnapshotWriter(w)
+	if err != nil {
+		return err
+	}
+	for k, v := range db {
+		if err := sw.add(k, v, expiry[k]); err != nil {
+			return err
+		}
+	}
+	return sw.close()
+}
+
+func (s *WriteOptimizedMap) Restore(r io.Reader) error {
+	rec := walRecord{Op: walOpRestore, Pairs: make([]Pair, 0), Expires: make(map[string]int64)}
+	err := readSnapshot(r, func(key string, value interface{}, expireAt time.Time) error {
+		rec.Pairs = append(rec.Pairs, Pair{key, value})
+		if !expireAt.IsZero() {
+			rec.Expires[key] = expireAt.UnixNano()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.weighted() {
+		var used int64
+		for _, pair := range rec.Pairs {
+			used += s.sizer(pair.Key, pair.Value)
+		}
+		if used > s.maxBytes {
+			return ErrKVFull
+		}
+	} else if len(rec.Pairs) > s.size {
+		return ErrKVFull
+	}
+	rec.Version = s.version + 1
+	rec.Time = time.Now().UnixNano()
+	if err := s.logRecord(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	for k, expireAt := range s.expiry {
+		s.exp.schedule(k, expireAt)
+	}
+	return nil
+}
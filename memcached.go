@@ -0,0 +1,512 @@
+package kv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MemcachedServer speaks the memcached text protocol in front of any Store:
+// get, gets, set, add, replace, cas, delete, incr, decr, touch, version and
+// quit. add needs a ConditionalStore, cas and gets need a VersionedStore
+// (the cas unique is the key's version, gets returns 0 without one) and
+// exptimes need a TTLStore.
+//
+// Values are stored as strings, so they mix with the other protocols. An item
+// with non zero flags is stored as {"data": ..., "flags": ...} instead, that
+// is the only way to keep its flags. Like everything else in the stores,
+// values only survive a restart intact if they are valid UTF-8.
+type MemcachedServer struct {
+	db    Store
+	addr  string
+	conns connGroup
+}
+
+func NewMemcachedServer(store Store, addr string) *MemcachedServer {
+	return &MemcachedServer{db: store, addr: addr}
+}
+
+func (s *MemcachedServer) Start() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Memcached server running at: %s\n", s.addr)
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it is closed or the server is shut
+// down.
+func (s *MemcachedServer) Serve(l net.Listener) error {
+	if !s.conns.addListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.conns.removeListener(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.conns.closed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections, closes the idle ones and waits for
+// the others to finish the command they are on. If ctx runs out first, the
+// remaining connections are closed and their BatchUpdates cancelled.
+func (s *MemcachedServer) Shutdown(ctx context.Context) error {
+	return s.conns.shutdown(ctx)
+}
+
+// The memcached defaults.
+const (
+	memcachedMaxKey   = 250
+	memcachedMaxValue = 1024 * 1024
+	memcachedMaxLine  = 2048
+	// exptimes up to 30 days are relative, bigger ones are unix times.
+	memcachedMaxRelative = 60 * 60 * 24 * 30
+)
+
+// memcachedConn is the per connection state.
+type memcachedConn struct {
+	*bufio.Writer
+	r *bufio.Reader
+	// noreply is set for the command being handled if it ended in noreply.
+	noreply bool
+	quit    bool
+}
+
+func (c *memcachedConn) reply(line string) {
+	if !c.noreply {
+		c.WriteString(line + "\r\n")
+	}
+}
+
+// storeError reports an error from the store. Like memcached, an item that
+// does not fit is "out of memory".
+func (c *memcachedConn) storeError(err error) {
+	if _, ok := err.(*kvFullError); ok {
+		c.reply("SERVER_ERROR out of memory storing object")
+		return
+	}
+	c.reply("SERVER_ERROR " + err.Error())
+}
+
+// errMemcachedBadChunk is a data block that is not the length it was
+// announced as. The stream can't be trusted after that.
+var errMemcachedBadChunk = errors.New("bad data chunk")
+
+func (s *MemcachedServer) serveConn(conn net.Conn) {
+	if _, ok := s.conns.add(conn); !ok {
+		conn.Close()
+		return
+	}
+	defer s.conns.remove(conn)
+	c := &memcachedConn{Writer: bufio.NewWriter(conn), r: bufio.NewReaderSize(conn, memcachedMaxLine)}
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			c.reply("CLIENT_ERROR line too long")
+			c.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !s.conns.setBusy(conn, true) {
+			return
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) > 0 {
+			if err := s.dispatch(c, fields); err != nil {
+				c.noreply = false
+				c.reply("CLIENT_ERROR " + err.Error())
+				c.Flush()
+				return
+			}
+		}
+		if c.quit || c.r.Buffered() == 0 {
+			if err := c.Flush(); err != nil {
+				return
+			}
+		}
+		// While shutting down, the command we just did is the last one.
+		if c.quit || !s.conns.setBusy(conn, c.r.Buffered() > 0) {
+			c.Flush()
+			return
+		}
+	}
+}
+
+// dispatch runs one command. It only returns an error when the connection
+// has to be closed.
+func (s *MemcachedServer) dispatch(c *memcachedConn, fields []string) error {
+	c.noreply = false
+	switch cmd := fields[0]; cmd {
+	case "get", "gets":
+		s.get(c, fields[1:], cmd == "gets")
+	case "set", "add", "replace", "cas":
+		return s.storage(c, cmd, fields[1:])
+	case "delete":
+		s.delete(c, fields[1:])
+	case "incr", "decr":
+		s.incr(c, fields[1:], cmd == "incr")
+	case "touch":
+		s.touch(c, fields[1:])
+	case "version":
+		c.reply("VERSION kv")
+	case "quit":
+		c.quit = true
+	default:
+		c.reply("ERROR")
+	}
+	return nil
+}
+
+// parseNoreply strips a trailing noreply off args.
+func (c *memcachedConn) parseNoreply(args []string, n int) []string {
+	if len(args) == n+1 && args[n] == "noreply" {
+		c.noreply = true
+		return args[:n]
+	}
+	return args
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > memcachedMaxKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// memcachedValue is what gets stored for data with flags.
+func memcachedValue(data string, flags uint32) interface{} {
+	if flags == 0 {
+		return data
+	}
+	return map[string]interface{}{"data": data, "flags": float64(flags)}
+}
+
+// memcachedItem is the other way around. Values that did not come from the
+// memcached server have no flags and are formatted like the Redis server
+// does.
+func memcachedItem(value interface{}) (data string, flags uint32) {
+	if m, ok := value.(map[string]interface{}); ok && len(m) == 2 {
+		data, isString := m["data"].(string)
+		flags, isNumber := m["flags"].(float64)
+		if isString && isNumber {
+			return data, uint32(flags)
+		}
+	}
+	return valueString(value), 0
+}
+
+// memcachedTTL converts an exptime. expired means the item is dead on
+// arrival (a negative exptime or a unix time in the past).
+func memcachedTTL(exptime int64, now time.Time) (ttl time.Duration, expired bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= memcachedMaxRelative:
+		return time.Duration(exptime) * time.Second, false
+	}
+	ttl = time.Unix(exptime, 0).Sub(now)
+	return ttl, ttl <= 0
+}
+
+func (s *MemcachedServer) get(c *memcachedConn, keys []string, withCAS bool) {
+	if len(keys) == 0 {
+		c.reply("ERROR")
+		return
+	}
+	versioned, hasVersions := s.db.(VersionedStore)
+	for _, key := range keys {
+		var value interface{}
+		var version uint64
+		var err error
+		if hasVersions {
+			var v Versioned
+			v, err = versioned.GetVersioned(key)
+			value, version = v.Value, v.Version
+		} else {
+			value, err = s.db.Get(key)
+		}
+		if err != nil {
+			continue
+		}
+		data, flags := memcachedItem(value)
+		line := "VALUE " + key + " " + strconv.FormatUint(uint64(flags), 10) + " " + strconv.Itoa(len(data))
+		if withCAS {
+			line += " " + strconv.FormatUint(version, 10)
+		}
+		c.reply(line)
+		c.reply(data)
+	}
+	c.reply("END")
+}
+
+// storage handles the commands that come with a data block:
+// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply].
+func (s *MemcachedServer) storage(c *memcachedConn, cmd string, args []string) error {
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+	args = c.parseNoreply(args, n)
+	if len(args) != n {
+		c.reply("ERROR")
+		return nil
+	}
+	key := args[0]
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		c.reply("CLIENT_ERROR bad command line format")
+		return nil
+	}
+
+	// Once we know its size, the data block has to be read no matter what
+	// else is wrong, or it would be taken for the next command. Too big ones
+	// are skipped over.
+	if size > memcachedMaxValue {
+		if _, err := c.r.Discard(size + 2); err != nil {
+			return err
+		}
+		c.reply("SERVER_ERROR object too large for cache")
+		return nil
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return err
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return errMemcachedBadChunk
+	}
+
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	var casUnique uint64
+	var err3 error
+	if cmd == "cas" {
+		casUnique, err3 = strconv.ParseUint(args[4], 10, 64)
+	}
+	if errors.Join(err1, err2, err3) != nil || !validMemcachedKey(key) {
+		c.reply("CLIENT_ERROR bad command line format")
+		return nil
+	}
+
+	value := memcachedValue(string(buf[:size]), uint32(flags))
+	ttl, expired := memcachedTTL(exptime, time.Now())
+	if _, ok := s.db.(TTLStore); ttl > 0 && !ok {
+		c.reply("SERVER_ERROR exptime not supported by this store")
+		return nil
+	}
+
+	reply := "STORED"
+	if cmd == "set" {
+		err = s.expire(key, value, ttl, expired)
+	} else {
+		reply, err = s.storeIf(cmd, key, value, ttl, expired, casUnique)
+	}
+	if err != nil {
+		c.storeError(err)
+		return nil
+	}
+	c.reply(reply)
+	return nil
+}
+
+// expire stores value for key with the given TTL, or deletes it if it is
+// already expired.
+func (s *MemcachedServer) expire(key string, value interface{}, ttl time.Duration, expired bool) error {
+	switch {
+	case expired:
+		return s.db.Delete(key)
+	case ttl > 0:
+		return s.db.(TTLStore).PutWithTTL(key, value, ttl)
+	default:
+		return s.db.Put(key, value)
+	}
+}
+
+// storeIf is add, replace and cas. On a VersionedStore the check and the
+// write are one step, exptime included, and like set they take away the TTL
+// the item had when there is no exptime. Other stores only get replace,
+// without an exptime, as an Update.
+func (s *MemcachedServer) storeIf(cmd, key string, value interface{}, ttl time.Duration, expired bool, casUnique uint64) (string, error) {
+	versioned, ok := s.db.(VersionedStore)
+	if !ok {
+		switch {
+		case cmd != "replace":
+			return "", fmt.Errorf("%s not supported by this store", cmd)
+		case expired:
+			return "", errors.New("exptime not supported by this store")
+		}
+		err := s.db.Update(key, value)
+		if isNotFound(err) {
+			return "NOT_STORED", nil
+		}
+		return "STORED", err
+	}
+
+	var cond Precondition
+	switch cmd {
+	case "add":
+		cond = IfNotExists
+	case "replace":
+		cond = IfExists
+	case "cas":
+		cond = func(current *Versioned) error {
+			if current == nil {
+				return newNotFoundError(key)
+			}
+			return IfMatch(casUnique)(current)
+		}
+	}
+	var err error
+	if expired {
+		// Stored and expired straight away, which leaves nothing.
+		err = versioned.DeleteIf(key, cond)
+		if isNotFound(err) && cmd == "add" {
+			err = nil
+		}
+	} else {
+		_, err = versioned.PutIfWithTTL(key, value, ttl, cond)
+	}
+	switch {
+	case isNotFound(err):
+		return "NOT_FOUND", nil
+	case err == ErrPreconditionFailed && cmd == "cas":
+		return "EXISTS", nil
+	case err == ErrPreconditionFailed:
+		return "NOT_STORED", nil
+	}
+	return "STORED", err
+}
+
+func (s *MemcachedServer) delete(c *memcachedConn, args []string) {
+	args = c.parseNoreply(args, 1)
+	if len(args) != 1 {
+		c.reply("ERROR")
+		return
+	}
+	if _, err := s.db.Get(args[0]); err != nil {
+		c.reply("NOT_FOUND")
+		return
+	}
+	if err := s.db.Delete(args[0]); err != nil {
+		c.storeError(err)
+		return
+	}
+	c.reply("DELETED")
+}
+
+// incr and decr are a compare-and-swap loop, so they need a ConditionalStore.
+// Like memcached, incr wraps around at 64 bits and decr stops at 0.
+func (s *MemcachedServer) incr(c *memcachedConn, args []string, up bool) {
+	args = c.parseNoreply(args, 2)
+	if len(args) != 2 {
+		c.reply("ERROR")
+		return
+	}
+	key := args[0]
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	conditional, ok := s.db.(ConditionalStore)
+	if !ok {
+		c.reply("SERVER_ERROR incr and decr not supported by this store")
+		return
+	}
+	for {
+		value, err := s.db.Get(key)
+		if err != nil {
+			c.reply("NOT_FOUND")
+			return
+		}
+		data, flags := memcachedItem(value)
+		n, err := strconv.ParseUint(data, 10, 64)
+		if err != nil {
+			c.reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+			return
+		}
+		switch {
+		case up:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		err = conditional.CompareAndSwap(key, value, memcachedValue(strconv.FormatUint(n, 10), flags))
+		if err == ErrValueMismatch || isNotFound(err) {
+			// Someone else got there first, go again.
+			continue
+		}
+		if err != nil {
+			c.storeError(err)
+			return
+		}
+		c.reply(strconv.FormatUint(n, 10))
+		return
+	}
+}
+
+// touch sets the exptime of an item without touching its value.
+func (s *MemcachedServer) touch(c *memcachedConn, args []string) {
+	args = c.parseNoreply(args, 2)
+	if len(args) != 2 {
+		c.reply("ERROR")
+		return
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		c.reply("CLIENT_ERROR invalid exptime argument")
+		return
+	}
+	ttl, expired := memcachedTTL(exptime, time.Now())
+	// Without TTLs there is nothing to set, only an exptime in the past
+	// means something: delete the item.
+	ttlStore, ok := s.db.(TTLStore)
+	if !ok && !expired {
+		c.reply("SERVER_ERROR touch not supported by this store")
+		return
+	}
+	if _, err := s.db.Get(args[0]); err != nil {
+		c.reply("NOT_FOUND")
+		return
+	}
+	if expired {
+		err = s.db.Delete(args[0])
+	} else {
+		err = ttlStore.Expire(args[0], ttl)
+	}
+	if isNotFound(err) {
+		c.reply("NOT_FOUND")
+		return
+	}
+	if err != nil {
+		c.storeError(err)
+		return
+	}
+	c.reply("TOUCHED")
+}
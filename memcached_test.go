@@ -0,0 +1,94 @@
+package kv
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemcached_Commands(t *testing.T) {
+	store := NewWriteOptimizedMapStore(1, true, 100)
+	do := tcpSession(t, NewMemcachedServer(store, "").Serve)
+
+	do("set a 0 0 5\r\nhello\r\n", "STORED\r\n")
+	do("get a missing\r\n", "VALUE a 0 5\r\nhello\r\nEND\r\n")
+	do("add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	do("add b 42 0 3\r\nabc\r\n", "STORED\r\n")
+	do("get b\r\n", "VALUE b 42 3\r\nabc\r\nEND\r\n")
+	do("replace missing 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	do("replace a 0 0 5\r\nworld\r\n", "STORED\r\n")
+
+	v, _ := store.GetVersioned("a")
+	cas := strconv.FormatUint(v.Version, 10)
+	do("gets a\r\n", "VALUE a 0 5 "+cas+"\r\nworld\r\nEND\r\n")
+	do("cas a 0 0 1 "+cas+"0\r\nx\r\n", "EXISTS\r\n")
+	do("cas missing 0 0 1 1\r\nx\r\n", "NOT_FOUND\r\n")
+	do("cas a 0 0 1 "+cas+"\r\nx\r\n", "STORED\r\n")
+
+	do("set n 0 0 2\r\n10\r\n", "STORED\r\n")
+	do("incr n 5\r\n", "15\r\n")
+	do("decr n 100\r\n", "0\r\n")
+	do("incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	do("incr missing 1\r\n", "NOT_FOUND\r\n")
+
+	do("touch n 100\r\n", "TOUCHED\r\n")
+	if ttl, _ := store.TTL("n"); ttl <= 0 || ttl > 100*time.Second {
+		t.Errorf("Expected n to expire in 100s, got %v", ttl)
+	}
+
+	// The conditional commands set the exptime in the same step, or take
+	// it away.
+	do("add e 0 100 1\r\ne\r\n", "STORED\r\n")
+	if ttl, _ := store.TTL("e"); ttl <= 0 || ttl > 100*time.Second {
+		t.Errorf("Expected add to set a TTL of 100s, got %v", ttl)
+	}
+	do("replace e 0 0 1\r\nf\r\n", "STORED\r\n")
+	if ttl, _ := store.TTL("e"); ttl != NoExpiry {
+		t.Errorf("Expected replace without exptime to clear the TTL, got %v", ttl)
+	}
+	v, _ = store.GetVersioned("e")
+	do("cas e 0 100 1 "+strconv.FormatUint(v.Version, 10)+"\r\ng\r\n", "STORED\r\n")
+	if ttl, _ := store.TTL("e"); ttl <= 0 {
+		t.Errorf("Expected cas to set a TTL, got %v", ttl)
+	}
+	do("add e 0 -1 1\r\nx\r\nget e\r\n", "NOT_STORED\r\nVALUE e 0 1\r\ng\r\nEND\r\n")
+	do("add gone 0 -1 1\r\nx\r\nget gone\r\n", "STORED\r\nEND\r\n")
+	do("touch e 0\r\n", "TOUCHED\r\n")
+	if ttl, _ := store.TTL("e"); ttl != NoExpiry {
+		t.Errorf("Expected touch with 0 to clear the TTL, got %v", ttl)
+	}
+	do("touch missing 10\r\n", "NOT_FOUND\r\n")
+
+	do("delete n\r\n", "DELETED\r\n")
+	do("delete n\r\n", "NOT_FOUND\r\n")
+
+	// noreply means no reply, the next command's is the first thing back.
+	do("set q 0 0 1 noreply\r\nq\r\nget q\r\n", "VALUE q 0 1\r\nq\r\nEND\r\n")
+	// A negative exptime is expired straight away.
+	do("set q 0 -1 1\r\nq\r\nget q\r\n", "STORED\r\nEND\r\n")
+	do("set a x 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format\r\n")
+	do("flush_all\r\n", "ERROR\r\n")
+	do("version\r\n", "VERSION kv\r\n")
+
+	// A data block of the wrong length ends the connection.
+	do("set a 0 0 1\r\ntoo long\r\n", "CLIENT_ERROR bad data chunk\r\n")
+}
+
+func TestMemcached_StoresWithoutExtras(t *testing.T) {
+	bitcask, err := OpenBitcaskStore(t.TempDir(), BitcaskOptions{Fsync: FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitcask.Close()
+	do := tcpSession(t, NewMemcachedServer(bitcask, "").Serve)
+
+	do("set a 0 0 1\r\n1\r\n", "STORED\r\n")
+	do("gets a\r\n", "VALUE a 0 1 0\r\n1\r\nEND\r\n")
+	do("add a 0 0 1\r\n1\r\n", "SERVER_ERROR add not supported by this store\r\n")
+	do("set a 0 10 1\r\n1\r\n", "SERVER_ERROR exptime not supported by this store\r\n")
+	do("touch a 0\r\n", "SERVER_ERROR touch not supported by this store\r\n")
+	do("touch missing 0\r\n", "SERVER_ERROR touch not supported by this store\r\n")
+	do("touch a -1\r\n", "TOUCHED\r\n")
+	do("get a\r\n", "END\r\n")
+	do("touch a -1\r\n", "NOT_FOUND\r\n")
+}
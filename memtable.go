@@ -0,0 +1,103 @@
+package kv
+
+import "math/rand"
+
+// memEntry is the latest write of a key that the LSM store knows about. The
+// value is kept JSON encoded, which is what ends up in the sstable anyway.
+type memEntry struct {
+	seq       uint64
+	tombstone bool
+	value     []byte
+}
+
+const memtableMaxLevel = 16
+
+type skipNode struct {
+	key   string
+	entry memEntry
+	next  []*skipNode
+}
+
+// memtable is a skip list sorted by key. It is not safe for concurrent use,
+// the LSM store guards it with its own lock.
+type memtable struct {
+	head  *skipNode
+	level int
+	len   int
+	// size is a rough estimate of the bytes this memtable will take on disk,
+	// used to decide when to flush it.
+	size int64
+	rnd  *rand.Rand
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		head:  &skipNode{next: make([]*skipNode, memtableMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (m *memtable) randomLevel() int {
+	level := 1
+	for level < memtableMaxLevel && m.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+func (m *memtable) put(key string, e memEntry) {
+	var update [memtableMaxLevel]*skipNode
+	x := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	if next := x.next[0]; next != nil && next.key == key {
+		m.size += int64(len(e.value) - len(next.entry.value))
+		next.entry = e
+		return
+	}
+
+	level := m.randomLevel()
+	if level > m.level {
+		for i := m.level; i < level; i++ {
+			update[i] = m.head
+		}
+		m.level = level
+	}
+	node := &skipNode{key: key, entry: e, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	m.len++
+	// Key, value and roughly what the record framing costs.
+	m.size += int64(len(key) + len(e.value) + 21)
+}
+
+func (m *memtable) get(key string) (memEntry, bool) {
+	x := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+	}
+	if x = x.next[0]; x != nil && x.key == key {
+		return x.entry, true
+	}
+	return memEntry{}, false
+}
+
+// each calls fn for every entry in key order.
+func (m *memtable) each(fn func(key string, e memEntry) error) error {
+	for x := m.head.next[0]; x != nil; x = x.next[0] {
+		if err := fn(x.key, x.entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package kv
+
+import "encoding/binary"
+
+// DefaultMerkleDepth gives a MerkleTree 1024 buckets, a few hundred keys
+// each for a store of a few hundred thousand.
+const DefaultMerkleDepth = 10
+
+// MerkleTree is a hash tree over a set of keys and digests of their values,
+// for two stores to find out which keys they disagree on without sending
+// each other all of them. The keys go in 2^depth buckets by their hash, and
+// every node of the tree is a hash of the nodes under it, so two trees with
+// the same root hold the same keys and values, and where they differ
+// narrows down one level at a time to the buckets that do.
+//
+// The hash of a bucket is the XOR of the hashes of its entries, so it can be
+// kept up to date as keys come and go without looking at the rest of the
+// bucket. The levels above are worked out again when they are asked for
+// after a change, which is 2^depth hashes. It is not safe for concurrent
+// use.
+type MerkleTree struct {
+	depth   int
+	buckets []map[string]uint64
+	leaves  []uint64
+	// levels are the hashes of every level, the root first and the leaves
+	// last, nil when a change made them stale.
+	levels [][]uint64
+}
+
+// NewMerkleTree returns an empty tree with 2^depth buckets,
+// DefaultMerkleDepth if depth isn't positive.
+func NewMerkleTree(depth int) *MerkleTree {
+	if depth <= 0 {
+		depth = DefaultMerkleDepth
+	}
+	return &MerkleTree{
+		depth:   depth,
+		buckets: make([]map[string]uint64, 1<<depth),
+		leaves:  make([]uint64, 1<<depth),
+	}
+}
+
+// Depth is the level of the buckets, the root is level 0.
+func (t *MerkleTree) Depth() int {
+	return t.depth
+}
+
+// Bucket returns the bucket of key.
+func (t *MerkleTree) Bucket(key string) int {
+	return int(ringHash(key) >> (64 - t.depth))
+}
+
+// Set puts key in the tree with the digest of its value, replacing the one
+// it had.
+func (t *MerkleTree) Set(key string, digest uint64) {
+	t.Remove(key)
+	i := t.Bucket(key)
+	if t.buckets[i] == nil {
+		t.buckets[i] = make(map[string]uint64)
+	}
+	t.buckets[i][key] = digest
+	t.leaves[i] ^= merkleEntryHash(key, digest)
+	t.levels = nil
+}
+
+// Remove takes key out of the tree, if it is there.
+func (t *MerkleTree) Remove(key string) {
+	i := t.Bucket(key)
+	digest, ok := t.buckets[i][key]
+	if !ok {
+		return
+	}
+	delete(t.buckets[i], key)
+	t.leaves[i] ^= merkleEntryHash(key, digest)
+	t.levels = nil
+}
+
+// Level returns the hashes of the 2^level nodes of level, 0 being the root
+// and Depth the buckets. The slice belongs to the tree, and is only good
+// until the next change.
+func (t *MerkleTree) Level(level int) []uint64 {
+	if t.levels == nil {
+		t.levels = make([][]uint64, t.depth+1)
+		t.levels[t.depth] = t.leaves
+		for l := t.depth - 1; l >= 0; l-- {
+			below := t.levels[l+1]
+			t.levels[l] = make([]uint64, len(below)/2)
+			for i := range t.levels[l] {
+				t.levels[l][i] = merkleNodeHash(below[2*i], below[2*i+1])
+			}
+		}
+	}
+	return t.levels[level]
+}
+
+// Entries returns the keys in bucket and their digests.
+func (t *MerkleTree) Entries(bucket int) map[string]uint64 {
+	entries := make(map[string]uint64, len(t.buckets[bucket]))
+	for key, digest := range t.buckets[bucket] {
+		entries[key] = digest
+	}
+	return entries
+}
+
+func merkleEntryHash(key string, digest uint64) uint64 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], digest)
+	return ringHash(key + "\x00" + string(b[:]))
+}
+
+// merkleNodeHash combines the hashes of two children. Two empty subtrees
+// make an empty one, so the empty parts of two trees match without any
+// hashing.
+func merkleNodeHash(left, right uint64) uint64 {
+	if left == 0 && right == 0 {
+		return 0
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], left)
+	binary.BigEndian.PutUint64(b[8:], right)
+	return ringHash(string(b[:]))
+}
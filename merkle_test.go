@@ -0,0 +1,50 @@
+package kv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	a, b := NewMerkleTree(6), NewMerkleTree(6)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		a.Set(key, uint64(i))
+		b.Set(key, uint64(i))
+	}
+	if a.Level(0)[0] != b.Level(0)[0] {
+		t.Fatalf("Expected the same keys to make the same root")
+	}
+	root := a.Level(0)[0]
+
+	// One change shows along a single path down to its bucket.
+	b.Set("key-7", 1000)
+	for level := 0; level <= b.Depth(); level++ {
+		var differ []int
+		for i := range a.Level(level) {
+			if a.Level(level)[i] != b.Level(level)[i] {
+				differ = append(differ, i)
+			}
+		}
+		want := b.Bucket("key-7") >> (b.Depth() - level)
+		if len(differ) != 1 || differ[0] != want {
+			t.Errorf("Expected node %d of level %d to differ, got %v", want, level, differ)
+		}
+	}
+	if entries := b.Entries(b.Bucket("key-7")); entries["key-7"] != 1000 {
+		t.Errorf("Expected the new digest in the bucket, got %v", entries)
+	}
+
+	// So does a key only one side has, until it is gone again.
+	a.Set("extra", 1)
+	if a.Level(0)[0] == root {
+		t.Errorf("Expected a new key to change the root")
+	}
+	a.Remove("extra")
+	if a.Level(0)[0] != root {
+		t.Errorf("Expected the root back once the key is removed")
+	}
+	if empty := NewMerkleTree(6); empty.Level(0)[0] != 0 {
+		t.Errorf("Expected an empty tree to hash to 0")
+	}
+}
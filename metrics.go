@@ -0,0 +1,436 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This is /metrics in the Prometheus text format, written by hand rather than
+// pulling in the client library for a handful of counters and histograms.
+// Every Server has its own, for its own store and its namespaces.
+
+type storeOp int
+
+const (
+	opGet storeOp = iota
+	opPut
+	opUpdate
+	opDelete
+	opBatchUpdate
+	numStoreOps
+)
+
+var storeOpNames = [numStoreOps]string{"get", "put", "update", "delete", "batch_update"}
+
+const (
+	resultOK = iota
+	resultNotFound
+	resultFull
+	resultConflict
+	resultError
+	numOpResults
+)
+
+var opResultNames = [numOpResults]string{"ok", "not_found", "full", "conflict", "error"}
+
+func opResult(err error) int {
+	switch err.(type) {
+	case nil:
+		return resultOK
+	case *notFoundError:
+		return resultNotFound
+	case *kvFullError:
+		return resultFull
+	case *preconditionFailedError, *keyExistsError, *valueMismatchError:
+		return resultConflict
+	}
+	return resultError
+}
+
+// batchSizeBuckets are the upper bounds of the BatchUpdate size histogram, in
+// pairs.
+var batchSizeBuckets = []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+
+// storeMetrics is what the stores count for /metrics. They embed it, the zero
+// value is ready to use. Only the operations of the Store interface are
+// counted, along with their variants the HTTP API uses: GetVersioned is a
+// get, PutWithTTL, PutIf, PutIfAbsent and GetOrPut are puts, UpdateIf and
+// CompareAndSwap updates and DeleteIf and CompareAndDelete deletes. A failed
+// precondition, an existing key or a mismatched value is a conflict.
+type storeMetrics struct {
+	ops       [numStoreOps][numOpResults]atomic.Uint64
+	rollbacks atomic.Uint64
+
+	mu         sync.Mutex
+	batchSizes *histogram
+}
+
+func (m *storeMetrics) observe(op storeOp, err error) {
+	m.ops[op][opResult(err)].Add(1)
+}
+
+// observeBatch counts a BatchUpdate of n pairs, err is what it returned.
+func (m *storeMetrics) observeBatch(n int, err error) {
+	m.observe(opBatchUpdate, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.batchSizes == nil {
+		m.batchSizes = newHistogram(batchSizeBuckets)
+	}
+	m.batchSizes.observe(float64(n))
+}
+
+// metrics is how /metrics finds the storeMetrics of a store.
+func (m *storeMetrics) metrics() *storeMetrics {
+	return m
+}
+
+// histogram is a Prometheus histogram: counts per bucket plus the sum and
+// count of everything observed. Not safe for concurrent use on its own.
+type histogram struct {
+	bounds []float64
+	// counts[i] is the number of observations in bucket i, not cumulative.
+	// The last one is +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+	h.count++
+}
+
+// latencyBuckets are the upper bounds of the request latency histograms, in
+// seconds. The Prometheus defaults.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// httpMetrics are the per endpoint request counts and latencies of a Server.
+type httpMetrics struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointMetrics
+}
+
+type endpointMetrics struct {
+	codes    map[int]uint64
+	duration *histogram
+}
+
+func (m *httpMetrics) observe(endpoint string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.endpoints == nil {
+		m.endpoints = make(map[string]*endpointMetrics)
+	}
+	e, ok := m.endpoints[endpoint]
+	if !ok {
+		e = &endpointMetrics{codes: make(map[int]uint64), duration: newHistogram(latencyBuckets)}
+		m.endpoints[endpoint] = e
+	}
+	e.codes[code]++
+	e.duration.observe(d.Seconds())
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController get at the real ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// metricsWriter writes the text format. Families have to be written whole,
+// so every family is a call with all of its samples.
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw *metricsWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	mw.printf("%s%s %s\n", name, labels, formatFloat(value))
+}
+
+func (mw *metricsWriter) histogram(name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		mw.sample(name+"_bucket", labels+sep+`le="`+formatFloat(bound)+`"`, float64(cumulative))
+	}
+	mw.sample(name+"_bucket", labels+sep+`le="+Inf"`, float64(h.count))
+	mw.sample(name+"_sum", labels, h.sum)
+	mw.sample(name+"_count", labels, float64(h.count))
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// label formats name="value", escaped the way the text format wants.
+func label(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+// storeName is the store label of the store metrics.
+func storeName(store Store) string {
+	switch store := store.(type) {
+	case *WriteOptimizedMap:
+		return "map"
+	case *lru:
+		return "cache"
+	case *ShardedSyncMapStore:
+		return "syncmap"
+	case *Bitcask:
+		return "bitcask"
+	case *LSM:
+		return "lsm"
+	case *RaftStore:
+		return "raft"
+	case *ReplicatedStore:
+		return storeName(store.store)
+
+	}
+	return fmt.Sprintf("%T", store)
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricsWriter{w: w}
+	s.writeHTTPMetrics(mw)
+	s.writeStoreMetrics(mw)
+	s.writeReplicationMetrics(mw)
+	s.writeQuorumMetrics(mw)
+}
+
+// writeReplicationMetrics reports where the server's store is in the feed, if
+// it is a ReplicatedStore.
+func (s *Server) writeReplicationMetrics(mw *metricsWriter) {
+	replicated, ok := s.db.(*ReplicatedStore)
+	if !ok {
+		return
+	}
+	status := replicated.Status()
+	role := label("role", status.Role)
+	mw.header("kv_replication_offset", "gauge", "Last write in the feed on a primary, last one applied on a replica.")
+	mw.sample("kv_replication_offset", role, float64(status.Offset))
+	if status.Role == roleReplica {
+		connected := 0.0
+		if status.Connected {
+			connected = 1
+		}
+		mw.header("kv_replication_connected", "gauge", "Whether the replica is streaming from the primary.")
+		mw.sample("kv_replication_connected", "", connected)
+		mw.header("kv_replication_lag", "gauge", "Writes the replica is behind the primary.")
+		mw.sample("kv_replication_lag", "", float64(status.Lag))
+		mw.header("kv_replication_lag_seconds", "gauge", "How much older the last write the replica applied is than the primary's latest.")
+		mw.sample("kv_replication_lag_seconds", "", status.LagSeconds)
+		return
+	}
+	mw.header("kv_replication_replica_lag", "gauge", "Writes the primary has not streamed to a replica yet.")
+	for _, replica := range status.Replicas {
+		mw.sample("kv_replication_replica_lag", label("replica", replica.Name), float64(replica.Lag))
+	}
+}
+
+// writeQuorumMetrics reports the read repairs, hints and anti-entropy of the
+// server's store, if it is a QuorumStore.
+func (s *Server) writeQuorumMetrics(mw *metricsWriter) {
+	q, ok := s.db.(*QuorumStore)
+	if !ok {
+		return
+	}
+	status := q.Status()
+	mw.header("kv_quorum_read_repairs_total", "counter", "Replicas that were behind and got the newest value after a read.")
+	mw.sample("kv_quorum_read_repairs_total", "", float64(status.ReadRepairs))
+	mw.header("kv_quorum_hints", "gauge", "Writes this node keeps for a node that was down.")
+	nodes := make([]string, 0, len(status.Hints))
+	for node := range status.Hints {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		mw.sample("kv_quorum_hints", label("node", node), float64(status.Hints[node]))
+	}
+	mw.header("kv_quorum_hints_delivered_total", "counter", "Hints handed over to the node they were for.")
+	mw.sample("kv_quorum_hints_delivered_total", "", float64(status.HintsDelivered))
+	ae := status.AntiEntropy
+	mw.header("kv_quorum_antientropy_rounds_total", "counter", "Merkle tree comparisons with another node.")
+	mw.sample("kv_quorum_antientropy_rounds_total", "", float64(ae.Rounds))
+	mw.header("kv_quorum_antientropy_failures_total", "counter", "Merkle tree comparisons that didn't finish.")
+	mw.sample("kv_quorum_antientropy_failures_total", "", float64(ae.Failures))
+	mw.header("kv_quorum_antientropy_keys_repaired_total", "counter", "Keys anti-entropy found a newer record of, on this node (pulled) or the other one (pushed).")
+	mw.sample("kv_quorum_antientropy_keys_repaired_total", label("direction", "pulled"), float64(ae.KeysPulled))
+	mw.sample("kv_quorum_antientropy_keys_repaired_total", label("direction", "pushed"), float64(ae.KeysPushed))
+}
+
+func (s *Server) writeHTTPMetrics(mw *metricsWriter) {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	endpoints := make([]string, 0, len(s.metrics.endpoints))
+	for endpoint := range s.metrics.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	mw.header("kv_http_requests_total", "counter", "HTTP requests by endpoint and status code.")
+	for _, endpoint := range endpoints {
+		codes := s.metrics.endpoints[endpoint].codes
+		sorted := make([]int, 0, len(codes))
+		for code := range codes {
+			sorted = append(sorted, code)
+		}
+		sort.Ints(sorted)
+		for _, code := range sorted {
+			mw.sample("kv_http_requests_total", label("endpoint", endpoint)+","+label("code", strconv.Itoa(code)), float64(codes[code]))
+		}
+	}
+	mw.header("kv_http_request_duration_seconds", "histogram", "How long HTTP requests took to handle, by endpoint.")
+	for _, endpoint := range endpoints {
+		mw.histogram("kv_http_request_duration_seconds", label("endpoint", endpoint), s.metrics.endpoints[endpoint].duration)
+	}
+}
+
+// labeledStore is a store and the labels of its samples.
+type labeledStore struct {
+	labels string
+	store  Store
+}
+
+// stores are the server's store and those of its namespaces. Only the
+// namespaces get a namespace label, so the samples of a server without any
+// look the same as they always did.
+func (s *Server) stores() []labeledStore {
+	stores := []labeledStore{{label("store", storeName(s.db)), s.db}}
+	if s.opts.Namespaces == nil {
+		return stores
+	}
+	for _, spec := range s.opts.Namespaces.List() {
+		if store, ok := s.opts.Namespaces.Store(spec.Name); ok {
+			stores = append(stores, labeledStore{label("store", storeName(store)) + "," + label("namespace", spec.Name), store})
+		}
+	}
+	return stores
+}
+
+func (s *Server) writeStoreMetrics(mw *metricsWriter) {
+	// A family has to be written whole, so it is one loop over the stores
+	// per family.
+	stores := s.stores()
+	var instrumented, counted, caches []labeledStore
+	for _, ls := range stores {
+		if _, ok := ls.store.(interface{ metrics() *storeMetrics }); ok {
+			instrumented = append(instrumented, ls)
+		}
+		if _, ok := ls.store.(interface{ Len() int }); ok {
+			counted = append(counted, ls)
+		}
+		if _, ok := ls.store.(interface{ Stats() CacheStats }); ok {
+			caches = append(caches, ls)
+		}
+	}
+
+	if len(instrumented) > 0 {
+		mw.header("kv_store_operations_total", "counter", "Store operations by result. A full result is a write refused with ErrKVFull.")
+		for _, ls := range instrumented {
+			m := ls.store.(interface{ metrics() *storeMetrics }).metrics()
+			for op := storeOp(0); op < numStoreOps; op++ {
+				for result := 0; result < numOpResults; result++ {
+					labels := ls.labels + "," + label("op", storeOpNames[op]) + "," + label("result", opResultNames[result])
+					mw.sample("kv_store_operations_total", labels, float64(m.ops[op][result].Load()))
+				}
+			}
+		}
+		mw.header("kv_store_batch_update_rollbacks_total", "counter", "Bulk updates that were undone because they failed or were cancelled halfway.")
+		for _, ls := range instrumented {
+			m := ls.store.(interface{ metrics() *storeMetrics }).metrics()
+			mw.sample("kv_store_batch_update_rollbacks_total", ls.labels, float64(m.rollbacks.Load()))
+		}
+		mw.header("kv_store_batch_update_size", "histogram", "Pairs per bulk update.")
+		for _, ls := range instrumented {
+			m := ls.store.(interface{ metrics() *storeMetrics }).metrics()
+			m.mu.Lock()
+			sizes := m.batchSizes
+			if sizes == nil {
+				sizes = newHistogram(batchSizeBuckets)
+			}
+			mw.histogram("kv_store_batch_update_size", ls.labels, sizes)
+			m.mu.Unlock()
+		}
+	}
+
+	if len(counted) > 0 {
+		mw.header("kv_store_entries", "gauge", "Keys currently in the store.")
+		for _, ls := range counted {
+			mw.sample("kv_store_entries", ls.labels, float64(ls.store.(interface{ Len() int }).Len()))
+		}
+	}
+
+	if len(caches) > 0 {
+		stats := make([]CacheStats, len(caches))
+		for i, ls := range caches {
+			stats[i] = ls.store.(interface{ Stats() CacheStats }).Stats()
+		}
+		mw.header("kv_cache_hits_total", "counter", "Reads that found their key.")
+		for i, ls := range caches {
+			mw.sample("kv_cache_hits_total", ls.labels, float64(stats[i].Hits))
+		}
+		mw.header("kv_cache_misses_total", "counter", "Reads that did not find their key.")
+		for i, ls := range caches {
+			mw.sample("kv_cache_misses_total", ls.labels, float64(stats[i].Misses))
+		}
+		mw.header("kv_cache_evictions_total", "counter", "Keys evicted to make room.")
+		for i, ls := range caches {
+			mw.sample("kv_cache_evictions_total", ls.labels, float64(stats[i].Evictions))
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package kv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// cancelledOnceStarted is a context that only says it is cancelled once it
+// is asked for Err, so BatchUpdate gets past its up front check and has to
+// roll back.
+type cancelledOnceStarted struct {
+	context.Context
+}
+
+func (cancelledOnceStarted) Done() <-chan struct{} { return nil }
+func (cancelledOnceStarted) Err() error            { return context.Canceled }
+
+func scrape(t *testing.T, server http.Handler) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics answered %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func expectMetrics(t *testing.T, metrics string, want ...string) {
+	t.Helper()
+	for _, line := range want {
+		if !strings.Contains(metrics, "\n"+line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestMetrics_Store(t *testing.T) {
+	store := NewWriteOptimizedMapStore(1, true, 2)
+	server := NewHTTPServer(store, "")
+	do := func(method, path, body string) {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+	do(http.MethodPost, "/set", `{"key":"a","value":1}`)
+	do(http.MethodPost, "/set", `{"key":"b","value":1}`)
+	do(http.MethodPost, "/set", `{"key":"c","value":1}`)
+	do(http.MethodGet, "/get?key=a", "")
+	do(http.MethodGet, "/get?key=missing", "")
+	do(http.MethodPatch, "/updateBulk", `[{"key":"a","value":2},{"key":"missing","value":2}]`)
+	do(http.MethodGet, "/nope", "")
+	store.BatchUpdate(cancelledOnceStarted{context.Background()}, []Pair{{"a", 3}})
+
+	expectMetrics(t, scrape(t, server),
+		`kv_http_requests_total{endpoint="/set",code="201"} 2`,
+		`kv_http_requests_total{endpoint="/set",code="507"} 1`,
+		`kv_http_requests_total{endpoint="/get",code="200"} 1`,
+		`kv_http_requests_total{endpoint="/get",code="404"} 1`,
+		`kv_http_requests_total{endpoint="/updateBulk",code="206"} 1`,
+		`kv_http_requests_total{endpoint="other",code="404"} 1`,
+		`kv_http_request_duration_seconds_count{endpoint="/set"} 3`,
+		`kv_store_operations_total{store="map",op="put",result="ok"} 2`,
+		`kv_store_operations_total{store="map",op="put",result="full"} 1`,
+		`kv_store_operations_total{store="map",op="get",result="ok"} 1`,
+		`kv_store_operations_total{store="map",op="get",result="not_found"} 1`,
+		`kv_store_operations_total{store="map",op="batch_update",result="ok"} 1`,
+		`kv_store_operations_total{store="map",op="batch_update",result="error"} 1`,
+		`kv_store_batch_update_rollbacks_total{store="map"} 1`,
+		`kv_store_batch_update_size_bucket{store="map",le="1"} 1`,
+		`kv_store_batch_update_size_bucket{store="map",le="5"} 2`,
+		`kv_store_batch_update_size_sum{store="map"} 3`,
+		`kv_store_entries{store="map"} 2`,
+	)
+}
+
+func TestMetrics_ConditionalOperations(t *testing.T) {
+	stores := map[string]ConditionalStore{
+		"map":     NewWriteOptimizedMapStore(1, true, 2),
+		"cache":   NewLRUCacheStore(2),
+		"syncmap": NewShardedSyncMapStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			server := NewHTTPServer(store, "")
+			store.PutIfAbsent("a", "1")
+			store.PutIfAbsent("a", "1")
+			store.GetOrPut("b", "1")
+			store.CompareAndSwap("a", "1", "2")
+			store.CompareAndSwap("a", "1", "3")
+			store.CompareAndDelete("a", "2")
+			store.CompareAndDelete("a", "2")
+
+			puts := "2"
+			if name == "map" {
+				// One more fits, the next doesn't.
+				store.PutIfAbsent("c", "1")
+				store.GetOrPut("d", "1")
+				puts = "3"
+			}
+			want := []string{
+				`kv_store_operations_total{store="` + name + `",op="put",result="ok"} ` + puts,
+				`kv_store_operations_total{store="` + name + `",op="put",result="conflict"} 1`,
+				`kv_store_operations_total{store="` + name + `",op="update",result="ok"} 1`,
+				`kv_store_operations_total{store="` + name + `",op="update",result="conflict"} 1`,
+				`kv_store_operations_total{store="` + name + `",op="delete",result="ok"} 1`,
+				`kv_store_operations_total{store="` + name + `",op="delete",result="not_found"} 1`,
+			}
+			if name == "map" {
+				want = append(want, `kv_store_operations_total{store="map",op="put",result="full"} 1`)
+			}
+			expectMetrics(t, scrape(t, server), want...)
+		})
+	}
+}
+
+func TestMetrics_Cache(t *testing.T) {
+	cache := NewLRUCacheStore(1)
+	server := NewHTTPServer(cache, "")
+	cache.Put("a", 1)
+	cache.Put("b", 1)
+	cache.Get("a")
+	cache.Get("b")
+	cache.BatchUpdate(context.Background(), []Pair{{"b", 2}})
+
+	expectMetrics(t, scrape(t, server),
+		`kv_cache_hits_total{store="cache"} 1`,
+		`kv_cache_misses_total{store="cache"} 1`,
+		`kv_cache_evictions_total{store="cache"} 1`,
+		`kv_store_entries{store="cache"} 1`,
+		// The update of a batch is not counted as an update of its own.
+		`kv_store_operations_total{store="cache",op="update",result="ok"} 0`,
+		`kv_store_operations_total{store="cache",op="batch_update",result="ok"} 1`,
+	)
+}
@@ -0,0 +1,526 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Namespaces are named stores that a single Server hosts next to its own, so
+// tenants (or databases, or whatever they are to you) don't each need a port.
+// Every namespace has its own engine and its own limits: one of them being
+// full doesn't make the others full too.
+//
+// A request picks its namespace with a /ns/<name> path prefix, as in
+// /ns/tenant1/get?key=a, or with the X-KV-Namespace header on the usual
+// paths. Without either it goes to the store the Server was made with.
+type Namespaces struct {
+	opts NamespacesOptions
+
+	mu     sync.RWMutex
+	spaces map[string]*namespace
+}
+
+// NamespacesOptions are the settings every namespace shares.
+type NamespacesOptions struct {
+	// Dir is where the namespaces keep their data, each in a directory of
+	// its own, along with a list of the namespaces that is read back on
+	// startup. The map engine writes a write-ahead log there, bitcask and lsm
+	// their files. Without a Dir namespaces only live in memory and the
+	// bitcask and lsm engines are not available.
+	Dir string
+	// Fsync and FsyncInterval are for the files in Dir.
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+}
+
+// NamespaceSpec says what a namespace is made of.
+type NamespaceSpec struct {
+	Name string `json:"name"`
+	// Engine is map (the default), syncmap, cache, bitcask or lsm.
+	Engine string `json:"engine,omitempty"`
+	// Capacity (in keys) or MaxBytes is the size limit of the map and
+	// cache engines, which need one of them. The others have no limit.
+	Capacity int   `json:"capacity,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// Eviction is the eviction policy of the cache engine, lru by default.
+	Eviction string `json:"eviction,omitempty"`
+}
+
+// namespace is a live namespace. Requests hold mu for reading while they use
+// the store, so Delete can wait for them before closing it.
+type namespace struct {
+	spec  NamespaceSpec
+	store Store
+	// deleting is set, under Namespaces.mu, while Delete removes the files.
+	// The namespace is gone for everything but Create until then.
+	deleting bool
+
+	mu sync.RWMutex
+}
+
+type namespaceNotFoundError struct{}
+
+func (e *namespaceNotFoundError) Error() string {
+	return "namespace not found"
+}
+
+var ErrNamespaceNotFound = &namespaceNotFoundError{}
+
+type namespaceExistsError struct{}
+
+func (e *namespaceExistsError) Error() string {
+	return "namespace already exists"
+}
+
+var ErrNamespaceExists = &namespaceExistsError{}
+
+// badNamespaceError is a NamespaceSpec that makes no sense.
+type badNamespaceError struct {
+	reason string
+}
+
+func (e *badNamespaceError) Error() string {
+	return "bad namespace: " + e.reason
+}
+
+// Names end up in paths, URLs and directory names, so they are kept boring.
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+const namespacesManifest = "namespaces.json"
+
+// NewNamespaces returns an empty set of namespaces, or the ones that were in
+// opts.Dir last time.
+func NewNamespaces(opts NamespacesOptions) (*Namespaces, error) {
+	n := &Namespaces{opts: opts, spaces: make(map[string]*namespace)}
+	if opts.Dir == "" {
+		return n, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(opts.Dir, namespacesManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return n, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var specs []NamespaceSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("kv: reading %s: %w", namespacesManifest, err)
+	}
+	for _, spec := range specs {
+		store, err := n.open(spec)
+		if err != nil {
+			n.Close()
+			return nil, fmt.Errorf("kv: opening namespace %s: %w", spec.Name, err)
+		}
+		n.spaces[spec.Name] = &namespace{spec: spec, store: store}
+	}
+	return n, nil
+}
+
+func (spec *NamespaceSpec) validate(dir string) error {
+	if !namespaceName.MatchString(spec.Name) {
+		return &badNamespaceError{fmt.Sprintf("name %q must be 1 to 64 letters, digits, - or _", spec.Name)}
+	}
+	if spec.Engine == "" {
+		spec.Engine = "map"
+	}
+	if spec.Capacity < 0 || spec.MaxBytes < 0 {
+		return &badNamespaceError{"capacity and maxBytes can't be negative"}
+	}
+	switch spec.Engine {
+	case "map", "cache":
+		if spec.Capacity == 0 && spec.MaxBytes == 0 {
+			return &badNamespaceError{fmt.Sprintf("the %s engine needs a capacity or maxBytes", spec.Engine)}
+		}
+	case "syncmap", "bitcask", "lsm":
+		if spec.Capacity != 0 || spec.MaxBytes != 0 {
+			return &badNamespaceError{fmt.Sprintf("the %s engine has no size limit", spec.Engine)}
+		}
+		if spec.Engine != "syncmap" && dir == "" {
+			return &badNamespaceError{fmt.Sprintf("the %s engine needs a data directory", spec.Engine)}
+		}
+	default:
+		return &badNamespaceError{fmt.Sprintf("unknown engine %q, expected map, syncmap, cache, bitcask or lsm", spec.Engine)}
+	}
+	if spec.Engine == "cache" {
+		if spec.Eviction == "" {
+			spec.Eviction = "lru"
+		}
+		if _, err := NewEvictionPolicy(spec.Eviction, max(spec.Capacity, 1)); err != nil {
+			return &badNamespaceError{err.Error()}
+		}
+	} else if spec.Eviction != "" {
+		return &badNamespaceError{"only the cache engine evicts"}
+	}
+	return nil
+}
+
+// open makes the store of a validated spec.
+func (n *Namespaces) open(spec NamespaceSpec) (Store, error) {
+	dir := filepath.Join(n.opts.Dir, spec.Name)
+	switch spec.Engine {
+	case "map":
+		store := NewWriteOptimizedMapStore(1, true, spec.Capacity)
+		if spec.MaxBytes > 0 {
+			store = NewWeightedWriteOptimizedMapStore(1, true, spec.MaxBytes, nil)
+		}
+		if n.opts.Dir == "" {
+			return store, nil
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		wal, err := OpenWAL(filepath.Join(dir, "wal"), WALOptions{Fsync: n.opts.Fsync, FsyncInterval: n.opts.FsyncInterval})
+		if err != nil {
+			return nil, err
+		}
+		if err := store.AttachWAL(wal); err != nil {
+			wal.Close()
+			return nil, err
+		}
+		return store, nil
+	case "syncmap":
+		return NewShardedSyncMapStore(), nil
+	case "cache":
+		policy, err := NewEvictionPolicy(spec.Eviction, max(spec.Capacity, 1))
+		if err != nil {
+			return nil, err
+		}
+		if spec.MaxBytes > 0 {
+			return NewWeightedCacheStore(spec.MaxBytes, nil, policy), nil
+		}
+		return NewCacheStore(spec.Capacity, policy), nil
+	case "bitcask":
+		return OpenBitcaskStore(dir, BitcaskOptions{Fsync: n.opts.Fsync, FsyncInterval: n.opts.FsyncInterval})
+	case "lsm":
+		return OpenLSMStore(dir, LSMOptions{Fsync: n.opts.Fsync, FsyncInterval: n.opts.FsyncInterval})
+	}
+	return nil, &badNamespaceError{fmt.Sprintf("unknown engine %q", spec.Engine)}
+}
+
+// Create makes a new namespace. It returns ErrNamespaceExists if the name is
+// taken, or still being deleted, and a *badNamespaceError if spec makes no
+// sense. A namespace with the name of one that was deleted starts out empty.
+func (n *Namespaces) Create(spec NamespaceSpec) error {
+	if err := spec.validate(n.opts.Dir); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.spaces[spec.Name]; ok {
+		return ErrNamespaceExists
+	}
+	store, err := n.open(spec)
+	if err != nil {
+		return err
+	}
+	n.spaces[spec.Name] = &namespace{spec: spec, store: store}
+	if err := n.writeManifest(); err != nil {
+		delete(n.spaces, spec.Name)
+		closeStore(store)
+		return err
+	}
+	return nil
+}
+
+// Delete removes a namespace and everything in it. It waits for the requests
+// using the namespace to finish, new ones already get ErrNamespaceNotFound.
+func (n *Namespaces) Delete(name string) error {
+	n.mu.Lock()
+	ns, ok := n.lookup(name)
+	if !ok {
+		n.mu.Unlock()
+		return ErrNamespaceNotFound
+	}
+	// It stays in spaces until its files are gone, or a Create of the same
+	// name could open them again and have them removed from under it.
+	ns.deleting = true
+	err := n.writeManifest()
+	if err != nil {
+		ns.deleting = false
+	}
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ns.mu.Lock()
+	err = closeStore(ns.store)
+	if n.opts.Dir != "" {
+		err = errors.Join(err, os.RemoveAll(filepath.Join(n.opts.Dir, name)))
+	}
+	ns.mu.Unlock()
+
+	n.mu.Lock()
+	delete(n.spaces, name)
+	n.mu.Unlock()
+	return err
+}
+
+// lookup returns the namespace name unless it is being deleted, must be
+// called with n.mu held.
+func (n *Namespaces) lookup(name string) (*namespace, bool) {
+	ns, ok := n.spaces[name]
+	if !ok || ns.deleting {
+		return nil, false
+	}
+	return ns, true
+}
+
+// List returns the specs of all the namespaces, sorted by name.
+func (n *Namespaces) List() []NamespaceSpec {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	specs := make([]NamespaceSpec, 0, len(n.spaces))
+	for _, ns := range n.spaces {
+		if !ns.deleting {
+			specs = append(specs, ns.spec)
+		}
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+// Store returns the store of the namespace name. It is only good until the
+// namespace is deleted.
+func (n *Namespaces) Store(name string) (Store, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	ns, ok := n.lookup(name)
+	if !ok {
+		return nil, false
+	}
+	return ns.store, true
+}
+
+// acquire returns the namespace name read locked, so it can't be deleted
+// until release is called.
+func (n *Namespaces) acquire(name string) (ns *namespace, release func(), ok bool) {
+	n.mu.RLock()
+	ns, ok = n.lookup(name)
+	if ok {
+		// Taken before letting go of n.mu, so Delete can't get in between
+		// and close the store under us.
+		ns.mu.RLock()
+	}
+	n.mu.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	return ns, ns.mu.RUnlock, true
+}
+
+// Close closes the stores of all the namespaces, but keeps their data.
+func (n *Namespaces) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var errs []error
+	for _, ns := range n.spaces {
+		// Delete closes the ones it is deleting itself.
+		if !ns.deleting {
+			errs = append(errs, closeStore(ns.store))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func closeStore(store Store) error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// writeManifest saves the list of namespaces, must be called with n.mu held.
+// Written to a temporary file and renamed, so a crash leaves either the old
+// list or the new one.
+func (n *Namespaces) writeManifest() error {
+	if n.opts.Dir == "" {
+		return nil
+	}
+	specs := make([]NamespaceSpec, 0, len(n.spaces))
+	for _, ns := range n.spaces {
+		if !ns.deleting {
+			specs = append(specs, ns.spec)
+		}
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	data, err := json.MarshalIndent(specs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(n.opts.Dir, ".namespaces-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(n.opts.Dir, namespacesManifest))
+}
+
+// NamespaceHeader picks the namespace of a request that doesn't have it in
+// its path.
+const NamespaceHeader = "X-KV-Namespace"
+
+type namespaceKey struct{}
+
+// splitNamespace takes the namespace off the path of r, /ns/tenant1/get
+// becomes /get, or gets it from the header. It is an error for the two to
+// disagree.
+func splitNamespace(r *http.Request) (string, *http.Request, error) {
+	name := r.Header.Get(NamespaceHeader)
+	rest, ok := strings.CutPrefix(r.URL.Path, "/ns/")
+	if !ok {
+		return name, r, nil
+	}
+	pathName, path, _ := strings.Cut(rest, "/")
+	if name != "" && name != pathName {
+		return "", r, fmt.Errorf("namespace %q in the path but %q in the %s header", pathName, name, NamespaceHeader)
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + path
+	r2.URL.RawPath = ""
+	return pathName, r2, nil
+}
+
+// serveNamespace hands r to the mux with the store of namespace name, or the
+// server's own if name is empty.
+func (s *Server) serveNamespace(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+	if s.opts.Namespaces == nil {
+		http.Error(w, "Namespaces not enabled", http.StatusNotFound)
+		return
+	}
+	if r.URL.Path == "/admin/namespaces" {
+		http.Error(w, "Namespaces don't nest", http.StatusBadRequest)
+		return
+	}
+	ns, release, ok := s.opts.Namespaces.acquire(name)
+	if !ok {
+		http.Error(w, ErrNamespaceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	defer release()
+	s.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), namespaceKey{}, ns)))
+}
+
+// store is the store r is for, the one of its namespace if it has one. A
+// QuorumStore comes with the consistency r asked for.
+func (s *Server) store(r *http.Request) Store {
+	if ns, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		return ns.store
+	}
+	if c, ok := r.Context().Value(consistencyKey{}).(Consistency); ok {
+		return s.db.(*QuorumStore).WithConsistency(c)
+	}
+	return s.db
+}
+
+// requestNamespace is the name of the namespace of r, empty for the server's
+// own store.
+func requestNamespace(r *http.Request) string {
+	if ns, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		return ns.spec.Name
+	}
+	return ""
+}
+
+// namespacesHandler lists the namespaces on a GET, creates one from the
+// NamespaceSpec in the body of a POST and deletes ?name= on a DELETE.
+// Creating a namespace takes write permission on all of it, deleting one
+// what a restore takes. Listing only shows the namespaces the identity has
+// any permission in.
+func (s *Server) namespacesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Namespaces == nil {
+		http.Error(w, "Namespaces not enabled", http.StatusNotImplemented)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		specs := make([]NamespaceSpec, 0)
+		for _, spec := range s.opts.Namespaces.List() {
+			if s.opts.ACL == nil || s.opts.ACL.namespacePermission(requestIdentity(r), spec.Name) != 0 {
+				specs = append(specs, spec)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Response{Value: specs})
+
+	case http.MethodPost:
+		var spec NamespaceSpec
+		err := json.NewDecoder(r.Body).Decode(&spec)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if !s.allowedNamespace(w, r, spec.Name, PermWrite) {
+			return
+		}
+		if err := s.opts.Namespaces.Create(spec); err != nil {
+			namespaceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if !s.allowedNamespace(w, r, name, PermWrite|PermDelete|PermBulk) {
+			return
+		}
+		if err := s.opts.Namespaces.Delete(name); err != nil {
+			namespaceError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func namespaceError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *namespaceNotFoundError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case *namespaceExistsError:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case *badNamespaceError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("namespace: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,222 @@
+package kv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer_Namespaces(t *testing.T) {
+	namespaces, err := NewNamespaces(NamespacesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewHTTPServerWithOptions(NewWriteOptimizedMapStore(1, true, 10), "", HTTPOptions{Namespaces: namespaces})
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, r)
+		return rec
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		header       []string
+		want         int
+	}{
+		{"create small", http.MethodPost, "/admin/namespaces", `{"name":"small","capacity":1}`, nil, http.StatusCreated},
+		{"create cache", http.MethodPost, "/admin/namespaces", `{"name":"cache","engine":"cache","capacity":1,"eviction":"lfu"}`, nil, http.StatusCreated},
+		{"create again", http.MethodPost, "/admin/namespaces", `{"name":"small","capacity":1}`, nil, http.StatusConflict},
+		{"bad name", http.MethodPost, "/admin/namespaces", `{"name":"../etc","capacity":1}`, nil, http.StatusBadRequest},
+		{"no capacity", http.MethodPost, "/admin/namespaces", `{"name":"big"}`, nil, http.StatusBadRequest},
+		{"bitcask without a dir", http.MethodPost, "/admin/namespaces", `{"name":"disk","engine":"bitcask"}`, nil, http.StatusBadRequest},
+
+		{"set by path", http.MethodPost, "/ns/small/set", `{"key":"a","value":1}`, nil, http.StatusCreated},
+		{"small is full", http.MethodPost, "/ns/small/set", `{"key":"b","value":1}`, nil, http.StatusInsufficientStorage},
+		{"cache evicts", http.MethodPost, "/set", `{"key":"b","value":1}`, []string{NamespaceHeader, "cache"}, http.StatusCreated},
+		{"cache evicts again", http.MethodPost, "/set", `{"key":"c","value":1}`, []string{NamespaceHeader, "cache"}, http.StatusCreated},
+		{"own store is not full", http.MethodPost, "/set", `{"key":"b","value":1}`, nil, http.StatusCreated},
+		{"get by header", http.MethodGet, "/get?key=a", "", []string{NamespaceHeader, "small"}, http.StatusOK},
+		{"keys are separate", http.MethodGet, "/get?key=a", "", nil, http.StatusNotFound},
+		{"keys are separate too", http.MethodGet, "/ns/cache/get?key=a", "", nil, http.StatusNotFound},
+		{"path and header disagree", http.MethodGet, "/ns/small/get?key=a", "", []string{NamespaceHeader, "cache"}, http.StatusBadRequest},
+		{"unknown namespace", http.MethodGet, "/ns/nope/get?key=a", "", nil, http.StatusNotFound},
+		{"no nesting", http.MethodGet, "/ns/small/admin/namespaces", "", nil, http.StatusBadRequest},
+
+		{"delete", http.MethodDelete, "/admin/namespaces?name=small", "", nil, http.StatusOK},
+		{"deleted", http.MethodGet, "/ns/small/get?key=a", "", nil, http.StatusNotFound},
+		{"delete again", http.MethodDelete, "/admin/namespaces?name=small", "", nil, http.StatusNotFound},
+		{"recreated empty", http.MethodPost, "/admin/namespaces", `{"name":"small","capacity":1}`, nil, http.StatusCreated},
+		{"recreated is empty", http.MethodGet, "/ns/small/get?key=a", "", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.path, tt.body, tt.header...)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.want, rec.Code, rec.Body)
+		}
+	}
+
+	var list struct {
+		Value []NamespaceSpec `json:"value"`
+	}
+	rec := do(http.MethodGet, "/admin/namespaces", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Value) != 2 || list.Value[0].Name != "cache" || list.Value[0].Eviction != "lfu" || list.Value[1].Engine != "map" {
+		t.Errorf("Expected cache and small, got %+v", list.Value)
+	}
+
+	expectMetrics(t, scrape(t, server),
+		`kv_store_entries{store="map"} 1`,
+		`kv_store_entries{store="cache",namespace="cache"} 1`,
+		`kv_cache_evictions_total{store="cache",namespace="cache"} 1`,
+		`kv_store_operations_total{store="map",namespace="small",op="put",result="ok"} 0`,
+		`kv_http_requests_total{endpoint="/set",code="507"} 1`,
+	)
+}
+
+func TestServer_NamespacesACL(t *testing.T) {
+	namespaces, _ := NewNamespaces(NamespacesOptions{})
+	namespaces.Create(NamespaceSpec{Name: "a", Capacity: 10})
+	namespaces.Create(NamespaceSpec{Name: "b", Capacity: 10})
+	server := NewHTTPServerWithOptions(NewWriteOptimizedMapStore(1, true, 10), "", HTTPOptions{
+		Namespaces: namespaces,
+		Auth:       []Authenticator{NewAPIKeys(map[string]string{"k-alice": "alice", "k-admin": "admin"})},
+		ACL: ACL{
+			{Identity: "alice", Namespace: "a", Permission: PermRead | PermWrite},
+			{Identity: "admin", Namespace: AnyNamespace, Permission: PermRead | PermWrite | PermDelete | PermBulk},
+		},
+	})
+	do := func(method, path, body, key string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := do(http.MethodPost, "/ns/a/set", `{"key":"x","value":1}`, "k-alice"); code != http.StatusCreated {
+		t.Errorf("Expected alice to write to a, got %d", code)
+	}
+	if code := do(http.MethodPost, "/ns/b/set", `{"key":"x","value":1}`, "k-alice"); code != http.StatusForbidden {
+		t.Errorf("Expected alice not to write to b, got %d", code)
+	}
+	if code := do(http.MethodPost, "/set", `{"key":"x","value":1}`, "k-alice"); code != http.StatusForbidden {
+		t.Errorf("Expected alice not to write to the server's store, got %d", code)
+	}
+	if code := do(http.MethodPost, "/admin/namespaces", `{"name":"c","capacity":1}`, "k-alice"); code != http.StatusForbidden {
+		t.Errorf("Expected alice not to create namespaces, got %d", code)
+	}
+	if code := do(http.MethodDelete, "/admin/namespaces?name=a", "", "k-alice"); code != http.StatusForbidden {
+		t.Errorf("Expected alice not to delete her namespace, got %d", code)
+	}
+	if code := do(http.MethodPost, "/admin/namespaces", `{"name":"c","capacity":1}`, "k-admin"); code != http.StatusCreated {
+		t.Errorf("Expected admin to create namespaces, got %d", code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/namespaces", nil)
+	r.Header.Set("X-API-Key", "k-alice")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, r)
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"value":[{"name":"a","engine":"map","capacity":10}]}` {
+		t.Errorf("Expected alice to only see a, got %s", body)
+	}
+}
+
+func TestNamespaces_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	namespaces, err := NewNamespaces(NamespacesOptions{Dir: dir, Fsync: FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []NamespaceSpec{
+		{Name: "m", Capacity: 10},
+		{Name: "bc", Engine: "bitcask"},
+		{Name: "gone", Engine: "lsm"},
+	} {
+		if err := namespaces.Create(spec); err != nil {
+			t.Fatalf("Creating %s: %v", spec.Name, err)
+		}
+	}
+	for _, name := range []string{"m", "bc"} {
+		store, _ := namespaces.Store(name)
+		if err := store.Put("k", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := namespaces.Delete("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gone")); !os.IsNotExist(err) {
+		t.Errorf("Expected the data of a deleted namespace to be removed, got %v", err)
+	}
+	if err := namespaces.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces, err = NewNamespaces(NamespacesOptions{Dir: dir, Fsync: FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer namespaces.Close()
+	if specs := namespaces.List(); len(specs) != 2 {
+		t.Fatalf("Expected 2 namespaces after reopening, got %+v", specs)
+	}
+	for _, name := range []string{"m", "bc"} {
+		store, _ := namespaces.Store(name)
+		if value, err := store.Get("k"); err != nil || value != name {
+			t.Errorf("Expected %s to keep its data, got %v, %v", name, value, err)
+		}
+	}
+}
+
+func TestNamespaces_CreateWhileDeleting(t *testing.T) {
+	dir := t.TempDir()
+	namespaces, err := NewNamespaces(NamespacesOptions{Dir: dir, Fsync: FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer namespaces.Close()
+	if err := namespaces.Create(NamespaceSpec{Name: "a", Engine: "bitcask"}); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := namespaces.Store("a")
+	store.Put("old", 1)
+
+	// A request still using a keeps Delete from getting to the files.
+	_, release, _ := namespaces.acquire("a")
+	deleted := make(chan error, 1)
+	go func() { deleted <- namespaces.Delete("a") }()
+	waitFor(t, "a to be on its way out", func() bool {
+		_, ok := namespaces.Store("a")
+		return !ok
+	})
+	if err := namespaces.Create(NamespaceSpec{Name: "a", Engine: "bitcask"}); err != ErrNamespaceExists {
+		t.Errorf("Expected a namespace that is being deleted to keep its name, got %v", err)
+	}
+	if err := namespaces.Delete("a"); err != ErrNamespaceNotFound {
+		t.Errorf("Expected a second Delete to find nothing, got %v", err)
+	}
+	release()
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := namespaces.Create(NamespaceSpec{Name: "a", Engine: "bitcask"}); err != nil {
+		t.Fatal(err)
+	}
+	store, _ = namespaces.Store("a")
+	if _, err := store.Get("old"); !isNotFound(err) {
+		t.Errorf("Expected the new a to start out empty, got %v", err)
+	}
+}
@@ -0,0 +1,634 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QuorumStore replicates every key over N of a set of nodes, the way Dynamo
+// does. The nodes of a key are the first N clockwise from it on a Ring, and
+// any node can coordinate a read or a write of any key: a write is sent to
+// all N and succeeds once W of them have it, a read asks all N and answers
+// with the newest value of the first R. With R+W > N every read sees the
+// last successful write. Lower R or W trade that for speed and
+// availability, per request if need be, see WithConsistency.
+//
+// Replicas that disagree are put right on the way: once every replica of a
+// read has answered, the ones that were behind get the newest value (read
+// repair). A replica that is down is replaced for writes by the next node
+// on the ring that isn't a replica of the key (sloppy quorum), which keeps
+// the write as a hint and hands it over once the replica is back (hinted
+// handoff). Hints only live in memory. What both miss, keys nobody reads
+// and hints lost with the node that kept them, anti-entropy finds by
+// comparing Merkle trees with the other replicas in the background.
+//
+// Every node keeps its replicas in a store of its own, as records holding
+// the value and when it was written. The newest write wins, decided by the
+// clock of the node that coordinated it, so nodes whose clocks are apart
+// can lose writes that came shortly after another. Deleted keys stay
+// behind as tombstones, a replica that missed the delete would bring the
+// key back otherwise.
+type QuorumStore struct {
+	*quorumNode
+	// r and w are the consistency of this view of the store.
+	r, w int
+}
+
+// quorumNode is what all the views of a QuorumStore share.
+type quorumNode struct {
+	local  Store
+	opts   QuorumOptions
+	ring   *Ring
+	client *http.Client
+
+	// applyMu makes reading, comparing and writing a local record one step.
+	applyMu sync.Mutex
+	// clock is the last timestamp handed out, in microseconds.
+	clock atomic.Uint64
+
+	mu sync.Mutex
+	// hints are the writes this node keeps for others that were down, by
+	// node and key, newest only.
+	hints     map[string]map[string]quorumRecord
+	hintCount int
+
+	readRepairs    atomic.Uint64
+	hintsDelivered atomic.Uint64
+
+	// trees are the Merkle trees of the keys this node shares with each
+	// other node, nil if the local store can't list its keys.
+	treeMu sync.Mutex
+	trees  map[string]*MerkleTree
+
+	aeRounds, aeFailures, aePulled, aePushed atomic.Uint64
+	aeLastPeer, aeLastError                  string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// QuorumOptions configure a QuorumStore.
+type QuorumOptions struct {
+	// Self is the URL of the HTTP server of this node, as it is in Nodes.
+	Self string
+	// Nodes are the URLs of the HTTP servers of every node, this one
+	// included. Every node needs the same ones.
+	Nodes []string
+	// N is how many nodes have a copy of every key, 3 by default (or the
+	// number of nodes if there are fewer). R and W are how many replicas a
+	// read and a write wait for by default, a majority of N unless set.
+	N, R, W int
+	// VirtualNodes is how many points every node gets on the ring,
+	// DefaultVirtualNodes if it is 0.
+	VirtualNodes int
+	// Timeout bounds every request to another node. Defaults to 1s.
+	Timeout time.Duration
+	// HandoffInterval is how often hints are offered to the nodes they are
+	// for. Defaults to 1s.
+	HandoffInterval time.Duration
+	// MaxHints is how many writes a node keeps for others, it refuses to
+	// stand in for more. Defaults to 10000.
+	MaxHints int
+	// AntiEntropyInterval is how often this node compares its Merkle trees
+	// with another node, 30s by default, never if negative. MerkleDepth is
+	// the depth of the trees, DefaultMerkleDepth if 0, every node needs the
+	// same.
+	AntiEntropyInterval time.Duration
+	MerkleDepth         int
+	// HTTPClient is for talking to the other nodes, for TLS say. APIKey is
+	// sent along if they want one.
+	HTTPClient *http.Client
+	APIKey     string
+}
+
+// quorumRecord is what the local stores hold. Deleted makes it a tombstone.
+type quorumRecord struct {
+	Value   interface{} `json:"value,omitempty"`
+	Time    uint64      `json:"time"`
+	Node    string      `json:"node"`
+	Deleted bool        `json:"deleted,omitempty"`
+}
+
+// newer reports whether a is a later write than b. Nil is older than
+// anything.
+func (a *quorumRecord) newer(b *quorumRecord) bool {
+	if a == nil {
+		return false
+	}
+	if b == nil || a.Time != b.Time {
+		return b == nil || a.Time > b.Time
+	}
+	return a.Node > b.Node
+}
+
+// quorumError is a read or a write that didn't hear from enough replicas.
+type quorumError struct {
+	op        string
+	need, got int
+}
+
+func (e *quorumError) Error() string {
+	return fmt.Sprintf("quorum not reached for the %s: %d of %d replicas answered", e.op, e.got, e.need)
+}
+
+// errTooManyHints is a node refusing to stand in for another, it holds
+// MaxHints already.
+var errTooManyHints = errors.New("kv: too many hints for other nodes")
+
+// NewQuorumStore makes local this node's part of a QuorumStore. Close closes
+// local too.
+func NewQuorumStore(local Store, opts QuorumOptions) (*QuorumStore, error) {
+	nodes := make([]string, len(opts.Nodes))
+	self := false
+	for i, node := range opts.Nodes {
+		nodes[i] = strings.TrimRight(node, "/")
+		self = self || nodes[i] == strings.TrimRight(opts.Self, "/")
+	}
+	if !self {
+		return nil, fmt.Errorf("kv: %q is not one of the nodes", opts.Self)
+	}
+	opts.Self = strings.TrimRight(opts.Self, "/")
+	ring := NewRing(nodes, opts.VirtualNodes)
+	if opts.N == 0 {
+		opts.N = 3
+	}
+	opts.N = min(opts.N, len(ring.Nodes()))
+	if opts.R == 0 {
+		opts.R = opts.N/2 + 1
+	}
+	if opts.W == 0 {
+		opts.W = opts.N/2 + 1
+	}
+	if opts.N < 1 || opts.R < 1 || opts.R > opts.N || opts.W < 1 || opts.W > opts.N {
+		return nil, fmt.Errorf("kv: expected 1 <= R, W <= N, got N=%d R=%d W=%d", opts.N, opts.R, opts.W)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	if opts.HandoffInterval == 0 {
+		opts.HandoffInterval = time.Second
+	}
+	if opts.MaxHints == 0 {
+		opts.MaxHints = 10000
+	}
+	if opts.AntiEntropyInterval == 0 {
+		opts.AntiEntropyInterval = 30 * time.Second
+	}
+	if opts.MerkleDepth == 0 {
+		opts.MerkleDepth = DefaultMerkleDepth
+	}
+	if opts.MerkleDepth < 1 || opts.MerkleDepth > 20 {
+		return nil, fmt.Errorf("kv: expected a Merkle depth of 1 to 20, got %d", opts.MerkleDepth)
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+	q := &quorumNode{
+		local:  local,
+		opts:   opts,
+		ring:   ring,
+		client: client,
+		hints:  make(map[string]map[string]quorumRecord),
+	}
+	if err := q.buildTrees(); err != nil {
+		return nil, err
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.wg.Add(1)
+	go q.handoff()
+	if q.trees != nil && opts.AntiEntropyInterval > 0 {
+		q.wg.Add(1)
+		go q.antiEntropy()
+	}
+	return &QuorumStore{quorumNode: q, r: opts.R, w: opts.W}, nil
+}
+
+// Close stops handing off hints and anti-entropy, waits for the repairs and writes still
+// going on in the background and closes the local store.
+func (q *QuorumStore) Close() error {
+	q.cancel()
+	q.wg.Wait()
+	return closeStore(q.local)
+}
+
+// Consistency is how many replicas a read (R) or a write (W) waits for.
+// Zero leaves the default of the store.
+type Consistency struct {
+	R, W int
+}
+
+// WithConsistency returns a view of the store that waits for the replicas c
+// asks for, capped at N. It shares everything else with q.
+func (q *QuorumStore) WithConsistency(c Consistency) *QuorumStore {
+	view := *q
+	if c.R > 0 {
+		view.r = min(c.R, q.opts.N)
+	}
+	if c.W > 0 {
+		view.w = min(c.W, q.opts.N)
+	}
+	return &view
+}
+
+func (q *QuorumStore) Get(key string) (interface{}, error) {
+	record, err := q.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil || record.Deleted {
+		return nil, newNotFoundError(key)
+	}
+	return record.Value, nil
+}
+
+func (q *QuorumStore) Put(key string, value interface{}) error {
+	// The value goes through JSON to the other replicas, it does here too
+	// so they all hand back the same thing.
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	record := quorumRecord{Time: q.now(), Node: q.opts.Self}
+	if err := json.Unmarshal(data, &record.Value); err != nil {
+		return err
+	}
+	return q.write(key, record)
+}
+
+// Update is a read and then a write, another write of the key can come in
+// between.
+func (q *QuorumStore) Update(key string, value interface{}) error {
+	if _, err := q.Get(key); err != nil {
+		return err
+	}
+	return q.Put(key, value)
+}
+
+func (q *QuorumStore) Delete(key string) error {
+	return q.write(key, quorumRecord{Time: q.now(), Node: q.opts.Self, Deleted: true})
+}
+
+// BatchUpdate updates the keys that exist one after the other. There is no
+// rolling back, the pairs before a failure stay updated.
+func (q *QuorumStore) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+	var updated []Pair
+	for _, pair := range pairs {
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+		err := q.Update(pair.Key, pair.Value)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return updated, err
+		}
+		updated = append(updated, pair)
+	}
+	return updated, nil
+}
+
+// now returns a timestamp later than any this node handed out before, even
+// if the clock went back.
+func (q *quorumNode) now() uint64 {
+	for {
+		last := q.clock.Load()
+		next := max(uint64(time.Now().UnixMicro()), last+1)
+		if q.clock.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// replicas returns the nodes of key, its N replicas first and then the rest
+// of the ring in the order they stand in for them.
+func (q *quorumNode) replicas(key string) []string {
+	return q.ring.Owners(key, len(q.ring.nodes))
+}
+
+// quorumAnswer is a node that answered, with the record it has for a read.
+type quorumAnswer struct {
+	node   string
+	record *quorumRecord
+}
+
+// fanOut calls call for the first n nodes at once. When a node fails, the
+// next one after the first n that nobody has tried yet takes over, told
+// which node it stands in for. The answers come out of the channel, which
+// is closed once every call is done.
+func (q *quorumNode) fanOut(nodes []string, n int, call func(ctx context.Context, node, standingInFor string) (*quorumRecord, error)) <-chan quorumAnswer {
+	answers := make(chan quorumAnswer, n)
+	var mu sync.Mutex
+	next := n
+	var wg sync.WaitGroup
+	for _, replica := range nodes[:n] {
+		wg.Add(1)
+		q.wg.Add(1)
+		go func(replica string) {
+			defer q.wg.Done()
+			defer wg.Done()
+			node, standingInFor := replica, ""
+			for {
+				ctx, cancel := context.WithTimeout(q.ctx, q.opts.Timeout)
+				record, err := call(ctx, node, standingInFor)
+				cancel()
+				if err == nil {
+					answers <- quorumAnswer{node, record}
+					return
+				}
+				mu.Lock()
+				if next >= len(nodes) || q.ctx.Err() != nil {
+					mu.Unlock()
+					return
+				}
+				node, standingInFor = nodes[next], replica
+				next++
+				mu.Unlock()
+			}
+		}(replica)
+	}
+	go func() {
+		wg.Wait()
+		close(answers)
+	}()
+	return answers
+}
+
+// write sends record to the replicas of key and waits for W of them. The
+// others carry on in the background.
+func (q *QuorumStore) write(key string, record quorumRecord) error {
+	answers := q.fanOut(q.replicas(key), q.opts.N, func(ctx context.Context, node, standingInFor string) (*quorumRecord, error) {
+		return nil, q.send(ctx, node, key, record, standingInFor)
+	})
+	acks := 0
+	for range answers {
+		if acks++; acks == q.w {
+			return nil
+		}
+	}
+	return &quorumError{"write", q.w, acks}
+}
+
+// read asks the replicas of key and answers with the newest record of the
+// first R, nil if none of them has one. Once the others are in too, the
+// replicas that are behind get repaired.
+func (q *QuorumStore) read(key string) (*quorumRecord, error) {
+	nodes := q.replicas(key)
+	answers := q.fanOut(nodes, q.opts.N, func(ctx context.Context, node, _ string) (*quorumRecord, error) {
+		return q.fetch(ctx, node, key)
+	})
+	var got []quorumAnswer
+	for answer := range answers {
+		if got = append(got, answer); len(got) == q.r {
+			break
+		}
+	}
+	if len(got) < q.r {
+		return nil, &quorumError{"read", q.r, len(got)}
+	}
+	var newest *quorumRecord
+	for _, answer := range got {
+		if answer.record.newer(newest) {
+			newest = answer.record
+		}
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		for answer := range answers {
+			got = append(got, answer)
+		}
+		q.repair(key, nodes[:q.opts.N], got)
+	}()
+	return newest, nil
+}
+
+// repair sends the newest record of answers to the replicas that answered
+// with an older one. The nodes that only stood in are left alone, they have
+// no business keeping the key.
+func (q *quorumNode) repair(key string, replicas []string, answers []quorumAnswer) {
+	var newest *quorumRecord
+	for _, answer := range answers {
+		if answer.record.newer(newest) {
+			newest = answer.record
+		}
+	}
+	if newest == nil {
+		return
+	}
+	for _, answer := range answers {
+		isReplica := false
+		for _, replica := range replicas {
+			isReplica = isReplica || replica == answer.node
+		}
+		if !isReplica || !newest.newer(answer.record) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(q.ctx, q.opts.Timeout)
+		if q.send(ctx, answer.node, key, *newest, "") == nil {
+			q.readRepairs.Add(1)
+		}
+		cancel()
+	}
+}
+
+// send writes record to node, as a hint for standingInFor if it is set.
+func (q *quorumNode) send(ctx context.Context, node, key string, record quorumRecord, standingInFor string) error {
+	if node != q.opts.Self {
+		return q.call(ctx, http.MethodPost, node, "/quorum/record", quorumWrite{key, record, standingInFor}, nil)
+	}
+	if standingInFor != "" {
+		return q.hint(standingInFor, key, record)
+	}
+	return q.apply(key, record)
+}
+
+// fetch returns the record node has for key, nil if it has none.
+func (q *quorumNode) fetch(ctx context.Context, node, key string) (*quorumRecord, error) {
+	if node == q.opts.Self {
+		return q.lookup(key)
+	}
+	var resp struct {
+		Record *quorumRecord `json:"record"`
+	}
+	err := q.call(ctx, http.MethodGet, node, "/quorum/record?key="+url.QueryEscape(key), nil, &resp)
+	return resp.Record, err
+}
+
+// lookup returns the newest record this node has for key, in its store or
+// in a hint for another node.
+func (q *quorumNode) lookup(key string) (*quorumRecord, error) {
+	record, err := q.localRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, hints := range q.hints {
+		if hint, ok := hints[key]; ok && hint.newer(record) {
+			record = &hint
+		}
+	}
+	return record, nil
+}
+
+// localRecord returns the record of key in the local store, nil if there
+// is none.
+func (q *quorumNode) localRecord(key string) (*quorumRecord, error) {
+	value, err := q.local.Get(key)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch value := value.(type) {
+	case quorumRecord:
+		return &value, nil
+	case map[string]interface{}:
+		// A store that keeps its data on disk hands back what it decoded
+		// from JSON.
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		var record quorumRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+	return nil, fmt.Errorf("kv: %s is not a quorum record, but a %T", key, value)
+}
+
+// apply stores record locally, unless what is there is newer.
+func (q *quorumNode) apply(key string, record quorumRecord) error {
+	q.applyMu.Lock()
+	defer q.applyMu.Unlock()
+	current, err := q.localRecord(key)
+	if err != nil {
+		return err
+	}
+	if !record.newer(current) {
+		return nil
+	}
+	if err := q.local.Put(key, record); err != nil {
+		return err
+	}
+	q.track(key, &record)
+	return nil
+}
+
+// hint keeps record for node until it can be handed over.
+func (q *quorumNode) hint(node, key string, record quorumRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	hints := q.hints[node]
+	current, ok := hints[key]
+	if !ok && q.hintCount >= q.opts.MaxHints {
+		return errTooManyHints
+	}
+	if hints == nil {
+		hints = make(map[string]quorumRecord)
+		q.hints[node] = hints
+	}
+	if !ok {
+		q.hintCount++
+	}
+	if !ok || record.newer(&current) {
+		hints[key] = record
+	}
+	return nil
+}
+
+// handoff offers the hints to the nodes they are for every HandoffInterval,
+// until Close.
+func (q *quorumNode) handoff() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.opts.HandoffInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		q.mu.Lock()
+		pending := make(map[string]map[string]quorumRecord, len(q.hints))
+		for node, hints := range q.hints {
+			pending[node] = make(map[string]quorumRecord, len(hints))
+			for key, record := range hints {
+				pending[node][key] = record
+			}
+		}
+		q.mu.Unlock()
+
+		for node, hints := range pending {
+			for key, record := range hints {
+				ctx, cancel := context.WithTimeout(q.ctx, q.opts.Timeout)
+				err := q.send(ctx, node, key, record, "")
+				cancel()
+				if err != nil {
+					// Still down, no point trying the rest of its hints.
+					break
+				}
+				q.hintsDelivered.Add(1)
+				q.mu.Lock()
+				// Unless a newer one came in meanwhile.
+				if current, ok := q.hints[node][key]; ok && current.Time == record.Time && current.Node == record.Node {
+					delete(q.hints[node], key)
+					q.hintCount--
+					if len(q.hints[node]) == 0 {
+						delete(q.hints, node)
+					}
+				}
+				q.mu.Unlock()
+			}
+		}
+	}
+}
+
+// QuorumStatus is what /quorum/status reports.
+type QuorumStatus struct {
+	Self  string   `json:"self"`
+	Nodes []string `json:"nodes"`
+	N     int      `json:"n"`
+	R     int      `json:"r"`
+	W     int      `json:"w"`
+	// Hints is how many writes this node keeps for each node that was down.
+	Hints          map[string]int    `json:"hints"`
+	HintsDelivered uint64            `json:"hintsDelivered"`
+	ReadRepairs    uint64            `json:"readRepairs"`
+	AntiEntropy    AntiEntropyStatus `json:"antiEntropy"`
+}
+
+func (q *QuorumStore) Status() QuorumStatus {
+	status := QuorumStatus{
+		Self:           q.opts.Self,
+		Nodes:          q.ring.Nodes(),
+		N:              q.opts.N,
+		R:              q.opts.R,
+		W:              q.opts.W,
+		Hints:          make(map[string]int),
+		HintsDelivered: q.hintsDelivered.Load(),
+		ReadRepairs:    q.readRepairs.Load(),
+		AntiEntropy:    q.antiEntropyStatus(),
+	}
+	q.mu.Lock()
+	for node, hints := range q.hints {
+		status.Hints[node] = len(hints)
+	}
+	q.mu.Unlock()
+	return status
+}
@@ -0,0 +1,280 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type quorumTestNode struct {
+	url    string
+	local  *WriteOptimizedMap
+	store  *QuorumStore
+	server *Server
+	// down makes the node answer every request with a 503.
+	down atomic.Bool
+	// refused counts the requests it answered while down.
+	refused atomic.Int64
+	http    *httptest.Server
+}
+
+func (n *quorumTestNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if n.down.Load() || n.server == nil {
+		n.refused.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	n.server.ServeHTTP(w, r)
+}
+
+// startQuorumCluster starts size nodes on loopback, with opts for all.
+func startQuorumCluster(t *testing.T, size int, opts QuorumOptions) []*quorumTestNode {
+	nodes := make([]*quorumTestNode, size)
+	for i := range nodes {
+		nodes[i] = &quorumTestNode{}
+		nodes[i].http = httptest.NewUnstartedServer(nodes[i])
+		nodes[i].url = "http://" + nodes[i].http.Listener.Addr().String()
+		opts.Nodes = append(opts.Nodes, nodes[i].url)
+	}
+	if opts.HandoffInterval == 0 {
+		opts.HandoffInterval = 20 * time.Millisecond
+	}
+	for _, n := range nodes {
+		opts.Self = n.url
+		n.local = NewWriteOptimizedMapStore(1, true, 1000)
+		store, err := NewQuorumStore(n.local, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.store = store
+		n.server = NewHTTPServer(store, "")
+		n.http.Start()
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.http.Close()
+			n.store.Close()
+		}
+	})
+	return nodes
+}
+
+// byURL returns the nodes with the given URLs, in that order.
+func byURL(nodes []*quorumTestNode, urls ...string) []*quorumTestNode {
+	var found []*quorumTestNode
+	for _, url := range urls {
+		for _, n := range nodes {
+			if n.url == url {
+				found = append(found, n)
+			}
+		}
+	}
+	return found
+}
+
+// localValue is the value of the record n keeps for key, nil if it has none
+// or a tombstone.
+func (n *quorumTestNode) localValue(key string) interface{} {
+	record, _ := n.store.localRecord(key)
+	if record == nil || record.Deleted {
+		return nil
+	}
+	return record.Value
+}
+
+func TestQuorum_ReadsAndWrites(t *testing.T) {
+	nodes := startQuorumCluster(t, 3, QuorumOptions{})
+	a, b := nodes[0].store, nodes[1].store
+
+	if err := a.Put("k", 1); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.Get("k"); err != nil || value != float64(1) {
+		t.Errorf("Expected any node to read k, got %v, %v", value, err)
+	}
+	waitFor(t, "k on every replica", func() bool {
+		for _, n := range nodes {
+			if n.localValue("k") != float64(1) {
+				return false
+			}
+		}
+		return true
+	})
+	if err := b.Update("k", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := a.Get("k"); value != "two" {
+		t.Errorf("Expected the update to win, got %v", value)
+	}
+	if err := a.Update("missing", 1); !isNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	updated, err := b.BatchUpdate(context.Background(), []Pair{{"k", 3}, {"missing", 3}})
+	if err != nil || len(updated) != 1 || updated[0].Key != "k" {
+		t.Errorf("Expected only k to be updated, got %v, %v", updated, err)
+	}
+	if err := nodes[2].store.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get("k"); !isNotFound(err) {
+		t.Errorf("Expected k to be deleted, got %v", err)
+	}
+
+	// Consistency per request over HTTP.
+	do := func(node *quorumTestNode, method, path, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, node.url+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := do(nodes[0], http.MethodPost, "/set?w=all", `{"key":"h","value":"x"}`); code != http.StatusCreated {
+		t.Fatalf("Expected /set?w=all to work, got %d", code)
+	}
+	// w=all only answered once every replica had it.
+	for _, n := range nodes {
+		if n.localValue("h") != "x" {
+			t.Errorf("Expected h on %s right away", n.url)
+		}
+	}
+	if code := do(nodes[1], http.MethodGet, "/get?key=h&r=one", ""); code != http.StatusOK {
+		t.Errorf("Expected /get?r=one to work, got %d", code)
+	}
+	for _, bad := range []string{"r=4", "w=0", "r=most"} {
+		if code := do(nodes[0], http.MethodGet, "/get?key=h&"+bad, ""); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be a 400, got %d", bad, code)
+		}
+	}
+
+	// Two of three down: a quorum is out of reach, one replica isn't.
+	nodes[1].down.Store(true)
+	nodes[2].down.Store(true)
+	if err := a.Put("q", 1); err == nil {
+		t.Errorf("Expected a write without a quorum to fail")
+	}
+	if code := do(nodes[0], http.MethodPost, "/set?w=one", `{"key":"q","value":1}`); code != http.StatusCreated {
+		t.Errorf("Expected w=one to do with one replica, got %d", code)
+	}
+	if code := do(nodes[0], http.MethodGet, "/get?key=q&r=quorum", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected r=quorum to be a 503 with two replicas down, got %d", code)
+	}
+	if value, err := a.WithConsistency(Consistency{R: 1}).Get("q"); err != nil || value != float64(1) {
+		t.Errorf("Expected R=1 to do with one replica, got %v, %v", value, err)
+	}
+}
+
+func TestQuorum_RepairAndHandoff(t *testing.T) {
+	nodes := startQuorumCluster(t, 4, QuorumOptions{N: 3})
+	replicas := byURL(nodes, nodes[0].store.replicas("k")...)
+	coordinator, stale, standIn := replicas[0].store, replicas[1], replicas[3]
+
+	// Read repair: one replica is behind, a read puts it right.
+	if err := coordinator.WithConsistency(Consistency{W: 3}).Put("k", "new"); err != nil {
+		t.Fatal(err)
+	}
+	stale.local.Put("k", quorumRecord{Value: "old", Time: 1, Node: stale.url})
+	if value, err := coordinator.WithConsistency(Consistency{R: 3}).Get("k"); err != nil || value != "new" {
+		t.Errorf("Expected the newest value to win, got %v, %v", value, err)
+	}
+	waitFor(t, "the stale replica to be repaired", func() bool { return stale.localValue("k") == "new" })
+	if repairs := coordinator.Status().ReadRepairs; repairs != 1 {
+		t.Errorf("Expected one read repair, got %d", repairs)
+	}
+
+	// Hinted handoff: with a replica down, the fourth node stands in for it,
+	// so even W=3 goes through.
+	stale.down.Store(true)
+	if err := coordinator.WithConsistency(Consistency{W: 3}).Put("k", "while down"); err != nil {
+		t.Fatalf("Expected a sloppy quorum, got %v", err)
+	}
+	if hints := standIn.store.Status().Hints[stale.url]; hints != 1 {
+		t.Errorf("Expected the stand-in to keep a hint for %s, got %v", stale.url, standIn.store.Status().Hints)
+	}
+	if standIn.localValue("k") != nil {
+		t.Errorf("Expected the stand-in not to keep k as its own")
+	}
+	// A read that needs three replicas finds the hint.
+	if value, err := coordinator.WithConsistency(Consistency{R: 3}).Get("k"); err != nil || value != "while down" {
+		t.Errorf("Expected to read the write from the stand-in, got %v, %v", value, err)
+	}
+	expectMetrics(t, scrape(t, standIn.server), fmt.Sprintf(`kv_quorum_hints{node=%q} 1`, stale.url))
+
+	stale.down.Store(false)
+	waitFor(t, "the hint to be handed over", func() bool { return stale.localValue("k") == "while down" })
+	waitFor(t, "the hint to be gone", func() bool { return len(standIn.store.Status().Hints) == 0 })
+	if delivered := standIn.store.Status().HintsDelivered; delivered != 1 {
+		t.Errorf("Expected one hint delivered, got %d", delivered)
+	}
+}
+
+func TestQuorum_AntiEntropy(t *testing.T) {
+	nodes := startQuorumCluster(t, 3, QuorumOptions{AntiEntropyInterval: -1})
+	a, c := nodes[0], nodes[2]
+
+	// a and b get keys while c is down, c and b get more while a is, and
+	// nobody reads them.
+	c.down.Store(true)
+	for i := 0; i < 20; i++ {
+		if err := a.store.Put(fmt.Sprintf("early-%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The writes only wait for two replicas, the third is still trying.
+	waitFor(t, "c to refuse the writes", func() bool { return c.refused.Load() == 20 })
+	c.down.Store(false)
+	a.down.Store(true)
+	for i := 0; i < 5; i++ {
+		if err := c.store.Put(fmt.Sprintf("late-%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "a to refuse the writes", func() bool { return a.refused.Load() == 5 })
+	a.down.Store(false)
+
+	repaired, err := a.store.syncWith(context.Background(), c.url)
+	if err != nil || repaired != 25 {
+		t.Fatalf("Expected 25 keys repaired, got %d, %v", repaired, err)
+	}
+	for i := 0; i < 20; i++ {
+		if value := c.localValue(fmt.Sprintf("early-%d", i)); value != float64(i) {
+			t.Errorf("Expected early-%d on c, got %v", i, value)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if value := a.localValue(fmt.Sprintf("late-%d", i)); value != float64(i) {
+			t.Errorf("Expected late-%d on a, got %v", i, value)
+		}
+	}
+	for _, peer := range []*quorumTestNode{c, nodes[1]} {
+		if repaired, err := a.store.syncWith(context.Background(), peer.url); err != nil || repaired != 0 {
+			t.Errorf("Expected a and %s to agree, got %d repaired, %v", peer.url, repaired, err)
+		}
+	}
+
+	status := a.store.Status().AntiEntropy
+	if status.Rounds != 3 || status.KeysPulled != 5 || status.KeysPushed != 20 {
+		t.Errorf("Expected 3 rounds, 5 keys pulled and 20 pushed, got %+v", status)
+	}
+	expectMetrics(t, scrape(t, a.server),
+		`kv_quorum_antientropy_rounds_total 3`,
+		`kv_quorum_antientropy_keys_repaired_total{direction="pulled"} 5`,
+		`kv_quorum_antientropy_keys_repaired_total{direction="pushed"} 20`,
+	)
+
+	// A failed comparison shows too.
+	c.down.Store(true)
+	if _, err := a.store.syncWith(context.Background(), c.url); err == nil {
+		t.Errorf("Expected comparing with a node that is down to fail")
+	}
+	if status := a.store.Status().AntiEntropy; status.Failures != 1 || status.LastError == "" {
+		t.Errorf("Expected the failure in the status, got %+v", status)
+	}
+}
@@ -0,0 +1,216 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// quorumWrite is the body of a POST /quorum/record. StandingInFor is the
+// node the record is a hint for, if it isn't for the node getting it.
+type quorumWrite struct {
+	Key           string       `json:"key"`
+	Record        quorumRecord `json:"record"`
+	StandingInFor string       `json:"standingInFor,omitempty"`
+}
+
+// call sends req (JSON encoded, if not nil) to node and decodes the answer
+// into resp, if not nil. Anything but a 200 is an error.
+func (q *quorumNode) call(ctx context.Context, method, node, path string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, node+path, body)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if q.opts.APIKey != "" {
+		httpReq.Header.Set("X-API-Key", q.opts.APIKey)
+	}
+	httpResp, err := q.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return &nodeError{node, fmt.Errorf("%d %s", httpResp.StatusCode, strings.TrimSpace(string(msg)))}
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// quorumHandler serves what the nodes of a QuorumStore ask each other:
+//
+//	GET  /quorum/status         where this node is, see QuorumStatus
+//	GET  /quorum/record?key=    the record this node has for key
+//	POST /quorum/record         a quorumWrite
+//	POST /quorum/records        the records this node has for some keys
+//	POST /quorum/merkle         hashes of a level of a Merkle tree
+//	POST /quorum/merkle/buckets the entries of some buckets of one
+//
+// The status takes read permission on the whole store, the records take
+// every permission, like the Raft RPCs.
+func (s *Server) quorumHandler(w http.ResponseWriter, r *http.Request) {
+	q, ok := s.store(r).(*QuorumStore)
+	if !ok {
+		http.Error(w, "The store is not a quorum store", http.StatusNotFound)
+		return
+	}
+	perm := PermRead | PermWrite | PermDelete | PermBulk
+	if r.URL.Path == "/quorum/status" {
+		perm = PermRead
+	}
+	if !s.allowedPrefix(w, r, perm, "") {
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/quorum/status" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(q.Status())
+	case r.URL.Path == "/quorum/record" && r.Method == http.MethodGet:
+		record, err := q.lookup(r.URL.Query().Get("key"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Record *quorumRecord `json:"record"`
+		}{record})
+	case r.URL.Path == "/quorum/record" && r.Method == http.MethodPost:
+		var write quorumWrite
+		err := json.NewDecoder(r.Body).Decode(&write)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if write.StandingInFor != "" {
+			err = q.hint(write.StandingInFor, write.Key, write.Record)
+		} else {
+			err = q.apply(write.Key, write.Record)
+		}
+		switch {
+		case err == errTooManyHints:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case err == ErrKVFull:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case r.URL.Path == "/quorum/records" && r.Method == http.MethodPost:
+		var req recordsRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		resp := recordsResponse{Records: make(map[string]quorumRecord, len(req.Keys))}
+		for _, key := range req.Keys {
+			record, err := q.localRecord(key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if record != nil {
+				resp.Records[key] = *record
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case (r.URL.Path == "/quorum/merkle" || r.URL.Path == "/quorum/merkle/buckets") && r.Method == http.MethodPost:
+		var req merkleRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if q.trees == nil {
+			http.Error(w, "The local store can't list its keys", http.StatusNotImplemented)
+			return
+		}
+		if r.URL.Path == "/quorum/merkle/buckets" {
+			req.Level = q.opts.MerkleDepth
+		}
+		if !q.validIndexes(req.Level, req.Indexes) {
+			http.Error(w, "No such nodes in the tree", http.StatusBadRequest)
+			return
+		}
+		var resp interface{}
+		if r.URL.Path == "/quorum/merkle" {
+			resp = merkleLevelResponse{q.opts.MerkleDepth, q.treeLevel(req.Peer, req.Level, req.Indexes)}
+		} else {
+			resp = merkleBucketsResponse{q.treeBuckets(req.Peer, req.Indexes)}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case r.URL.Path == "/quorum/status" || r.URL.Path == "/quorum/record" || r.URL.Path == "/quorum/records" ||
+		r.URL.Path == "/quorum/merkle" || r.URL.Path == "/quorum/merkle/buckets":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type consistencyKey struct{}
+
+// withConsistency puts the consistency levels asked for by the ?r= and ?w=
+// query parameters of r in its context, if the server's store is a
+// QuorumStore. Each is a number of replicas up to N, or one of one, quorum
+// (a majority of N) and all.
+func (s *Server) withConsistency(r *http.Request) (*http.Request, error) {
+	q, ok := s.db.(*QuorumStore)
+	if !ok {
+		return r, nil
+	}
+	query := r.URL.Query()
+	if !query.Has("r") && !query.Has("w") {
+		return r, nil
+	}
+	var c Consistency
+	var err error
+	if c.R, err = consistencyLevel(query.Get("r"), q.opts.N); err != nil {
+		return r, fmt.Errorf("r: %v", err)
+	}
+	if c.W, err = consistencyLevel(query.Get("w"), q.opts.N); err != nil {
+		return r, fmt.Errorf("w: %v", err)
+	}
+	return r.WithContext(context.WithValue(r.Context(), consistencyKey{}, c)), nil
+}
+
+// consistencyLevel is the number of replicas level stands for, 0 if it is
+// empty.
+func consistencyLevel(level string, n int) (int, error) {
+	switch level {
+	case "":
+		return 0, nil
+	case "one":
+		return 1, nil
+	case "quorum":
+		return n/2 + 1, nil
+	case "all":
+		return n, nil
+	}
+	replicas, err := strconv.Atoi(level)
+	if err != nil || replicas < 1 || replicas > n {
+		return 0, fmt.Errorf("expected one, quorum, all or 1 to %d, got %q", n, level)
+	}
+	return replicas, nil
+}
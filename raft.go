@@ -0,0 +1,962 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RaftStore is a WriteOptimizedMap replicated with Raft over a cluster of
+// servers, so that losing a minority of them loses neither data nor the
+// ability to write. Writes go through the leader: they are appended to its
+// log, copied to the other members and applied to every map in the same
+// order once a majority has them. A write on a follower is forwarded to the
+// leader, so clients can talk to any member.
+//
+// Reads are answered from the local map, so a follower (or a leader that
+// hasn't noticed it was voted out yet) can return a value that is slightly
+// behind. That is the price of not going through the log for every read.
+//
+// This follows the Raft paper and the dissertation fairly closely: leader
+// election, log replication, log compaction with snapshots (sent whole to
+// followers that fall behind the log) and membership changes one server at a
+// time. The members talk JSON over HTTP, under /raft/ on the same port as the
+// rest of the API (the Server mounts it when its store is a RaftStore).
+type RaftStore struct {
+	opts    RaftOptions
+	sm      *WriteOptimizedMap
+	client  *http.Client
+	storage *raftStorage
+
+	// applyMu is held while the map is changed, by the applier and by an
+	// incoming snapshot. Taken before mu when both are needed.
+	applyMu sync.Mutex
+
+	mu        sync.Mutex
+	applyCond *sync.Cond
+	role      raftRole
+	term      uint64
+	votedFor  string
+	leader    string
+	// heardFromLeader is when the leader last showed signs of life, which
+	// keeps servers that were removed from the cluster from disrupting it.
+	heardFromLeader  time.Time
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+	// log[0] is not a real entry but the index and term of the last entry
+	// in the snapshot, 0 and 0 without one.
+	log         []raftEntry
+	commitIndex uint64
+	lastApplied uint64
+	// config is the membership in effect, the one in the last config entry
+	// of the log (committed or not), or the snapshot's.
+	config         map[string]string
+	configIndex    uint64
+	snapshotConfig map[string]string
+	snapshot       []byte
+	// Leader state.
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+	waiters     map[uint64]raftWaiter
+
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// RaftOptions configure a member of a Raft cluster.
+type RaftOptions struct {
+	// ID names this member, it has to be unique in the cluster.
+	ID string
+	// Peers maps the ID of every member of the initial cluster, this one
+	// included, to the URL of its HTTP server, like http://10.0.0.1:11200.
+	// It has to be the same on all of them. It is only used the first time
+	// a member starts, after that the membership is in the log.
+	Peers map[string]string
+	// Join starts a member that is not part of any cluster yet, to be added
+	// to one with AddMember. Peers is ignored then.
+	Join bool
+	// Dir keeps the log, the snapshot and the vote of the member, it must
+	// survive restarts. Without it nothing does, which is only safe if a
+	// member that restarts is removed and joins again as a new one. Good
+	// enough for tests.
+	Dir string
+	// Fsync is for the files in Dir, FsyncAlways by default. Anything else
+	// (FsyncInterval is the same as FsyncNever here) means a crash of the
+	// machine can lose entries the member said it had, which Raft is not
+	// built for.
+	Fsync FsyncPolicy
+	// ElectionTimeout is how long a follower waits to hear from a leader
+	// before it runs for election, plus a random amount up to as much
+	// again. Defaults to 300ms. HeartbeatInterval is how often the leader
+	// makes itself heard when there is nothing to replicate, 50ms by
+	// default.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many applied entries the log keeps before
+	// they are compacted into a snapshot. Defaults to 10000.
+	SnapshotThreshold int
+	// ProposeTimeout is how long a write waits for a leader to commit it.
+	// Defaults to 5s.
+	ProposeTimeout time.Duration
+	// HTTPClient is for talking to the other members, for TLS say. APIKey
+	// is sent along if the servers want one.
+	HTTPClient *http.Client
+	APIKey     string
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (role raftRole) String() string {
+	return [...]string{"follower", "candidate", "leader"}[role]
+}
+
+type raftEntryType uint8
+
+const (
+	raftEntryCommand raftEntryType = iota
+	raftEntryNoop
+	raftEntryConfig
+)
+
+type raftEntry struct {
+	Index uint64        `json:"index"`
+	Term  uint64        `json:"term"`
+	Type  raftEntryType `json:"type,omitempty"`
+	// Command is a raftCommand, kept encoded so every member applies
+	// exactly the same values (the leader would otherwise have the Go
+	// values it was given and the followers what JSON made of them).
+	Command json.RawMessage `json:"command,omitempty"`
+	// Config is the membership from this entry on.
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// raftCommand is a write to the map.
+type raftCommand struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+	Pairs []Pair      `json:"pairs,omitempty"`
+}
+
+// raftResult is what applying an entry returned.
+type raftResult struct {
+	err     error
+	updated []Pair
+}
+
+// raftWaiter is a write waiting for its entry to be applied. If the entry
+// that ends up at index has another term, the write was lost.
+type raftWaiter struct {
+	term uint64
+	ch   chan raftResult
+}
+
+type raftError struct {
+	msg string
+}
+
+func (e *raftError) Error() string {
+	return "raft: " + e.msg
+}
+
+var (
+	// ErrNoLeader is returned by writes when no leader could be found
+	// before the ProposeTimeout, which means a majority is down or cut off.
+	ErrNoLeader = &raftError{"no leader"}
+	// ErrLeadershipLost means the leader lost its job before the write
+	// committed. The write may or may not have happened.
+	ErrLeadershipLost = &raftError{"leadership lost, the write may or may not have happened"}
+	// ErrMembershipChange is returned while an earlier membership change is
+	// not committed yet.
+	ErrMembershipChange = &raftError{"another membership change is in progress"}
+	ErrRaftClosed       = &raftError{"closed"}
+	// errNotLeader sends a write on to the leader.
+	errNotLeader = &raftError{"not the leader"}
+)
+
+var errRaftOptions = errors.New("kv: raft needs an ID, and Peers with that ID in it unless it joins")
+
+// NewRaftStore starts a member of a Raft cluster with sm as its state
+// machine. sm should be empty and have no write-ahead log, the Raft log is
+// what keeps it. Close stops the member.
+func NewRaftStore(sm *WriteOptimizedMap, opts RaftOptions) (*RaftStore, error) {
+	if _, ok := opts.Peers[opts.ID]; opts.ID == "" || (!opts.Join && !ok) {
+		return nil, errRaftOptions
+	}
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = 300 * time.Millisecond
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if opts.SnapshotThreshold <= 0 {
+		opts.SnapshotThreshold = 10000
+	}
+	if opts.ProposeTimeout <= 0 {
+		opts.ProposeTimeout = 5 * time.Second
+	}
+	r := &RaftStore{
+		opts:        opts,
+		sm:          sm,
+		client:      opts.HTTPClient,
+		log:         []raftEntry{{}},
+		replicating: make(map[string]bool),
+		waiters:     make(map[uint64]raftWaiter),
+	}
+	if r.client == nil {
+		r.client = &http.Client{}
+	}
+	r.applyCond = sync.NewCond(&r.mu)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	if opts.Dir != "" {
+		storage, state, err := openRaftStorage(opts.Dir, opts.Fsync)
+		if err != nil {
+			return nil, err
+		}
+		r.storage = storage
+		r.term, r.votedFor = state.Term, state.VotedFor
+		if state.snapshot != nil {
+			if err := sm.Restore(bytes.NewReader(state.snapshot)); err != nil {
+				storage.close()
+				return nil, fmt.Errorf("kv: restoring raft snapshot: %w", err)
+			}
+			meta := state.snapshotMeta
+			r.log[0] = raftEntry{Index: meta.Index, Term: meta.Term}
+			r.snapshotConfig = meta.Config
+			r.snapshot = state.snapshot
+			r.commitIndex, r.lastApplied = meta.Index, meta.Index
+		}
+		r.log = append(r.log, state.entries...)
+	}
+	if r.lastIndex() == 0 && !opts.Join {
+		// Every member of the initial cluster starts its log with the same
+		// config entry, from a term no leader ever had.
+		bootstrap := raftEntry{Index: 1, Term: 0, Type: raftEntryConfig, Config: opts.Peers}
+		if err := r.persistAppend(bootstrap); err != nil {
+			r.storage.close()
+			return nil, err
+		}
+		r.log = append(r.log, bootstrap)
+	}
+	r.updateConfig()
+	r.resetElectionTimer()
+
+	r.wg.Add(2)
+	go r.run()
+	go r.applyLoop()
+	return r, nil
+}
+
+// Close stops the member. The others carry on without it, and elect a new
+// leader if it was the leader.
+func (r *RaftStore) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	r.applyCond.Broadcast()
+	for index, w := range r.waiters {
+		w.ch <- raftResult{err: ErrRaftClosed}
+		delete(r.waiters, index)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return r.storage.close()
+}
+
+// Get reads the local map, see RaftStore about how stale that can be.
+func (r *RaftStore) Get(key string) (interface{}, error) {
+	return r.sm.Get(key)
+}
+
+func (r *RaftStore) Put(key string, value interface{}) error {
+	return r.write(context.Background(), raftCommand{Op: "put", Key: key, Value: value}).err
+}
+
+func (r *RaftStore) Update(key string, value interface{}) error {
+	return r.write(context.Background(), raftCommand{Op: "update", Key: key, Value: value}).err
+}
+
+func (r *RaftStore) Delete(key string) error {
+	return r.write(context.Background(), raftCommand{Op: "delete", Key: key}).err
+}
+
+// BatchUpdate is applied as one entry, so it is all or nothing on every
+// member. Cancelling ctx stops the waiting, but not the write if it got into
+// the log already.
+func (r *RaftStore) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := r.write(ctx, raftCommand{Op: "batch", Pairs: pairs})
+	return res.updated, res.err
+}
+
+// Keys lists the keys of the local map.
+func (r *RaftStore) Keys() ([]string, error) {
+	return r.sm.Keys()
+}
+
+// Len is the number of keys in the local map.
+func (r *RaftStore) Len() int {
+	return r.sm.Len()
+}
+
+// metrics are those of the local map, so they count the writes this member
+// applied, wherever they came from.
+func (r *RaftStore) metrics() *storeMetrics {
+	return r.sm.metrics()
+}
+
+// write gets cmd committed and applied, by the leader wherever it is.
+func (r *RaftStore) write(ctx context.Context, cmd raftCommand) raftResult {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return raftResult{err: err}
+	}
+	entry := raftEntry{Type: raftEntryCommand, Command: data}
+	var res raftResult
+	err = r.onLeader(ctx, func() error {
+		res, err = r.propose(ctx, entry)
+		return err
+	}, func(addr string) error {
+		res, err = r.forward(ctx, addr, data)
+		return err
+	})
+	if err != nil {
+		return raftResult{err: err}
+	}
+	return res
+}
+
+// onLeader runs local if this member is the leader, and remote with the
+// address of the leader if it knows of another one. errNotLeader from either
+// means the leader moved, and it tries again until ctx or the ProposeTimeout
+// runs out.
+func (r *RaftStore) onLeader(ctx context.Context, local func() error, remote func(addr string) error) error {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.ProposeTimeout)
+	defer cancel()
+	for {
+		err := local()
+		if err != errNotLeader {
+			return err
+		}
+		r.mu.Lock()
+		addr := r.config[r.leader]
+		if r.leader == r.opts.ID {
+			addr = ""
+		}
+		r.mu.Unlock()
+		if addr != "" {
+			if err := remote(addr); err != errNotLeader {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if addr == "" && ctx.Err() == context.DeadlineExceeded {
+				return ErrNoLeader
+			}
+			return ctx.Err()
+		case <-r.ctx.Done():
+			return ErrRaftClosed
+		case <-time.After(r.opts.HeartbeatInterval / 2):
+		}
+	}
+}
+
+// propose appends entry to the log if this member is the leader and waits
+// for it to be applied.
+func (r *RaftStore) propose(ctx context.Context, entry raftEntry) (raftResult, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return raftResult{}, ErrRaftClosed
+	}
+	if r.role != raftLeader {
+		r.mu.Unlock()
+		return raftResult{}, errNotLeader
+	}
+	index, err := r.appendLocal(entry)
+	if err != nil {
+		r.mu.Unlock()
+		return raftResult{}, err
+	}
+	ch := make(chan raftResult, 1)
+	r.waiters[index] = raftWaiter{term: r.term, ch: ch}
+	r.broadcast()
+	r.mu.Unlock()
+
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-ctx.Done():
+		return raftResult{}, ctx.Err()
+	}
+}
+
+// AddMember adds the member id, reachable at addr, to the cluster. It should
+// have been started with Join. It gets the log (or a snapshot) from the
+// leader and votes from then on, so add members one at a time and let each
+// catch up. Only one membership change can be in progress at a time.
+func (r *RaftStore) AddMember(ctx context.Context, id, addr string) error {
+	if id == "" || addr == "" {
+		return &raftError{"a member needs an ID and an address"}
+	}
+	return r.changeMembers(ctx, id, addr)
+}
+
+// RemoveMember removes the member id from the cluster. Removing the leader
+// makes it step down once the change is committed.
+func (r *RaftStore) RemoveMember(ctx context.Context, id string) error {
+	return r.changeMembers(ctx, id, "")
+}
+
+// changeMembers adds id at addr, or removes it if addr is empty.
+func (r *RaftStore) changeMembers(ctx context.Context, id, addr string) error {
+	local := func() error {
+		r.mu.Lock()
+		if r.role != raftLeader {
+			r.mu.Unlock()
+			return errNotLeader
+		}
+		if r.configIndex > r.commitIndex {
+			r.mu.Unlock()
+			return ErrMembershipChange
+		}
+		config := make(map[string]string, len(r.config)+1)
+		for member, memberAddr := range r.config {
+			config[member] = memberAddr
+		}
+		if addr == "" {
+			if _, ok := config[id]; !ok {
+				r.mu.Unlock()
+				return &raftError{fmt.Sprintf("%s is not a member", id)}
+			}
+			delete(config, id)
+			if len(config) == 0 {
+				r.mu.Unlock()
+				return &raftError{"can't remove the last member"}
+			}
+		} else {
+			config[id] = addr
+		}
+		r.mu.Unlock()
+		// Someone else may have changed the membership in between, in
+		// which case appendLocal refuses this one.
+		res, err := r.propose(ctx, raftEntry{Type: raftEntryConfig, Config: config})
+		if err != nil {
+			return err
+		}
+		return res.err
+	}
+	remote := func(leader string) error {
+		return r.forwardMembers(ctx, leader, id, addr)
+	}
+	return r.onLeader(ctx, local, remote)
+}
+
+// RaftStatus is what a member knows about the cluster.
+type RaftStatus struct {
+	ID            string            `json:"id"`
+	Role          string            `json:"role"`
+	Term          uint64            `json:"term"`
+	Leader        string            `json:"leader"`
+	LastIndex     uint64            `json:"lastIndex"`
+	CommitIndex   uint64            `json:"commitIndex"`
+	LastApplied   uint64            `json:"lastApplied"`
+	SnapshotIndex uint64            `json:"snapshotIndex"`
+	Members       map[string]string `json:"members"`
+}
+
+// Status returns what the member knows about the cluster.
+func (r *RaftStore) Status() RaftStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make(map[string]string, len(r.config))
+	for id, addr := range r.config {
+		members[id] = addr
+	}
+	return RaftStatus{
+		ID:            r.opts.ID,
+		Role:          r.role.String(),
+		Term:          r.term,
+		Leader:        r.leader,
+		LastIndex:     r.lastIndex(),
+		CommitIndex:   r.commitIndex,
+		LastApplied:   r.lastApplied,
+		SnapshotIndex: r.log[0].Index,
+		Members:       members,
+	}
+}
+
+// The rest must be called with mu held, unless they say otherwise.
+
+func (r *RaftStore) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *RaftStore) lastTerm() uint64 {
+	return r.log[len(r.log)-1].Term
+}
+
+// entry returns the entry at index, which must be in the log and not the
+// snapshot.
+func (r *RaftStore) entry(index uint64) raftEntry {
+	return r.log[index-r.log[0].Index]
+}
+
+// entryTerm is the term of the entry at index, which can also be the last
+// one of the snapshot.
+func (r *RaftStore) entryTerm(index uint64) uint64 {
+	return r.log[index-r.log[0].Index].Term
+}
+
+func (r *RaftStore) resetElectionTimer() {
+	timeout := r.opts.ElectionTimeout + time.Duration(rand.Int63n(int64(r.opts.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// updateConfig makes the last config in the log the one in effect.
+func (r *RaftStore) updateConfig() {
+	r.config, r.configIndex = r.snapshotConfig, r.log[0].Index
+	for i := len(r.log) - 1; i > 0; i-- {
+		if r.log[i].Type == raftEntryConfig {
+			r.config, r.configIndex = r.log[i].Config, r.log[i].Index
+			break
+		}
+	}
+	if r.role == raftLeader {
+		for id := range r.config {
+			if _, ok := r.nextIndex[id]; !ok {
+				r.nextIndex[id] = r.lastIndex() + 1
+				r.matchIndex[id] = 0
+			}
+		}
+	}
+}
+
+// configAt is the membership as of index.
+func (r *RaftStore) configAt(index uint64) map[string]string {
+	for i := index - r.log[0].Index; i > 0; i-- {
+		if r.log[i].Type == raftEntryConfig {
+			return r.log[i].Config
+		}
+	}
+	return r.snapshotConfig
+}
+
+// stepDown makes the member a follower, in term if that is newer than its
+// own.
+func (r *RaftStore) stepDown(term uint64) {
+	if term > r.term {
+		r.term, r.votedFor, r.leader = term, "", ""
+		// Failing to save a newer term without a vote is safe, the member
+		// just remembers the older term after a restart.
+		if err := r.saveState(); err != nil {
+			log.Printf("raft %s: saving state: %v", r.opts.ID, err)
+		}
+	}
+	if r.role != raftFollower {
+		log.Printf("raft %s: stepping down in term %d", r.opts.ID, r.term)
+		r.role = raftFollower
+		r.resetElectionTimer()
+	}
+}
+
+// saveState persists the term and the vote. Nothing that depends on them,
+// a vote granted or asked for, may go out before it succeeds: a member that
+// restarts without them could vote twice in the same term.
+func (r *RaftStore) saveState() error {
+	if err := r.storage.saveState(r.term, r.votedFor); err != nil {
+		return fmt.Errorf("kv: saving the raft state: %w", err)
+	}
+	return nil
+}
+
+func (r *RaftStore) persistAppend(entries ...raftEntry) error {
+	if err := r.storage.append(entries); err != nil {
+		return fmt.Errorf("kv: appending to the raft log: %w", err)
+	}
+	return nil
+}
+
+// appendLocal appends entry to the leader's log in its term and returns its
+// index.
+func (r *RaftStore) appendLocal(entry raftEntry) (uint64, error) {
+	if entry.Type == raftEntryConfig && r.configIndex > r.commitIndex {
+		return 0, ErrMembershipChange
+	}
+	entry.Index, entry.Term = r.lastIndex()+1, r.term
+	if err := r.persistAppend(entry); err != nil {
+		return 0, err
+	}
+	r.log = append(r.log, entry)
+	if entry.Type == raftEntryConfig {
+		r.updateConfig()
+	}
+	// A cluster of one commits on its own.
+	r.advanceCommit()
+	return entry.Index, nil
+}
+
+func (r *RaftStore) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.tick()
+		}
+	}
+}
+
+func (r *RaftStore) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	now := time.Now()
+	if r.role == raftLeader {
+		if now.Sub(r.lastBroadcast) >= r.opts.HeartbeatInterval {
+			r.broadcast()
+		}
+		return
+	}
+	if now.After(r.electionDeadline) {
+		r.campaign()
+	}
+}
+
+// campaign runs for leader in the next term.
+func (r *RaftStore) campaign() {
+	r.resetElectionTimer()
+	if _, ok := r.config[r.opts.ID]; !ok {
+		// Not a member (yet, or anymore), so not up for election.
+		return
+	}
+	r.role = raftCandidate
+	r.term++
+	r.votedFor = r.opts.ID
+	r.leader = ""
+	if err := r.saveState(); err != nil {
+		// No votes asked for, so none can be counted twice. The vote for
+		// itself stays, the member won't vote for anyone else this term.
+		log.Printf("raft %s: not campaigning for term %d: %v", r.opts.ID, r.term, err)
+		r.role = raftFollower
+		return
+	}
+
+	votes := 1
+	if votes > len(r.config)/2 {
+		r.becomeLeader()
+		return
+	}
+	req := raftVoteRequest{Term: r.term, Candidate: r.opts.ID, LastIndex: r.lastIndex(), LastTerm: r.lastTerm()}
+	for id, addr := range r.config {
+		if id == r.opts.ID {
+			continue
+		}
+		r.wg.Add(1)
+		go func(addr string) {
+			defer r.wg.Done()
+			var resp raftVoteResponse
+			ctx, cancel := context.WithTimeout(r.ctx, r.opts.ElectionTimeout)
+			err := r.call(ctx, addr, "/raft/vote", req, &resp)
+			cancel()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if resp.Term > r.term {
+				r.stepDown(resp.Term)
+				return
+			}
+			if r.role != raftCandidate || r.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes > len(r.config)/2 {
+				r.becomeLeader()
+			}
+		}(addr)
+	}
+}
+
+func (r *RaftStore) becomeLeader() {
+	log.Printf("raft %s: leader for term %d", r.opts.ID, r.term)
+	r.role = raftLeader
+	r.leader = r.opts.ID
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	r.updateConfig()
+	// Entries of earlier terms only commit along with one of this term, so
+	// a new leader gets one in right away.
+	if _, err := r.appendLocal(raftEntry{Type: raftEntryNoop}); err != nil {
+		log.Printf("raft %s: %v", r.opts.ID, err)
+	}
+	r.broadcast()
+}
+
+// broadcast sends whatever each follower is missing, or a heartbeat.
+func (r *RaftStore) broadcast() {
+	r.lastBroadcast = time.Now()
+	r.heardFromLeader = r.lastBroadcast
+	for id := range r.config {
+		if id != r.opts.ID && !r.replicating[id] && !r.closed {
+			r.replicating[id] = true
+			r.wg.Add(1)
+			go r.replicateTo(id)
+		}
+	}
+}
+
+// raftMaxBatch is the most entries sent in one append.
+const raftMaxBatch = 512
+
+// replicateTo sends the follower id what it is missing until it has it all,
+// or until something goes wrong, in which case the next heartbeat tries
+// again. Only one runs per follower. Called without the lock.
+func (r *RaftStore) replicateTo(id string) {
+	defer r.wg.Done()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer delete(r.replicating, id)
+	for {
+		addr, ok := r.config[id]
+		if r.role != raftLeader || !ok || r.closed {
+			return
+		}
+		term := r.term
+		next := r.nextIndex[id]
+		if next == 0 {
+			next = r.lastIndex() + 1
+		}
+
+		if next <= r.log[0].Index {
+			req := raftSnapshotRequest{
+				Term:      term,
+				Leader:    r.opts.ID,
+				LastIndex: r.log[0].Index,
+				LastTerm:  r.log[0].Term,
+				Config:    r.snapshotConfig,
+				Data:      r.snapshot,
+			}
+			r.mu.Unlock()
+			var resp raftSnapshotResponse
+			err := r.call(r.ctx, addr, "/raft/snapshot", req, &resp)
+			r.mu.Lock()
+			if err != nil {
+				return
+			}
+			if resp.Term > r.term {
+				r.stepDown(resp.Term)
+				return
+			}
+			if r.role != raftLeader || r.term != term {
+				return
+			}
+			r.matchIndex[id] = max(r.matchIndex[id], req.LastIndex)
+			r.nextIndex[id] = r.matchIndex[id] + 1
+			r.advanceCommit()
+			continue
+		}
+
+		entries := r.log[next-r.log[0].Index:]
+		if len(entries) > raftMaxBatch {
+			entries = entries[:raftMaxBatch]
+		}
+		req := raftAppendRequest{
+			Term:      term,
+			Leader:    r.opts.ID,
+			PrevIndex: next - 1,
+			PrevTerm:  r.entryTerm(next - 1),
+			Entries:   append([]raftEntry(nil), entries...),
+			Commit:    r.commitIndex,
+		}
+		r.mu.Unlock()
+		var resp raftAppendResponse
+		ctx, cancel := context.WithTimeout(r.ctx, 2*r.opts.ElectionTimeout)
+		err := r.call(ctx, addr, "/raft/append", req, &resp)
+		cancel()
+		r.mu.Lock()
+		if err != nil {
+			return
+		}
+		if resp.Term > r.term {
+			r.stepDown(resp.Term)
+			return
+		}
+		if r.role != raftLeader || r.term != term {
+			return
+		}
+		if resp.Success {
+			match := req.PrevIndex + uint64(len(req.Entries))
+			r.matchIndex[id] = max(r.matchIndex[id], match)
+			r.nextIndex[id] = r.matchIndex[id] + 1
+			r.advanceCommit()
+		} else {
+			// The follower says where its log might match ours.
+			r.nextIndex[id] = max(1, min(next-1, resp.LastIndex+1))
+		}
+		if r.nextIndex[id] > r.lastIndex() {
+			return
+		}
+	}
+}
+
+// advanceCommit commits up to the last entry of the leader's term that a
+// majority has.
+func (r *RaftStore) advanceCommit() {
+	if r.role != raftLeader {
+		return
+	}
+	for n := r.lastIndex(); n > r.commitIndex && n > r.log[0].Index; n-- {
+		if r.entryTerm(n) != r.term {
+			// Older entries only commit along with one of this term.
+			break
+		}
+		count := 0
+		for id := range r.config {
+			if id == r.opts.ID || r.matchIndex[id] >= n {
+				count++
+			}
+		}
+		if count > len(r.config)/2 {
+			r.commitIndex = n
+			r.applyCond.Broadcast()
+			break
+		}
+	}
+	// A leader that removed itself leaves once that is committed.
+	if _, ok := r.config[r.opts.ID]; !ok && r.configIndex <= r.commitIndex {
+		log.Printf("raft %s: removed from the cluster", r.opts.ID)
+		r.role = raftFollower
+		r.leader = ""
+	}
+}
+
+// applyLoop applies committed entries to the map, in order, and hands the
+// results to the writes waiting for them. Called without the lock.
+func (r *RaftStore) applyLoop() {
+	defer r.wg.Done()
+	for {
+		r.mu.Lock()
+		for !r.closed && r.lastApplied >= r.commitIndex {
+			r.applyCond.Wait()
+		}
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		entries := append([]raftEntry(nil), r.log[r.lastApplied+1-r.log[0].Index:r.commitIndex+1-r.log[0].Index]...)
+		r.mu.Unlock()
+
+		r.applyMu.Lock()
+		for _, e := range entries {
+			r.mu.Lock()
+			// A snapshot may have come in and taken us past it.
+			skip := e.Index != r.lastApplied+1
+			r.mu.Unlock()
+			if skip {
+				continue
+			}
+			res := r.apply(e)
+			r.mu.Lock()
+			r.lastApplied = e.Index
+			if w, ok := r.waiters[e.Index]; ok {
+				delete(r.waiters, e.Index)
+				if w.term != e.Term {
+					res = raftResult{err: ErrLeadershipLost}
+				}
+				w.ch <- res
+			}
+			r.mu.Unlock()
+		}
+		r.maybeSnapshot()
+		r.applyMu.Unlock()
+	}
+}
+
+// apply applies an entry to the map. Called with applyMu held.
+func (r *RaftStore) apply(e raftEntry) raftResult {
+	if e.Type != raftEntryCommand {
+		return raftResult{}
+	}
+	var cmd raftCommand
+	if err := json.Unmarshal(e.Command, &cmd); err != nil {
+		return raftResult{err: err}
+	}
+	switch cmd.Op {
+	case "put":
+		return raftResult{err: r.sm.Put(cmd.Key, cmd.Value)}
+	case "update":
+		return raftResult{err: r.sm.Update(cmd.Key, cmd.Value)}
+	case "delete":
+		return raftResult{err: r.sm.Delete(cmd.Key)}
+	case "batch":
+		updated, err := r.sm.BatchUpdate(context.Background(), cmd.Pairs)
+		return raftResult{err: err, updated: updated}
+	}
+	return raftResult{err: &raftError{"unknown command " + cmd.Op}}
+}
+
+// maybeSnapshot compacts the log into a snapshot once it has enough applied
+// entries. Called with applyMu held, so the map is as of lastApplied.
+func (r *RaftStore) maybeSnapshot() {
+	r.mu.Lock()
+	due := r.lastApplied-r.log[0].Index >= uint64(r.opts.SnapshotThreshold)
+	r.mu.Unlock()
+	if !due {
+		return
+	}
+	var buf bytes.Buffer
+	if err := r.sm.Snapshot(&buf); err != nil {
+		log.Printf("raft %s: taking a snapshot: %v", r.opts.ID, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := r.lastApplied
+	r.compact(index, r.entryTerm(index), r.configAt(index), buf.Bytes())
+}
+
+// compact replaces the log up to index with the snapshot data.
+func (r *RaftStore) compact(index, term uint64, config map[string]string, data []byte) {
+	var rest []raftEntry
+	if index >= r.log[0].Index && index <= r.lastIndex() && r.entryTerm(index) == term {
+		rest = r.log[index-r.log[0].Index+1:]
+	}
+	r.log = append([]raftEntry{{Index: index, Term: term}}, rest...)
+	r.snapshotConfig = config
+	r.snapshot = data
+	r.updateConfig()
+	if err := r.storage.saveSnapshot(index, term, config, data, r.log[1:]); err != nil {
+		log.Printf("raft %s: saving a snapshot: %v", r.opts.ID, err)
+	}
+}
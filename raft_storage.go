@@ -0,0 +1,240 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// raftStorage keeps what a Raft member must not forget across restarts in a
+// directory:
+//
+//	raft-state     the current term and vote, JSON
+//	raft-log       the entries after the snapshot, one JSON object a line
+//	raft-snapshot  a JSON line with the index, term and membership of the
+//	               snapshot, then the snapshot of the map
+//
+// The log is appended to, and rewritten when entries are dropped from either
+// end, which doesn't happen often. Everything else is replaced by writing a
+// temporary file and renaming it. A nil *raftStorage keeps nothing.
+type raftStorage struct {
+	dir   string
+	fsync bool
+	log   *os.File
+}
+
+const (
+	raftStateFile    = "raft-state"
+	raftLogFile      = "raft-log"
+	raftSnapshotFile = "raft-snapshot"
+)
+
+type raftHardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+type raftSnapshotMeta struct {
+	Index  uint64            `json:"index"`
+	Term   uint64            `json:"term"`
+	Config map[string]string `json:"config"`
+}
+
+// raftSavedState is what openRaftStorage found in the directory.
+type raftSavedState struct {
+	raftHardState
+	snapshotMeta raftSnapshotMeta
+	// snapshot is nil without one.
+	snapshot []byte
+	entries  []raftEntry
+}
+
+func openRaftStorage(dir string, fsync FsyncPolicy) (*raftStorage, *raftSavedState, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	s := &raftStorage{dir: dir, fsync: fsync == FsyncAlways}
+	state := &raftSavedState{}
+
+	data, err := os.ReadFile(filepath.Join(dir, raftStateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &state.raftHardState)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("kv: reading %s: %w", raftStateFile, err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, raftSnapshotFile))
+	if err == nil {
+		meta, rest, _ := bytes.Cut(data, []byte("\n"))
+		err = json.Unmarshal(meta, &state.snapshotMeta)
+		state.snapshot = rest
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("kv: reading %s: %w", raftSnapshotFile, err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	next := state.snapshotMeta.Index + 1
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e raftEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line can be cut short by a crash, and it was never
+			// acknowledged then.
+			break
+		}
+		if e.Index < next {
+			// Already in the snapshot, the log is rewritten after it.
+			continue
+		}
+		if e.Index != next {
+			f.Close()
+			return nil, nil, fmt.Errorf("kv: %s skips from %d to %d", raftLogFile, next-1, e.Index)
+		}
+		state.entries = append(state.entries, e)
+		next++
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	s.log = f
+	// Rewriting drops whatever was torn at the end, so new entries don't
+	// land after it.
+	if err := s.rewrite(state.entries); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return s, state, nil
+}
+
+func (s *raftStorage) saveState(term uint64, votedFor string) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(raftHardState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	return s.replace(raftStateFile, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// append adds entries to the end of the log.
+func (s *raftStorage) append(entries []raftEntry) error {
+	if s == nil || len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if s.fsync {
+		return s.log.Sync()
+	}
+	return nil
+}
+
+// rewrite replaces the log with entries.
+func (s *raftStorage) rewrite(entries []raftEntry) error {
+	if s == nil {
+		return nil
+	}
+	err := s.replace(raftLogFile, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, raftLogFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log = f
+	return nil
+}
+
+// saveSnapshot saves a snapshot of the map as of index, and rest as the log
+// after it.
+func (s *raftStorage) saveSnapshot(index, term uint64, config map[string]string, data []byte, rest []raftEntry) error {
+	if s == nil {
+		return nil
+	}
+	meta, err := json.Marshal(raftSnapshotMeta{Index: index, Term: term, Config: config})
+	if err != nil {
+		return err
+	}
+	err = s.replace(raftSnapshotFile, func(w io.Writer) error {
+		if _, err := w.Write(append(meta, '\n')); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// A crash here leaves the old log next to the new snapshot, and the
+	// entries it already has are skipped on the way in.
+	return s.rewrite(rest)
+}
+
+// replace writes name through a temporary file, so a crash leaves the old
+// version or the new one.
+func (s *raftStorage) replace(name string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(s.dir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if s.fsync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
+
+func (s *raftStorage) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.log.Close()
+}
@@ -0,0 +1,333 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type raftNode struct {
+	id     string
+	url    string
+	store  *RaftStore
+	http   *httptest.Server
+	server atomic.Pointer[Server]
+}
+
+// ServeHTTP answers 503 until the node has a server, since the others can
+// call before it is done starting.
+func (n *raftNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if server := n.server.Load(); server != nil {
+		server.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, "starting", http.StatusServiceUnavailable)
+}
+
+func (n *raftNode) stop() {
+	n.store.Close()
+	n.http.CloseClientConnections()
+	n.http.Close()
+}
+
+func newRaftNode(id string) *raftNode {
+	n := &raftNode{id: id}
+	n.http = httptest.NewServer(n)
+	n.url = n.http.URL
+	return n
+}
+
+func (n *raftNode) start(t *testing.T, opts RaftOptions) {
+	opts.ID = n.id
+	if opts.ElectionTimeout == 0 {
+		opts.ElectionTimeout = 100 * time.Millisecond
+		opts.HeartbeatInterval = 20 * time.Millisecond
+	}
+	store, err := NewRaftStore(NewWriteOptimizedMapStore(1, true, 1000), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.store = store
+	n.server.Store(NewHTTPServer(store, ""))
+}
+
+// startRaftCluster starts a cluster of the nodes named ids on loopback.
+func startRaftCluster(t *testing.T, opts RaftOptions, ids ...string) []*raftNode {
+	nodes := make([]*raftNode, len(ids))
+	opts.Peers = make(map[string]string)
+	for i, id := range ids {
+		nodes[i] = newRaftNode(id)
+		opts.Peers[id] = nodes[i].url
+	}
+	for _, n := range nodes {
+		n.start(t, opts)
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	})
+	return nodes
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForLeader waits for exactly one of nodes to lead, and for the others
+// to know it.
+func waitForLeader(t *testing.T, nodes ...*raftNode) (leader *raftNode, followers []*raftNode) {
+	t.Helper()
+	waitFor(t, "a leader", func() bool {
+		leader, followers = nil, nil
+		for _, n := range nodes {
+			if n.store.Status().Role == "leader" {
+				if leader != nil {
+					return false
+				}
+				leader = n
+			} else {
+				followers = append(followers, n)
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, n := range followers {
+			if n.store.Status().Leader != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader, followers
+}
+
+func waitForValue(t *testing.T, key string, want interface{}, nodes ...*raftNode) {
+	t.Helper()
+	for _, n := range nodes {
+		waitFor(t, fmt.Sprintf("%s=%v on %s", key, want, n.id), func() bool {
+			value, err := n.store.Get(key)
+			return err == nil && value == want
+		})
+	}
+}
+
+func TestRaft_Cluster(t *testing.T) {
+	nodes := startRaftCluster(t, RaftOptions{}, "a", "b", "c")
+	leader, followers := waitForLeader(t, nodes...)
+
+	if err := leader.store.Put("on-leader", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := followers[0].store.Put("on-follower", "y"); err != nil {
+		t.Fatalf("Expected a follower to forward a write, got %v", err)
+	}
+	updated, err := followers[1].store.BatchUpdate(context.Background(), []Pair{{"on-leader", "z"}, {"on-follower", 1}})
+	if err != nil || len(updated) != 2 {
+		t.Fatalf("Expected a forwarded batch to update both pairs, got %v, %v", updated, err)
+	}
+	if err := followers[0].store.Update("missing", 1); !isNotFound(err) {
+		t.Errorf("Expected the leader's not found to make it back, got %v", err)
+	}
+	if err := followers[1].store.Delete("on-follower"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Through the HTTP API of a follower, like a client would.
+	resp, err := http.Post(followers[0].url+"/set", "application/json", strings.NewReader(`{"key":"http","value":"h"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected /set on a follower to work, got %d", resp.StatusCode)
+	}
+
+	waitForValue(t, "on-leader", "z", nodes...)
+	waitForValue(t, "http", "h", nodes...)
+	for _, n := range nodes {
+		if _, err := n.store.Get("on-follower"); !isNotFound(err) {
+			t.Errorf("Expected on-follower to be deleted on %s, got %v", n.id, err)
+		}
+	}
+
+	// Lose the leader, the other two carry on.
+	leader.stop()
+	newLeader, rest := waitForLeader(t, followers...)
+	if newLeader.store.Status().Term <= leader.store.Status().Term {
+		t.Errorf("Expected a new term after the leader died")
+	}
+	if err := rest[0].store.Put("after", true); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, "after", true, followers...)
+	waitForValue(t, "http", "h", followers...)
+
+	// And without a majority nothing goes.
+	rest[0].stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := newLeader.store.BatchUpdate(ctx, []Pair{{"alone", 1}}); err == nil {
+		t.Errorf("Expected a write without a majority to fail")
+	}
+}
+
+func TestRaft_SnapshotsAndMembership(t *testing.T) {
+	nodes := startRaftCluster(t, RaftOptions{SnapshotThreshold: 5}, "a", "b", "c")
+	leader, _ := waitForLeader(t, nodes...)
+	for i := 0; i < 20; i++ {
+		if err := leader.store.Put(fmt.Sprintf("k%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForValue(t, "k19", float64(19), nodes...)
+	if status := leader.store.Status(); status.SnapshotIndex == 0 || status.LastIndex-status.SnapshotIndex > 5 {
+		t.Errorf("Expected the log to be compacted, got %+v", status)
+	}
+
+	// The new member is too far behind for the log, it needs the snapshot.
+	d := newRaftNode("d")
+	d.start(t, RaftOptions{Join: true, SnapshotThreshold: 5})
+	defer d.stop()
+	body := fmt.Sprintf(`{"id":"d","addr":%q}`, d.url)
+	resp, err := http.Post(nodes[1].url+"/raft/members", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected to add d through any member, got %d", resp.StatusCode)
+	}
+	all := append(nodes, d)
+	waitForValue(t, "k0", float64(0), d)
+	waitForValue(t, "k19", float64(19), d)
+	if err := d.store.Put("from-d", "d"); err != nil {
+		t.Fatalf("Expected the new member to forward writes, got %v", err)
+	}
+	waitForValue(t, "from-d", "d", all...)
+
+	// Remove the leader itself, the other three elect a new one.
+	if err := nodes[2].store.RemoveMember(context.Background(), leader.id); err != nil {
+		t.Fatal(err)
+	}
+	var rest []*raftNode
+	for _, n := range all {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+	newLeader, _ := waitForLeader(t, rest...)
+	if members := newLeader.store.Status().Members; len(members) != 3 || members[leader.id] != "" {
+		t.Errorf("Expected %s to be gone, got %v", leader.id, members)
+	}
+	leader.stop()
+	if err := d.store.Put("after-removal", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, "after-removal", float64(1), rest...)
+
+	if err := newLeader.store.RemoveMember(context.Background(), "nobody"); err == nil {
+		t.Errorf("Expected removing a stranger to fail")
+	}
+}
+
+func TestRaft_Restart(t *testing.T) {
+	dir := t.TempDir()
+	opts := RaftOptions{
+		ID:                "solo",
+		Peers:             map[string]string{"solo": "http://127.0.0.1:1"},
+		Dir:               dir,
+		Fsync:             FsyncNever,
+		SnapshotThreshold: 3,
+		ElectionTimeout:   50 * time.Millisecond,
+	}
+	store, err := NewRaftStore(NewWriteOptimizedMapStore(1, true, 100), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a leader", func() bool { return store.Status().Role == "leader" })
+	for i := 0; i < 5; i++ {
+		if err := store.Put(fmt.Sprintf("k%d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("k0"); err != nil {
+		t.Fatal(err)
+	}
+	term := store.Status().Term
+	store.Close()
+
+	store, err = NewRaftStore(NewWriteOptimizedMapStore(1, true, 100), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if status := store.Status(); status.SnapshotIndex == 0 || status.Term != term {
+		t.Errorf("Expected the snapshot and the term to survive, got %+v", status)
+	}
+	waitFor(t, "a leader", func() bool { return store.Status().Role == "leader" })
+	// The entries after the snapshot are applied again once committed.
+	waitFor(t, "the log to be applied", func() bool { return store.Len() == 4 })
+	if value, err := store.Get("k4"); err != nil || value != float64(4) {
+		t.Errorf("Expected k4 to survive, got %v, %v", value, err)
+	}
+	if _, err := store.Get("k0"); !isNotFound(err) {
+		t.Errorf("Expected k0 to stay deleted, got %v", err)
+	}
+	if err := store.Put("k5", 5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaft_NoVotesWithoutSavedState(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewRaftStore(NewWriteOptimizedMapStore(1, true, 100), RaftOptions{
+		ID:              "a",
+		Peers:           map[string]string{"a": "http://127.0.0.1:1", "b": "http://127.0.0.1:2"},
+		Dir:             dir,
+		Fsync:           FsyncNever,
+		ElectionTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// With nowhere to save the vote, it isn't given, and no campaign starts.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	vote := raftVoteRequest{Term: 5, Candidate: "b", LastIndex: 100, LastTerm: 100}
+	if resp := store.handleVote(vote); resp.Granted {
+		t.Errorf("Expected no vote without saving it")
+	}
+	store.mu.Lock()
+	store.campaign()
+	role := store.role
+	store.mu.Unlock()
+	if role != raftFollower {
+		t.Errorf("Expected no campaign without saving the vote, got role %v", role)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	vote.Term = 7
+	if resp := store.handleVote(vote); !resp.Granted {
+		t.Errorf("Expected the vote once it can be saved")
+	}
+}
@@ -0,0 +1,475 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The members of a Raft cluster talk JSON over HTTP:
+//
+//	POST /raft/vote      RequestVote
+//	POST /raft/append    AppendEntries, heartbeats included
+//	POST /raft/snapshot  InstallSnapshot, the whole snapshot in one go
+//	POST /raft/propose   a follower handing a write to the leader
+//
+// and there is
+//
+//	GET    /raft/status        what a member knows about the cluster
+//	POST   /raft/members       {"id": ..., "addr": ...} adds a member
+//	DELETE /raft/members?id=   removes one
+//
+// for whoever runs it. Membership changes can be sent to any member.
+
+type raftVoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"lastIndex"`
+	LastTerm  uint64 `json:"lastTerm"`
+}
+
+type raftVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type raftAppendRequest struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex uint64      `json:"prevIndex"`
+	PrevTerm  uint64      `json:"prevTerm"`
+	Entries   []raftEntry `json:"entries,omitempty"`
+	Commit    uint64      `json:"commit"`
+}
+
+type raftAppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex is where the logs might match when Success is false, so the
+	// leader doesn't have to go back one entry at a time.
+	LastIndex uint64 `json:"lastIndex"`
+}
+
+type raftSnapshotRequest struct {
+	Term      uint64            `json:"term"`
+	Leader    string            `json:"leader"`
+	LastIndex uint64            `json:"lastIndex"`
+	LastTerm  uint64            `json:"lastTerm"`
+	Config    map[string]string `json:"config"`
+	Data      []byte            `json:"data"`
+}
+
+type raftSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+type raftProposeRequest struct {
+	Command json.RawMessage `json:"command"`
+}
+
+// raftProposeResponse is a raftResult on the wire. Error is "not_found",
+// "full" and "leadership_lost" for those errors, and the message of any
+// other.
+type raftProposeResponse struct {
+	Error   string `json:"error,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Updated []Pair `json:"updated,omitempty"`
+}
+
+type raftMembersRequest struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+func newRaftProposeResponse(res raftResult) raftProposeResponse {
+	resp := raftProposeResponse{Updated: res.updated}
+	switch err := res.err.(type) {
+	case nil:
+	case *notFoundError:
+		resp.Error, resp.Key = "not_found", err.key
+	case *kvFullError:
+		resp.Error = "full"
+	default:
+		if err == ErrLeadershipLost {
+			resp.Error = "leadership_lost"
+		} else {
+			resp.Error = err.Error()
+		}
+	}
+	return resp
+}
+
+func (resp raftProposeResponse) result() raftResult {
+	res := raftResult{updated: resp.Updated}
+	switch resp.Error {
+	case "":
+	case "not_found":
+		res.err = newNotFoundError(resp.Key)
+	case "full":
+		res.err = ErrKVFull
+	case "leadership_lost":
+		res.err = ErrLeadershipLost
+	default:
+		res.err = &raftError{"leader: " + resp.Error}
+	}
+	return res
+}
+
+func (r *RaftStore) handleVote(req raftVoteRequest) raftVoteResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// With a leader around, the candidate is either cut off from it or was
+	// removed from the cluster, and shouldn't get to disrupt it.
+	if r.leader != "" && time.Since(r.heardFromLeader) < r.opts.ElectionTimeout {
+		return raftVoteResponse{Term: r.term}
+	}
+	if req.Term < r.term {
+		return raftVoteResponse{Term: r.term}
+	}
+	r.stepDown(req.Term)
+	upToDate := req.LastTerm > r.lastTerm() || (req.LastTerm == r.lastTerm() && req.LastIndex >= r.lastIndex())
+	if !upToDate || (r.votedFor != "" && r.votedFor != req.Candidate) {
+		return raftVoteResponse{Term: r.term}
+	}
+	previous := r.votedFor
+	r.votedFor = req.Candidate
+	if err := r.saveState(); err != nil {
+		log.Printf("raft %s: not voting for %s: %v", r.opts.ID, req.Candidate, err)
+		r.votedFor = previous
+		return raftVoteResponse{Term: r.term}
+	}
+	r.resetElectionTimer()
+	return raftVoteResponse{Term: r.term, Granted: true}
+}
+
+// follow makes the member a follower of leader in term.
+func (r *RaftStore) follow(term uint64, leader string) {
+	r.stepDown(term)
+	r.leader = leader
+	r.heardFromLeader = time.Now()
+	r.resetElectionTimer()
+}
+
+func (r *RaftStore) handleAppend(req raftAppendRequest) raftAppendResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Term < r.term {
+		return raftAppendResponse{Term: r.term, LastIndex: r.lastIndex()}
+	}
+	r.follow(req.Term, req.Leader)
+	lastNew := req.PrevIndex + uint64(len(req.Entries))
+
+	// The snapshot has everything up to its last entry, and it is all
+	// committed, so whatever the leader sends of that must match.
+	base := r.log[0].Index
+	if req.PrevIndex < base {
+		skip := min(base-req.PrevIndex, uint64(len(req.Entries)))
+		req.Entries = req.Entries[skip:]
+		req.PrevIndex, req.PrevTerm = base, r.log[0].Term
+	}
+	if req.PrevIndex > r.lastIndex() {
+		return raftAppendResponse{Term: r.term, LastIndex: r.lastIndex()}
+	}
+	if term := r.entryTerm(req.PrevIndex); term != req.PrevTerm {
+		// Skip the whole term that doesn't match rather than one entry.
+		i := req.PrevIndex
+		for i > base+1 && r.entryTerm(i-1) == term {
+			i--
+		}
+		return raftAppendResponse{Term: r.term, LastIndex: i - 1}
+	}
+
+	truncated := false
+	var appended []raftEntry
+	for i, e := range req.Entries {
+		if e.Index <= r.lastIndex() {
+			if r.entryTerm(e.Index) == e.Term {
+				continue
+			}
+			r.log = r.log[:e.Index-base]
+			truncated = true
+		}
+		appended = req.Entries[i:]
+		break
+	}
+	r.log = append(r.log, appended...)
+	var err error
+	if truncated {
+		err = r.storage.rewrite(r.log[1:])
+	} else {
+		err = r.persistAppend(appended...)
+	}
+	if err != nil {
+		// The leader will try again, and the entries it hasn't heard about
+		// must not count.
+		log.Printf("raft %s: %v", r.opts.ID, err)
+		r.log = r.log[:len(r.log)-len(appended)]
+		return raftAppendResponse{Term: r.term, LastIndex: r.lastIndex()}
+	}
+	if truncated || len(appended) > 0 {
+		r.updateConfig()
+	}
+	if commit := min(req.Commit, lastNew); commit > r.commitIndex {
+		r.commitIndex = commit
+		r.applyCond.Broadcast()
+	}
+	return raftAppendResponse{Term: r.term, Success: true, LastIndex: r.lastIndex()}
+}
+
+func (r *RaftStore) handleSnapshot(req raftSnapshotRequest) raftSnapshotResponse {
+	r.mu.Lock()
+	if req.Term < r.term {
+		defer r.mu.Unlock()
+		return raftSnapshotResponse{Term: r.term}
+	}
+	r.follow(req.Term, req.Leader)
+	r.mu.Unlock()
+
+	// Hold off the applier, and check again that the snapshot is newer than
+	// what it applied in the meantime.
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	stale := req.LastIndex <= r.lastApplied
+	r.mu.Unlock()
+	if !stale {
+		if err := r.sm.Restore(bytes.NewReader(req.Data)); err != nil {
+			log.Printf("raft %s: installing a snapshot: %v", r.opts.ID, err)
+			stale = true
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stale {
+		return raftSnapshotResponse{Term: r.term}
+	}
+	r.compact(req.LastIndex, req.LastTerm, req.Config, req.Data)
+	r.lastApplied = req.LastIndex
+	r.commitIndex = max(r.commitIndex, req.LastIndex)
+	return raftSnapshotResponse{Term: r.term}
+}
+
+type raftRPCError struct {
+	code int
+	msg  string
+}
+
+func (e *raftRPCError) Error() string {
+	return fmt.Sprintf("raft: %d %s", e.code, e.msg)
+}
+
+// call sends req to the member at addr and decodes the answer into resp.
+func (r *RaftStore) call(ctx context.Context, addr, path string, req, resp interface{}) error {
+	return r.do(ctx, http.MethodPost, addr, path, req, resp)
+}
+
+func (r *RaftStore) do(ctx context.Context, method, addr, path string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(addr, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if r.opts.APIKey != "" {
+		httpReq.Header.Set("X-API-Key", r.opts.APIKey)
+	}
+	httpResp, err := r.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return &raftRPCError{httpResp.StatusCode, strings.TrimSpace(string(msg))}
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// retryable is true for the errors that mean the leader moved or is out of
+// reach, so it is worth finding it again.
+func retryable(err error) bool {
+	if err, ok := err.(*raftRPCError); ok {
+		return err.code == http.StatusMisdirectedRequest || err.code == http.StatusServiceUnavailable
+	}
+	return true
+}
+
+// forward hands a write to the leader at addr.
+func (r *RaftStore) forward(ctx context.Context, addr string, command []byte) (raftResult, error) {
+	var resp raftProposeResponse
+	err := r.call(ctx, addr, "/raft/propose", raftProposeRequest{Command: command}, &resp)
+	if err != nil {
+		if ctx.Err() == nil && retryable(err) {
+			err = errNotLeader
+		}
+		return raftResult{}, err
+	}
+	return resp.result(), nil
+}
+
+// forwardMembers hands a membership change to the leader at addr.
+func (r *RaftStore) forwardMembers(ctx context.Context, leader, id, addr string) error {
+	var err error
+	if addr == "" {
+		err = r.do(ctx, http.MethodDelete, leader, "/raft/members?id="+url.QueryEscape(id), nil, nil)
+	} else {
+		err = r.call(ctx, leader, "/raft/members", raftMembersRequest{ID: id, Addr: addr}, nil)
+	}
+	if err, ok := err.(*raftRPCError); ok && err.code == http.StatusConflict {
+		return ErrMembershipChange
+	}
+	if err != nil && ctx.Err() == nil && retryable(err) {
+		return errNotLeader
+	}
+	return err
+}
+
+// raftHandler serves /raft/ when the store is a RaftStore. Members talking
+// to each other need every permission, like /admin/restore, since they can
+// change anything. /raft/status only needs read.
+func (s *Server) raftHandler(w http.ResponseWriter, r *http.Request) {
+	raft, ok := s.store(r).(*RaftStore)
+	if !ok {
+		http.Error(w, "The store is not replicated", http.StatusNotFound)
+		return
+	}
+	perm := PermRead | PermWrite | PermDelete | PermBulk
+	if r.URL.Path == "/raft/status" {
+		perm = PermRead
+	}
+	if !s.allowedPrefix(w, r, perm, "") {
+		return
+	}
+	raft.serveHTTP(w, r)
+}
+
+func (r *RaftStore) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/raft/status":
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeRaftJSON(w, r.Status())
+	case "/raft/vote":
+		var vote raftVoteRequest
+		if decodeRaftRequest(w, req, &vote) {
+			writeRaftJSON(w, r.handleVote(vote))
+		}
+	case "/raft/append":
+		var appendReq raftAppendRequest
+		if decodeRaftRequest(w, req, &appendReq) {
+			writeRaftJSON(w, r.handleAppend(appendReq))
+		}
+	case "/raft/snapshot":
+		var snapshot raftSnapshotRequest
+		if decodeRaftRequest(w, req, &snapshot) {
+			writeRaftJSON(w, r.handleSnapshot(snapshot))
+		}
+	case "/raft/propose":
+		var propose raftProposeRequest
+		if !decodeRaftRequest(w, req, &propose) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), r.opts.ProposeTimeout)
+		defer cancel()
+		res, err := r.propose(ctx, raftEntry{Type: raftEntryCommand, Command: propose.Command})
+		if err != nil {
+			raftHTTPError(w, err)
+			return
+		}
+		writeRaftJSON(w, newRaftProposeResponse(res))
+	case "/raft/members":
+		var err error
+		switch req.Method {
+		case http.MethodPost:
+			var member raftMembersRequest
+			if !decodeRaftRequest(w, req, &member) {
+				return
+			}
+			err = r.AddMember(req.Context(), member.ID, member.Addr)
+		case http.MethodDelete:
+			err = r.RemoveMember(req.Context(), req.URL.Query().Get("id"))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			raftHTTPError(w, err)
+			return
+		}
+		writeRaftJSON(w, r.Status())
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func decodeRaftRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeRaftJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func raftHTTPError(w http.ResponseWriter, err error) {
+	switch {
+	case err == errNotLeader:
+		http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+	case err == ErrMembershipChange:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == ErrNoLeader, err == ErrRaftClosed, err == context.DeadlineExceeded:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		if _, ok := err.(*raftError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// unavailable answers 503 if err is the store saying it can't take writes
+// right now, like a RaftStore without a leader, a read-only replica or a
+// QuorumStore short of replicas, and 502 if a node behind a ClusterStore
+// failed.
+func unavailable(w http.ResponseWriter, err error) bool {
+	switch err.(type) {
+	case *raftError, *readOnlyError, *quorumError:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	case *nodeError:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package kv
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Every on-disk format in this package frames its entries the same way:
+//
+//	[4 byte length][4 byte crc32 (castagnoli) of payload][payload]
+//
+// That way a torn write at the end of a file (the process died halfway through
+// a write) is detectable, and so is a flipped bit anywhere else.
+const recordHeaderSize = 8
+
+// maxRecordSize is a sanity limit so a corrupt length field does not make us
+// allocate gigabytes before the checksum gets a chance to fail.
+const maxRecordSize = 1 << 30
+
+// Entry flags.
+const (
+	entryPut byte = iota
+	entryTombstone
+	// entryBatch marks every entry of a batch except the last one. On startup
+	// a batch only counts once its last entry has been read, so a crash halfway
+	// through writing one never leaves half of it applied.
+	entryBatch
+)
+
+var errCorruptRecord = errors.New("kv: corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// appendRecord frames payload and appends it to buf.
+func appendRecord(buf []byte, payload []byte) []byte {
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, crcTable))
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// writeRecord frames payload and writes it with a single Write call so that
+// concurrent appenders to the same file never interleave.
+func writeRecord(w io.Writer, payload []byte) error {
+	_, err := w.Write(appendRecord(make([]byte, 0, recordHeaderSize+len(payload)), payload))
+	return err
+}
+
+// readRecord reads the next record. It returns io.EOF when there is nothing
+// left, io.ErrUnexpectedEOF when the file ends halfway through a record and
+// errCorruptRecord when the checksum does not match.
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, errCorruptRecord
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errCorruptRecord
+	}
+	return payload, nil
+}
+
+// Stores that keep key/value entries on disk (bitcask data files, sstables)
+// use the same payload layout inside a record:
+//
+//	[8 byte sequence number][1 byte flag][4 byte key length][key][json value]
+//
+// Tombstones have no value.
+func encodeEntryRecord(seq uint64, flag byte, key string, value interface{}) ([]byte, error) {
+	var encoded []byte
+	if flag != entryTombstone {
+		var err error
+		if encoded, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+	return encodeRawEntryRecord(seq, flag, key, encoded), nil
+}
+
+// encodeRawEntryRecord is encodeEntryRecord for a value that is already JSON.
+func encodeRawEntryRecord(seq uint64, flag byte, key string, encoded []byte) []byte {
+	payload := make([]byte, 13, 13+len(key)+len(encoded))
+	binary.LittleEndian.PutUint64(payload[0:8], seq)
+	payload[8] = flag
+	binary.LittleEndian.PutUint32(payload[9:13], uint32(len(key)))
+	payload = append(payload, key...)
+	return append(payload, encoded...)
+}
+
+func decodeEntryRecord(payload []byte) (seq uint64, flag byte, key string, value []byte, err error) {
+	if len(payload) < 13 {
+		return 0, 0, "", nil, errCorruptRecord
+	}
+	keyLen := int(binary.LittleEndian.Uint32(payload[9:13]))
+	if len(payload) < 13+keyLen {
+		return 0, 0, "", nil, errCorruptRecord
+	}
+	return binary.LittleEndian.Uint64(payload[0:8]), payload[8], string(payload[13 : 13+keyLen]), payload[13+keyLen:], nil
+}
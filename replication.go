@@ -0,0 +1,807 @@
+package kv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicatedStore is a store that is either the primary of a group of
+// read-only replicas, or one of the replicas. It is the lighter option next
+// to RaftStore: the primary answers a write as soon as its own store has it
+// and streams it to the replicas afterwards, so a replica can be behind, and
+// the writes it hasn't got yet are lost if the primary goes away for good.
+//
+// The primary keeps its writes in a feed, numbered by offset. A replica
+// starts from a snapshot of the primary and the offset it was taken at, and
+// then follows the feed from there. One that falls further behind than the
+// feed goes (or whose primary restarted, or was restored from a snapshot)
+// starts over from a new snapshot. A replica can be promoted to primary by
+// hand when the primary is gone, the others then have to be pointed at it.
+//
+// The store underneath has to be a Snapshotter. Writes on the primary are
+// serialized, so the feed has them in the order the store applied them.
+type ReplicatedStore struct {
+	store Store
+	opts  ReplicationOptions
+
+	// writeMu serializes the writes on the primary and the snapshots replicas
+	// start from, so that a snapshot is exactly the feed up to its offset.
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	role string
+	// feed is the primary's.
+	feed *feed
+	// replicas are the streams the primary is serving, by replica name.
+	replicas map[string]*replicaPosition
+
+	// The rest is the replica's. feedID and offset are where it is in the
+	// feed of the primary, feedID is empty when it needs a snapshot.
+	primary       string
+	feedID        string
+	offset        uint64
+	primaryOffset uint64
+	// appliedTime is when the primary wrote the last record applied, the
+	// replica is that far behind in time while it isn't caught up.
+	appliedTime time.Time
+	lastContact time.Time
+	connected   bool
+	lastError   string
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	closed      bool
+}
+
+// ReplicationOptions configure either side of a ReplicatedStore.
+type ReplicationOptions struct {
+	// FeedSize is how many writes the primary keeps for replicas to catch up
+	// from, one further behind needs a snapshot. Defaults to 10000.
+	FeedSize int
+	// HeartbeatInterval is how often the primary tells idle replicas where
+	// the feed is, and a replica that hasn't heard anything for three of
+	// them reconnects. Defaults to 1s.
+	HeartbeatInterval time.Duration
+	// RetryInterval is how long a replica waits before reconnecting after an
+	// error. Defaults to 1s.
+	RetryInterval time.Duration
+	// Name is what a replica calls itself when it reports to the primary,
+	// the host name by default.
+	Name string
+	// HTTPClient is for a replica talking to the primary, for TLS say.
+	// APIKey is sent along if the primary wants one.
+	HTTPClient *http.Client
+	APIKey     string
+}
+
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+)
+
+type readOnlyError struct {
+	primary string
+}
+
+func (e *readOnlyError) Error() string {
+	return "read-only replica, write to the primary at " + e.primary
+}
+
+// ErrNotSnapshotter is returned for a store that can't be replicated because
+// it can't take or restore snapshots.
+var ErrNotSnapshotter = errors.New("kv: replication needs a store that implements Snapshotter")
+
+// NewPrimaryStore makes store the primary of a group of replicas.
+func NewPrimaryStore(store Store, opts ReplicationOptions) (*ReplicatedStore, error) {
+	if _, ok := store.(Snapshotter); !ok {
+		return nil, ErrNotSnapshotter
+	}
+	r := newReplicatedStore(store, opts)
+	r.role = rolePrimary
+	r.feed = newFeed(0, r.opts.FeedSize)
+	return r, nil
+}
+
+// NewReplicaStore makes store a read-only replica of the primary at the URL
+// primary, like http://10.0.0.1:11200. Whatever store holds is replaced by
+// the snapshot of the primary once it gets one. Close stops following it.
+func NewReplicaStore(store Store, primary string, opts ReplicationOptions) (*ReplicatedStore, error) {
+	if _, ok := store.(Snapshotter); !ok {
+		return nil, ErrNotSnapshotter
+	}
+	r := newReplicatedStore(store, opts)
+	r.role = roleReplica
+	r.primary = strings.TrimSuffix(primary, "/")
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.wg.Add(1)
+	go r.follow(ctx)
+	return r, nil
+}
+
+func newReplicatedStore(store Store, opts ReplicationOptions) *ReplicatedStore {
+	if opts.FeedSize <= 0 {
+		opts.FeedSize = 10000
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = time.Second
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	if opts.Name == "" {
+		opts.Name, _ = os.Hostname()
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{}
+	}
+	return &ReplicatedStore{store: store, opts: opts, replicas: make(map[string]*replicaPosition)}
+}
+
+// Close stops following the primary, and closes the store underneath.
+func (r *ReplicatedStore) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.feed != nil {
+		r.feed.close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return closeStore(r.store)
+}
+
+// Promote makes a replica the primary. It stops following the old primary
+// and takes writes from then on, with a feed of its own the other replicas
+// start over from. It does nothing on a primary.
+func (r *ReplicatedStore) Promote() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return errors.New("kv: replicated store closed")
+	}
+	if r.role == rolePrimary {
+		r.mu.Unlock()
+		return nil
+	}
+	r.cancel()
+	r.mu.Unlock()
+	r.wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Printf("replication: promoted to primary at offset %d, was following %s", r.offset, r.primary)
+	r.role = rolePrimary
+	r.feed = newFeed(r.offset, r.opts.FeedSize)
+	r.primary, r.feedID, r.connected, r.cancel = "", "", false, nil
+	return nil
+}
+
+func (r *ReplicatedStore) Get(key string) (interface{}, error) {
+	return r.store.Get(key)
+}
+
+func (r *ReplicatedStore) Put(key string, value interface{}) error {
+	return r.write(func() (*feedRecord, error) {
+		if err := r.store.Put(key, value); err != nil {
+			return nil, err
+		}
+		return &feedRecord{Op: "put", Key: key, Value: value}, nil
+	})
+}
+
+func (r *ReplicatedStore) Update(key string, value interface{}) error {
+	return r.write(func() (*feedRecord, error) {
+		if err := r.store.Update(key, value); err != nil {
+			return nil, err
+		}
+		return &feedRecord{Op: "update", Key: key, Value: value}, nil
+	})
+}
+
+func (r *ReplicatedStore) Delete(key string) error {
+	return r.write(func() (*feedRecord, error) {
+		if err := r.store.Delete(key); err != nil {
+			return nil, err
+		}
+		return &feedRecord{Op: "delete", Key: key}, nil
+	})
+}
+
+// BatchUpdate goes to the replicas as the pairs that were updated, in one
+// record. A batch that failed halfway without rolling back still changed
+// some keys, so those go out either way.
+func (r *ReplicatedStore) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+	var updated []Pair
+	err := r.write(func() (*feedRecord, error) {
+		var err error
+		updated, err = r.store.BatchUpdate(ctx, pairs)
+		if len(updated) == 0 {
+			return nil, err
+		}
+		return &feedRecord{Op: "batch", Pairs: updated}, err
+	})
+	return updated, err
+}
+
+// write applies a write on the primary, and adds the record apply returns to
+// the feed unless it is nil.
+func (r *ReplicatedStore) write(apply func() (*feedRecord, error)) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	r.mu.Lock()
+	role, primary, f := r.role, r.primary, r.feed
+	r.mu.Unlock()
+	if role != rolePrimary {
+		return &readOnlyError{primary}
+	}
+	rec, err := apply()
+	if rec != nil {
+		f.append(*rec)
+	}
+	return err
+}
+
+// Snapshot is the snapshot of the store underneath.
+func (r *ReplicatedStore) Snapshot(w io.Writer) error {
+	return r.store.(Snapshotter).Snapshot(w)
+}
+
+// Restore restores the primary. Its replicas can't follow that in the feed,
+// so they start over from a snapshot.
+func (r *ReplicatedStore) Restore(rd io.Reader) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	r.mu.Lock()
+	role, primary := r.role, r.primary
+	r.mu.Unlock()
+	if role != rolePrimary {
+		return &readOnlyError{primary}
+	}
+	if err := r.store.(Snapshotter).Restore(rd); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offset := r.feed.last()
+	r.feed.close()
+	r.feed = newFeed(offset, r.opts.FeedSize)
+	return nil
+}
+
+func (r *ReplicatedStore) Keys() ([]string, error) {
+	if lister, ok := r.store.(KeyLister); ok {
+		return lister.Keys()
+	}
+	return nil, errors.New("kv: the store can't list its keys")
+}
+
+func (r *ReplicatedStore) Len() int {
+	if counted, ok := r.store.(interface{ Len() int }); ok {
+		return counted.Len()
+	}
+	return 0
+}
+
+// metrics are those of the store underneath, so a replica counts the writes
+// it applied from the feed.
+func (r *ReplicatedStore) metrics() *storeMetrics {
+	if instrumented, ok := r.store.(interface{ metrics() *storeMetrics }); ok {
+		return instrumented.metrics()
+	}
+	return &storeMetrics{}
+}
+
+// ReplicationStatus is where a primary or a replica is in the feed.
+type ReplicationStatus struct {
+	Role string `json:"role"`
+	// FeedID names the feed, the primary's own or the one the replica
+	// follows. It changes when the primary restarts, restores a snapshot or
+	// is promoted.
+	FeedID string `json:"feedId"`
+	// Offset is the last write in the feed of the primary, and the last
+	// one applied on a replica.
+	Offset uint64 `json:"offset"`
+	// The rest is a replica's. Lag is how many writes it is behind the
+	// primary, as of the last it heard from it, and LagSeconds how much
+	// older the last one it applied is than the primary's latest.
+	Primary       string  `json:"primary,omitempty"`
+	PrimaryOffset uint64  `json:"primaryOffset,omitempty"`
+	Lag           uint64  `json:"lag"`
+	LagSeconds    float64 `json:"lagSeconds"`
+	Connected     bool    `json:"connected"`
+	// LastContact is how long ago the replica last heard from the primary.
+	LastContact float64 `json:"lastContactSeconds,omitempty"`
+	LastError   string  `json:"lastError,omitempty"`
+	// Replicas are the ones streaming from a primary.
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+}
+
+// ReplicaStatus is a replica as the primary sees it. Sent is the last write
+// streamed to it, which it may not have applied yet.
+type ReplicaStatus struct {
+	Name      string  `json:"name"`
+	Sent      uint64  `json:"sent"`
+	Lag       uint64  `json:"lag"`
+	Connected bool    `json:"connected"`
+	LastSeen  float64 `json:"lastSeenSeconds"`
+}
+
+type replicaPosition struct {
+	sent      uint64
+	connected bool
+	lastSeen  time.Time
+}
+
+// Status returns where the store is in the feed.
+func (r *ReplicatedStore) Status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.role == rolePrimary {
+		status := ReplicationStatus{Role: rolePrimary, FeedID: r.feed.id, Offset: r.feed.last(), Connected: true}
+		for name, pos := range r.replicas {
+			status.Replicas = append(status.Replicas, ReplicaStatus{
+				Name:      name,
+				Sent:      pos.sent,
+				Lag:       status.Offset - min(pos.sent, status.Offset),
+				Connected: pos.connected,
+				LastSeen:  now.Sub(pos.lastSeen).Seconds(),
+			})
+		}
+		sort.Slice(status.Replicas, func(i, j int) bool { return status.Replicas[i].Name < status.Replicas[j].Name })
+		return status
+	}
+	status := ReplicationStatus{
+		Role:          roleReplica,
+		FeedID:        r.feedID,
+		Offset:        r.offset,
+		Primary:       r.primary,
+		PrimaryOffset: r.primaryOffset,
+		Connected:     r.connected,
+		LastError:     r.lastError,
+	}
+	if r.primaryOffset > r.offset {
+		status.Lag = r.primaryOffset - r.offset
+		if !r.appliedTime.IsZero() {
+			status.LagSeconds = now.Sub(r.appliedTime).Seconds()
+		}
+	}
+	if !r.lastContact.IsZero() {
+		status.LastContact = now.Sub(r.lastContact).Seconds()
+	}
+	return status
+}
+
+// feedRecord is a write in the feed, or a heartbeat with the offset of the
+// last write when Op is "heartbeat".
+type feedRecord struct {
+	Offset uint64      `json:"offset"`
+	Time   int64       `json:"time,omitempty"`
+	Op     string      `json:"op"`
+	Key    string      `json:"key,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+	Pairs  []Pair      `json:"pairs,omitempty"`
+}
+
+// feed is the last writes of a primary.
+type feed struct {
+	mu      sync.Mutex
+	id      string
+	records []feedRecord
+	// next is the offset of the next write.
+	next uint64
+	size int
+	// changed is closed and replaced on every write, to wake the streams.
+	changed chan struct{}
+	closed  bool
+}
+
+// newFeed starts a feed with a new ID after offset.
+func newFeed(offset uint64, size int) *feed {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &feed{id: hex.EncodeToString(id), next: offset + 1, size: size, changed: make(chan struct{})}
+}
+
+func (f *feed) append(rec feedRecord) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rec.Offset, rec.Time = f.next, time.Now().UnixNano()
+	f.next++
+	f.records = append(f.records, rec)
+	if len(f.records) > f.size {
+		f.records = f.records[len(f.records)-f.size:]
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *feed) last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.next - 1
+}
+
+// since returns up to max writes after offset, the offset of the last write,
+// and a channel that is closed on the next one. ok is false if the feed
+// doesn't go back that far, or was closed.
+func (f *feed) since(offset uint64, max int) (records []feedRecord, last uint64, changed chan struct{}, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldest := f.next - uint64(len(f.records))
+	if f.closed || offset+1 < oldest || offset >= f.next {
+		return nil, 0, nil, false
+	}
+	records = f.records[offset+1-oldest:]
+	if len(records) > max {
+		records = records[:max]
+	}
+	return append([]feedRecord(nil), records...), f.next - 1, f.changed, true
+}
+
+// close ends the streams of the feed, when it is replaced.
+func (f *feed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.changed)
+	}
+}
+
+// snapshot writes a snapshot of the primary along with the feed ID and the
+// offset it was taken at. Writes have to wait while it is taken, so it goes
+// to a temporary file first: a replica that reads it slowly, or not at all,
+// must not hold up the primary.
+func (r *ReplicatedStore) snapshot(w http.ResponseWriter) {
+	tmp, err := os.CreateTemp("", "kv-replication-snapshot-*")
+	if err != nil {
+		log.Printf("replication: snapshot failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	r.writeMu.Lock()
+	r.mu.Lock()
+	f := r.feed
+	r.mu.Unlock()
+	offset := f.last()
+	err = r.store.(Snapshotter).Snapshot(tmp)
+	r.writeMu.Unlock()
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("replication: snapshot failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(feedIDHeader, f.id)
+	w.Header().Set(feedOffsetHeader, strconv.FormatUint(offset, 10))
+	if _, err := io.Copy(w, tmp); err != nil {
+		log.Printf("replication: sending a snapshot failed: %v", err)
+	}
+}
+
+const (
+	feedIDHeader     = "X-KV-Feed-ID"
+	feedOffsetHeader = "X-KV-Feed-Offset"
+)
+
+// stream sends the replica name the writes after offset in the feed id, one
+// JSON record a line, and a heartbeat when there are none for a while. It
+// goes on until the replica goes away, stop is closed or the feed is
+// replaced.
+func (r *ReplicatedStore) stream(w http.ResponseWriter, req *http.Request, stop <-chan struct{}) {
+	q := req.URL.Query()
+	offset, err := strconv.ParseUint(q.Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	name := q.Get("name")
+	if name == "" {
+		name = req.RemoteAddr
+	}
+	r.mu.Lock()
+	f := r.feed
+	r.mu.Unlock()
+	if _, _, _, ok := f.since(offset, 0); !ok || q.Get("id") != f.id {
+		http.Error(w, "The feed doesn't go back that far, start from a snapshot", http.StatusGone)
+		return
+	}
+
+	pos := &replicaPosition{sent: offset, connected: true, lastSeen: time.Now()}
+	r.mu.Lock()
+	r.replicas[name] = pos
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		pos.connected = false
+		r.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	enc := json.NewEncoder(w)
+	heartbeat := time.NewTicker(r.opts.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		records, last, changed, ok := f.since(offset, 256)
+		if !ok {
+			return
+		}
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return
+			}
+		}
+		if len(records) == 0 {
+			select {
+			case <-changed:
+				continue
+			case <-heartbeat.C:
+				if err := enc.Encode(feedRecord{Op: "heartbeat", Offset: last}); err != nil {
+					return
+				}
+			case <-req.Context().Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if len(records) > 0 {
+			offset = records[len(records)-1].Offset
+		}
+		r.mu.Lock()
+		pos.sent, pos.lastSeen = offset, time.Now()
+		r.mu.Unlock()
+	}
+}
+
+// follow keeps the replica in step with the primary until ctx is done.
+func (r *ReplicatedStore) follow(ctx context.Context) {
+	defer r.wg.Done()
+	for ctx.Err() == nil {
+		err := r.followOnce(ctx)
+		r.mu.Lock()
+		r.connected = false
+		if err != nil && ctx.Err() == nil {
+			r.lastError = err.Error()
+		}
+		r.mu.Unlock()
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		log.Printf("replication: following %s: %v", r.primary, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.opts.RetryInterval):
+		}
+	}
+}
+
+var errFeedGone = errors.New("the primary's feed doesn't go back far enough")
+
+// followOnce gets a snapshot if the replica needs one, and then applies the
+// feed until the stream breaks. It returns nil when the replica needs a new
+// snapshot.
+func (r *ReplicatedStore) followOnce(ctx context.Context) error {
+	r.mu.Lock()
+	id, offset := r.feedID, r.offset
+	r.mu.Unlock()
+	if id == "" {
+		if err := r.catchUp(ctx); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		id, offset = r.feedID, r.offset
+		r.mu.Unlock()
+	}
+
+	// A primary that stops answering without closing the connection is
+	// noticed by its missing heartbeats.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timeout := 3 * r.opts.HeartbeatInterval
+	watchdog := time.AfterFunc(timeout, cancel)
+	defer watchdog.Stop()
+
+	q := url.Values{"id": {id}, "from": {strconv.FormatUint(offset, 10)}, "name": {r.opts.Name}}
+	resp, err := r.get(ctx, "/replication/stream?"+q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		r.mu.Lock()
+		r.feedID = ""
+		r.mu.Unlock()
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return replicationStatusError(resp)
+	}
+
+	r.mu.Lock()
+	r.connected, r.lastError = true, ""
+	r.mu.Unlock()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var rec feedRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				// The primary replaced its feed or is shutting down,
+				// reconnecting finds out which.
+				return nil
+			}
+			return err
+		}
+		watchdog.Reset(timeout)
+		if rec.Op != "heartbeat" {
+			if err := r.apply(rec); err != nil {
+				// There is no way to skip a write and stay in step, so
+				// start over from a snapshot.
+				r.mu.Lock()
+				r.feedID = ""
+				r.mu.Unlock()
+				return fmt.Errorf("applying offset %d: %w", rec.Offset, err)
+			}
+		}
+		r.mu.Lock()
+		r.lastContact = time.Now()
+		if rec.Op == "heartbeat" {
+			r.primaryOffset = rec.Offset
+		} else {
+			r.offset = rec.Offset
+			r.primaryOffset = max(r.primaryOffset, rec.Offset)
+			r.appliedTime = time.Unix(0, rec.Time)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// catchUp replaces the store with a snapshot of the primary.
+func (r *ReplicatedStore) catchUp(ctx context.Context) error {
+	resp, err := r.get(ctx, "/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return replicationStatusError(resp)
+	}
+	id := resp.Header.Get(feedIDHeader)
+	offset, err := strconv.ParseUint(resp.Header.Get(feedOffsetHeader), 10, 64)
+	if err != nil || id == "" {
+		return errors.New("the primary sent a snapshot without a feed position")
+	}
+	if err := r.store.(Snapshotter).Restore(resp.Body); err != nil {
+		return fmt.Errorf("restoring the primary's snapshot: %w", err)
+	}
+	log.Printf("replication: restored a snapshot of %s at offset %d", r.primary, offset)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.feedID, r.offset = id, offset
+	r.primaryOffset = max(r.primaryOffset, offset)
+	r.appliedTime, r.lastContact = time.Now(), time.Now()
+	return nil
+}
+
+// apply applies a write from the feed to the replica's store. A delete of a
+// key that is not there is fine, the primary had it and the replica doesn't
+// have to agree on why.
+func (r *ReplicatedStore) apply(rec feedRecord) error {
+	switch rec.Op {
+	case "put":
+		return r.store.Put(rec.Key, rec.Value)
+	case "update":
+		return r.store.Update(rec.Key, rec.Value)
+	case "delete":
+		if err := r.store.Delete(rec.Key); err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	case "batch":
+		_, err := r.store.BatchUpdate(context.Background(), rec.Pairs)
+		return err
+	}
+	return fmt.Errorf("unknown operation %q", rec.Op)
+}
+
+func (r *ReplicatedStore) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.opts.APIKey != "" {
+		req.Header.Set("X-API-Key", r.opts.APIKey)
+	}
+	return r.opts.HTTPClient.Do(req)
+}
+
+func replicationStatusError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("the primary answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// replicationHandler serves /replication/ when the store is a
+// ReplicatedStore: the snapshot and the stream replicas follow the primary
+// with, which need read on everything like /admin/snapshot, /status, and
+// /promote, which needs every permission.
+func (s *Server) replicationHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.store(r).(*ReplicatedStore)
+	if !ok {
+		http.Error(w, "The store is not replicated", http.StatusNotFound)
+		return
+	}
+	perm := PermRead
+	if r.URL.Path == "/replication/promote" {
+		perm = PermRead | PermWrite | PermDelete | PermBulk
+	}
+	if !s.allowedPrefix(w, r, perm, "") {
+		return
+	}
+
+	method := http.MethodGet
+	if r.URL.Path == "/replication/promote" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/replication/status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.Status())
+	case "/replication/promote":
+		if err := store.Promote(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.Status())
+	case "/replication/snapshot", "/replication/stream":
+		if store.Status().Role != rolePrimary {
+			http.Error(w, "Not the primary", http.StatusMisdirectedRequest)
+			return
+		}
+		if r.URL.Path == "/replication/snapshot" {
+			store.snapshot(w)
+		} else {
+			store.stream(w, r, s.draining)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,172 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestReplica(t *testing.T, primary, name string) *ReplicatedStore {
+	replica, err := NewReplicaStore(NewWriteOptimizedMapStore(1, true, 100), primary, ReplicationOptions{
+		Name:              name,
+		HeartbeatInterval: 50 * time.Millisecond,
+		RetryInterval:     20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { replica.Close() })
+	return replica
+}
+
+func waitForReplica(t *testing.T, replica *ReplicatedStore, key string, want interface{}) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%s=%v on the replica", key, want), func() bool {
+		value, err := replica.Get(key)
+		if want == nil {
+			return isNotFound(err)
+		}
+		return err == nil && value == want
+	})
+}
+
+func TestReplication(t *testing.T) {
+	bitcask, err := OpenBitcaskStore(t.TempDir(), BitcaskOptions{Fsync: FsyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitcask.Close()
+	if _, err := NewPrimaryStore(bitcask, ReplicationOptions{}); err != ErrNotSnapshotter {
+		t.Errorf("Expected a store without snapshots to be refused, got %v", err)
+	}
+	primary, err := NewPrimaryStore(NewWriteOptimizedMapStore(1, true, 100), ReplicationOptions{FeedSize: 5, HeartbeatInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, url, _ := startHTTPServer(t, primary)
+	defer server.Shutdown(context.Background())
+
+	// Written before the replica shows up, so it needs the snapshot.
+	for i := 0; i < 10; i++ {
+		primary.Put(fmt.Sprintf("k%d", i), i)
+	}
+	replica := newTestReplica(t, url, "r1")
+	waitForReplica(t, replica, "k9", float64(9))
+
+	primary.Put("a", "x")
+	primary.Update("k0", "updated")
+	primary.Delete("k1")
+	if _, err := primary.BatchUpdate(context.Background(), []Pair{{"k2", "b"}, {"k3", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplica(t, replica, "a", "x")
+	waitForReplica(t, replica, "k0", "updated")
+	waitForReplica(t, replica, "k1", nil)
+	waitForReplica(t, replica, "k3", "b")
+
+	if err := replica.Put("a", "y"); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("Expected the replica to refuse writes, got %v", err)
+	}
+	waitFor(t, "the replica to catch up", func() bool {
+		status := replica.Status()
+		return status.Connected && status.Lag == 0 && status.Offset == primary.Status().Offset
+	})
+	status := primary.Status()
+	if len(status.Replicas) != 1 || status.Replicas[0].Name != "r1" || !status.Replicas[0].Connected {
+		t.Errorf("Expected the primary to see r1, got %+v", status.Replicas)
+	}
+
+	// Restoring the primary replaces its feed, the replica starts over.
+	var snapshot bytes.Buffer
+	source := NewWriteOptimizedMapStore(1, true, 10)
+	source.Put("restored", true)
+	source.Snapshot(&snapshot)
+	oldFeed := status.FeedID
+	if err := primary.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplica(t, replica, "restored", true)
+	waitForReplica(t, replica, "a", nil)
+	if replica.Status().FeedID == oldFeed {
+		t.Errorf("Expected the replica to follow the new feed")
+	}
+}
+
+func TestReplication_Promote(t *testing.T) {
+	primary, _ := NewPrimaryStore(NewWriteOptimizedMapStore(1, true, 100), ReplicationOptions{HeartbeatInterval: 50 * time.Millisecond})
+	primaryServer, primaryURL, _ := startHTTPServer(t, primary)
+	replica := newTestReplica(t, primaryURL, "r1")
+	replicaServer, replicaURL, _ := startHTTPServer(t, replica)
+	defer replicaServer.Shutdown(context.Background())
+
+	primary.Put("a", 1)
+	waitForReplica(t, replica, "a", float64(1))
+
+	resp, err := http.Post(replicaURL+"/set", "application/json", strings.NewReader(`{"key":"b","value":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a write to the replica to get a 503, got %d", resp.StatusCode)
+	}
+	waitFor(t, "the replica to catch up", func() bool { return replica.Status().Lag == 0 })
+	expectMetrics(t, scrape(t, replicaServer), `kv_replication_connected 1`, `kv_replication_lag 0`)
+
+	// The primary goes away, and the replica takes over.
+	primaryServer.Shutdown(context.Background())
+	primary.Close()
+	resp, err = http.Post(replicaURL+"/replication/promote", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the promotion to work, got %d", resp.StatusCode)
+	}
+	if err := replica.Put("b", 2); err != nil {
+		t.Fatalf("Expected the promoted replica to take writes, got %v", err)
+	}
+
+	// And the other replicas follow it instead.
+	second := newTestReplica(t, replicaURL, "r2")
+	waitForReplica(t, second, "a", float64(1))
+	waitForReplica(t, second, "b", float64(2))
+	replica.Put("c", 3)
+	waitForReplica(t, second, "c", float64(3))
+}
+
+func TestReplication_SlowSnapshotReader(t *testing.T) {
+	primary, err := NewPrimaryStore(NewWriteOptimizedMapStore(1, true, 10000), ReplicationOptions{HeartbeatInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, url, _ := startHTTPServer(t, primary)
+	defer server.Shutdown(context.Background())
+	// Far more than the socket buffers hold, so a replica that doesn't read
+	// leaves most of the snapshot unsent.
+	value := strings.Repeat("x", 4096)
+	for i := 0; i < 5000; i++ {
+		primary.Put(fmt.Sprintf("k%d", i), value)
+	}
+
+	resp, err := http.Get(url + "/replication/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	done := make(chan error, 1)
+	go func() { done <- primary.Put("during", 1) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected writes to go on while a replica is slow to read the snapshot")
+	}
+}
@@ -0,0 +1,582 @@
+package kv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RESPServer speaks enough of the Redis protocol (RESP2, and RESP3 after a
+// HELLO 3) for redis-cli and the usual client libraries to use any Store.
+// Values set over RESP are stored as strings, values that were stored as
+// something else (numbers and objects from the HTTP API) are read back as
+// their JSON encoding.
+//
+// Pipelining comes for free: every connection reads commands as they come and
+// only flushes its replies once it has nothing more to read.
+type RESPServer struct {
+	db    Store
+	addr  string
+	conns connGroup
+}
+
+func NewRESPServer(store Store, addr string) *RESPServer {
+	return &RESPServer{db: store, addr: addr}
+}
+
+func (s *RESPServer) Start() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("RESP server running at: %s\n", s.addr)
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it is closed or the server is shut
+// down.
+func (s *RESPServer) Serve(l net.Listener) error {
+	if !s.conns.addListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.conns.removeListener(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.conns.closed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections, closes the idle ones and waits for
+// the others to finish the command they are on. If ctx runs out first, the
+// remaining connections are closed and their BatchUpdates cancelled.
+func (s *RESPServer) Shutdown(ctx context.Context) error {
+	return s.conns.shutdown(ctx)
+}
+
+// Same limits as Redis: 64KB for an inline command, 512MB for a bulk string.
+const (
+	respMaxInline = 64 * 1024
+	respMaxBulk   = 512 * 1024 * 1024
+	respMaxArgs   = 1024 * 1024
+)
+
+type respProtocolError struct {
+	msg string
+}
+
+func (e *respProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// respConn is the per connection state, which is just the writer for the
+// replies and the protocol version picked with HELLO.
+type respConn struct {
+	*bufio.Writer
+	proto int
+	quit  bool
+	// ctx is cancelled when the connection goes away, for BatchUpdate.
+	ctx context.Context
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	ctx, ok := s.conns.add(conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	defer s.conns.remove(conn)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r := bufio.NewReaderSize(conn, respMaxInline)
+	c := &respConn{Writer: bufio.NewWriter(conn), proto: 2, ctx: ctx}
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			// Like Redis, a client that sends garbage gets told why and
+			// then disconnected, there is no way to resync the stream.
+			if perr, ok := err.(*respProtocolError); ok {
+				c.err("ERR " + perr.Error())
+				c.Flush()
+			}
+			return
+		}
+		if !s.conns.setBusy(conn, true) {
+			return
+		}
+		if len(args) > 0 {
+			s.dispatch(c, args)
+		}
+		if c.quit || r.Buffered() == 0 {
+			if err := c.Flush(); err != nil {
+				return
+			}
+		}
+		// While shutting down, the command we just did is the last one.
+		if c.quit || !s.conns.setBusy(conn, r.Buffered() > 0) {
+			c.Flush()
+			return
+		}
+	}
+}
+
+// readRESPCommand reads either an array of bulk strings, which is what
+// clients send, or an inline command (words on a line), which is what you
+// type into telnet.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArgs {
+		return nil, &respProtocolError{"invalid multibulk length"}
+	}
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, &respProtocolError{fmt.Sprintf("expected '$', got '%.1s'", line)}
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, &respProtocolError{"invalid bulk length"}
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, &respProtocolError{"bulk string not terminated by CRLF"}
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", &respProtocolError{"too big inline request"}
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// The reply writers. Everything goes into the connection's buffer, serveConn
+// flushes it.
+
+func (c *respConn) ok() {
+	c.simple("OK")
+}
+
+func (c *respConn) simple(s string) {
+	c.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) err(msg string) {
+	c.WriteString("-" + msg + "\r\n")
+}
+
+func (c *respConn) integer(n int) {
+	c.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (c *respConn) bulk(s string) {
+	c.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *respConn) null() {
+	if c.proto == 3 {
+		c.WriteString("_\r\n")
+	} else {
+		c.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respConn) array(n int) {
+	c.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// dict starts a map of n entries, which is a flat array of 2n elements in
+// RESP2.
+func (c *respConn) dict(n int) {
+	if c.proto == 3 {
+		c.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.array(2 * n)
+	}
+}
+
+// storeError replies with err, using Redis' OOM error for a full store so
+// clients treat it like a Redis that hit maxmemory.
+func (c *respConn) storeError(err error) {
+	if _, ok := err.(*kvFullError); ok {
+		c.err("OOM " + err.Error())
+		return
+	}
+	c.err("ERR " + err.Error())
+}
+
+// valueString turns a stored value into the string a Redis (or memcached)
+// client expects.
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+type respCommand struct {
+	handler func(s *RESPServer, c *respConn, args []string)
+	// arity is the number of arguments, command name included, like Redis
+	// has it. Negative means at least that many.
+	arity int
+}
+
+var respCommands = map[string]respCommand{
+	"PING":    {(*RESPServer).ping, -1},
+	"ECHO":    {(*RESPServer).echo, 2},
+	"HELLO":   {(*RESPServer).hello, -1},
+	"QUIT":    {(*RESPServer).quit, 1},
+	"SELECT":  {(*RESPServer).selectDB, 2},
+	"COMMAND": {(*RESPServer).command, -1},
+	"CLIENT":  {(*RESPServer).client, -2},
+	"GET":     {(*RESPServer).get, 2},
+	"SET":     {(*RESPServer).set, -3},
+	"DEL":     {(*RESPServer).del, -2},
+	"EXISTS":  {(*RESPServer).exists, -2},
+	"MGET":    {(*RESPServer).mget, -2},
+	"MSET":    {(*RESPServer).mset, -3},
+	"MUPDATE": {(*RESPServer).mupdate, -3},
+}
+
+func (s *RESPServer) dispatch(c *respConn, args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, ok := respCommands[name]
+	if !ok {
+		c.err(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.err(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	cmd.handler(s, c, args)
+}
+
+func (s *RESPServer) ping(c *respConn, args []string) {
+	switch len(args) {
+	case 1:
+		c.simple("PONG")
+	case 2:
+		c.bulk(args[1])
+	default:
+		c.err("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *RESPServer) echo(c *respConn, args []string) {
+	c.bulk(args[1])
+}
+
+// hello switches the protocol version. AUTH and SETNAME are not supported.
+func (s *RESPServer) hello(c *respConn, args []string) {
+	if len(args) > 1 {
+		proto, err := strconv.Atoi(args[1])
+		if err != nil {
+			c.err("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			c.err("NOPROTO unsupported protocol version")
+			return
+		}
+		if len(args) > 2 {
+			c.err("ERR HELLO options are not supported")
+			return
+		}
+		c.proto = proto
+	}
+	c.dict(3)
+	c.bulk("server")
+	c.bulk("kv")
+	c.bulk("proto")
+	c.integer(c.proto)
+	c.bulk("mode")
+	c.bulk("standalone")
+}
+
+func (s *RESPServer) quit(c *respConn, args []string) {
+	c.ok()
+	c.quit = true
+}
+
+// selectDB only knows database 0, there is just the one store.
+func (s *RESPServer) selectDB(c *respConn, args []string) {
+	if args[1] != "0" {
+		c.err("ERR DB index is out of range")
+		return
+	}
+	c.ok()
+}
+
+// command exists because redis-cli and some libraries ask for the command
+// table when they connect. They cope with getting nothing back.
+func (s *RESPServer) command(c *respConn, args []string) {
+	c.array(0)
+}
+
+// client accepts the CLIENT SETNAME/SETINFO that libraries send on connect and
+// ignores it.
+func (s *RESPServer) client(c *respConn, args []string) {
+	c.ok()
+}
+
+func (s *RESPServer) get(c *respConn, args []string) {
+	value, err := s.db.Get(args[1])
+	if isNotFound(err) {
+		c.null()
+		return
+	}
+	if err != nil {
+		c.storeError(err)
+		return
+	}
+	c.bulk(valueString(value))
+}
+
+// set is SET key value [NX|XX] [EX seconds|PX milliseconds]. NX and XX
+// answer a null when the key was (or wasn't) there, like Redis.
+func (s *RESPServer) set(c *respConn, args []string) {
+	key, value := args[1], args[2]
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case (opt == "EX" || opt == "PX") && ttl == 0 && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 {
+				c.err("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			c.err("ERR syntax error")
+			return
+		}
+	}
+	ttlStore, ok := s.db.(TTLStore)
+	if ttl > 0 && !ok {
+		c.err("ERR expiry not supported by this store")
+		return
+	}
+
+	if nx || xx {
+		stored, err := s.setIf(key, value, nx, ttl)
+		if err != nil {
+			c.storeError(err)
+			return
+		}
+		if !stored {
+			c.null()
+			return
+		}
+		c.ok()
+		return
+	}
+
+	var err error
+	if ttl > 0 {
+		err = ttlStore.PutWithTTL(key, value, ttl)
+	} else {
+		err = s.db.Put(key, value)
+	}
+	if err != nil {
+		c.storeError(err)
+		return
+	}
+	c.ok()
+}
+
+// setIf does a SET with NX (ifAbsent) or XX and reports whether the value
+// was stored. Versioned stores get it done atomically, the expiry included,
+// and like a plain SET it clears the TTL when there is none. Other stores
+// fall back to the conditional operations or Update, which keeps the TTL,
+// and can't take an expiry since it would be a second write.
+func (s *RESPServer) setIf(key string, value interface{}, ifAbsent bool, ttl time.Duration) (bool, error) {
+	if versioned, ok := s.db.(VersionedStore); ok {
+		cond := IfExists
+		if ifAbsent {
+			cond = IfNotExists
+		}
+		_, err := versioned.PutIfWithTTL(key, value, ttl, cond)
+		if err == ErrPreconditionFailed {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if ttl > 0 {
+		return false, fmt.Errorf("NX and XX with an expiry not supported by this store")
+	}
+	if ifAbsent {
+		conditional, ok := s.db.(ConditionalStore)
+		if !ok {
+			return false, fmt.Errorf("NX not supported by this store")
+		}
+		err := conditional.PutIfAbsent(key, value)
+		if err == ErrKeyExists {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	err := s.db.Update(key, value)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// del counts the keys that existed when it got to them. The Store interface
+// does not say whether a Delete deleted anything, so that is a Get first.
+func (s *RESPServer) del(c *respConn, args []string) {
+	deleted := 0
+	for _, key := range args[1:] {
+		if _, err := s.db.Get(key); err == nil {
+			deleted++
+		}
+		if err := s.db.Delete(key); err != nil {
+			c.storeError(err)
+			return
+		}
+	}
+	c.integer(deleted)
+}
+
+func (s *RESPServer) exists(c *respConn, args []string) {
+	found := 0
+	for _, key := range args[1:] {
+		if _, err := s.db.Get(key); err == nil {
+			found++
+		}
+	}
+	c.integer(found)
+}
+
+func (s *RESPServer) mget(c *respConn, args []string) {
+	c.array(len(args) - 1)
+	for _, key := range args[1:] {
+		if value, err := s.db.Get(key); err == nil {
+			c.bulk(valueString(value))
+		} else {
+			c.null()
+		}
+	}
+}
+
+func respPairs(args []string) ([]Pair, bool) {
+	if len(args)%2 != 0 {
+		return nil, false
+	}
+	pairs := make([]Pair, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		pairs = append(pairs, Pair{args[i], args[i+1]})
+	}
+	return pairs, true
+}
+
+// mset is atomic, like in Redis, on stores with transactions. On the others
+// it is just one Put after the other.
+func (s *RESPServer) mset(c *respConn, args []string) {
+	pairs, ok := respPairs(args[1:])
+	if !ok {
+		c.err("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	txnStore, ok := s.db.(TxnStore)
+	if !ok {
+		for _, pair := range pairs {
+			if err := s.db.Put(pair.Key, pair.Value); err != nil {
+				c.storeError(err)
+				return
+			}
+		}
+		c.ok()
+		return
+	}
+	for {
+		txn := txnStore.Begin()
+		for _, pair := range pairs {
+			txn.Put(pair.Key, pair.Value)
+		}
+		err := txn.Commit()
+		if err == ErrTxnConflict {
+			// Blind writes only conflict with writes that landed after
+			// Begin, so this does not spin for long.
+			continue
+		}
+		if err != nil {
+			c.storeError(err)
+			return
+		}
+		c.ok()
+		return
+	}
+}
+
+// mupdate is MUPDATE key value [key value ...], our own command for
+// BatchUpdate. It replies with the keys that were updated.
+func (s *RESPServer) mupdate(c *respConn, args []string) {
+	pairs, ok := respPairs(args[1:])
+	if !ok {
+		c.err("ERR wrong number of arguments for 'mupdate' command")
+		return
+	}
+	updated, err := s.db.BatchUpdate(c.ctx, pairs)
+	if err != nil {
+		c.storeError(err)
+		return
+	}
+	c.array(len(updated))
+	for _, pair := range updated {
+		c.bulk(pair.Key)
+	}
+}
@@ -0,0 +1,124 @@
+package kv
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpSession serves a listener with serve, dials it and returns a function
+// that sends raw protocol and checks the exact bytes that come back.
+func tcpSession(t *testing.T, serve func(net.Listener) error) func(send, want string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	return func(send, want string) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(send)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("Sent %q, reading %q: %v (got %q)", send, want, err, got)
+		}
+		if string(got) != want {
+			t.Errorf("Sent %q, got %q, want %q", send, got, want)
+		}
+	}
+}
+
+func respCommandString(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.String()
+}
+
+func TestRESP_Commands(t *testing.T) {
+	store := NewWriteOptimizedMapStore(1, true, 100)
+	store.Put("number", float64(3))
+	do := tcpSession(t, NewRESPServer(store, "").Serve)
+
+	do(respCommandString("PING"), "+PONG\r\n")
+	do("PING hello\r\n", "$5\r\nhello\r\n")
+	do(respCommandString("SET", "a", "1"), "+OK\r\n")
+	do(respCommandString("GET", "a"), "$1\r\n1\r\n")
+	do(respCommandString("GET", "number"), "$1\r\n3\r\n")
+	do(respCommandString("GET", "missing"), "$-1\r\n")
+	do(respCommandString("SET", "a", "2", "NX"), "$-1\r\n")
+	do(respCommandString("SET", "b", "2", "XX"), "$-1\r\n")
+	do(respCommandString("SET", "b", "2", "NX"), "+OK\r\n")
+	do(respCommandString("SET", "b", "3", "XX"), "+OK\r\n")
+	do(respCommandString("SET", "a", "1", "NX", "XX"), "-ERR syntax error\r\n")
+	do(respCommandString("SET", "a", "1", "EX", "0"), "-ERR invalid expire time in 'set' command\r\n")
+	do(respCommandString("EXISTS", "a", "b", "c"), ":2\r\n")
+	do(respCommandString("MSET", "x", "1", "y", "2"), "+OK\r\n")
+	do(respCommandString("MGET", "x", "nope", "y"), "*3\r\n$1\r\n1\r\n$-1\r\n$1\r\n2\r\n")
+	do(respCommandString("MUPDATE", "x", "10", "nope", "11"), "*1\r\n$1\r\nx\r\n")
+	do(respCommandString("DEL", "x", "y", "nope"), ":2\r\n")
+	do(respCommandString("GET"), "-ERR wrong number of arguments for 'get' command\r\n")
+	do(respCommandString("FLUSHALL"), "-ERR unknown command 'FLUSHALL'\r\n")
+
+	// RESP3 nulls are different.
+	do(respCommandString("HELLO", "3"), "%3\r\n$6\r\nserver\r\n$2\r\nkv\r\n$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n")
+	do(respCommandString("GET", "missing"), "_\r\n")
+	do(respCommandString("HELLO", "4"), "-NOPROTO unsupported protocol version\r\n")
+
+	if ttl, err := store.TTL("b"); err != nil || ttl != NoExpiry {
+		t.Errorf("Expected b without a TTL, got %v, %v", ttl, err)
+	}
+	do(respCommandString("SET", "b", "4", "EX", "100"), "+OK\r\n")
+	if ttl, _ := store.TTL("b"); ttl <= 0 {
+		t.Errorf("Expected b to have a TTL, got %v", ttl)
+	}
+
+	// NX and XX set the expiry in the same step, or nothing at all.
+	do(respCommandString("SET", "c", "1", "NX", "EX", "100"), "+OK\r\n")
+	do(respCommandString("SET", "c", "2", "NX", "PX", "5"), "_\r\n")
+	if value, _ := store.Get("c"); value != "1" {
+		t.Errorf("Expected SET NX to leave c alone, got %v", value)
+	}
+	if ttl, _ := store.TTL("c"); ttl <= 99*time.Second {
+		t.Errorf("Expected c to keep its TTL of 100s, got %v", ttl)
+	}
+	do(respCommandString("SET", "c", "3", "XX"), "+OK\r\n")
+	if ttl, _ := store.TTL("c"); ttl != NoExpiry {
+		t.Errorf("Expected SET XX without EX to clear the TTL, got %v", ttl)
+	}
+}
+
+func TestRESP_Pipelining(t *testing.T) {
+	do := tcpSession(t, NewRESPServer(NewLRUCacheStore(100), "").Serve)
+
+	// All of it in one write, all the replies come back in order.
+	var send, want strings.Builder
+	for _, key := range []string{"a", "b", "c"} {
+		send.WriteString(respCommandString("SET", key, key))
+		want.WriteString("+OK\r\n")
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		send.WriteString(respCommandString("GET", key))
+		want.WriteString("$1\r\n" + key + "\r\n")
+	}
+	do(send.String(), want.String())
+
+	// Garbage gets an error and the connection closed.
+	do("*1\r\n+PING\r\n", "-ERR Protocol error: expected '$', got '+'\r\n")
+}
@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is how many points every node gets on a Ring unless
+// told otherwise. Enough for the nodes to end up within a few percent of
+// their fair share of the keys.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent hash ring. Keys and nodes are hashed onto the same
+// circle, and a key belongs to the first node clockwise from it. Every node
+// is on the ring many times under different names (the virtual nodes), so
+// the keys spread evenly, and a node that joins or leaves only moves its own
+// share of the keys instead of reshuffling nearly all of them like the
+// modulo of getShardIndex would.
+//
+// Only the set of nodes matters, not their order, so every proxy and client
+// given the same nodes agrees on who owns what. The client package has a
+// copy of it, which has to stay a copy.
+type Ring struct {
+	points []ringPoint
+	nodes  []string
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// NewRing puts nodes on a ring, virtualNodes times each (DefaultVirtualNodes
+// if it isn't positive). The nodes are usually the URLs of the servers, and
+// have to be written the same way everywhere.
+func NewRing(nodes []string, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r := &Ring{}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, ringPoint{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Strings(r.nodes)
+	// Two points on the same hash are next to impossible, but if they
+	// happen the node name decides, not the order the nodes came in.
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return r
+}
+
+// ringHash is FNV-1a, which is fast but leaves similar strings (like
+// node#1 and node#2) close together, followed by the finalizer of
+// MurmurHash3 to scatter them around the ring.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Owner returns the node key belongs to, or "" if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	return r.points[r.search(key)].node
+}
+
+// Owners returns the first n different nodes clockwise from key, the owner
+// first. There are fewer if the ring doesn't have n nodes.
+func (r *Ring) Owners(key string, n int) []string {
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+	owners := make([]string, 0, n)
+	for i, start := 0, r.search(key); len(owners) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		seen := false
+		for _, owner := range owners {
+			seen = seen || owner == node
+		}
+		if !seen {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// search returns the index of the first point at or after the hash of key.
+func (r *Ring) search(key string) int {
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// Split groups pairs by the node they belong to, keeping their order.
+func (r *Ring) Split(pairs []Pair) map[string][]Pair {
+	split := make(map[string][]Pair)
+	for _, pair := range pairs {
+		owner := r.Owner(pair.Key)
+		split[owner] = append(split[owner], pair)
+	}
+	return split
+}
@@ -0,0 +1,66 @@
+package kv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing_Balance(t *testing.T) {
+	nodes := []string{"http://a:1", "http://b:1", "http://c:1"}
+	ring := NewRing(nodes, 0)
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		counts[ring.Owner(fmt.Sprintf("key-%d", i))]++
+	}
+	for _, node := range nodes {
+		// A third each, give or take.
+		if counts[node] < 8000 || counts[node] > 12000 {
+			t.Errorf("Expected about 10000 keys on %s, got %v", node, counts)
+		}
+	}
+
+	// The order of the nodes doesn't matter, and neither do duplicates.
+	other := NewRing([]string{"http://c:1", "http://a:1", "http://b:1", "http://a:1"}, 0)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if ring.Owner(key) != other.Owner(key) {
+			t.Fatalf("Expected both rings to agree on %s", key)
+		}
+	}
+	if empty := NewRing(nil, 0); empty.Owner("a") != "" || empty.Owners("a", 2) != nil {
+		t.Errorf("Expected an empty ring to own nothing")
+	}
+}
+
+func TestRing_AddNode(t *testing.T) {
+	before := NewRing([]string{"a", "b", "c"}, 64)
+	after := NewRing([]string{"a", "b", "c", "d"}, 64)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner := after.Owner(key); owner != before.Owner(key) {
+			if owner != "d" {
+				t.Fatalf("Expected %s to move to the new node only, it went to %s", key, owner)
+			}
+			moved++
+		}
+	}
+	// d should take about a quarter, nowhere near everything.
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("Expected about 2500 keys to move, %d did", moved)
+	}
+}
+
+func TestRing_Owners(t *testing.T) {
+	ring := NewRing([]string{"a", "b", "c"}, 0)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners := ring.Owners(key, 2)
+		if len(owners) != 2 || owners[0] != ring.Owner(key) || owners[0] == owners[1] {
+			t.Fatalf("Expected two different owners of %s starting with its owner, got %v", key, owners)
+		}
+		if all := ring.Owners(key, 5); len(all) != 3 {
+			t.Fatalf("Expected no more owners than nodes, got %v", all)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package kv
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingStore holds Get and BatchUpdate until release is closed or their
+// context is cancelled, so there is something in flight to drain.
+type blockingStore struct {
+	Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStore() *blockingStore {
+	return &blockingStore{
+		Store:   NewWriteOptimizedMapStore(1, true, 10),
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingStore) Get(key string) (interface{}, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.Store.Get(key)
+}
+
+func (b *blockingStore) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return b.Store.BatchUpdate(ctx, pairs)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func startHTTPServer(t *testing.T, store Store) (*Server, string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewHTTPServer(store, l.Addr().String())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	return server, "http://" + l.Addr().String(), served
+}
+
+// updateBulkAsync sends an /updateBulk and returns where its status code
+// will show up, 0 if it failed altogether.
+func updateBulkAsync(url, body string) chan int {
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPatch, url+"/updateBulk", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	return status
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	store := newBlockingStore()
+	store.Put("a", "1")
+	server, url, served := startHTTPServer(t, store)
+
+	status := updateBulkAsync(url, `[{"key":"a","value":"2"}]`)
+	<-store.started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	// Shutdown has to wait for the bulk update, but it stops taking new
+	// connections right away.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the request in flight was done", err)
+	default:
+	}
+	if _, err := http.Get(url + "/get?key=a"); err == nil {
+		t.Errorf("Expected new connections to be refused while shutting down")
+	}
+
+	close(store.release)
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("Expected the request in flight to finish with 200, got %d", got)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned an error: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServer_ShutdownCancelsBatchUpdates(t *testing.T) {
+	store := newBlockingStore()
+	store.Put("a", "1")
+	server, url, _ := startHTTPServer(t, store)
+
+	status := updateBulkAsync(url, `[{"key":"a","value":"2"}]`)
+	<-store.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Shutdown to run out of time, got %v", err)
+	}
+	// The handler has returned by now, so the update was cancelled rather
+	// than left running against a store that is about to be closed.
+	if value, _ := store.Store.Get("a"); value != "1" {
+		t.Errorf("Expected the cancelled bulk update not to apply, got %v", value)
+	}
+	select {
+	case <-status:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the client to be let go")
+	}
+}
+
+func TestRESPServer_Shutdown(t *testing.T) {
+	store := newBlockingStore()
+	store.Store.Put("a", "1")
+	server := NewRESPServer(store, "")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	idle, idleReader := dial()
+	idle.Write([]byte("PING\r\n"))
+	if line, _ := idleReader.ReadString('\n'); line != "+PONG\r\n" {
+		t.Fatalf("Unexpected reply to PING: %q", line)
+	}
+	busy, busyReader := dial()
+	busy.Write([]byte("GET a\r\nGET a\r\n"))
+	<-store.started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	// The idle connection is closed right away.
+	if _, err := idleReader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+
+	// The busy one gets the reply to the command it was on, and is closed
+	// instead of running the next one.
+	close(store.release)
+	reply, err := io.ReadAll(busyReader)
+	if err != nil || string(reply) != "$1\r\n1\r\n" {
+		t.Errorf("Expected one reply and then EOF, got %q, %v", reply, err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned an error: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+}
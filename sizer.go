@@ -0,0 +1,36 @@
+package kv
+
+import "encoding/json"
+
+// Sizer returns what a key and its value cost, in bytes, for the stores that
+// are limited by memory instead of by the number of keys. It has to give the
+// same answer every time for the same key and value.
+type Sizer func(key string, value interface{}) int64
+
+// DefaultSizer is an estimate of the payload only. Strings and byte slices
+// count their length, numbers and bools 8 bytes, and anything else (maps and
+// slices decoded from JSON mostly) the length of its JSON encoding. It does
+// not try to account for the overhead of the Go map and pointers, if you store
+// lots of tiny values leave some headroom.
+func DefaultSizer(key string, value interface{}) int64 {
+	return int64(len(key)) + valueSize(value)
+}
+
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case bool, int, int64, uint64, float64, int32, uint32, float32:
+		return 8
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		// Not something we could persist either, call it a pointer.
+		return 8
+	}
+	return int64(len(encoded))
+}
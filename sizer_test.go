@@ -0,0 +1,133 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultSizer(t *testing.T) {
+	cases := []struct {
+		value interface{}
+		want  int64
+	}{
+		{"hello", 1 + 5},
+		{[]byte("abc"), 1 + 3},
+		{float64(3), 1 + 8},
+		{true, 1 + 8},
+		{nil, 1},
+		{map[string]interface{}{"a": "b"}, 1 + int64(len(`{"a":"b"}`))},
+	}
+	for _, c := range cases {
+		if got := DefaultSizer("k", c.value); got != c.want {
+			t.Errorf("DefaultSizer(k, %v) = %d, want %d", c.value, got, c.want)
+		}
+	}
+}
+
+func TestWeightedCache_EvictsUntilUnderBudget(t *testing.T) {
+	cache := NewWeightedCacheStore(100, nil, NewLRUPolicy())
+	for _, k := range []string{"a", "b", "c", "d"} {
+		// 1 byte key + 19 byte value = 20 bytes each.
+		cache.Put(k, strings.Repeat("x", 19))
+	}
+	if cache.used != 80 {
+		t.Fatalf("Expected 80 bytes used, got %d", cache.used)
+	}
+
+	// 60 bytes only fits if a and b go.
+	cache.Put("e", strings.Repeat("x", 59))
+	for _, k := range []string{"a", "b"} {
+		if _, err := cache.Get(k); err == nil {
+			t.Errorf("Expected %s to be evicted", k)
+		}
+	}
+	for _, k := range []string{"c", "d", "e"} {
+		if _, err := cache.Get(k); err != nil {
+			t.Errorf("Expected %s to still be cached", k)
+		}
+	}
+	if cache.used != 100 {
+		t.Errorf("Expected 100 bytes used, got %d", cache.used)
+	}
+
+	// Growing a value also evicts.
+	cache.Update("e", strings.Repeat("x", 79))
+	if _, err := cache.Get("c"); err == nil {
+		t.Errorf("Expected c to be evicted after e grew")
+	}
+
+	if err := cache.Put("huge", strings.Repeat("x", 200)); err != ErrKVFull {
+		t.Errorf("Expected ErrKVFull for a value bigger than the cache, got %v", err)
+	}
+	if _, err := cache.Get("e"); err != nil {
+		t.Errorf("Expected a refused value not to evict anything")
+	}
+
+	cache.Delete("e")
+	cache.Delete("d")
+	if cache.used != 0 {
+		t.Errorf("Expected 0 bytes used after deleting everything, got %d", cache.used)
+	}
+}
+
+func TestWeightedMap_RejectsOverBudget(t *testing.T) {
+	// Custom sizer: only the value's length counts.
+	sizer := func(key string, value interface{}) int64 { return int64(len(value.(string))) }
+	path := filepath.Join(t.TempDir(), "kv.wal")
+	s := NewWeightedWriteOptimizedMapStore(1, true, 10, sizer)
+	w, err := OpenWAL(path, WALOptions{Fsync: FsyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL returned an error: %v", err)
+	}
+	s.AttachWAL(w)
+
+	if err := s.Put("a", "12345"); err != nil {
+		t.Fatalf("Put returned an error: %v", err)
+	}
+	if err := s.Put("b", "123456"); err != ErrKVFull {
+		t.Errorf("Expected ErrKVFull, got %v", err)
+	}
+	if err := s.Put("b", "12345"); err != nil {
+		t.Errorf("Expected a value that fits exactly to be accepted, got %v", err)
+	}
+	// Overwriting with something smaller is fine even when full.
+	if err := s.Put("a", "1"); err != nil {
+		t.Errorf("Expected an overwrite that shrinks to be accepted, got %v", err)
+	}
+	if err := s.Update("a", "123456"); err != ErrKVFull {
+		t.Errorf("Expected ErrKVFull from Update, got %v", err)
+	}
+	if _, err := s.BatchUpdate(context.Background(), []Pair{{"a", "12"}, {"b", "123456789"}}); err != ErrKVFull {
+		t.Errorf("Expected ErrKVFull from BatchUpdate, got %v", err)
+	}
+	if value, _ := s.Get("a"); value != "1" {
+		t.Errorf("Expected a refused batch to change nothing, a = %v", value)
+	}
+	s.Delete("b")
+	if s.used != 1 {
+		t.Errorf("Expected 1 byte used, got %d", s.used)
+	}
+	s.Close()
+
+	// The accounting has to be rebuilt when the log is replayed.
+	s = NewWeightedWriteOptimizedMapStore(1, true, 10, sizer)
+	w, _ = OpenWAL(path, WALOptions{Fsync: FsyncNever})
+	if err := s.AttachWAL(w); err != nil {
+		t.Fatalf("AttachWAL returned an error: %v", err)
+	}
+	defer s.Close()
+	if s.used != 1 {
+		t.Errorf("Expected 1 byte used after replay, got %d", s.used)
+	}
+
+	var buf bytes.Buffer
+	big := NewWriteOptimizedMapStore(1, true, 100)
+	big.Put("x", "12345678901")
+	big.Snapshot(&buf)
+	if err := s.Restore(&buf); err != ErrKVFull {
+		t.Errorf("Expected ErrKVFull restoring a snapshot over budget, got %v", err)
+	}
+}
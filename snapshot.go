@@ -0,0 +1,188 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshotter is implemented by stores that can dump their full contents and
+// load them back.
+type Snapshotter interface {
+	// Snapshot writes the contents of the store to w.
+	Snapshot(w io.Writer) error
+	// Restore replaces the contents of the store with the snapshot read from r.
+	// Nothing is changed unless the whole snapshot reads back fine.
+	Restore(r io.Reader) error
+}
+
+// The snapshot file format is:
+//
+//	[8 byte magic "KVSNAPSH"][4 byte version]
+//	[record]...              one per entry, see record.go for the framing
+//	[empty record]           marks the end of the entries
+//	[record]                 the trailer: entry count and a crc over all entries
+//
+// The per record checksums catch corruption of a single entry, the trailer
+// catches a snapshot that was cut short (e.g. a download that died halfway).
+const (
+	snapshotMagic   = "KVSNAPSH"
+	snapshotVersion = 1
+)
+
+var errBadSnapshot = errors.New("kv: not a valid snapshot")
+
+type snapshotEntry struct {
+	Key   string      `json:"k"`
+	Value interface{} `json:"v"`
+	// ExpireAt is the expiry of keys with a TTL, in unix nanoseconds.
+	ExpireAt int64 `json:"e,omitempty"`
+}
+
+type snapshotTrailer struct {
+	Count uint64 `json:"count"`
+	CRC   uint32 `json:"crc"`
+}
+
+type snapshotWriter struct {
+	w     *bufio.Writer
+	count uint64
+	crc   uint32
+}
+
+func newSnapshotWriter(w io.Writer) (*snapshotWriter, error) {
+	bw := bufio.NewWriter(w)
+	var header [12]byte
+	copy(header[:8], snapshotMagic)
+	binary.LittleEndian.PutUint32(header[8:], snapshotVersion)
+	if _, err := bw.Write(header[:]); err != nil {
+		return nil, err
+	}
+	return &snapshotWriter{w: bw}, nil
+}
+
+// add writes an entry. expireAt is the zero time for keys without a TTL.
+func (sw *snapshotWriter) add(key string, value interface{}, expireAt time.Time) error {
+	e := snapshotEntry{Key: key, Value: value}
+	if !expireAt.IsZero() {
+		e.ExpireAt = expireAt.UnixNano()
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	sw.count++
+	sw.crc = crc32.Update(sw.crc, crcTable, payload)
+	return writeRecord(sw.w, payload)
+}
+
+func (sw *snapshotWriter) close() error {
+	if err := writeRecord(sw.w, nil); err != nil {
+		return err
+	}
+	trailer, err := json.Marshal(snapshotTrailer{Count: sw.count, CRC: sw.crc})
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(sw.w, trailer); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// readSnapshot calls fn for every entry in the snapshot. Callers must not
+// treat the entries as valid until readSnapshot returns nil, the trailer is
+// only checked at the very end.
+func readSnapshot(r io.Reader, fn func(key string, value interface{}, expireAt time.Time) error) error {
+	br := bufio.NewReader(r)
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return errBadSnapshot
+	}
+	if !bytes.Equal(header[:8], []byte(snapshotMagic)) {
+		return errBadSnapshot
+	}
+	if version := binary.LittleEndian.Uint32(header[8:]); version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", errBadSnapshot, version)
+	}
+
+	var count uint64
+	var crc uint32
+	for {
+		payload, err := readRecord(br)
+		if err != nil {
+			return fmt.Errorf("%w: reading entry %d: %v", errBadSnapshot, count, err)
+		}
+		if len(payload) == 0 {
+			break
+		}
+		var e snapshotEntry
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return fmt.Errorf("%w: %v", errBadSnapshot, err)
+		}
+		count++
+		crc = crc32.Update(crc, crcTable, payload)
+		var expireAt time.Time
+		if e.ExpireAt != 0 {
+			expireAt = time.Unix(0, e.ExpireAt)
+		}
+		if err := fn(e.Key, e.Value, expireAt); err != nil {
+			return err
+		}
+	}
+
+	payload, err := readRecord(br)
+	if err != nil {
+		return fmt.Errorf("%w: reading trailer: %v", errBadSnapshot, err)
+	}
+	var trailer snapshotTrailer
+	if err := json.Unmarshal(payload, &trailer); err != nil {
+		return fmt.Errorf("%w: %v", errBadSnapshot, err)
+	}
+	if trailer.Count != count || trailer.CRC != crc {
+		return errBadSnapshot
+	}
+	return nil
+}
+
+// SnapshotToFile writes a snapshot of s to path. The snapshot is written to a
+// temporary file first and renamed into place, so path always holds either
+// the previous snapshot or the complete new one.
+func SnapshotToFile(s Snapshotter, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := s.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RestoreFromFile restores s from the snapshot at path.
+func RestoreFromFile(s Snapshotter, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Restore(f)
+}
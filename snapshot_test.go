@@ -0,0 +1,227 @@
+package kv
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	type snapshotStore interface {
+		Store
+		Snapshotter
+	}
+	stores := map[string]func() snapshotStore{
+		"map": func() snapshotStore { return NewWriteOptimizedMapStore(1, true, 100) },
+		"lru": func() snapshotStore { return NewLRUCacheStore(100) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			src := newStore()
+			src.Put("a", "1")
+			src.Put("b", map[string]interface{}{"nested": true})
+
+			var buf bytes.Buffer
+			if err := src.Snapshot(&buf); err != nil {
+				t.Fatalf("Snapshot returned an error: %v", err)
+			}
+
+			dst := newStore()
+			dst.Put("stale", "gone after restore")
+			if err := dst.Restore(&buf); err != nil {
+				t.Fatalf("Restore returned an error: %v", err)
+			}
+
+			if value, err := dst.Get("a"); err != nil || value != "1" {
+				t.Errorf("Get(a) = %v, %v after restore", value, err)
+			}
+			if value, err := dst.Get("b"); err != nil || value.(map[string]interface{})["nested"] != true {
+				t.Errorf("Get(b) = %v, %v after restore", value, err)
+			}
+			if _, err := dst.Get("stale"); err == nil {
+				t.Errorf("Expected keys that are not in the snapshot to be gone")
+			}
+		})
+	}
+}
+
+func TestSnapshot_ShardedSyncMapStore(t *testing.T) {
+	src := NewShardedSyncMapStore()
+	for _, k := range []string{"a", "b", "c"} {
+		src.Put(k, k)
+	}
+	path := filepath.Join(t.TempDir(), "kv.snapshot")
+	if err := SnapshotToFile(src, path); err != nil {
+		t.Fatalf("SnapshotToFile returned an error: %v", err)
+	}
+
+	dst := NewShardedSyncMapStore()
+	dst.Put("stale", "x")
+	if err := RestoreFromFile(dst, path); err != nil {
+		t.Fatalf("RestoreFromFile returned an error: %v", err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if value, err := dst.Get(k); err != nil || value != k {
+			t.Errorf("Get(%s) = %v, %v after restore", k, value, err)
+		}
+	}
+	if _, err := dst.Get("stale"); err == nil {
+		t.Errorf("Expected keys that are not in the snapshot to be gone")
+	}
+}
+
+// pausingWriter blocks its first Write until resume is closed, so writes
+// can land in the middle of a snapshot.
+type pausingWriter struct {
+	bytes.Buffer
+	paused chan struct{}
+	resume chan struct{}
+}
+
+func (w *pausingWriter) Write(p []byte) (int, error) {
+	if w.paused != nil {
+		close(w.paused)
+		w.paused = nil
+		<-w.resume
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestSnapshot_ShardedSyncMapStoreIsPointInTime(t *testing.T) {
+	src := NewShardedSyncMapStore()
+	old := strings.Repeat("o", 100)
+	for i := 0; i < 1000; i++ {
+		src.Put("k"+strconv.Itoa(i), old)
+	}
+
+	w := &pausingWriter{paused: make(chan struct{}), resume: make(chan struct{})}
+	paused := w.paused
+	errc := make(chan error, 1)
+	go func() { errc <- src.Snapshot(w) }()
+	<-paused
+	for i := 0; i < 1000; i++ {
+		key := "k" + strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			src.Put(key, "new")
+		case 1:
+			src.Delete(key)
+			src.Put(key, "new")
+		case 2:
+			src.Delete(key)
+		}
+		src.Put("added"+strconv.Itoa(i), "new")
+	}
+	close(w.resume)
+	if err := <-errc; err != nil {
+		t.Fatalf("Snapshot returned an error: %v", err)
+	}
+
+	dst := NewShardedSyncMapStore()
+	if err := dst.Restore(&w.Buffer); err != nil {
+		t.Fatalf("Restore returned an error: %v", err)
+	}
+	if n := dst.Len(); n != 1000 {
+		t.Errorf("Expected the 1000 keys of when the snapshot started, got %d", n)
+	}
+	for i := 0; i < 1000; i++ {
+		key := "k" + strconv.Itoa(i)
+		if value, err := dst.Get(key); err != nil || value != old {
+			t.Fatalf("Get(%s) = %v, %v, expected the value from before the snapshot", key, value, err)
+		}
+	}
+}
+
+func TestSnapshot_CorruptSnapshotIsRejected(t *testing.T) {
+	src := NewWriteOptimizedMapStore(1, true, 100)
+	src.Put("a", "1")
+	src.Put("b", "2")
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+	good := buf.Bytes()
+
+	tests := map[string][]byte{
+		"truncated":      good[:len(good)-5],
+		"flipped bit":    append(append([]byte{}, good[:20]...), append([]byte{good[20] ^ 0x01}, good[21:]...)...),
+		"not a snapshot": []byte("hello"),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			dst := NewWriteOptimizedMapStore(1, true, 100)
+			dst.Put("keep", "me")
+			if err := dst.Restore(bytes.NewReader(data)); err == nil {
+				t.Fatal("Expected Restore to fail")
+			}
+			if value, err := dst.Get("keep"); err != nil || value != "me" {
+				t.Errorf("Expected a failed restore to leave the store untouched, got %v, %v", value, err)
+			}
+		})
+	}
+}
+
+func TestSnapshot_LRURestoreKeepsMostRecent(t *testing.T) {
+	src := NewLRUCacheStore(3)
+	src.Put("old", 1)
+	src.Put("mid", 2)
+	src.Put("new", 3)
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+
+	dst := NewLRUCacheStore(2)
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore returned an error: %v", err)
+	}
+	if _, err := dst.Get("old"); err == nil {
+		t.Errorf("Expected the least recently used entry to be dropped")
+	}
+	for _, k := range []string{"mid", "new"} {
+		if _, err := dst.Get(k); err != nil {
+			t.Errorf("Expected %s to survive the restore: %v", k, err)
+		}
+	}
+}
+
+func TestSnapshot_MapRestoreRespectsSize(t *testing.T) {
+	src := NewWriteOptimizedMapStore(1, true, 100)
+	src.Put("a", 1)
+	src.Put("b", 2)
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+
+	dst := NewWriteOptimizedMapStore(1, true, 1)
+	if err := dst.Restore(&buf); err != ErrKVFull {
+		t.Errorf("Expected ErrKVFull, got %v", err)
+	}
+}
+
+func TestSnapshot_HTTPEndpoints(t *testing.T) {
+	src := NewHTTPServer(NewWriteOptimizedMapStore(1, true, 100), "")
+	src.db.Put("a", "1")
+	dst := NewHTTPServer(NewLRUCacheStore(100), "")
+
+	rec := httptest.NewRecorder()
+	src.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/snapshot returned %d", rec.Code)
+	}
+
+	restore := httptest.NewRecorder()
+	dst.mux.ServeHTTP(restore, httptest.NewRequest(http.MethodPost, "/admin/restore", rec.Body))
+	if restore.Code != http.StatusOK {
+		t.Fatalf("POST /admin/restore returned %d: %s", restore.Code, restore.Body)
+	}
+	if value, err := dst.db.Get("a"); err != nil || value != "1" {
+		t.Errorf("Get(a) = %v, %v after restore", value, err)
+	}
+
+	bad := httptest.NewRecorder()
+	dst.mux.ServeHTTP(bad, httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader([]byte("nope"))))
+	if bad.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad snapshot, got %d", bad.Code)
+	}
+}
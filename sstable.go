@@ -0,0 +1,310 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// An sstable is an immutable file of entries sorted by key:
+//
+//	[record]...   entries, see encodeEntryRecord
+//	[record]...   sparse index, one [8 byte offset][key] every sstableIndexInterval entries
+//	[record]      bloom filter over every key in the table
+//	[record]      json sstableMeta
+//	[footer]      offsets of the index, bloom filter and meta plus a magic number
+//
+// The index and bloom filter are loaded into memory when the table is opened,
+// the entries stay on disk.
+const (
+	sstableExt           = ".sst"
+	sstableMagic         = uint64(0x4b564c534d535354) // "KVLSMSST"
+	sstableFooterSize    = 32
+	sstableIndexInterval = 16
+)
+
+type sstableMeta struct {
+	MinKey string `json:"minKey"`
+	MaxKey string `json:"maxKey"`
+	Count  int    `json:"count"`
+	MaxSeq uint64 `json:"maxSeq"`
+}
+
+type sstIndexEntry struct {
+	key    string
+	offset int64
+}
+
+type sstable struct {
+	id      uint64
+	path    string
+	f       *os.File
+	size    int64
+	dataEnd int64
+	index   []sstIndexEntry
+	bloom   *bloomFilter
+	meta    sstableMeta
+}
+
+func openSSTable(path string, id uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadSSTable(f, path, id)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("kv: opening sstable %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func loadSSTable(f *os.File, path string, id uint64) (*sstable, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < sstableFooterSize {
+		return nil, errCorruptRecord
+	}
+	var footer [sstableFooterSize]byte
+	if _, err := f.ReadAt(footer[:], size-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(footer[24:32]) != sstableMagic {
+		return nil, errCorruptRecord
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	bloomOffset := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	metaOffset := int64(binary.LittleEndian.Uint64(footer[16:24]))
+	if !(indexOffset <= bloomOffset && bloomOffset <= metaOffset && metaOffset <= size-sstableFooterSize) {
+		return nil, errCorruptRecord
+	}
+
+	t := &sstable{id: id, path: path, f: f, size: size, dataEnd: indexOffset}
+
+	r := bufio.NewReader(io.NewSectionReader(f, indexOffset, bloomOffset-indexOffset))
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) < 8 {
+			return nil, errCorruptRecord
+		}
+		t.index = append(t.index, sstIndexEntry{
+			offset: int64(binary.LittleEndian.Uint64(payload[0:8])),
+			key:    string(payload[8:]),
+		})
+	}
+
+	payload, err := readRecord(io.NewSectionReader(f, bloomOffset, metaOffset-bloomOffset))
+	if err != nil {
+		return nil, err
+	}
+	if t.bloom, err = unmarshalBloomFilter(payload); err != nil {
+		return nil, err
+	}
+
+	payload, err = readRecord(io.NewSectionReader(f, metaOffset, size-sstableFooterSize-metaOffset))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &t.meta); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sstable) overlaps(minKey, maxKey string) bool {
+	return t.meta.MinKey <= maxKey && minKey <= t.meta.MaxKey
+}
+
+// get looks key up. hash is bloomHash(key), passed in so a Get that checks
+// several tables only hashes once.
+func (t *sstable) get(key string, hash uint64) (memEntry, bool, error) {
+	if key < t.meta.MinKey || key > t.meta.MaxKey || !t.bloom.mayContain(hash) {
+		return memEntry{}, false, nil
+	}
+
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key }) - 1
+	if i < 0 {
+		return memEntry{}, false, nil
+	}
+	start, end := t.index[i].offset, t.dataEnd
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+	block := make([]byte, end-start)
+	if _, err := t.f.ReadAt(block, start); err != nil {
+		return memEntry{}, false, err
+	}
+
+	r := bytes.NewReader(block)
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			return memEntry{}, false, nil
+		}
+		if err != nil {
+			return memEntry{}, false, err
+		}
+		seq, flag, k, value, err := decodeEntryRecord(payload)
+		if err != nil {
+			return memEntry{}, false, err
+		}
+		if k == key {
+			return memEntry{seq: seq, tombstone: flag == entryTombstone, value: value}, true, nil
+		}
+		if k > key {
+			return memEntry{}, false, nil
+		}
+	}
+}
+
+func (t *sstable) iter() *sstIterator {
+	return &sstIterator{r: bufio.NewReader(io.NewSectionReader(t.f, 0, t.dataEnd))}
+}
+
+func (t *sstable) close() error {
+	return t.f.Close()
+}
+
+// sstIterator walks the entries of a table in key order.
+type sstIterator struct {
+	r     *bufio.Reader
+	key   string
+	entry memEntry
+	err   error
+}
+
+func (it *sstIterator) next() bool {
+	payload, err := readRecord(it.r)
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		return false
+	}
+	seq, flag, key, value, err := decodeEntryRecord(payload)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.key = key
+	it.entry = memEntry{seq: seq, tombstone: flag == entryTombstone, value: value}
+	return true
+}
+
+// sstWriter writes a new table. Entries have to be added in key order.
+type sstWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	path   string
+	offset int64
+	index  []sstIndexEntry
+	hashes []uint64
+	meta   sstableMeta
+	fpRate float64
+}
+
+func createSSTable(path string, falsePositiveRate float64) (*sstWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{f: f, w: bufio.NewWriter(f), path: path, fpRate: falsePositiveRate}, nil
+}
+
+func (w *sstWriter) add(key string, e memEntry) error {
+	flag := entryPut
+	if e.tombstone {
+		flag = entryTombstone
+	}
+	if w.meta.Count%sstableIndexInterval == 0 {
+		w.index = append(w.index, sstIndexEntry{key: key, offset: w.offset})
+	}
+	if w.meta.Count == 0 {
+		w.meta.MinKey = key
+	}
+	w.meta.MaxKey = key
+	w.meta.Count++
+	if e.seq > w.meta.MaxSeq {
+		w.meta.MaxSeq = e.seq
+	}
+	w.hashes = append(w.hashes, bloomHash(key))
+
+	buf := appendRecord(nil, encodeRawEntryRecord(e.seq, flag, key, e.value))
+	w.offset += int64(len(buf))
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// size is how many bytes of entries have been written so far.
+func (w *sstWriter) size() int64 {
+	return w.offset
+}
+
+// finish writes the index, bloom filter and footer and syncs the file.
+func (w *sstWriter) finish() error {
+	indexOffset := w.offset
+	for _, ie := range w.index {
+		payload := make([]byte, 8, 8+len(ie.key))
+		binary.LittleEndian.PutUint64(payload, uint64(ie.offset))
+		buf := appendRecord(nil, append(payload, ie.key...))
+		w.offset += int64(len(buf))
+		if _, err := w.w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	bloomOffset := w.offset
+	bloom := newBloomFilter(len(w.hashes), w.fpRate)
+	for _, h := range w.hashes {
+		bloom.add(h)
+	}
+	buf := appendRecord(nil, bloom.marshal())
+	w.offset += int64(len(buf))
+	if _, err := w.w.Write(buf); err != nil {
+		return err
+	}
+
+	metaOffset := w.offset
+	meta, err := json.Marshal(w.meta)
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(w.w, meta); err != nil {
+		return err
+	}
+
+	var footer [sstableFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(bloomOffset))
+	binary.LittleEndian.PutUint64(footer[16:24], uint64(metaOffset))
+	binary.LittleEndian.PutUint64(footer[24:32], sstableMagic)
+	if _, err := w.w.Write(footer[:]); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+func (w *sstWriter) abort() {
+	w.f.Close()
+	os.Remove(w.path)
+}
@@ -7,7 +7,10 @@ package kv
 
 import (
 	"context"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const shardCount = 32
@@ -24,46 +27,547 @@ func getShardIndex(key string) uint32 {
 
 type ShardedSyncMapStore struct {
 	shards [shardCount]sync.Map
+	exp    expirer
+	// version is the last version handed out.
+	version atomic.Uint64
+
+	// gate is read locked by every write, from taking its version until it
+	// has told the running snapshots what it replaced, and write locked by
+	// Snapshot to start and to finish. snapshots are the ones running, they
+	// only change with the gate write locked.
+	gate      sync.RWMutex
+	snapshots []*syncSnapshot
+
+	storeMetrics
+}
+
+// syncSnapshot is a Snapshot in progress, of the store as it was when the
+// last version handed out was cut. The first write of a key after that
+// leaves what the key had at the cut in before, so the snapshot can still
+// write it out once it gets to the key.
+type syncSnapshot struct {
+	cut    uint64
+	mu     sync.Mutex
+	before map[string]syncBefore
+}
+
+type syncBefore struct {
+	// entry is nil if the key didn't exist at the cut.
+	entry *syncEntry
+	// written is set once the snapshot has written the entry out.
+	written bool
+}
+
+// syncEntry is what actually goes in the shards. Entries are never modified
+// in place, every write stores a new one, so readers need no locking.
+type syncEntry struct {
+	value interface{}
+	// expireAt is the zero time for entries without a TTL.
+	expireAt time.Time
+	version  uint64
+	modified time.Time
+}
+
+func (s *ShardedSyncMapStore) newEntry(value interface{}, expireAt time.Time) *syncEntry {
+	return &syncEntry{value: value, expireAt: expireAt, version: s.version.Add(1), modified: time.Now()}
+}
+
+func (e *syncEntry) versioned() *Versioned {
+	return &Versioned{Value: e.value, Version: e.version, Modified: e.modified}
 }
 
 func NewShardedSyncMapStore() *ShardedSyncMapStore {
-	return &ShardedSyncMapStore{}
+	s := &ShardedSyncMapStore{}
+	s.exp = newExpirer(s.removeExpired)
+	return s
+}
+
+// load returns the live entry of key, deleting it if it has expired.
+func (s *ShardedSyncMapStore) load(key string) (*syncEntry, bool) {
+	e, live := s.peek(key)
+	if e != nil && !live {
+		s.gate.RLock()
+		s.swap(key, e, nil)
+		s.gate.RUnlock()
+	}
+	if !live {
+		return nil, false
+	}
+	return e, true
+}
+
+// loadLocked is load for the writes, which hold the gate already.
+func (s *ShardedSyncMapStore) loadLocked(key string) (*syncEntry, bool) {
+	e, live := s.peek(key)
+	if e != nil && !live {
+		s.swap(key, e, nil)
+	}
+	if !live {
+		return nil, false
+	}
+	return e, true
 }
 
-func (s *ShardedSyncMapStore) Get(key string) (interface{}, error) {
+// peek returns the entry of key, nil if there is none, and whether it is
+// live.
+func (s *ShardedSyncMapStore) peek(key string) (*syncEntry, bool) {
+	value, ok := s.shards[getShardIndex(key)].Load(key)
+	if !ok {
+		return nil, false
+	}
+	e := value.(*syncEntry)
+	return e, !s.exp.expired(e.expireAt)
+}
+
+// swap replaces the entry e of key (nil if there is none) with next (nil
+// deletes it), unless someone got there first. Must be called with the gate
+// read locked.
+func (s *ShardedSyncMapStore) swap(key string, e, next *syncEntry) bool {
 	shard := &s.shards[getShardIndex(key)]
-	value, ok := shard.Load(key)
+	var swapped bool
+	switch {
+	case e == nil:
+		_, loaded := shard.LoadOrStore(key, next)
+		swapped = !loaded
+	case next == nil:
+		swapped = shard.CompareAndDelete(key, e)
+	default:
+		swapped = shard.CompareAndSwap(key, e, next)
+	}
+	if swapped {
+		s.replaced(key, e)
+	}
+	return swapped
+}
+
+// replaced tells the running snapshots that the entry old of key (nil if
+// there was none) was just replaced or deleted. Must be called with the
+// gate read locked.
+func (s *ShardedSyncMapStore) replaced(key string, old *syncEntry) {
+	for _, snap := range s.snapshots {
+		snap.mu.Lock()
+		before, ok := snap.before[key]
+		switch {
+		case old != nil && old.version > snap.cut:
+			// Written after the cut, the write that replaced the entry of
+			// the cut tells about that one.
+		case !ok:
+			snap.before[key] = syncBefore{entry: old}
+		case before.entry == nil && old != nil:
+			// A delete of the entry of the cut and a put after it raced,
+			// and the put got here first.
+			snap.before[key] = syncBefore{entry: old}
+		}
+		snap.mu.Unlock()
+	}
+}
+
+func (s *ShardedSyncMapStore) removeExpired(keys []string) {
+	for _, key := range keys {
+		s.load(key)
+	}
+}
+
+// Close stops the expiry of keys with a TTL.
+func (s *ShardedSyncMapStore) Close() error {
+	s.exp.stop()
+	return nil
+}
+
+func (s *ShardedSyncMapStore) Get(key string) (_ interface{}, err error) {
+	defer func() { s.observe(opGet, err) }()
+	e, ok := s.load(key)
 	if !ok {
 		return nil, newNotFoundError(key)
 	}
-	return value, nil
+	return e.value, nil
 }
 
-func (s *ShardedSyncMapStore) Put(key string, value interface{}) error {
-	shard := &s.shards[getShardIndex(key)]
-	shard.Store(key, value)
+func (s *ShardedSyncMapStore) GetVersioned(key string) (_ Versioned, err error) {
+	defer func() { s.observe(opGet, err) }()
+	e, ok := s.load(key)
+	if !ok {
+		return Versioned{}, newNotFoundError(key)
+	}
+	return *e.versioned(), nil
+}
+
+// The versioned writes work like the conditional ones below: check against
+// what load returned, then only write if it is still the same entry.
+
+func (s *ShardedSyncMapStore) PutIf(key string, value interface{}, cond Precondition) (Versioned, error) {
+	return s.putIf(key, value, time.Time{}, cond)
+}
+
+func (s *ShardedSyncMapStore) PutIfWithTTL(key string, value interface{}, ttl time.Duration, cond Precondition) (Versioned, error) {
+	return s.putIf(key, value, s.exp.expireAt(ttl), cond)
+}
+
+func (s *ShardedSyncMapStore) putIf(key string, value interface{}, expireAt time.Time, cond Precondition) (_ Versioned, err error) {
+	defer func() { s.observe(opPut, err) }()
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		e, ok := s.loadLocked(key)
+		var current *Versioned
+		if ok {
+			current = e.versioned()
+		}
+		if err := cond.check(current); err != nil {
+			return Versioned{}, err
+		}
+		next := s.newEntry(value, expireAt)
+		if s.swap(key, e, next) {
+			if !expireAt.IsZero() {
+				s.exp.schedule(key, expireAt)
+			}
+			return *next.versioned(), nil
+		}
+	}
+}
+
+func (s *ShardedSyncMapStore) UpdateIf(key string, value interface{}, cond Precondition) (_ Versioned, err error) {
+	defer func() { s.observe(opUpdate, err) }()
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		e, ok := s.loadLocked(key)
+		if !ok {
+			return Versioned{}, newNotFoundError(key)
+		}
+		if err := cond.check(e.versioned()); err != nil {
+			return Versioned{}, err
+		}
+		next := s.newEntry(value, e.expireAt)
+		if s.swap(key, e, next) {
+			return *next.versioned(), nil
+		}
+	}
+}
+
+func (s *ShardedSyncMapStore) DeleteIf(key string, cond Precondition) (err error) {
+	defer func() { s.observe(opDelete, err) }()
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		e, ok := s.loadLocked(key)
+		if !ok {
+			return cond.check(nil)
+		}
+		if err := cond.check(e.versioned()); err != nil {
+			return err
+		}
+		if s.swap(key, e, nil) {
+			return nil
+		}
+	}
+}
+
+// store sets key no matter what. It is a compare-and-swap loop instead of a
+// plain Store so that a writer that got its version first but stores last
+// can't put an older version over a newer one.
+func (s *ShardedSyncMapStore) store(key string, value interface{}, expireAt time.Time) {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		// Expired or not, it gets replaced.
+		current, _ := s.peek(key)
+		if s.swap(key, current, s.newEntry(value, expireAt)) {
+			return
+		}
+	}
+}
+
+func (s *ShardedSyncMapStore) Put(key string, value interface{}) (err error) {
+	defer func() { s.observe(opPut, err) }()
+	s.store(key, value, time.Time{})
 	return nil
 }
 
-func (s *ShardedSyncMapStore) Delete(key string) error {
-	shard := &s.shards[getShardIndex(key)]
-	shard.Delete(key)
+func (s *ShardedSyncMapStore) PutWithTTL(key string, value interface{}, ttl time.Duration) (err error) {
+	defer func() { s.observe(opPut, err) }()
+	expireAt := s.exp.now().Add(ttl)
+	s.store(key, value, expireAt)
+	s.exp.schedule(key, expireAt)
 	return nil
 }
 
-func (s *ShardedSyncMapStore) BatchUpdate(ctx context.Context, pairs []Pair) ([]Pair, error) {
+func (s *ShardedSyncMapStore) TTL(key string) (time.Duration, error) {
+	e, ok := s.load(key)
+	if !ok {
+		return 0, newNotFoundError(key)
+	}
+	return s.exp.remaining(e.expireAt), nil
+}
+
+func (s *ShardedSyncMapStore) Expire(key string, ttl time.Duration) (err error) {
+	defer func() { s.observe(opUpdate, err) }()
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	expireAt := s.exp.expireAt(ttl)
+	for {
+		e, ok := s.loadLocked(key)
+		if !ok {
+			return newNotFoundError(key)
+		}
+		if s.swap(key, e, s.newEntry(e.value, expireAt)) {
+			if !expireAt.IsZero() {
+				s.exp.schedule(key, expireAt)
+			}
+			return nil
+		}
+	}
+}
+
+// update swaps in value for key if it exists, keeping its TTL.
+func (s *ShardedSyncMapStore) update(key string, value interface{}) bool {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		e, ok := s.loadLocked(key)
+		if !ok {
+			return false
+		}
+		if s.swap(key, e, s.newEntry(value, e.expireAt)) {
+			return true
+		}
+	}
+}
+
+func (s *ShardedSyncMapStore) Update(key string, value interface{}) (err error) {
+	defer func() { s.observe(opUpdate, err) }()
+	if !s.update(key, value) {
+		return newNotFoundError(key)
+	}
+	return nil
+}
+
+// The conditional operations are all a load followed by one of sync.Map's
+// own compare-and-swap style calls, retried if the entry changed in between.
+// Expired entries are treated as absent, load deletes them.
+
+func (s *ShardedSyncMapStore) PutIfAbsent(key string, value interface{}) (err error) {
+	defer func() { s.observe(opPut, err) }()
+	if _, loaded := s.getOrPut(key, value); loaded {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+func (s *ShardedSyncMapStore) CompareAndSwap(key string, old, new interface{}) (err error) {
+	defer func() { s.observe(opUpdate, err) }()
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		e, ok := s.loadLocked(key)
+		if !ok {
+			return newNotFoundError(key)
+		}
+		if !valuesEqual(e.value, old) {
+			return ErrValueMismatch
+		}
+		if s.swap(key, e, s.newEntry(new, e.expireAt)) {
+			return nil
+		}
+	}
+}
+
+func (s *ShardedSyncMapStore) CompareAndDelete(key string, old interface{}) (err error) {
+	defer func() { s.observe(opDelete, err) }()
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		e, ok := s.loadLocked(key)
+		if !ok {
+			return newNotFoundError(key)
+		}
+		if !valuesEqual(e.value, old) {
+			return ErrValueMismatch
+		}
+		if s.swap(key, e, nil) {
+			return nil
+		}
+	}
+}
+
+func (s *ShardedSyncMapStore) GetOrPut(key string, value interface{}) (_ interface{}, _ bool, err error) {
+	defer func() { s.observe(opPut, err) }()
+	actual, loaded := s.getOrPut(key, value)
+	return actual, loaded, nil
+}
+
+func (s *ShardedSyncMapStore) getOrPut(key string, value interface{}) (interface{}, bool) {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for {
+		e, ok := s.loadLocked(key)
+		if ok {
+			return e.value, true
+		}
+		if s.swap(key, nil, s.newEntry(value, time.Time{})) {
+			return value, false
+		}
+	}
+}
+
+func (s *ShardedSyncMapStore) Delete(key string) (err error) {
+	defer func() { s.observe(opDelete, err) }()
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	if old, loaded := s.shards[getShardIndex(key)].LoadAndDelete(key); loaded {
+		s.replaced(key, old.(*syncEntry))
+	}
+	return nil
+}
+
+func (s *ShardedSyncMapStore) BatchUpdate(ctx context.Context, pairs []Pair) (_ []Pair, err error) {
+	defer func() { s.observeBatch(len(pairs), err) }()
 	updatedPairs := make([]Pair, 0, len(pairs))
 	for _, pair := range pairs {
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
 		default:
-			shard := &s.shards[getShardIndex(pair.Key)]
-			if _, ok := shard.Load(pair.Key); ok {
-				shard.Store(pair.Key, pair.Value)
+			if s.update(pair.Key, pair.Value) {
 				updatedPairs = append(updatedPairs, pair)
 			}
 		}
 	}
 	return updatedPairs, nil
 }
+
+// Len has to range over every shard to count, sync.Map does not keep a
+// count. Expired entries that have not been collected yet count too.
+func (s *ShardedSyncMapStore) Len() int {
+	n := 0
+	for i := range s.shards {
+		s.shards[i].Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+	}
+	return n
+}
+
+// Keys ranges over each sync.Map in turn, it is not a point in time view
+// like Snapshot. Writes that land while it runs may or may not be in it.
+func (s *ShardedSyncMapStore) Keys() ([]string, error) {
+	var keys []string
+	for i := range s.shards {
+		s.shards[i].Range(func(key, value interface{}) bool {
+			if !s.exp.expired(value.(*syncEntry).expireAt) {
+				keys = append(keys, key.(string))
+			}
+			return true
+		})
+	}
+	return keys, nil
+}
+
+// Snapshot is the store as of when it started, even though it ranges over
+// each sync.Map in turn and writers carry on meanwhile. Whatever they wrote
+// since is skipped, and what they replaced is written instead, see
+// syncSnapshot. Writers only wait for the snapshot to start and to finish,
+// not while it writes.
+func (s *ShardedSyncMapStore) Snapshot(w io.Writer) error {
+	sw, err := newSnapshotWriter(w)
+	if err != nil {
+		return err
+	}
+	snap := &syncSnapshot{before: make(map[string]syncBefore)}
+	s.gate.Lock()
+	snap.cut = s.version.Load()
+	s.snapshots = append(append([]*syncSnapshot(nil), s.snapshots...), snap)
+	s.gate.Unlock()
+	finish := func() {
+		// Once the writes in flight are done, nothing touches snap anymore.
+		s.gate.Lock()
+		defer s.gate.Unlock()
+		var others []*syncSnapshot
+		for _, other := range s.snapshots {
+			if other != snap {
+				others = append(others, other)
+			}
+		}
+		s.snapshots = others
+	}
+
+	for i := range s.shards {
+		s.shards[i].Range(func(key, value interface{}) bool {
+			e := value.(*syncEntry)
+			if e.version > snap.cut {
+				// before has, or will have by the end, what it replaced.
+				return true
+			}
+			// Still there, so this is the entry of the cut.
+			snap.mu.Lock()
+			_, replaced := snap.before[key.(string)]
+			if !replaced {
+				snap.before[key.(string)] = syncBefore{entry: e, written: true}
+			}
+			snap.mu.Unlock()
+			if replaced || s.exp.expired(e.expireAt) {
+				return true
+			}
+			err = sw.add(key.(string), e.value, e.expireAt)
+			return err == nil
+		})
+		if err != nil {
+			finish()
+			return err
+		}
+	}
+	finish()
+
+	for key, before := range snap.before {
+		if before.entry == nil || before.written || s.exp.expired(before.entry.expireAt) {
+			continue
+		}
+		if err := sw.add(key, before.entry.value, before.entry.expireAt); err != nil {
+			return err
+		}
+	}
+	return sw.close()
+}
+
+// Restore is not atomic: writes racing with it may survive.
+func (s *ShardedSyncMapStore) Restore(r io.Reader) error {
+	var shards [shardCount]map[string]syncEntry
+	for i := range shards {
+		shards[i] = make(map[string]syncEntry)
+	}
+	err := readSnapshot(r, func(key string, value interface{}, expireAt time.Time) error {
+		shards[getShardIndex(key)][key] = syncEntry{value: value, expireAt: expireAt}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.Range(func(key, _ interface{}) bool {
+			if _, ok := shards[i][key.(string)]; !ok {
+				if old, loaded := shard.LoadAndDelete(key); loaded {
+					s.replaced(key.(string), old.(*syncEntry))
+				}
+			}
+			return true
+		})
+		for k, restored := range shards[i] {
+			e := s.newEntry(restored.value, restored.expireAt)
+			old, loaded := shard.Swap(k, e)
+			if loaded {
+				s.replaced(k, old.(*syncEntry))
+			} else {
+				s.replaced(k, nil)
+			}
+			if !e.expireAt.IsZero() {
+				s.exp.schedule(k, e.expireAt)
+			}
+		}
+	}
+	return nil
+}
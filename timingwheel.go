@@ -0,0 +1,203 @@
+package kv
+
+import (
+	"sync"
+	"time"
+)
+
+// timingWheel is a hierarchical timing wheel (the same idea as the old Linux
+// kernel timers or Kafka's purgatory). Level 0 has one slot per tick, every
+// level above has slots that are wheelSize times wider. A key is put in the
+// lowest level that can hold its expiry, and whenever a level wraps around the
+// next slot of the level above is cascaded down. Adding a key is O(1) and so is
+// every tick, no matter how many keys are waiting.
+//
+// The wheel never removes anything. A key that gets deleted or overwritten
+// before it fires is simply reported anyway, and the store checks whether it
+// really expired before deleting it. That keeps the stores from having to
+// track where in the wheel each of their keys sits.
+type timingWheel struct {
+	mu      sync.Mutex
+	tick    time.Duration
+	start   time.Time
+	current uint64
+	levels  [wheelLevels][wheelSize][]wheelEntry
+
+	onExpire func(keys []string)
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits
+	wheelMask   = wheelSize - 1
+	wheelLevels = 6
+
+	// defaultExpiryTick is how often the stores look for expired keys. Gets
+	// never return an expired key regardless, this only bounds how long one
+	// keeps using memory.
+	defaultExpiryTick = 100 * time.Millisecond
+)
+
+type wheelEntry struct {
+	key    string
+	expire uint64
+}
+
+// newTimingWheel starts a wheel that calls onExpire (from its own goroutine)
+// with the keys that are due. Stop it with stop.
+func newTimingWheel(tick time.Duration, onExpire func(keys []string)) *timingWheel {
+	w := &timingWheel{
+		tick:     tick,
+		start:    time.Now(),
+		onExpire: onExpire,
+		done:     make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// add schedules key to be reported at expireAt (rounded up to the next tick).
+func (w *timingWheel) add(key string, expireAt time.Time) {
+	ticks := uint64(0)
+	if d := expireAt.Sub(w.start); d > 0 {
+		ticks = uint64((d + w.tick - 1) / w.tick)
+	}
+	w.mu.Lock()
+	// The slot for the current tick has already been handled.
+	if ticks <= w.current {
+		ticks = w.current + 1
+	}
+	w.place(wheelEntry{key: key, expire: ticks})
+	w.mu.Unlock()
+}
+
+// place puts an entry in the right slot. Must be called with the lock held.
+func (w *timingWheel) place(e wheelEntry) {
+	if e.expire < w.current {
+		e.expire = w.current
+	}
+	delta := e.expire - w.current
+	level := 0
+	for level < wheelLevels-1 && delta >= uint64(1)<<(wheelBits*(level+1)) {
+		level++
+	}
+	slot := (e.expire >> (wheelBits * level)) & wheelMask
+	w.levels[level][slot] = append(w.levels[level][slot], e)
+}
+
+// advance moves the wheel forward to tick and returns every key that is due.
+func (w *timingWheel) advance(tick uint64) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	expired := make([]string, 0)
+	for w.current < tick {
+		w.current++
+		// Cascade every level that just wrapped around, top down, so entries
+		// can fall all the way to level 0 in one go.
+		for level := wheelLevels - 1; level > 0; level-- {
+			if w.current&(uint64(1)<<(wheelBits*level)-1) != 0 {
+				continue
+			}
+			slot := (w.current >> (wheelBits * level)) & wheelMask
+			entries := w.levels[level][slot]
+			w.levels[level][slot] = nil
+			for _, e := range entries {
+				w.place(e)
+			}
+		}
+		slot := w.current & wheelMask
+		for _, e := range w.levels[0][slot] {
+			expired = append(expired, e.key)
+		}
+		w.levels[0][slot] = nil
+	}
+	return expired
+}
+
+func (w *timingWheel) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-ticker.C:
+			if expired := w.advance(uint64(now.Sub(w.start) / w.tick)); len(expired) > 0 {
+				w.onExpire(expired)
+			}
+		}
+	}
+}
+
+func (w *timingWheel) stop() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+// expirer is what the stores embed to get active expiry. The wheel (and its
+// goroutine) is only started the first time a key with a TTL shows up, so
+// stores that never use TTLs pay nothing for it.
+type expirer struct {
+	mu       sync.Mutex
+	wheel    *timingWheel
+	tick     time.Duration
+	onExpire func(keys []string)
+	// now is swappable so tests can move time forward.
+	now func() time.Time
+}
+
+func newExpirer(onExpire func(keys []string)) expirer {
+	return expirer{tick: defaultExpiryTick, onExpire: onExpire, now: time.Now}
+}
+
+func (e *expirer) schedule(key string, expireAt time.Time) {
+	e.mu.Lock()
+	if e.wheel == nil {
+		e.wheel = newTimingWheel(e.tick, e.onExpire)
+	}
+	wheel := e.wheel
+	e.mu.Unlock()
+	wheel.add(key, expireAt)
+}
+
+// expireAt turns a TTL into an expiry time, the zero time if ttl is not
+// positive.
+func (e *expirer) expireAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return e.now().Add(ttl)
+}
+
+// expired reports whether expireAt (the zero time meaning no expiry) is in the past.
+func (e *expirer) expired(expireAt time.Time) bool {
+	return !expireAt.IsZero() && !e.now().Before(expireAt)
+}
+
+// remaining turns an expiry time into what TTL returns.
+func (e *expirer) remaining(expireAt time.Time) time.Duration {
+	if expireAt.IsZero() {
+		return NoExpiry
+	}
+	if d := expireAt.Sub(e.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// stop must not be called with the store's lock held, the wheel might be
+// waiting for it to delete expired keys.
+func (e *expirer) stop() {
+	e.mu.Lock()
+	wheel := e.wheel
+	e.wheel = nil
+	e.mu.Unlock()
+	if wheel != nil {
+		wheel.stop()
+	}
+}
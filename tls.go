@@ -0,0 +1,185 @@
+package kv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions turn on HTTPS for a Server.
+type TLSOptions struct {
+	// CertFile and KeyFile are the PEM encoded certificate (chain) and key
+	// of the server.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of the CAs client certificates are
+	// verified against. Setting it turns on mutual TLS.
+	ClientCAFile string
+	// ClientAuth is how much to insist on a client certificate when
+	// ClientCAFile is set. Defaults to tls.RequireAndVerifyClientCert,
+	// tls.VerifyClientCertIfGiven lets clients without one in too.
+	ClientAuth tls.ClientAuthType
+	// Identities maps the subject of a client certificate to the name of an
+	// identity, see IdentityFromContext. A subject is looked up in full
+	// ("CN=alice,O=Acme") and then by its common name ("alice"). Leaving it
+	// empty makes the common name the identity, a certificate that is not
+	// in a non empty map has none.
+	Identities map[string]string
+	// ReloadInterval is how often, at most, the files are checked for
+	// changes. A change is picked up by the next handshake after that, so
+	// certificates can be rotated without a restart. Defaults to 10s.
+	ReloadInterval time.Duration
+}
+
+var errTLSOptions = errors.New("kv: TLS needs both a certificate and a key file")
+
+// tlsReloader hands out the tls.Config for every handshake, reloading the
+// files when they change. If the new files don't load (say the certificate
+// was replaced but not the key yet) it keeps using the old ones and tries
+// again next time.
+type tlsReloader struct {
+	opts TLSOptions
+
+	mu      sync.Mutex
+	config  *tls.Config
+	checked time.Time
+	modTime map[string]time.Time
+}
+
+func newTLSReloader(opts TLSOptions) (*tlsReloader, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errTLSOptions
+	}
+	if opts.ClientAuth == tls.NoClientCert && opts.ClientCAFile != "" {
+		opts.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if opts.ReloadInterval == 0 {
+		opts.ReloadInterval = 10 * time.Second
+	}
+	r := &tlsReloader{opts: opts}
+	modTime, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.opts.CertFile, r.opts.KeyFile}
+	if r.opts.ClientCAFile != "" {
+		files = append(files, r.opts.ClientCAFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) modTimes() (map[string]time.Time, error) {
+	modTime := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTime[file] = info.ModTime()
+	}
+	return modTime, nil
+}
+
+// load reads the files into a new config. Must be called with the lock held.
+func (r *tlsReloader) load(modTime map[string]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("kv: loading TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if r.opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.opts.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("kv: loading client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("kv: no certificates in %s", r.opts.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = r.opts.ClientAuth
+	}
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
+
+// current returns the config to use, reloading it first if the files
+// changed since the last check.
+func (r *tlsReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < r.opts.ReloadInterval {
+		return r.config
+	}
+	r.checked = time.Now()
+	modTime, err := r.modTimes()
+	if err != nil {
+		log.Printf("kv: checking TLS files, keeping the old ones: %v", err)
+		return r.config
+	}
+	for file, t := range modTime {
+		if !t.Equal(r.modTime[file]) {
+			if err := r.load(modTime); err != nil {
+				log.Printf("kv: reloading TLS files, keeping the old ones: %v", err)
+			} else {
+				log.Printf("kv: reloaded TLS files")
+			}
+			break
+		}
+	}
+	return r.config
+}
+
+// tlsConfig is what the http.Server gets. GetCertificate is only there for
+// the sake of http.Server.ServeTLS, which wants to see a certificate.
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+	}
+}
+
+// certIdentity is the identity of the verified client certificate of a
+// request, if there is one and it maps to one.
+func (o *TLSOptions) certIdentity(r *http.Request) (Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if len(o.Identities) == 0 {
+		if subject.CommonName == "" {
+			return Identity{}, false
+		}
+		return Identity{Name: subject.CommonName, Method: "tls"}, true
+	}
+	if name, ok := o.Identities[subject.String()]; ok {
+		return Identity{Name: name, Method: "tls"}, true
+	}
+	if name, ok := o.Identities[subject.CommonName]; ok && subject.CommonName != "" {
+		return Identity{Name: name, Method: "tls"}, true
+	}
+	return Identity{}, false
+}
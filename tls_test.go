@@ -0,0 +1,203 @@
+package kv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for subject, for a server if
+// server is set and for a client otherwise.
+func (ca *testCA) issue(t *testing.T, serial int64, subject pkix.Name, server bool) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	cert, key := ca.issue(t, 2, pkix.Name{CommonName: "server"}, true)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	writeFile(t, caFile, ca.pem)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewHTTPServerWithOptions(NewLRUCacheStore(10), l.Addr().String(), HTTPOptions{TLS: &TLSOptions{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		// Check the files on every handshake.
+		ReloadInterval: time.Nanosecond,
+	}})
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert, clientKey := ca.issue(t, 3, pkix.Name{CommonName: "alice"}, false)
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(certs []tls.Certificate) (*tls.ConnectionState, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/admin/keys")
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected 200, got %d", resp.StatusCode)
+		}
+		return resp.TLS, nil
+	}
+
+	state, err := get([]tls.Certificate{pair})
+	if err != nil {
+		t.Fatalf("Request with a client certificate failed: %v", err)
+	}
+	if serial := state.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("Expected the server certificate with serial 2, got %d", serial)
+	}
+	if _, err := get(nil); err == nil {
+		t.Errorf("Expected a request without a client certificate to be refused")
+	}
+
+	// Rotating the certificate does not need a restart.
+	cert, key = ca.issue(t, 4, pkix.Name{CommonName: "server"}, true)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	// Make sure the modification time changes even on a coarse clock.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	state, err = get([]tls.Certificate{pair})
+	if err != nil {
+		t.Fatalf("Request after the rotation failed: %v", err)
+	}
+	if serial := state.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Errorf("Expected the new certificate with serial 4, got %d", serial)
+	}
+
+	// A broken file keeps the old certificate in use.
+	writeFile(t, certFile, []byte("garbage"))
+	os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute))
+	if _, err := get([]tls.Certificate{pair}); err != nil {
+		t.Errorf("Expected the old certificate to keep working, got %v", err)
+	}
+}
+
+func TestTLSOptions_Identity(t *testing.T) {
+	ca := newTestCA(t)
+	identity := func(opts TLSOptions, subject pkix.Name) string {
+		certPEM, _ := ca.issue(t, 5, subject, false)
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}}
+		id, ok := opts.certIdentity(r)
+		if !ok {
+			return ""
+		}
+		return id.Name
+	}
+
+	alice := pkix.Name{CommonName: "alice", Organization: []string{"Acme"}}
+	if got := identity(TLSOptions{}, alice); got != "alice" {
+		t.Errorf("Expected the common name without a mapping, got %q", got)
+	}
+	mapped := TLSOptions{Identities: map[string]string{"CN=alice,O=Acme": "admin", "bob": "reader"}}
+	if got := identity(mapped, alice); got != "admin" {
+		t.Errorf("Expected the full subject to map to admin, got %q", got)
+	}
+	if got := identity(mapped, pkix.Name{CommonName: "bob", Organization: []string{"Other"}}); got != "reader" {
+		t.Errorf("Expected the common name to map to reader, got %q", got)
+	}
+	if got := identity(mapped, pkix.Name{CommonName: "mallory"}); got != "" {
+		t.Errorf("Expected an unmapped subject to have no identity, got %q", got)
+	}
+}
@@ -0,0 +1,259 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock replaces an expirer's clock so tests don't have to sleep.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func useFakeClock(e *expirer) *fakeClock {
+	c := &fakeClock{now: time.Now()}
+	e.now = func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.now
+	}
+	return c
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestTTL_LazyExpiry(t *testing.T) {
+	type ttlStore interface {
+		TTLStore
+		Close() error
+	}
+	stores := map[string]func() (ttlStore, *expirer){
+		"map": func() (ttlStore, *expirer) {
+			s := NewWriteOptimizedMapStore(1, true, 100)
+			return s, &s.exp
+		},
+		"lru": func() (ttlStore, *expirer) {
+			s := NewLRUCacheStore(100)
+			return s, &s.exp
+		},
+		"syncmap": func() (ttlStore, *expirer) {
+			s := NewShardedSyncMapStore()
+			return s, &s.exp
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store, exp := newStore()
+			defer store.Close()
+			clock := useFakeClock(exp)
+
+			store.PutWithTTL("short", "1", time.Second)
+			store.PutWithTTL("long", "2", time.Hour)
+			store.Put("forever", "3")
+
+			if ttl, err := store.TTL("short"); err != nil || ttl != time.Second {
+				t.Errorf("TTL(short) = %v, %v, want 1s", ttl, err)
+			}
+			if ttl, err := store.TTL("forever"); err != nil || ttl != NoExpiry {
+				t.Errorf("TTL(forever) = %v, %v, want NoExpiry", ttl, err)
+			}
+
+			// Update keeps the TTL, a plain Put clears it.
+			if err := store.Update("long", "20"); err != nil {
+				t.Fatalf("Update returned an error: %v", err)
+			}
+			if ttl, _ := store.TTL("long"); ttl != time.Hour {
+				t.Errorf("Expected Update to keep the TTL, got %v", ttl)
+			}
+
+			// Expire changes the TTL and nothing else.
+			if err := store.Expire("forever", time.Minute); err != nil {
+				t.Fatalf("Expire returned an error: %v", err)
+			}
+			if ttl, _ := store.TTL("forever"); ttl != time.Minute {
+				t.Errorf("Expected Expire to set the TTL, got %v", ttl)
+			}
+			if value, _ := store.Get("forever"); value != "3" {
+				t.Errorf("Expected Expire to keep the value, got %v", value)
+			}
+			if err := store.Expire("forever", 0); err != nil {
+				t.Fatalf("Expire returned an error: %v", err)
+			}
+			if ttl, _ := store.TTL("forever"); ttl != NoExpiry {
+				t.Errorf("Expected Expire with 0 to take the TTL away, got %v", ttl)
+			}
+			if err := store.Expire("missing", time.Minute); !isNotFound(err) {
+				t.Errorf("Expected Expire of a missing key to fail, got %v", err)
+			}
+
+			clock.advance(time.Second)
+			if _, err := store.Get("short"); err == nil {
+				t.Errorf("Expected short to have expired")
+			}
+			if _, err := store.TTL("short"); err == nil {
+				t.Errorf("Expected TTL of an expired key to fail")
+			}
+			if err := store.Update("short", "x"); err == nil {
+				t.Errorf("Expected Update of an expired key to fail")
+			}
+			if value, err := store.Get("long"); err != nil || value != "20" {
+				t.Errorf("Get(long) = %v, %v", value, err)
+			}
+
+			store.Put("long", "plain")
+			clock.advance(2 * time.Hour)
+			if value, err := store.Get("long"); err != nil || value != "plain" {
+				t.Errorf("Expected Put to clear the TTL, Get(long) = %v, %v", value, err)
+			}
+			if value, err := store.Get("forever"); err != nil || value != "3" {
+				t.Errorf("Get(forever) = %v, %v", value, err)
+			}
+		})
+	}
+}
+
+func TestTTL_ActiveExpiry(t *testing.T) {
+	s := NewLRUCacheStore(100)
+	defer s.Close()
+	s.exp.tick = time.Millisecond
+
+	s.PutWithTTL("a", "1", 5*time.Millisecond)
+	s.Put("b", "2")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.RLock()
+		n := len(s.items)
+		s.mu.RUnlock()
+		if n == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Expected the expired key to be removed without a Get")
+}
+
+func TestTTL_SurvivesWALAndSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+	s := NewWriteOptimizedMapStore(1, true, 100)
+	w, err := OpenWAL(path, WALOptions{Fsync: FsyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL returned an error: %v", err)
+	}
+	if err := s.AttachWAL(w); err != nil {
+		t.Fatalf("AttachWAL returned an error: %v", err)
+	}
+	s.PutWithTTL("a", "1", time.Hour)
+	s.PutWithTTL("b", "2", time.Hour)
+	s.Put("b", "plain")
+	s.Close()
+
+	s = NewWriteOptimizedMapStore(1, true, 100)
+	w, _ = OpenWAL(path, WALOptions{Fsync: FsyncNever})
+	if err := s.AttachWAL(w); err != nil {
+		t.Fatalf("AttachWAL returned an error: %v", err)
+	}
+	defer s.Close()
+	if ttl, err := s.TTL("a"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL(a) = %v, %v after replay", ttl, err)
+	}
+	if ttl, err := s.TTL("b"); err != nil || ttl != NoExpiry {
+		t.Errorf("TTL(b) = %v, %v after replay, want NoExpiry", ttl, err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot returned an error: %v", err)
+	}
+	dst := NewLRUCacheStore(100)
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore returned an error: %v", err)
+	}
+	if ttl, err := dst.TTL("a"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL(a) = %v, %v after restore", ttl, err)
+	}
+}
+
+func TestTimingWheel(t *testing.T) {
+	var fired []string
+	w := &timingWheel{tick: time.Millisecond, start: time.Now(), onExpire: func([]string) {}}
+
+	// Expiries spread over every level, plus one in the past.
+	expiries := map[string]uint64{"past": 0, "1": 1, "63": 63, "64": 64, "100": 100, "5000": 5000, "300000": 300000}
+	for key, ticks := range expiries {
+		w.add(key, w.start.Add(time.Duration(ticks)*w.tick))
+	}
+
+	for tick := uint64(1); tick <= 300000; tick++ {
+		for _, key := range w.advance(tick) {
+			fired = append(fired, key)
+			want := expiries[key]
+			if want == 0 {
+				want = 1
+			}
+			if tick != want {
+				t.Errorf("%s fired at tick %d, want %d", key, tick, want)
+			}
+		}
+	}
+	sort.Strings(fired)
+	if len(fired) != len(expiries) {
+		t.Errorf("Expected every key to fire once, got %v", fired)
+	}
+}
+
+func TestTTL_HTTP(t *testing.T) {
+	s := NewLRUCacheStore(100)
+	defer s.Close()
+	server := NewHTTPServer(s, "")
+
+	rec := httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(`{"key":"a","value":"1","ttl":60}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /set returned %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ttl?key=a", nil))
+	var resp Response
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /ttl returned %d, %v", rec.Code, err)
+	}
+	if ttl := resp.Value.(float64); ttl <= 59 || ttl > 60 {
+		t.Errorf("GET /ttl returned %v, want just under 60", ttl)
+	}
+
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(`{"key":"b","value":"1"}`)))
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ttl?key=b", nil))
+	if !strings.Contains(rec.Body.String(), `"value":-1`) {
+		t.Errorf("Expected a TTL of -1 for a key without one, got %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ttl?key=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /ttl of a missing key returned %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/set", strings.NewReader(`{"key":"c","value":"1","ttl":-1}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a negative ttl to be rejected, got %d", rec.Code)
+	}
+}
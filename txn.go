@@ -0,0 +1,343 @@
+package kv
+
+import (
+	"math"
+	"time"
+)
+
+// Transactions on WriteOptimizedMap use multi-version concurrency control,
+// on top of the per key versions the map already has. A transaction reads the
+// map as it was when it began (its read version) and buffers its own writes,
+// so it never holds the lock for more than a single read and writers are
+// never kept waiting on it. Commit takes the lock, checks that no key the
+// transaction wrote was written by someone else after it began (first
+// committer wins) and applies all the writes as one WAL record.
+//
+// That is snapshot isolation, not serializability. Two transactions that
+// each read what the other writes can both commit (write skew). Check makes a
+// read count as a write for conflict detection, which is what the HTTP
+// endpoint uses for its conditions.
+//
+// Old values are only kept around while there are transactions that may
+// still need them, see track. With no open transactions the map costs exactly
+// what it did before.
+
+// TxnStore is implemented by the stores that support transactions.
+type TxnStore interface {
+	Store
+	Begin() *Txn
+}
+
+type txnConflictError struct{}
+
+func (e *txnConflictError) Error() string {
+	return "transaction conflict"
+}
+
+// ErrTxnConflict is returned by Commit when another write got to one of the
+// transaction's keys first. The transaction can just be retried.
+var ErrTxnConflict = &txnConflictError{}
+
+type txnDoneError struct{}
+
+func (e *txnDoneError) Error() string {
+	return "transaction already committed or rolled back"
+}
+
+var ErrTxnDone = &txnDoneError{}
+
+// keyState is one version of a key in the history kept for transactions.
+// TTLs are not kept: a transaction sees a key that has since expired as it
+// was when the transaction began.
+type keyState struct {
+	version  uint64
+	modified time.Time
+	value    interface{}
+	deleted  bool
+}
+
+type txnWrite struct {
+	value   interface{}
+	deleted bool
+}
+
+// Txn is a transaction on a WriteOptimizedMap. It is not safe for concurrent
+// use. Every transaction has to end with Commit or Rollback, an open one
+// keeps the map from forgetting old versions.
+type Txn struct {
+	s           *WriteOptimizedMap
+	readVersion uint64
+	writes      map[string]txnWrite
+	// order is the order keys were first written in, so the log record (and
+	// the versions handed out) don't depend on map iteration.
+	order []string
+	// checked are the keys passed to Check, they conflict like writes.
+	checked map[string]struct{}
+	done    bool
+}
+
+// Begin starts a transaction that sees the map as it is right now.
+func (s *WriteOptimizedMap) Begin() *Txn {
+	s.m.Lock()
+	defer s.m.Unlock()
+	t := &Txn{
+		s:           s,
+		readVersion: s.version,
+		writes:      make(map[string]txnWrite),
+		checked:     make(map[string]struct{}),
+	}
+	s.txns[t] = struct{}{}
+	return t
+}
+
+// Get returns the transaction's own write of key if it has one and the value
+// key had when the transaction began otherwise.
+func (t *Txn) Get(key string) (interface{}, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if w, ok := t.writes[key]; ok {
+		if w.deleted {
+			return nil, newNotFoundError(key)
+		}
+		return w.value, nil
+	}
+	t.s.m.RLock()
+	v := t.s.readAt(key, t.readVersion)
+	t.s.m.RUnlock()
+	if v == nil {
+		return nil, newNotFoundError(key)
+	}
+	return v.Value, nil
+}
+
+// Check runs cond against the version of key the transaction sees, ignoring
+// its own writes, and makes the commit fail with ErrTxnConflict if key is
+// written by anyone else in the meantime. So a check that passes still holds
+// when the transaction commits.
+func (t *Txn) Check(key string, cond Precondition) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.s.m.RLock()
+	v := t.s.readAt(key, t.readVersion)
+	t.s.m.RUnlock()
+	if err := cond.check(v); err != nil {
+		return err
+	}
+	t.checked[key] = struct{}{}
+	return nil
+}
+
+// Put sets key when the transaction commits. Like Store.Put it clears any TTL
+// the key had.
+func (t *Txn) Put(key string, value interface{}) error {
+	return t.write(key, txnWrite{value: value})
+}
+
+// Delete deletes key when the transaction commits.
+func (t *Txn) Delete(key string) error {
+	return t.write(key, txnWrite{deleted: true})
+}
+
+func (t *Txn) write(key string, w txnWrite) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if _, ok := t.writes[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.writes[key] = w
+	return nil
+}
+
+// Commit applies the transaction's writes all at once, or none of them if it
+// returns an error. The transaction is over either way.
+func (t *Txn) Commit() error {
+	s := t.s
+	s.m.Lock()
+	defer s.m.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	defer s.endTxn(t)
+
+	for _, key := range t.order {
+		if s.lastWrite(key) > t.readVersion {
+			return ErrTxnConflict
+		}
+	}
+	for key := range t.checked {
+		if s.lastWrite(key) > t.readVersion {
+			return ErrTxnConflict
+		}
+	}
+
+	rec := s.newRecord(walOpCommit)
+	puts := make(map[string]interface{})
+	for _, key := range t.order {
+		w := t.writes[key]
+		if !w.deleted {
+			rec.Pairs = append(rec.Pairs, Pair{key, w.value})
+			puts[key] = w.value
+		} else if _, exists := s.db[key]; exists {
+			rec.Deletes = append(rec.Deletes, key)
+		}
+	}
+	if len(rec.Pairs) == 0 && len(rec.Deletes) == 0 {
+		return nil
+	}
+	if !s.txnFits(puts, rec.Deletes) {
+		s.purgeExpired()
+		if !s.txnFits(puts, rec.Deletes) {
+			return ErrKVFull
+		}
+	}
+	if err := s.logRecord(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
+	return nil
+}
+
+// Rollback drops the transaction's writes. Rolling back a transaction that
+// is already over does nothing, so it is fine to defer it.
+func (t *Txn) Rollback() error {
+	s := t.s
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !t.done {
+		s.endTxn(t)
+	}
+	return nil
+}
+
+// historyWrite is a change of key to version, once the oldest open
+// transaction began after it the states of key before it are of no use.
+type historyWrite struct {
+	version uint64
+	key     string
+}
+
+// endTxn forgets t and every old version no open transaction can see anymore.
+// Only the keys written since the oldest open transaction began are looked
+// at, not the whole history. Must be called with the lock held.
+func (s *WriteOptimizedMap) endTxn(t *Txn) {
+	t.done = true
+	delete(s.txns, t)
+	if len(s.txns) == 0 {
+		s.history = make(map[string][]keyState)
+		s.written = nil
+		return
+	}
+	oldest := uint64(math.MaxUint64)
+	for open := range s.txns {
+		oldest = min(oldest, open.readVersion)
+	}
+	// Versions go up, except for the older ones a BatchUpdate rollback puts
+	// back. Those just get pruned a little later, with the writes before them.
+	for len(s.written) > 0 && s.written[0].version <= oldest {
+		s.prune(s.written[0].key, oldest)
+		s.written = s.written[1:]
+	}
+}
+
+// prune drops the states of key before the one the oldest open transaction
+// sees, and the whole history of key if that is the current state. Must be
+// called with the lock held.
+func (s *WriteOptimizedMap) prune(key string, oldest uint64) {
+	states, ok := s.history[key]
+	if !ok {
+		return
+	}
+	i := len(states) - 1
+	for i > 0 && states[i].version > oldest {
+		i--
+	}
+	if i == len(states)-1 {
+		// Every open transaction sees the current state.
+		delete(s.history, key)
+	} else if i > 0 {
+		s.history[key] = states[i:]
+	}
+}
+
+// track records that key is about to change to next, if there are open
+// transactions that may still need its old value. The first time a key
+// changes the state it had before goes in too, so the history of a key always
+// goes back to before the oldest open transaction began. Must be called with
+// the lock held, before db is changed.
+func (s *WriteOptimizedMap) track(key string, next keyState) {
+	if len(s.txns) == 0 {
+		return
+	}
+	states, ok := s.history[key]
+	if !ok {
+		prev := keyState{deleted: true}
+		if value, exists := s.db[key]; exists {
+			kv := s.versions[key]
+			prev = keyState{version: kv.version, modified: kv.modified, value: value}
+		}
+		states = []keyState{prev}
+	}
+	s.history[key] = append(states, next)
+	s.written = append(s.written, historyWrite{version: next.version, key: key})
+}
+
+// readAt returns the versioned value key had at version, nil if it did not
+// exist. Must be called with at least the read lock held.
+func (s *WriteOptimizedMap) readAt(key string, version uint64) *Versioned {
+	states, ok := s.history[key]
+	if !ok {
+		// Nothing changed key since the oldest open transaction began.
+		return s.current(key)
+	}
+	// Searched newest first rather than by version because a BatchUpdate
+	// rollback puts back an older version on top.
+	for i := len(states) - 1; i >= 0; i-- {
+		state := states[i]
+		if state.version > version {
+			continue
+		}
+		if i == len(states)-1 {
+			// Still the current state, which may have expired since.
+			return s.current(key)
+		}
+		if state.deleted {
+			return nil
+		}
+		return &Versioned{Value: state.value, Version: state.version, Modified: state.modified}
+	}
+	return nil
+}
+
+// lastWrite returns the version of the last write to key, deletes included.
+// Must be called with at least the read lock held.
+func (s *WriteOptimizedMap) lastWrite(key string) uint64 {
+	if states, ok := s.history[key]; ok {
+		return states[len(states)-1].version
+	}
+	return s.versions[key].version
+}
+
+// txnFits is fits, and the key limit, for a commit. Must be called with the
+// lock held.
+func (s *WriteOptimizedMap) txnFits(puts map[string]interface{}, deletes []string) bool {
+	if s.weighted() {
+		used := s.used
+		for key, value := range puts {
+			used += s.sizer(key, value) - s.costs[key]
+		}
+		for _, key := range deletes {
+			used -= s.costs[key]
+		}
+		return used <= s.maxBytes
+	}
+	n := len(s.db) - len(deletes)
+	for key := range puts {
+		if _, exists := s.db[key]; !exists {
+			n++
+		}
+	}
+	return n <= s.size
+}
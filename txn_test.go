@@ -0,0 +1,311 @@
+package kv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTxn_ReadsASnapshot(t *testing.T) {
+	s := NewWriteOptimizedMapStore(1, true, 100)
+	s.Put("a", "1")
+	s.Put("b", "1")
+
+	txn := s.Begin()
+	defer txn.Rollback()
+
+	// None of these are visible to txn.
+	s.Put("a", "2")
+	s.Put("a", "3")
+	s.Delete("b")
+	s.Put("c", "1")
+
+	if value, err := txn.Get("a"); err != nil || value != "1" {
+		t.Errorf("txn.Get(a) = %v, %v, want 1", value, err)
+	}
+	if value, err := txn.Get("b"); err != nil || value != "1" {
+		t.Errorf("txn.Get(b) = %v, %v, want 1", value, err)
+	}
+	if _, err := txn.Get("c"); err == nil {
+		t.Errorf("Expected c, created after the transaction began, not to be visible")
+	}
+
+	// A transaction that begins now sees the new values.
+	later := s.Begin()
+	if value, _ := later.Get("a"); value != "3" {
+		t.Errorf("Expected a later transaction to see a = 3, got %v", value)
+	}
+	if _, err := later.Get("b"); err == nil {
+		t.Errorf("Expected a later transaction not to see b")
+	}
+	later.Rollback()
+
+	txn.Rollback()
+	if len(s.history) != 0 {
+		t.Errorf("Expected the history to be dropped with no open transactions, %d keys left", len(s.history))
+	}
+}
+
+func TestTxn_HistoryIsPrunedWhileTransactionsStayOpen(t *testing.T) {
+	s := NewWriteOptimizedMapStore(1, true, 100)
+	s.Put("a", "1")
+	s.Put("b", "1")
+
+	first := s.Begin()
+	s.Put("a", "2")
+	s.Put("a", "3")
+	second := s.Begin()
+	defer second.Rollback()
+	s.Put("b", "2")
+
+	// Nothing open is older than second now: a is back to current, b only
+	// keeps the state second sees.
+	first.Rollback()
+	if _, ok := s.history["a"]; ok {
+		t.Errorf("Expected the history of a to be dropped, got %v", s.history["a"])
+	}
+	if states := s.history["b"]; len(states) != 2 {
+		t.Errorf("Expected b to keep the state second sees and the current one, got %v", states)
+	}
+	if len(s.written) != 1 || s.written[0].key != "b" {
+		t.Errorf("Expected only the write of b second can't see to be left to prune, got %v", s.written)
+	}
+	if value, _ := second.Get("a"); value != "3" {
+		t.Errorf("second.Get(a) = %v, want 3", value)
+	}
+	if value, _ := second.Get("b"); value != "1" {
+		t.Errorf("second.Get(b) = %v, want 1", value)
+	}
+}
+
+func TestTxn_Commit(t *testing.T) {
+	s := NewWriteOptimizedMapStore(1, true, 100)
+	s.Put("a", "1")
+	s.Put("b", "1")
+
+	txn := s.Begin()
+	txn.Put("a", "2")
+	txn.Delete("b")
+	txn.Put("c", "3")
+	if value, _ := txn.Get("a"); value != "2" {
+		t.Errorf("Expected the transaction to see its own write, got %v", value)
+	}
+	if _, err := txn.Get("b"); err == nil {
+		t.Errorf("Expected the transaction to see its own delete")
+	}
+	if value, _ := s.Get("a"); value != "1" {
+		t.Errorf("Expected writes to be invisible before commit, got %v", value)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit returned an error: %v", err)
+	}
+	if value, _ := s.Get("a"); value != "2" {
+		t.Errorf("Expected a = 2, got %v", value)
+	}
+	if _, err := s.Get("b"); err == nil {
+		t.Errorf("Expected b to be deleted")
+	}
+	if value, _ := s.Get("c"); value != "3" {
+		t.Errorf("Expected c = 3, got %v", value)
+	}
+	if err := txn.Put("d", "4"); err != ErrTxnDone {
+		t.Errorf("Expected ErrTxnDone using a committed transaction, got %v", err)
+	}
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Errorf("Expected ErrTxnDone committing twice, got %v", err)
+	}
+
+	rolledBack := s.Begin()
+	rolledBack.Put("a", "5")
+	rolledBack.Rollback()
+	if value, _ := s.Get("a"); value != "2" {
+		t.Errorf("Expected a rolled back write to be dropped, got %v", value)
+	}
+
+	full := NewWriteOptimizedMapStore(1, true, 2)
+	full.Put("a", "1")
+	txn = full.Begin()
+	txn.Put("b", "2")
+	txn.Put("c", "3")
+	if err := txn.Commit(); err != ErrKVFull {
+		t.Errorf("Expected ErrKVFull, got %v", err)
+	}
+	if _, err := full.Get("b"); err == nil {
+		t.Errorf("Expected a refused commit to write nothing")
+	}
+}
+
+func TestTxn_Conflicts(t *testing.T) {
+	s := NewWriteOptimizedMapStore(1, true, 100)
+	s.Put("a", "1")
+
+	first, second := s.Begin(), s.Begin()
+	first.Put("a", "first")
+	second.Put("a", "second")
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Commit returned an error: %v", err)
+	}
+	if err := second.Commit(); err != ErrTxnConflict {
+		t.Errorf("Expected ErrTxnConflict, got %v", err)
+	}
+
+	// Writes outside of transactions conflict too, deletes included.
+	txn := s.Begin()
+	txn.Put("a", "txn")
+	s.Delete("a")
+	if err := txn.Commit(); err != ErrTxnConflict {
+		t.Errorf("Expected ErrTxnConflict after a delete, got %v", err)
+	}
+
+	// Transactions writing different keys don't conflict.
+	first, second = s.Begin(), s.Begin()
+	first.Put("x", 1)
+	second.Put("y", 2)
+	if err := first.Commit(); err != nil {
+		t.Errorf("Commit returned an error: %v", err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Errorf("Commit returned an error: %v", err)
+	}
+
+	// Unless one of them checked the key the other wrote.
+	first, second = s.Begin(), s.Begin()
+	if err := first.Check("x", IfExists); err != nil {
+		t.Fatalf("Check returned an error: %v", err)
+	}
+	first.Put("z", 1)
+	second.Delete("x")
+	second.Commit()
+	if err := first.Commit(); err != ErrTxnConflict {
+		t.Errorf("Expected ErrTxnConflict on a checked key, got %v", err)
+	}
+	txn = s.Begin()
+	defer txn.Rollback()
+	if err := txn.Check("x", IfExists); err != ErrPreconditionFailed {
+		t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+	}
+}
+
+// TestTxn_Counter increments a counter from many goroutines, retrying on
+// conflicts. Any lost update shows up in the final count.
+func TestTxn_Counter(t *testing.T) {
+	s := NewWriteOptimizedMapStore(1, true, 100)
+	s.Put("counter", 0)
+
+	const goroutines, increments = 8, 50
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					txn := s.Begin()
+					value, _ := txn.Get("counter")
+					txn.Put("counter", value.(int)+1)
+					if txn.Commit() == nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := s.Get("counter"); value != goroutines*increments {
+		t.Errorf("Expected counter to be %d, got %v", goroutines*increments, value)
+	}
+	if len(s.history) != 0 || len(s.txns) != 0 {
+		t.Errorf("Expected no history and no open transactions, got %d and %d", len(s.history), len(s.txns))
+	}
+}
+
+func TestTxn_SurvivesWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+	open := func() *WriteOptimizedMap {
+		s := NewWriteOptimizedMapStore(1, true, 100)
+		w, err := OpenWAL(path, WALOptions{Fsync: FsyncNever})
+		if err != nil {
+			t.Fatalf("OpenWAL returned an error: %v", err)
+		}
+		if err := s.AttachWAL(w); err != nil {
+			t.Fatalf("AttachWAL returned an error: %v", err)
+		}
+		return s
+	}
+
+	s := open()
+	s.Put("a", "1")
+	txn := s.Begin()
+	txn.Put("a", "2")
+	txn.Put("b", "2")
+	txn.Delete("a")
+	txn.Put("c", "3")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit returned an error: %v", err)
+	}
+	want, _ := s.GetVersioned("c")
+	s.Close()
+
+	s = open()
+	defer s.Close()
+	if _, err := s.Get("a"); err == nil {
+		t.Errorf("Expected a to stay deleted after replay")
+	}
+	if value, _ := s.Get("b"); value != "2" {
+		t.Errorf("Expected b = 2 after replay, got %v", value)
+	}
+	if got, _ := s.GetVersioned("c"); got.Version != want.Version {
+		t.Errorf("Expected c to keep version %d, got %d", want.Version, got.Version)
+	}
+}
+
+func TestTxn_HTTP(t *testing.T) {
+	store := NewWriteOptimizedMapStore(1, true, 100)
+	server := NewHTTPServer(store, "")
+	do := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/txn", strings.NewReader(body)))
+		return rec
+	}
+	store.Put("a", 1)
+	version, _ := store.GetVersioned("a")
+
+	rec := do(`{"conditions":[{"key":"a","value":1},{"key":"b","exists":false}],
+		"operations":[{"op":"put","key":"b","value":"x"},{"op":"get","key":"a"},{"op":"get","key":"b"},{"op":"get","key":"c"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	want := `[{"key":"a","value":1,"found":true},{"key":"b","value":"x","found":true},{"key":"c","value":null,"found":false}]`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	cases := []struct {
+		body string
+		want int
+	}{
+		{`{"conditions":[{"key":"b","exists":false}],"operations":[{"op":"delete","key":"a"}]}`, http.StatusPreconditionFailed},
+		{`{"conditions":[{"key":"a","version":` + strings.Trim(version.ETag(), `"`) + `}],"operations":[{"op":"delete","key":"a"}]}`, http.StatusOK},
+		{`{"conditions":[{"key":"a","exists":true}]}`, http.StatusPreconditionFailed},
+		{`{"operations":[{"op":"increment","key":"a"}]}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if rec := do(c.body); rec.Code != c.want {
+			t.Errorf("POST /txn %s returned %d, want %d", c.body, rec.Code, c.want)
+		}
+	}
+	if _, err := store.Get("a"); err == nil {
+		t.Errorf("Expected a to be deleted")
+	}
+
+	server = NewHTTPServer(NewLRUCacheStore(10), "")
+	if rec := do(`{}`); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 from a store without transactions, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package kv
+
+import (
+	"strconv"
+	"time"
+)
+
+// Versioned is a value along with its version and when it was last written.
+// Versions come from one counter per store, so every write gets a version
+// that was never used before, even if a key is deleted and created again.
+// That is what makes them safe to use as ETags.
+type Versioned struct {
+	Value    interface{} `json:"value"`
+	Version  uint64      `json:"version"`
+	Modified time.Time   `json:"modified"`
+}
+
+// ETag formats the version as a strong HTTP entity tag.
+func (v Versioned) ETag() string {
+	return `"` + strconv.FormatUint(v.Version, 10) + `"`
+}
+
+// Precondition is checked against the current version of a key (nil if it
+// does not exist) while the store holds the key locked, so nothing can change
+// it between the check and the write. It returns ErrPreconditionFailed (or any
+// other error) to stop the write.
+type Precondition func(current *Versioned) error
+
+// VersionedStore is implemented by the stores that keep a version per key,
+// for optimistic concurrency: read a version, then write only if it is still
+// the current one.
+type VersionedStore interface {
+	Store
+	GetVersioned(key string) (Versioned, error)
+	// PutIf stores value if cond passes and returns the new version.
+	PutIf(key string, value interface{}, cond Precondition) (Versioned, error)
+	// PutIfWithTTL is PutIf, except that the key expires after ttl (never if
+	// ttl is 0), set in the same step as the value.
+	PutIfWithTTL(key string, value interface{}, ttl time.Duration, cond Precondition) (Versioned, error)
+	// UpdateIf is PutIf for keys that have to exist already, like Update. It
+	// keeps the key's TTL.
+	UpdateIf(key string, value interface{}, cond Precondition) (Versioned, error)
+	// DeleteIf deletes key if cond passes.
+	DeleteIf(key string, cond Precondition) error
+}
+
+type preconditionFailedError struct{}
+
+func (e *preconditionFailedError) Error() string {
+	return "precondition failed"
+}
+
+var ErrPreconditionFailed = &preconditionFailedError{}
+
+// IfMatch passes if the key exists and has one of the given versions.
+func IfMatch(versions ...uint64) Precondition {
+	return func(current *Versioned) error {
+		if current != nil {
+			for _, v := range versions {
+				if current.Version == v {
+					return nil
+				}
+			}
+		}
+		return ErrPreconditionFailed
+	}
+}
+
+// IfNoneMatch passes if the key does not exist or has none of the versions.
+func IfNoneMatch(versions ...uint64) Precondition {
+	return func(current *Versioned) error {
+		if current != nil {
+			for _, v := range versions {
+				if current.Version == v {
+					return ErrPreconditionFailed
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// IfExists is If-Match: * in HTTP.
+func IfExists(current *Versioned) error {
+	if current == nil {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// IfNotExists is If-None-Match: * in HTTP.
+func IfNotExists(current *Versioned) error {
+	if current != nil {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// check runs cond, which may be nil.
+func (cond Precondition) check(current *Versioned) error {
+	if cond == nil {
+		return nil
+	}
+	return cond(current)
+}
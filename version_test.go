@@ -0,0 +1,200 @@
+package kv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var versionedStores = map[string]func() VersionedStore{
+	"map":     func() VersionedStore { return NewWriteOptimizedMapStore(1, true, 1000) },
+	"lru":     func() VersionedStore { return NewLRUCacheStore(1000) },
+	"syncmap": func() VersionedStore { return NewShardedSyncMapStore() },
+}
+
+func TestVersioned_VersionsGoUp(t *testing.T) {
+	for name, newStore := range versionedStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore()
+			s.Put("a", "1")
+			v1, err := s.GetVersioned("a")
+			if err != nil || v1.Value != "1" || v1.Version == 0 || v1.Modified.IsZero() {
+				t.Fatalf("GetVersioned(a) = %+v, %v", v1, err)
+			}
+
+			s.Update("a", "2")
+			v2, _ := s.GetVersioned("a")
+			if v2.Version <= v1.Version {
+				t.Errorf("Expected Update to raise the version, %d then %d", v1.Version, v2.Version)
+			}
+
+			// A key that is deleted and created again must not get its old
+			// version back, or a stale ETag would match.
+			s.Delete("a")
+			s.Put("a", "1")
+			v3, _ := s.GetVersioned("a")
+			if v3.Version <= v2.Version {
+				t.Errorf("Expected a recreated key to get a new version, %d then %d", v2.Version, v3.Version)
+			}
+		})
+	}
+}
+
+func TestVersioned_Preconditions(t *testing.T) {
+	for name, newStore := range versionedStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore()
+
+			v, err := s.PutIf("a", "1", IfNotExists)
+			if err != nil {
+				t.Fatalf("PutIf returned an error: %v", err)
+			}
+			if _, err := s.PutIf("a", "2", IfNotExists); err != ErrPreconditionFailed {
+				t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+			}
+
+			if _, err := s.UpdateIf("a", "2", IfMatch(v.Version+100)); err != ErrPreconditionFailed {
+				t.Errorf("Expected ErrPreconditionFailed for a stale version, got %v", err)
+			}
+			v2, err := s.UpdateIf("a", "2", IfMatch(v.Version))
+			if err != nil {
+				t.Fatalf("UpdateIf returned an error: %v", err)
+			}
+			if _, err := s.UpdateIf("missing", "2", nil); err == nil {
+				t.Errorf("Expected UpdateIf of a missing key to fail")
+			}
+
+			if err := s.DeleteIf("a", IfMatch(v.Version)); err != ErrPreconditionFailed {
+				t.Errorf("Expected ErrPreconditionFailed deleting with an old version, got %v", err)
+			}
+			if err := s.DeleteIf("a", IfNoneMatch(v.Version)); err != nil {
+				t.Errorf("DeleteIf returned an error: %v", err)
+			}
+			if _, err := s.Get("a"); err == nil {
+				t.Errorf("Expected a to be deleted")
+			}
+			if _, err := s.PutIf("a", "3", IfMatch(v2.Version)); err != ErrPreconditionFailed {
+				t.Errorf("Expected IfMatch on a deleted key to fail, got %v", err)
+			}
+
+			// The TTL goes in with the value or not at all.
+			ttls := s.(TTLStore)
+			if _, err := s.PutIfWithTTL("t", "1", time.Minute, IfNotExists); err != nil {
+				t.Fatalf("PutIfWithTTL returned an error: %v", err)
+			}
+			if ttl, _ := ttls.TTL("t"); ttl <= 0 || ttl > time.Minute {
+				t.Errorf("Expected t to expire within a minute, got %v", ttl)
+			}
+			if _, err := s.PutIfWithTTL("t", "2", time.Hour, IfNotExists); err != ErrPreconditionFailed {
+				t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+			}
+			if ttl, _ := ttls.TTL("t"); ttl > time.Minute {
+				t.Errorf("Expected a failed PutIfWithTTL to leave the TTL alone, got %v", ttl)
+			}
+			if _, err := s.PutIfWithTTL("t", "3", 0, IfExists); err != nil {
+				t.Fatalf("PutIfWithTTL returned an error: %v", err)
+			}
+			if ttl, _ := ttls.TTL("t"); ttl != NoExpiry {
+				t.Errorf("Expected no TTL after a PutIfWithTTL without one, got %v", ttl)
+			}
+		})
+	}
+}
+
+func TestVersioned_SurvivesWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+	open := func() *WriteOptimizedMap {
+		s := NewWriteOptimizedMapStore(1, true, 100)
+		w, err := OpenWAL(path, WALOptions{Fsync: FsyncNever})
+		if err != nil {
+			t.Fatalf("OpenWAL returned an error: %v", err)
+		}
+		if err := s.AttachWAL(w); err != nil {
+			t.Fatalf("AttachWAL returned an error: %v", err)
+		}
+		return s
+	}
+
+	s := open()
+	s.Put("a", "1")
+	s.Put("b", "1")
+	s.BatchUpdate(context.Background(), []Pair{{"a", "2"}, {"b", "2"}})
+	s.Update("a", "3")
+	want := map[string]Versioned{}
+	for _, k := range []string{"a", "b"} {
+		want[k], _ = s.GetVersioned(k)
+	}
+	s.Close()
+
+	s = open()
+	defer s.Close()
+	for k, w := range want {
+		got, _ := s.GetVersioned(k)
+		if got.Version != w.Version || !got.Modified.Equal(w.Modified) {
+			t.Errorf("%s has version %d (%v) after replay, want %d (%v)", k, got.Version, got.Modified, w.Version, w.Modified)
+		}
+	}
+	s.Put("c", "1")
+	if c, _ := s.GetVersioned("c"); c.Version <= want["a"].Version {
+		t.Errorf("Expected new versions to continue after the replayed ones, got %d", c.Version)
+	}
+}
+
+func TestVersioned_HTTP(t *testing.T) {
+	server := NewHTTPServer(NewWriteOptimizedMapStore(1, true, 100), "")
+	do := func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		server.mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/set", `{"key":"a","value":"1"}`, "If-None-Match", "*")
+	if rec.Code != http.StatusCreated || rec.Header().Get("ETag") == "" {
+		t.Fatalf("POST /set returned %d with ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	etag := rec.Header().Get("ETag")
+	if rec := do(http.MethodPost, "/set", `{"key":"a","value":"1"}`, "If-None-Match", "*"); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 creating a key that exists, got %d", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/get?key=a", "")
+	if rec.Header().Get("ETag") != etag || rec.Header().Get("Last-Modified") == "" {
+		t.Errorf("GET /get returned ETag %q and Last-Modified %q, want ETag %q", rec.Header().Get("ETag"), rec.Header().Get("Last-Modified"), etag)
+	}
+	if rec := do(http.MethodGet, "/get?key=a", "", "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d", rec.Code)
+	}
+
+	if rec := do(http.MethodPatch, "/update", `{"key":"a","value":"2"}`, "If-Match", `"12345"`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 updating with a stale ETag, got %d", rec.Code)
+	}
+	rec = do(http.MethodPatch, "/update", `{"key":"a","value":"2"}`, "If-Match", `W/"0", `+etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("PATCH /update returned %d with ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	if rec := do(http.MethodDelete, "/delete?key=a", "", "If-Match", etag); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 deleting with a stale ETag, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/delete?key=a", "", "If-Match", "*"); rec.Code != http.StatusOK {
+		t.Errorf("DELETE /delete returned %d", rec.Code)
+	}
+	// A ttl goes with the precondition, in the same write.
+	if rec := do(http.MethodPost, "/set", `{"key":"t","value":"1","ttl":60}`, "If-None-Match", "*"); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /set with a ttl and If-None-Match returned %d", rec.Code)
+	}
+	if ttl, err := server.db.(TTLStore).TTL("t"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL(t) = %v, %v, want about a minute", ttl, err)
+	}
+	if rec := do(http.MethodPost, "/set", `{"key":"t","value":"2","ttl":60}`, "If-None-Match", "*"); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 creating a key that exists with a ttl, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,304 @@
+package kv
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy controls when the write-ahead log forces its writes to disk.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways fsyncs after every record. This is the slowest option but it
+	// is the only one where an acknowledged write survives a power loss.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval fsyncs in the background every WALOptions.FsyncInterval.
+	// A crash of the machine can lose up to one interval worth of writes.
+	FsyncInterval
+	// FsyncNever leaves flushing to the OS. Writes still survive the process
+	// dying (they are in the page cache), just not the machine dying.
+	FsyncNever
+)
+
+const defaultFsyncInterval = 100 * time.Millisecond
+
+// WALOptions configures a write-ahead log.
+type WALOptions struct {
+	Fsync FsyncPolicy
+	// FsyncInterval is only used with FsyncInterval. Defaults to 100ms.
+	FsyncInterval time.Duration
+}
+
+type walOp uint8
+
+const (
+	walOpPut walOp = iota + 1
+	walOpUpdate
+	walOpDelete
+	// A batch is a single record so that replaying a log never applies half of it.
+	walOpBatchUpdate
+	// A restore replaces the whole contents of the store with the pairs in the record.
+	walOpRestore
+	// A commit is a transaction: Pairs are put (like walOpPut) and then
+	// Deletes are deleted.
+	walOpCommit
+)
+
+type walRecord struct {
+	Op    walOp  `json:"op"`
+	Pairs []Pair `json:"pairs"`
+	// Expires holds the expiry (unix nanoseconds) of the keys of a put or a
+	// restore that have a TTL.
+	Expires map[string]int64 `json:"expires,omitempty"`
+	// Version is the version given to the first pair, the others get the
+	// ones after it. Time (unix nanoseconds) is when the record was written.
+	// Both are logged so a replay gives every key the version and modified
+	// time it had before, old logs without them just get new ones.
+	Version uint64 `json:"version,omitempty"`
+	Time    int64  `json:"time,omitempty"`
+	// Deletes are the keys a commit deletes.
+	Deletes []string `json:"deletes,omitempty"`
+}
+
+var errWALClosed = errors.New("kv: write-ahead log is closed")
+
+// walFile is what the log needs of its file. It is an *os.File, except in
+// tests that need the disk to fail.
+type walFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Name() string
+}
+
+// WAL is an append-only log of mutations. Values are stored as JSON, the same
+// way they come in over HTTP, which means numbers come back as float64 after a
+// replay.
+type WAL struct {
+	mu     sync.Mutex
+	f      walFile
+	opts   WALOptions
+	dirty  bool
+	closed bool
+	// broken is set when a failed append couldn't be cut off the log again.
+	// Anything appended after it would be lost behind the torn record, so
+	// every append fails from then on.
+	broken error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenWAL opens (or creates) the log at path. Call Replay before appending to
+// it, so that a torn record from a previous crash gets cut off first.
+func OpenWAL(path string, opts WALOptions) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Fsync == FsyncInterval && opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = defaultFsyncInterval
+	}
+	w := &WAL{f: f, opts: opts, done: make(chan struct{})}
+	if opts.Fsync == FsyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// Replay calls fn for every record in the log, oldest first. If the log ends
+// with a torn or corrupt record (we crashed halfway through writing it) the
+// log is truncated right before it. Those writes were never acknowledged.
+// A bad record with good ones after it is not a crash though, the disk lost
+// acknowledged writes, and cutting it off would throw away the good ones as
+// well. Replay returns an error instead and leaves the log alone.
+func (w *WAL) Replay(fn func(walRecord) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := &countingReader{r: w.f}
+	var good int64
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			follows, ferr := w.recordFollows(good)
+			if ferr != nil {
+				return ferr
+			}
+			if follows {
+				return fmt.Errorf("kv: write-ahead log %s has a bad record at offset %d with valid ones after it: %w", w.f.Name(), good, errCorruptRecord)
+			}
+			log.Printf("wal: discarding torn record at offset %d: %v", good, err)
+			if err := w.f.Truncate(good); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		good = r.n
+	}
+	_, err := w.f.Seek(good, io.SeekStart)
+	return err
+}
+
+// recordFollows reports whether a valid record starts anywhere in the log
+// after the bad one at offset. The length of a bad record can't be trusted,
+// so it tries every byte.
+func (w *WAL) recordFollows(offset int64) (bool, error) {
+	if _, err := w.f.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	rest, err := io.ReadAll(w.f)
+	if err != nil {
+		return false, err
+	}
+	for i := 1; i+recordHeaderSize < len(rest); i++ {
+		size := int(binary.LittleEndian.Uint32(rest[i : i+4]))
+		payload := rest[i+recordHeaderSize:]
+		// Every record is a JSON object, which rules out most offsets
+		// before the checksum has to.
+		if size == 0 || size > len(payload) || payload[0] != '{' {
+			continue
+		}
+		if crc32.Checksum(payload[:size], crcTable) == binary.LittleEndian.Uint32(rest[i+4:i+8]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Append writes a record to the log and, depending on the fsync policy, waits
+// for it to hit the disk.
+func (w *WAL) Append(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errWALClosed
+	}
+	if w.broken != nil {
+		return w.broken
+	}
+	offset, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	err = writeRecord(w.f, payload)
+	if err == nil && w.opts.Fsync == FsyncAlways {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		// Whatever made it to the file goes again. A torn record would make
+		// the ones after it unreplayable, and a whole one that failed to
+		// sync is a write the caller was told failed.
+		w.undo(offset)
+		return err
+	}
+	if w.opts.Fsync != FsyncAlways {
+		w.dirty = true
+	}
+	return nil
+}
+
+// undo cuts the log back to offset after a failed append. Must be called
+// with the lock held.
+func (w *WAL) undo(offset int64) {
+	err := w.f.Truncate(offset)
+	if err == nil {
+		_, err = w.f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("wal: cutting off a failed append: %v", err)
+		w.broken = fmt.Errorf("kv: write-ahead log %s is broken, a failed append could not be cut off: %w", w.f.Name(), err)
+	}
+}
+
+// Sync forces everything appended so far to disk.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *WAL) syncLocked() error {
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+func (w *WAL) syncLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.opts.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Printf("wal: background fsync failed: %v", err)
+			}
+		}
+	}
+}
+
+// Close syncs and closes the log.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	err := w.syncLocked()
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	w.wg.Wait()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
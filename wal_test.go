@@ -0,0 +1,229 @@
+package kv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestWAL(t *testing.T, path string) *WAL {
+	t.Helper()
+	w, err := OpenWAL(path, WALOptions{Fsync: FsyncNever})
+	if err != nil {
+		t.Fatalf("OpenWAL returned an error: %v", err)
+	}
+	return w
+}
+
+func TestWAL_ReplayRebuildsMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+
+	m := NewWriteOptimizedMapStore(1, true, 10)
+	if err := m.AttachWAL(openTestWAL(t, path)); err != nil {
+		t.Fatalf("AttachWAL returned an error: %v", err)
+	}
+	m.Put("a", "1")
+	m.Put("b", "2")
+	m.Put("c", "3")
+	m.Update("a", "10")
+	m.Delete("b")
+	if _, err := m.BatchUpdate(context.Background(), []Pair{{"c", "30"}, {"missing", "x"}}); err != nil {
+		t.Fatalf("BatchUpdate returned an error: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+
+	restarted := NewWriteOptimizedMapStore(1, true, 10)
+	if err := restarted.AttachWAL(openTestWAL(t, path)); err != nil {
+		t.Fatalf("AttachWAL returned an error: %v", err)
+	}
+	defer restarted.Close()
+
+	want := map[string]interface{}{"a": "10", "c": "30"}
+	if !reflect.DeepEqual(restarted.db, want) {
+		t.Errorf("replayed state = %v, want %v", restarted.db, want)
+	}
+}
+
+func TestWAL_TornRecordIsDiscarded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+
+	m := NewWriteOptimizedMapStore(1, false, 10)
+	m.AttachWAL(openTestWAL(t, path))
+	m.Put("a", "1")
+	m.BatchUpdate(context.Background(), []Pair{{"a", "2"}})
+	m.Close()
+
+	// Simulate a crash halfway through writing the next record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x01, 0x02})
+	f.Close()
+
+	restarted := NewWriteOptimizedMapStore(1, false, 10)
+	if err := restarted.AttachWAL(openTestWAL(t, path)); err != nil {
+		t.Fatalf("AttachWAL returned an error: %v", err)
+	}
+	if value, _ := restarted.Get("a"); value != "2" {
+		t.Fatalf("Expected a=2 after replay, got %v", value)
+	}
+
+	// The log should be usable again after the torn tail got cut off.
+	restarted.Put("b", "3")
+	restarted.Close()
+
+	again := NewWriteOptimizedMapStore(1, false, 10)
+	if err := again.AttachWAL(openTestWAL(t, path)); err != nil {
+		t.Fatalf("AttachWAL returned an error: %v", err)
+	}
+	defer again.Close()
+	want := map[string]interface{}{"a": "2", "b": "3"}
+	if !reflect.DeepEqual(again.db, want) {
+		t.Errorf("replayed state = %v, want %v", again.db, want)
+	}
+}
+
+func TestWAL_CorruptRecordBeforeGoodOnesIsAnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+
+	m := NewWriteOptimizedMapStore(1, false, 10)
+	m.AttachWAL(openTestWAL(t, path))
+	m.Put("a", "1")
+	m.Put("b", "2")
+	m.Put("c", "3")
+	m.Close()
+
+	// Flip a byte in the payload of the second record, the third one is
+	// still fine.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := recordHeaderSize + int(binary.LittleEndian.Uint32(data[0:4]))
+	data[second+recordHeaderSize+2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewWriteOptimizedMapStore(1, false, 10)
+	w := openTestWAL(t, path)
+	defer w.Close()
+	if err := restarted.AttachWAL(w); !errors.Is(err, errCorruptRecord) {
+		t.Fatalf("Expected AttachWAL to fail with a corrupt record, got %v", err)
+	}
+	if after, err := os.ReadFile(path); err != nil || len(after) != len(data) {
+		t.Errorf("Expected the log to be left alone, it has %d bytes instead of %d (%v)", len(after), len(data), err)
+	}
+}
+
+// failingFile is a log file on a disk that fails when told to. A failing
+// write still writes half of what it was given, like a full disk.
+type failingFile struct {
+	*os.File
+	failWrite, failSync, failTruncate bool
+}
+
+var errDiskFailed = errors.New("disk failed")
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.failWrite {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errDiskFailed
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errDiskFailed
+	}
+	return f.File.Sync()
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errDiskFailed
+	}
+	return f.File.Truncate(size)
+}
+
+func TestWAL_FailedAppendIsCutOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+	w, err := OpenWAL(path, WALOptions{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatalf("OpenWAL returned an error: %v", err)
+	}
+	f := &failingFile{File: w.f.(*os.File)}
+	w.f = f
+	put := func(key string) walRecord { return walRecord{Op: walOpPut, Pairs: []Pair{{key, "1"}}} }
+
+	if err := w.Append(put("a")); err != nil {
+		t.Fatalf("Append returned an error: %v", err)
+	}
+	f.failWrite = true
+	if err := w.Append(put("torn")); !errors.Is(err, errDiskFailed) {
+		t.Fatalf("Expected the torn append to fail, got %v", err)
+	}
+	f.failWrite, f.failSync = false, true
+	if err := w.Append(put("unsynced")); !errors.Is(err, errDiskFailed) {
+		t.Fatalf("Expected the append that failed to sync to fail, got %v", err)
+	}
+	f.failSync = false
+	if err := w.Append(put("b")); err != nil {
+		t.Fatalf("Append after the failures returned an error: %v", err)
+	}
+	w.Close()
+
+	var keys []string
+	w = openTestWAL(t, path)
+	if err := w.Replay(func(rec walRecord) error {
+		keys = append(keys, rec.Pairs[0].Key)
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay returned an error: %v", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("replayed %v, want %v", keys, want)
+	}
+
+	// If the failed append can't be cut off, nothing goes after it.
+	f = &failingFile{File: w.f.(*os.File), failWrite: true, failTruncate: true}
+	w.f = f
+	defer w.Close()
+	if err := w.Append(put("torn")); !errors.Is(err, errDiskFailed) {
+		t.Fatalf("Expected the torn append to fail, got %v", err)
+	}
+	f.failWrite, f.failTruncate = false, false
+	if err := w.Append(put("c")); err == nil {
+		t.Errorf("Expected appends to a log with a torn record in it to fail")
+	}
+}
+
+func TestWAL_CancelledBatchIsNotLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+
+	m := NewWriteOptimizedMapStore(1, true, 10)
+	m.AttachWAL(openTestWAL(t, path))
+	m.Put("a", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.BatchUpdate(ctx, []Pair{{"a", "2"}}); err == nil {
+		t.Fatal("Expected BatchUpdate to fail on a cancelled context")
+	}
+	m.Close()
+
+	restarted := NewWriteOptimizedMapStore(1, true, 10)
+	restarted.AttachWAL(openTestWAL(t, path))
+	defer restarted.Close()
+	if value, _ := restarted.Get("a"); value != "1" {
+		t.Errorf("Expected a=1 after replay, got %v", value)
+	}
+}